@@ -0,0 +1,222 @@
+package cephclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+)
+
+// AdminClient calls the admin API of a driver server.
+type AdminClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewAdminClient(address string, token string, tlsConfig *voldriver.TLSConfig) (*AdminClient, error) {
+	baseURL, httpClient, err := newHTTPClient(address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &AdminClient{baseURL: baseURL, token: token, http: httpClient}, nil
+}
+
+func (c *AdminClient) Volumes(env voldriver.Env) ([]cephdriver.VolumeDetails, error) {
+	volumes := []cephdriver.VolumeDetails{}
+	err := c.call(env, "GET", cephdriver.ADMIN_VOLUMES_PATH, nil, &volumes)
+	return volumes, err
+}
+
+func (c *AdminClient) Volume(env voldriver.Env, name string) (cephdriver.VolumeDetails, error) {
+	volume := cephdriver.VolumeDetails{}
+	err := c.call(env, "GET", volumePath(name), nil, &volume)
+	return volume, err
+}
+
+// ForceUnmount force-unmounts the holder of a volume, or all of its holders
+// when holderID is empty.
+func (c *AdminClient) ForceUnmount(env voldriver.Env, name string, holderID string) (cephdriver.VolumeDetails, error) {
+	path := volumePath(name) + "/unmount"
+	if holderID != "" {
+		path += "?holder=" + url.QueryEscape(holderID)
+	}
+
+	volume := cephdriver.VolumeDetails{}
+	err := c.call(env, "POST", path, nil, &volume)
+	return volume, err
+}
+
+// Update changes the opts of a volume. Holders that are already bound keep
+// the current options until the volume is remounted; the volume lists the
+// options involved as pending changes.
+func (c *AdminClient) Update(env voldriver.Env, name string, opts map[string]interface{}) (cephdriver.VolumeDetails, error) {
+	volume := cephdriver.VolumeDetails{}
+	err := c.call(env, "PATCH", volumePath(name), opts, &volume)
+	return volume, err
+}
+
+// RotateKeyring replaces the keyring of a volume, remounting it with the new
+// key if it is mounted.
+func (c *AdminClient) RotateKeyring(env voldriver.Env, name string, keyring string) (cephdriver.VolumeDetails, error) {
+	volume := cephdriver.VolumeDetails{}
+	err := c.call(env, "POST", volumePath(name)+"/rotate-keyring", cephdriver.KeyringRotation{Keyring: keyring}, &volume)
+	return volume, err
+}
+
+// RotateClientKeyring replaces the keyring of every volume of a cephx client
+// and returns those volumes. If any of them fails to mount with the new key,
+// all of them keep the old one.
+func (c *AdminClient) RotateClientKeyring(env voldriver.Env, clientID string, keyring string) ([]cephdriver.VolumeDetails, error) {
+	volumes := []cephdriver.VolumeDetails{}
+	err := c.call(env, "POST", cephdriver.ADMIN_CLIENTS_PATH+"/"+url.PathEscape(clientID)+"/rotate-keyring", cephdriver.KeyringRotation{Keyring: keyring}, &volumes)
+	return volumes, err
+}
+
+func (c *AdminClient) Remount(env voldriver.Env, name string) (cephdriver.VolumeDetails, error) {
+	volume := cephdriver.VolumeDetails{}
+	err := c.call(env, "POST", volumePath(name)+"/remount", nil, &volume)
+	return volume, err
+}
+
+// Heartbeat records that the holder of a volume is still alive, keeping the
+// driver's idle policy from unmounting it.
+func (c *AdminClient) Heartbeat(env voldriver.Env, name string, holderID string) (cephdriver.VolumeDetails, error) {
+	volume := cephdriver.VolumeDetails{}
+	err := c.call(env, "POST", volumePath(name)+"/heartbeat?holder="+url.QueryEscape(holderID), nil, &volume)
+	return volume, err
+}
+
+// Diagnostics queries the admin socket of the ceph-fuse process mounting a volume.
+func (c *AdminClient) Diagnostics(env voldriver.Env, name string) (cephdriver.VolumeDiagnostics, error) {
+	diagnostics := cephdriver.VolumeDiagnostics{}
+	err := c.call(env, "GET", volumePath(name)+"/diagnostics", nil, &diagnostics)
+	return diagnostics, err
+}
+
+func (c *AdminClient) Remove(env voldriver.Env, name string) error {
+	return c.call(env, "DELETE", volumePath(name), nil, nil)
+}
+
+// Events streams the lifecycle events of the driver, or of a single volume
+// when name is not empty, to handle. It returns once the stream or the
+// context of env ends, or when handle returns an error.
+func (c *AdminClient) Events(env voldriver.Env, name string, handle func(cephdriver.Event) error) error {
+	path := cephdriver.ADMIN_EVENTS_PATH
+	if name != "" {
+		path += "?volume=" + url.QueryEscape(name)
+	}
+
+	logger := env.Logger().Session("admin-events", lager.Data{"path": path})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	req, err := http.NewRequest("GET", c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(env.Context())
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	// The stream lasts for as long as the caller wants it to.
+	httpClient := *c.http
+	httpClient.Timeout = 0
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Error("failed-sending-request", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return adminResponseError(resp)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := cephdriver.Event{}
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF || env.Context().Err() != nil {
+				return nil
+			}
+			logger.Error("failed-reading-event", err)
+			return err
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+}
+
+func volumePath(name string) string {
+	return cephdriver.ADMIN_VOLUMES_PATH + "/" + url.PathEscape(name)
+}
+
+type adminErrorResponse struct {
+	Err  string               `json:"error"`
+	Code cephdriver.ErrorCode `json:"code"`
+}
+
+func (c *AdminClient) call(env voldriver.Env, method string, path string, request interface{}, response interface{}) error {
+	logger := env.Logger().Session("admin-call", lager.Data{"method": method, "path": path})
+	logger.Debug("start")
+	defer logger.Debug("end")
+
+	var body io.Reader
+	if request != nil {
+		contents, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(contents)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(env.Context())
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		logger.Error("failed-sending-request", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return adminResponseError(resp)
+	}
+
+	if response == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return decodeBody(resp, response)
+}
+
+func adminResponseError(resp *http.Response) error {
+	errResponse := adminErrorResponse{}
+	if err := decodeBody(resp, &errResponse); err != nil || errResponse.Err == "" {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if errResponse.Code != "" {
+		return newDriverError(&cephdriver.Error{Code: errResponse.Code, Message: errResponse.Err, Retryable: cephdriver.IsRetryable(errResponse.Code)})
+	}
+	return errors.New(errResponse.Err)
+}
+
+func decodeBody(resp *http.Response, response interface{}) error {
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,13 @@
+package cephclient_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCephclient(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cephclient Suite")
+}
@@ -0,0 +1,246 @@
+package cephclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+)
+
+const DEFAULT_TIMEOUT = 30 * time.Second
+
+// Client calls a driver server over HTTP, on a TCP address, with TLS when
+// the spec has a TLS configuration, or on a unix socket. It implements
+// voldriver.Driver; transport failures are reported in the Err field of
+// the responses like any other driver error.
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+func NewClient(spec voldriver.DriverSpec) (*Client, error) {
+	baseURL, httpClient, err := newHTTPClient(spec.Address, spec.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{baseURL: baseURL, http: httpClient}, nil
+}
+
+func newHTTPClient(address string, tlsConfig *voldriver.TLSConfig) (string, *http.Client, error) {
+	transport := &http.Transport{}
+	httpClient := &http.Client{Transport: transport, Timeout: DEFAULT_TIMEOUT}
+
+	if strings.HasPrefix(address, "unix://") {
+		socketPath := strings.TrimPrefix(address, "unix://")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		}
+		return "http://unix", httpClient, nil
+	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		config, err := newTLSConfig(tlsConfig)
+		if err != nil {
+			return "", nil, err
+		}
+		transport.TLSClientConfig = config
+		scheme = "https"
+	}
+
+	if !strings.Contains(address, "://") {
+		address = scheme + "://" + address
+	} else if tlsConfig != nil {
+		address = "https://" + address[strings.Index(address, "://")+3:]
+	}
+	return strings.TrimSuffix(address, "/"), httpClient, nil
+}
+
+func newTLSConfig(config *voldriver.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if config.CAFile != "" {
+		ca, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func (c *Client) Activate(env voldriver.Env) voldriver.ActivateResponse {
+	response := voldriver.ActivateResponse{}
+	if err := c.call(env, "Plugin.Activate", nil, &response); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+func (c *Client) Capabilities(env voldriver.Env) voldriver.CapabilitiesResponse {
+	response := voldriver.CapabilitiesResponse{}
+	if err := c.call(env, "VolumeDriver.Capabilities", nil, &response); err != nil {
+		env.Logger().Error("failed-getting-capabilities", err)
+	}
+	return response
+}
+
+func (c *Client) Create(env voldriver.Env, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	return c.callForError(env, "VolumeDriver.Create", createRequest)
+}
+
+func (c *Client) Get(env voldriver.Env, getRequest voldriver.GetRequest) voldriver.GetResponse {
+	response := voldriver.GetResponse{}
+	if err := c.call(env, "VolumeDriver.Get", getRequest, &response); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+// GetForHolder gets a volume with the mount point of one of its holders,
+// and the list of all of them.
+func (c *Client) GetForHolder(env voldriver.Env, getRequest cephdriver.GetRequest) cephdriver.GetResponse {
+	response := cephdriver.GetResponse{}
+	if err := c.call(env, "VolumeDriver.Get", getRequest, &response); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+func (c *Client) List(env voldriver.Env) voldriver.ListResponse {
+	response := voldriver.ListResponse{}
+	if err := c.call(env, "VolumeDriver.List", nil, &response); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+func (c *Client) Mount(env voldriver.Env, mountRequest voldriver.MountRequest) voldriver.MountResponse {
+	response := voldriver.MountResponse{}
+	if err := c.call(env, "VolumeDriver.Mount", mountRequest, &response); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+// MountWithOpts mounts a volume with the 'Opts' the driver server accepts on
+// its Mount route.
+func (c *Client) MountWithOpts(env voldriver.Env, mountRequest cephdriver.MountRequest) voldriver.MountResponse {
+	response := voldriver.MountResponse{}
+	if err := c.call(env, "VolumeDriver.Mount", mountRequest, &response); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+func (c *Client) Path(env voldriver.Env, pathRequest voldriver.PathRequest) voldriver.PathResponse {
+	response := voldriver.PathResponse{}
+	if err := c.call(env, "VolumeDriver.Path", pathRequest, &response); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+// PathForHolder gets the mount point of a volume for one of its holders.
+func (c *Client) PathForHolder(env voldriver.Env, pathRequest cephdriver.PathRequest) voldriver.PathResponse {
+	response := voldriver.PathResponse{}
+	if err := c.call(env, "VolumeDriver.Path", pathRequest, &response); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+func (c *Client) Unmount(env voldriver.Env, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
+	return c.callForError(env, "VolumeDriver.Unmount", unmountRequest)
+}
+
+func (c *Client) Remove(env voldriver.Env, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
+	return c.callForError(env, "VolumeDriver.Remove", removeRequest)
+}
+
+func (c *Client) callForError(env voldriver.Env, route string, request interface{}) voldriver.ErrorResponse {
+	response := voldriver.ErrorResponse{}
+	if err := c.call(env, route, request, &response); err != nil {
+		response.Err = err.Error()
+	}
+	return response
+}
+
+func (c *Client) call(env voldriver.Env, route string, request interface{}, response interface{}) error {
+	logger := env.Logger().Session("call", lager.Data{"route": route})
+	logger.Debug("start")
+	defer logger.Debug("end")
+
+	body := []byte("{}")
+	if request != nil {
+		var err error
+		body, err = json.Marshal(request)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+"/"+route, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(env.Context())
+	req.Header.Set("Content-Type", "application/json")
+
+	return doJSON(logger, c.http, req, response)
+}
+
+func doJSON(logger lager.Logger, httpClient *http.Client, req *http.Request, response interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Error("failed-sending-request", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("failed-reading-response", err)
+		return err
+	}
+
+	if len(bytes.TrimSpace(contents)) == 0 {
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	if err := json.Unmarshal(contents, response); err != nil {
+		logger.Error("failed-parsing-response", err, lager.Data{"status": resp.StatusCode})
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(contents)))
+		}
+		return errors.New("invalid response from driver")
+	}
+	return nil
+}
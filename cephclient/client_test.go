@@ -0,0 +1,263 @@
+package cephclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephclient"
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		tmpDir  string
+		testEnv voldriver.Env
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "cephclient")
+		Expect(err).NotTo(HaveOccurred())
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("ClientTest"), context.TODO())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	Describe("DiscoverSpec", func() {
+		It("reads a JSON spec", func() {
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "cephdriver.json"), []byte(`{"Name":"cephdriver","Addr":"http://127.0.0.1:9750","TLSConfig":{"CAFile":"ca.crt"}}`), 0644)).To(Succeed())
+
+			spec, err := cephclient.DiscoverSpec(tmpDir, "cephdriver")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(spec.Address).To(Equal("http://127.0.0.1:9750"))
+			Expect(spec.TLSConfig.CAFile).To(Equal("ca.crt"))
+		})
+
+		It("reads a URL spec", func() {
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "cephdriver.spec"), []byte("unix:///var/vcap/data/cephdriver.sock\n"), 0644)).To(Succeed())
+
+			spec, err := cephclient.DiscoverSpec(tmpDir, "cephdriver")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(spec.Name).To(Equal("cephdriver"))
+			Expect(spec.Address).To(Equal("unix:///var/vcap/data/cephdriver.sock"))
+		})
+
+		It("fails when there is no spec", func() {
+			_, err := cephclient.DiscoverSpec(tmpDir, "cephdriver")
+			Expect(err).To(MatchError("no spec for driver 'cephdriver' in " + tmpDir))
+		})
+	})
+
+	Describe("driver calls", func() {
+		var (
+			requests []string
+			bodies   []map[string]interface{}
+			handler  http.HandlerFunc
+		)
+
+		BeforeEach(func() {
+			requests = nil
+			bodies = nil
+			handler = func(w http.ResponseWriter, req *http.Request) {
+				requests = append(requests, req.Method+" "+req.URL.Path)
+				body := map[string]interface{}{}
+				json.NewDecoder(req.Body).Decode(&body)
+				bodies = append(bodies, body)
+
+				switch req.URL.Path {
+				case "/VolumeDriver.Mount":
+					w.Write([]byte(`{"Mountpoint":"/some/mountpoint"}`))
+				case "/VolumeDriver.List":
+					w.Write([]byte(`{"Volumes":[{"Name":"volume-name","Mountpoint":""}]}`))
+				case "/VolumeDriver.Remove":
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(`{"Err":"Volume 'volume-name' not found"}`))
+				default:
+					w.Write([]byte(`{}`))
+				}
+			}
+		})
+
+		It("calls the driver over TCP", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			client, err := cephclient.NewClient(voldriver.DriverSpec{Address: server.URL})
+			Expect(err).NotTo(HaveOccurred())
+
+			mountResponse := client.Mount(testEnv, voldriver.MountRequest{Name: "volume-name", ID: "container-1"})
+			Expect(mountResponse.Err).To(Equal(""))
+			Expect(mountResponse.Mountpoint).To(Equal("/some/mountpoint"))
+			Expect(requests).To(Equal([]string{"POST /VolumeDriver.Mount"}))
+			Expect(bodies[0]).To(Equal(map[string]interface{}{"Name": "volume-name", "ID": "container-1"}))
+
+			listResponse := client.List(testEnv)
+			Expect(listResponse.Volumes).To(HaveLen(1))
+
+			removeResponse := client.Remove(testEnv, voldriver.RemoveRequest{Name: "volume-name"})
+			Expect(removeResponse.Err).To(Equal("Volume 'volume-name' not found"))
+		})
+
+		It("calls the driver over a unix socket", func() {
+			socketPath := filepath.Join(tmpDir, "driver.sock")
+			listener, err := net.Listen("unix", socketPath)
+			Expect(err).NotTo(HaveOccurred())
+			server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: handler}}
+			server.Start()
+			defer server.Close()
+
+			client, err := cephclient.NewClient(voldriver.DriverSpec{Address: "unix://" + socketPath})
+			Expect(err).NotTo(HaveOccurred())
+
+			response := client.Create(testEnv, voldriver.CreateRequest{Name: "volume-name", Opts: map[string]interface{}{"ip": "some-ip"}})
+			Expect(response.Err).To(Equal(""))
+			Expect(requests).To(Equal([]string{"POST /VolumeDriver.Create"}))
+		})
+
+		It("calls the driver over TLS", func() {
+			server := httptest.NewTLSServer(handler)
+			defer server.Close()
+
+			client, err := cephclient.NewClient(voldriver.DriverSpec{Address: server.Listener.Addr().String(), TLSConfig: &voldriver.TLSConfig{InsecureSkipVerify: true}})
+			Expect(err).NotTo(HaveOccurred())
+
+			response := client.Unmount(testEnv, voldriver.UnmountRequest{Name: "volume-name"})
+			Expect(response.Err).To(Equal(""))
+			Expect(requests).To(Equal([]string{"POST /VolumeDriver.Unmount"}))
+		})
+
+		It("reports transport failures as driver errors", func() {
+			client, err := cephclient.NewClient(voldriver.DriverSpec{Address: "unix://" + filepath.Join(tmpDir, "missing.sock")})
+			Expect(err).NotTo(HaveOccurred())
+
+			response := client.Get(testEnv, voldriver.GetRequest{Name: "volume-name"})
+			Expect(response.Err).NotTo(BeEmpty())
+		})
+	})
+
+	Describe("AdminClient", func() {
+		var (
+			server *httptest.Server
+			client *cephclient.AdminClient
+			driver *cephlocal.LocalDriver
+		)
+
+		BeforeEach(func() {
+			driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(new(voldriverfakes.FakeInvoker), new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root"})
+			Expect(driver.Create(testEnv, voldriver.CreateRequest{Name: "volume-name", Opts: map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}}).Err).To(Equal(""))
+			Expect(driver.Mount(testEnv, voldriver.MountRequest{Name: "volume-name", ID: "container-1"}).Err).To(Equal(""))
+
+			server = httptest.NewServer(cephlocal.NewAdminHandler(lagertest.NewTestLogger("ClientTest"), driver, "some-token"))
+
+			var err error
+			client, err = cephclient.NewAdminClient(server.Listener.Addr().String(), "some-token", nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("lists and shows volumes", func() {
+			volumes, err := client.Volumes(testEnv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volumes).To(HaveLen(1))
+			Expect(volumes[0].Holders).To(Equal([]string{"container-1"}))
+
+			volume, err := client.Volume(testEnv, "volume-name")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volume.Keyring).To(Equal(cephlocal.REDACTED))
+		})
+
+		It("updates volumes and remounts them", func() {
+			volume, err := client.Update(testEnv, "volume-name", map[string]interface{}{"ip": "other-ip"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volume.Monitor).To(Equal("other-ip:6789"))
+			Expect(volume.PendingChanges).To(Equal([]string{"ip"}))
+
+			volume, err = client.Remount(testEnv, "volume-name")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volume.PendingChanges).To(BeEmpty())
+
+			_, err = client.Update(testEnv, "volume-name", map[string]interface{}{"port": "not-a-port"})
+			Expect(errors.Is(err, cephclient.ErrInvalidOpts)).To(BeTrue())
+		})
+
+		It("rotates keyrings", func() {
+			volume, err := client.RotateKeyring(testEnv, "volume-name", "[client.app]\n\tkey = new-key\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volume.Holders).To(Equal([]string{"container-1"}))
+
+			volumes, err := client.RotateClientKeyring(testEnv, "app", "[client.app]\n\tkey = newer-key\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volumes).To(HaveLen(1))
+			Expect(volumes[0].Name).To(Equal("volume-name"))
+
+			_, err = client.RotateClientKeyring(testEnv, "app", "[client.other]\n\tkey = k\n")
+			Expect(errors.Is(err, cephclient.ErrInvalidOpts)).To(BeTrue())
+		})
+
+		It("force-unmounts and removes volumes", func() {
+			volume, err := client.ForceUnmount(testEnv, "volume-name", "container-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(volume.Holders).To(BeEmpty())
+
+			Expect(client.Remove(testEnv, "volume-name")).To(Succeed())
+			_, err = client.Volume(testEnv, "volume-name")
+			Expect(err).To(MatchError("Volume 'volume-name' not found"))
+		})
+
+		It("streams the events of a volume", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			events := make(chan cephlocal.Event, 100)
+			done := make(chan error, 1)
+			go func() {
+				done <- client.Events(driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("ClientTest"), ctx), "volume-name", func(event cephlocal.Event) error {
+					events <- event
+					return nil
+				})
+			}()
+
+			// Mount until the stream is connected and the event comes through.
+			Eventually(func() int {
+				driver.Mount(testEnv, voldriver.MountRequest{Name: "volume-name", ID: "container-1"})
+				return len(events)
+			}).ShouldNot(BeZero())
+
+			event := <-events
+			Expect(event.Operation).To(Equal(cephlocal.EVENT_MOUNT))
+			Expect(event.Holder).To(Equal("container-1"))
+
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("fails with the wrong token", func() {
+			client, err := cephclient.NewAdminClient(server.URL, "other-token", nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.Volumes(testEnv)
+			Expect(err).To(MatchError("unauthorized"))
+		})
+	})
+})
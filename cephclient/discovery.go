@@ -0,0 +1,50 @@
+package cephclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/voldriver"
+)
+
+// DiscoverSpec reads the spec a driver server wrote to driversPath, either
+// as a JSON driver spec (.json) or as a bare URL (.spec).
+func DiscoverSpec(driversPath string, name string) (voldriver.DriverSpec, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(driversPath, name+".json"))
+	if err == nil {
+		spec := voldriver.DriverSpec{}
+		if err := json.Unmarshal(contents, &spec); err != nil {
+			return voldriver.DriverSpec{}, fmt.Errorf("invalid driver spec %s.json (%s)", name, err.Error())
+		}
+		if spec.Name == "" {
+			spec.Name = name
+		}
+		return spec, nil
+	}
+	if !os.IsNotExist(err) {
+		return voldriver.DriverSpec{}, err
+	}
+
+	contents, err = ioutil.ReadFile(filepath.Join(driversPath, name+".spec"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return voldriver.DriverSpec{}, fmt.Errorf("no spec for driver '%s' in %s", name, driversPath)
+		}
+		return voldriver.DriverSpec{}, err
+	}
+	return voldriver.DriverSpec{Name: name, Address: strings.TrimSpace(string(contents))}, nil
+}
+
+// NewClientFromDriversPath connects to the driver whose spec the server wrote
+// to driversPath under name.
+func NewClientFromDriversPath(driversPath string, name string) (*Client, error) {
+	spec, err := DiscoverSpec(driversPath, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(spec)
+}
@@ -0,0 +1,103 @@
+package cephclient
+
+import (
+	"errors"
+	"regexp"
+
+	"code.cloudfoundry.org/cephdriver"
+)
+
+// Kinds of driver errors. Errors returned by the typed methods of Client
+// wrap one of these, so that callers can test for them with errors.Is.
+var (
+	ErrVolumeNotFound    = errors.New("volume not found")
+	ErrVolumeConflict    = errors.New("volume already exists with different opts")
+	ErrInvalidVolumeName = errors.New("invalid volume name")
+	ErrInvalidHolderID   = errors.New("invalid holder ID")
+	ErrInvalidOpts       = errors.New("invalid opts")
+	ErrNotMounted        = errors.New("volume not mounted")
+	ErrMountFailed       = errors.New("mount failed")
+	ErrMountTimeout      = errors.New("mount timed out")
+	ErrMountPending      = errors.New("mount in progress")
+	ErrOverloaded        = errors.New("driver overloaded")
+	ErrTooManyMounts     = errors.New("too many mounted volumes")
+	ErrAuthFailed        = errors.New("authentication failed")
+	ErrUnmountFailed     = errors.New("unmount failed")
+	ErrDriver            = errors.New("driver error")
+)
+
+// DriverError is an error reported by the driver. Its message is the one the
+// driver returned, without the code; Kind classifies it.
+type DriverError struct {
+	Kind      error
+	Code      cephdriver.ErrorCode
+	Retryable bool
+	Message   string
+}
+
+func (e *DriverError) Error() string {
+	return e.Message
+}
+
+func (e *DriverError) Unwrap() error {
+	return e.Kind
+}
+
+var codeKinds = map[cephdriver.ErrorCode]error{
+	cephdriver.ERR_INVALID_VOLUME_NAME: ErrInvalidVolumeName,
+	cephdriver.ERR_INVALID_HOLDER_ID:   ErrInvalidHolderID,
+	cephdriver.ERR_INVALID_OPTS:        ErrInvalidOpts,
+	cephdriver.ERR_INVALID_KEYRING:     ErrInvalidOpts,
+	cephdriver.ERR_VOLUME_NOT_FOUND:    ErrVolumeNotFound,
+	cephdriver.ERR_VOLUME_CONFLICT:     ErrVolumeConflict,
+	cephdriver.ERR_NOT_MOUNTED:         ErrNotMounted,
+	cephdriver.ERR_AUTH_FAILED:         ErrAuthFailed,
+	cephdriver.ERR_MOUNT_TIMEOUT:       ErrMountTimeout,
+	cephdriver.ERR_MOUNT_FAILED:        ErrMountFailed,
+	cephdriver.ERR_MOUNT_PENDING:       ErrMountPending,
+	cephdriver.ERR_OVERLOADED:          ErrOverloaded,
+	cephdriver.ERR_TOO_MANY_MOUNTS:     ErrTooManyMounts,
+	cephdriver.ERR_UNMOUNT_FAILED:      ErrUnmountFailed,
+	cephdriver.ERR_REMOUNT_FAILED:      ErrMountFailed,
+}
+
+// Drivers that predate error codes are classified by their messages.
+var errorKinds = []struct {
+	pattern *regexp.Regexp
+	kind    error
+}{
+	{regexp.MustCompile(`^Volume '.*' (not found|is unknown)$`), ErrVolumeNotFound},
+	{regexp.MustCompile(`^Volume '.*' already exists with different Opts$`), ErrVolumeConflict},
+	{regexp.MustCompile(`^Invalid volume name `), ErrInvalidVolumeName},
+	{regexp.MustCompile(`^Missing mandatory 'volume_name'$`), ErrInvalidVolumeName},
+	{regexp.MustCompile(`field in 'Opts'`), ErrInvalidOpts},
+	{regexp.MustCompile(`^Volume .* not mounted`), ErrNotMounted},
+	{regexp.MustCompile(`^Error mounting `), ErrMountFailed},
+	{regexp.MustCompile(`^Error unmounting `), ErrUnmountFailed},
+}
+
+// ToError maps the error string of a driver response back to a DriverError,
+// or nil when the response carries no error.
+func ToError(message string) error {
+	decoded := cephdriver.DecodeError(message)
+	if decoded == nil {
+		return nil
+	}
+	return newDriverError(decoded)
+}
+
+func newDriverError(decoded *cephdriver.Error) *DriverError {
+	driverError := &DriverError{Kind: ErrDriver, Code: decoded.Code, Retryable: decoded.Retryable, Message: decoded.Message}
+	if kind, ok := codeKinds[decoded.Code]; ok {
+		driverError.Kind = kind
+		return driverError
+	}
+
+	for _, errorKind := range errorKinds {
+		if errorKind.pattern.MatchString(decoded.Message) {
+			driverError.Kind = errorKind.kind
+			break
+		}
+	}
+	return driverError
+}
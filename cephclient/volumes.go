@@ -0,0 +1,81 @@
+package cephclient
+
+import (
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/voldriver"
+)
+
+var _ voldriver.Driver = &Client{}
+
+// CreateVolume creates a volume from typed options rather than raw opts.
+// Fields left empty are not sent, so that the driver reports missing
+// mandatory fields instead of accepting empty ones.
+func (c *Client) CreateVolume(env voldriver.Env, name string, config cephdriver.MountConfig) error {
+	opts := config.Opts()
+	for key, value := range opts {
+		if value == "" {
+			delete(opts, key)
+		}
+	}
+	return ToError(c.Create(env, voldriver.CreateRequest{Name: name, Opts: opts}).Err)
+}
+
+// GetVolume gets a volume with its holders and their mount points.
+func (c *Client) GetVolume(env voldriver.Env, name string) (cephdriver.VolumeInfo, error) {
+	response := c.GetForHolder(env, cephdriver.GetRequest{Name: name})
+	return response.Volume, ToError(response.Err)
+}
+
+// VolumePath returns the mount point of a volume for a holder.
+func (c *Client) VolumePath(env voldriver.Env, name string, holderID string) (string, error) {
+	response := c.PathForHolder(env, cephdriver.PathRequest{Name: name, ID: holderID})
+	return response.Mountpoint, ToError(response.Err)
+}
+
+func (c *Client) ListVolumes(env voldriver.Env) ([]voldriver.VolumeInfo, error) {
+	response := c.List(env)
+	return response.Volumes, ToError(response.Err)
+}
+
+// MountVolume mounts a volume for a holder and returns its mount point.
+func (c *Client) MountVolume(env voldriver.Env, name string, holderID string) (string, error) {
+	response := c.Mount(env, voldriver.MountRequest{Name: name, ID: holderID})
+	return response.Mountpoint, ToError(response.Err)
+}
+
+// MountSubDirectory mounts a sub-directory of a volume for a holder and
+// returns its mount point.
+func (c *Client) MountSubDirectory(env voldriver.Env, name string, holderID string, subDirectory string) (string, error) {
+	options := cephdriver.MountOptions{SubDirectory: subDirectory}
+	response := c.MountWithOpts(env, cephdriver.MountRequest{Name: name, ID: holderID, Opts: options.Opts()})
+	return response.Mountpoint, ToError(response.Err)
+}
+
+// WaitForMount mounts a volume for a holder and, while a driver that mounts
+// asynchronously reports the mount as pending, asks again every interval
+// until the mount is done or the context of env ends.
+func (c *Client) WaitForMount(env voldriver.Env, name string, holderID string, interval time.Duration) (string, error) {
+	for {
+		mountPoint, err := c.MountVolume(env, name, holderID)
+		if !errors.Is(err, ErrMountPending) {
+			return mountPoint, err
+		}
+
+		select {
+		case <-env.Context().Done():
+			return "", env.Context().Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (c *Client) UnmountVolume(env voldriver.Env, name string, holderID string) error {
+	return ToError(c.Unmount(env, voldriver.UnmountRequest{Name: name, ID: holderID}).Err)
+}
+
+func (c *Client) RemoveVolume(env voldriver.Env, name string) error {
+	return ToError(c.Remove(env, voldriver.RemoveRequest{Name: name}).Err)
+}
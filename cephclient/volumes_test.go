@@ -0,0 +1,245 @@
+package cephclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/cephdriver/cephclient"
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// driverHandler serves the voldriver routes the client uses from driver.
+func driverHandler(driver voldriver.Driver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		env := driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("DriverHandler"), req.Context())
+		decoder := json.NewDecoder(req.Body)
+
+		var response interface{}
+		switch req.URL.Path {
+		case "/VolumeDriver.Create":
+			request := voldriver.CreateRequest{}
+			decoder.Decode(&request)
+			response = driver.Create(env, request)
+		case "/VolumeDriver.Get":
+			request := voldriver.GetRequest{}
+			decoder.Decode(&request)
+			response = driver.Get(env, request)
+		case "/VolumeDriver.List":
+			response = driver.List(env)
+		case "/VolumeDriver.Mount":
+			request := voldriver.MountRequest{}
+			decoder.Decode(&request)
+			response = driver.Mount(env, request)
+		case "/VolumeDriver.Unmount":
+			request := voldriver.UnmountRequest{}
+			decoder.Decode(&request)
+			response = driver.Unmount(env, request)
+		case "/VolumeDriver.Remove":
+			request := voldriver.RemoveRequest{}
+			decoder.Decode(&request)
+			response = driver.Remove(env, request)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+var _ = Describe("Typed client", func() {
+	var (
+		tmpDir      string
+		server      *httptest.Server
+		client      *cephclient.Client
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeIoutil  *ioutil_fake.FakeIoutil
+		testEnv     voldriver.Env
+		config      cephdriver.MountConfig
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "cephclient")
+		Expect(err).NotTo(HaveOccurred())
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("TypedClientTest"), context.TODO())
+
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeIoutil = new(ioutil_fake.FakeIoutil)
+		driver := cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), fakeIoutil, cephlocal.LocalDriverConfig{RootDir: "some-root"})
+		logger := lagertest.NewTestLogger("VolumeHandler")
+		server = httptest.NewServer(cephlocal.NewVolumeHandler(logger, driver, cephlocal.NewMetrics(), driverHandler(driver)))
+
+		spec, err := json.Marshal(voldriver.DriverSpec{Name: "cephdriver", Address: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, "cephdriver.json"), spec, 0644)).To(Succeed())
+
+		client, err = cephclient.NewClientFromDriversPath(tmpDir, "cephdriver")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = cephdriver.MountConfig{Keyring: "some-keyring", IP: "some-ip", Port: 3300, RemoteMountPoint: "/some/remote", ReadOnly: true}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("creates volumes from typed options", func() {
+		Expect(client.CreateVolume(testEnv, "volume-name", config)).To(Succeed())
+
+		mountPoint, err := client.MountVolume(testEnv, "volume-name", "container-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mountPoint).To(Equal("some-root/volumes/volume-name/container-1"))
+
+		_, _, args := fakeInvoker.InvokeArgsForCall(0)
+		Expect(args).To(ContainElement("some-ip:3300"))
+		_, _, args = fakeInvoker.InvokeArgsForCall(1)
+		Expect(args).To(ContainElement("ro"))
+
+		volume, err := client.GetVolume(testEnv, "volume-name")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(volume.Mountpoint).To(Equal(mountPoint))
+		Expect(volume.Holders).To(Equal([]cephdriver.HolderInfo{{ID: "container-1", Mountpoint: mountPoint}}))
+
+		volumes, err := client.ListVolumes(testEnv)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(volumes).To(HaveLen(1))
+
+		Expect(client.UnmountVolume(testEnv, "volume-name", "container-1")).To(Succeed())
+		Expect(client.RemoveVolume(testEnv, "volume-name")).To(Succeed())
+	})
+
+	It("mounts sub-directories of volumes for holders", func() {
+		// The mount table shows the bind mount of the sub-directory, which the
+		// driver checks after binding it.
+		fakeIoutil.ReadFileStub = func(filename string) ([]byte, error) {
+			if filename != "/proc/self/mountinfo" || fakeInvoker.InvokeCallCount() < 2 {
+				return nil, nil
+			}
+			_, _, shareArgs := fakeInvoker.InvokeArgsForCall(0)
+			return []byte("100 20 0:50 / " + shareArgs[6] + " rw - fuse.ceph-fuse ceph-fuse rw\n" +
+				"101 20 0:50 /app/data some-root/volumes/volume-name/container-1 rw - fuse.ceph-fuse ceph-fuse rw\n"), nil
+		}
+
+		Expect(client.CreateVolume(testEnv, "volume-name", config)).To(Succeed())
+
+		mountPoint, err := client.MountSubDirectory(testEnv, "volume-name", "container-1", "app/data")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mountPoint).To(Equal("some-root/volumes/volume-name/container-1"))
+
+		_, _, shareArgs := fakeInvoker.InvokeArgsForCall(0)
+		_, _, bindArgs := fakeInvoker.InvokeArgsForCall(1)
+		Expect(bindArgs).To(ContainElement(filepath.Join(shareArgs[6], "app/data")))
+
+		path, err := client.VolumePath(testEnv, "volume-name", "container-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal(mountPoint))
+
+		_, err = client.VolumePath(testEnv, "volume-name", "container-2")
+		Expect(errors.Is(err, cephclient.ErrNotMounted)).To(BeTrue())
+
+		_, err = client.MountSubDirectory(testEnv, "volume-name", "container-2", "../other")
+		Expect(errors.Is(err, cephclient.ErrInvalidOpts)).To(BeTrue())
+	})
+
+	It("maps driver errors to typed errors", func() {
+		_, err := client.GetVolume(testEnv, "unknown")
+		Expect(errors.Is(err, cephclient.ErrVolumeNotFound)).To(BeTrue())
+		Expect(err).To(MatchError("Volume 'unknown' not found"))
+
+		err = client.CreateVolume(testEnv, "volume-name", cephdriver.MountConfig{IP: "some-ip"})
+		Expect(errors.Is(err, cephclient.ErrInvalidOpts)).To(BeTrue())
+
+		err = client.CreateVolume(testEnv, "../volume", config)
+		Expect(errors.Is(err, cephclient.ErrInvalidVolumeName)).To(BeTrue())
+
+		Expect(client.CreateVolume(testEnv, "volume-name", config)).To(Succeed())
+		config.IP = "other-ip"
+		err = client.CreateVolume(testEnv, "volume-name", config)
+		Expect(errors.Is(err, cephclient.ErrVolumeConflict)).To(BeTrue())
+
+		err = client.UnmountVolume(testEnv, "volume-name", "")
+		Expect(errors.Is(err, cephclient.ErrNotMounted)).To(BeTrue())
+
+		fakeInvoker.InvokeReturns(nil, errors.New("connection refused"))
+		_, err = client.MountVolume(testEnv, "volume-name", "container-1")
+		Expect(errors.Is(err, cephclient.ErrMountFailed)).To(BeTrue())
+	})
+
+	Context("when the driver mounts asynchronously", func() {
+		BeforeEach(func() {
+			server.Close()
+			driver := cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root", AsyncMount: true})
+			server = httptest.NewServer(driverHandler(driver))
+
+			spec, err := json.Marshal(voldriver.DriverSpec{Name: "cephdriver", Address: server.URL})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(tmpDir, "cephdriver.json"), spec, 0644)).To(Succeed())
+
+			client, err = cephclient.NewClientFromDriversPath(tmpDir, "cephdriver")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("reports the mount as pending", func() {
+			Expect(client.CreateVolume(testEnv, "volume-name", config)).To(Succeed())
+
+			_, err := client.MountVolume(testEnv, "volume-name", "container-1")
+			Expect(errors.Is(err, cephclient.ErrMountPending)).To(BeTrue())
+			Expect(err.(*cephclient.DriverError).Retryable).To(BeTrue())
+		})
+
+		It("waits for the mount to be done", func() {
+			Expect(client.CreateVolume(testEnv, "volume-name", config)).To(Succeed())
+
+			mountPoint, err := client.WaitForMount(testEnv, "volume-name", "container-1", time.Millisecond)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mountPoint).To(Equal("some-root/volumes/volume-name/container-1"))
+		})
+	})
+
+	Describe("ToError", func() {
+		It("returns nil without an error", func() {
+			Expect(cephclient.ToError("")).To(BeNil())
+		})
+
+		It("classifies errors by their code", func() {
+			err := cephclient.ToError("Error mounting 'volume-name' (exit status 1) [AUTH_FAILED]")
+			Expect(errors.Is(err, cephclient.ErrAuthFailed)).To(BeTrue())
+			Expect(err).To(MatchError("Error mounting 'volume-name' (exit status 1)"))
+
+			driverError := err.(*cephclient.DriverError)
+			Expect(driverError.Code).To(Equal(cephlocal.ERR_AUTH_FAILED))
+			Expect(driverError.Retryable).To(BeFalse())
+		})
+
+		It("classifies errors of drivers without codes by their message", func() {
+			err := cephclient.ToError("Error unmounting 'volume-name' (device busy)")
+			Expect(errors.Is(err, cephclient.ErrUnmountFailed)).To(BeTrue())
+			Expect(err.(*cephclient.DriverError).Code).To(Equal(cephlocal.ERR_UNKNOWN))
+		})
+
+		It("classifies unknown errors as driver errors", func() {
+			err := cephclient.ToError("something else")
+			Expect(errors.Is(err, cephclient.ErrDriver)).To(BeTrue())
+			Expect(err).To(MatchError("something else"))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package cephdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCephdriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cephdriver Suite")
+}
@@ -0,0 +1,388 @@
+package cephlocal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+const REDACTED = "[REDACTED]"
+
+const (
+	ADMIN_VOLUMES_PATH = cephdriver.ADMIN_VOLUMES_PATH
+	ADMIN_CLIENTS_PATH = cephdriver.ADMIN_CLIENTS_PATH
+)
+
+type VolumeDetails = cephdriver.VolumeDetails
+
+type ForceUnmountRequest struct {
+	Name string
+	ID   string
+}
+
+// Volumes describes every volume, sorted by name. Mounted volumes whose
+// ceph-fuse mount has gone stale or whose client was evicted are reported as
+// unhealthy.
+func (d *LocalDriver) Volumes(env voldriver.Env) []VolumeDetails {
+	logger := env.Logger().Session("volumes")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	volumes := d.volumeDetails("")
+	d.checkVolumeHealth(volumes)
+	return volumes
+}
+
+// VolumeDetails describes a single volume.
+func (d *LocalDriver) VolumeDetails(env voldriver.Env, name string) (VolumeDetails, bool) {
+	logger := env.Logger().Session("volume-details", lager.Data{"volume_name": name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	volumes := d.volumeDetails(name)
+	if len(volumes) == 0 {
+		return VolumeDetails{}, false
+	}
+	d.checkVolumeHealth(volumes)
+	return volumes[0], true
+}
+
+// ForceUnmount lazily unmounts the bind mount of a holder, or of every holder
+// when no ID is given, releasing the holders even if their mounts are busy.
+func (d *LocalDriver) ForceUnmount(env voldriver.Env, forceUnmountRequest ForceUnmountRequest) (response voldriver.ErrorResponse) {
+	started := time.Now()
+	defer func() {
+		d.publishOperation(EVENT_FORCE_UNMOUNT, forceUnmountRequest.Name, forceUnmountRequest.ID, started, response.Err)
+	}()
+
+	defer d.lockVolumes(forceUnmountRequest.Name)()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	logger := env.Logger().Session("force-unmount", lager.Data{"volume_name": forceUnmountRequest.Name, "holder": forceUnmountRequest.ID})
+	logger.Info("start")
+	defer logger.Info("end")
+	defer d.persist(logger)
+
+	volume, ok := d.volumes[forceUnmountRequest.Name]
+	if !ok {
+		logger.Info("force-unmount-volume-not-found")
+		return voldriver.ErrorResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", forceUnmountRequest.Name).Encode()}
+	}
+
+	holderIDs := volume.holderIDs()
+	if forceUnmountRequest.ID != "" {
+		if !volume.Holders[forceUnmountRequest.ID] {
+			logger.Info("force-unmount-holder-not-found")
+			return voldriver.ErrorResponse{Err: newError(ERR_NOT_MOUNTED, "Volume '%s' is not held by '%s'", forceUnmountRequest.Name, forceUnmountRequest.ID).Encode()}
+		}
+		holderIDs = []string{forceUnmountRequest.ID}
+	}
+
+	env = driverhttp.EnvWithLogger(logger, env)
+	errs := []string{}
+	for _, holderID := range holderIDs {
+		if err := d.unbind(env, volume, holderID, true); err != nil {
+			logger.Error("failed-force-unmounting-holder", err, lager.Data{"holder": holderID})
+			errs = append(errs, fmt.Sprintf("Error unmounting '%s' for '%s' (%s)", forceUnmountRequest.Name, holderID, err.Error()))
+		}
+	}
+
+	if len(errs) > 0 {
+		unmountErr := newError(ERR_UNMOUNT_FAILED, "%s", strings.Join(errs, "; "))
+		volume.LastError = unmountErr.Message
+		return voldriver.ErrorResponse{Err: unmountErr.Encode()}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (d *LocalDriver) volumeDetails(only string) []VolumeDetails {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	volumes := []VolumeDetails{}
+	for name, volume := range d.volumes {
+		if only != "" && name != only {
+			continue
+		}
+
+		details := VolumeDetails{
+			Name:             name,
+			Monitor:          fmt.Sprintf("%s:%d", volume.IP, volume.Port),
+			RemoteMountPoint: volume.RemoteMountPoint,
+			SubDirectory:     volume.SubDirectory,
+			ReadOnly:         volume.ReadOnly,
+			Keyring:          REDACTED,
+			LocalMountPoint:  volume.LocalMountPoint,
+			Holders:          volume.holderIDs(),
+			MountCount:       len(volume.Holders),
+			PendingChanges:   volume.PendingChanges,
+			Healthy:          true,
+			LastError:        volume.LastError,
+			LogFile:          d.shareLogFile(shareKey(volume)),
+		}
+		if len(volume.LastSeen) > 0 {
+			details.LastSeen = map[string]time.Time{}
+			for holderID, at := range volume.LastSeen {
+				details.LastSeen[holderID] = at
+			}
+		}
+		if share, ok := d.shares[volume.ShareKey]; ok {
+			details.ShareMountPoint = share.MountPoint
+			details.KeyPath = share.KeyPath
+			details.LogFile = d.shareLogFile(share.Key)
+			details.FusePid = share.Pid
+			details.FuseExits = share.Exits
+			details.FuseRestarts = share.Restarts
+			details.LastFuseExit = share.LastExit
+			details.MemoryLimit = share.MemoryLimit
+			details.CPULimit = share.CPULimit
+			details.Cgroup = share.Cgroup
+			details.AdminSocket = share.AdminSocket
+			details.Evicted = share.Evicted
+			details.Evictions = share.Evictions
+			details.LastEviction = share.LastEviction
+
+			usage := d.fuseUsage(share)
+			details.MemoryUsage = usage.MemoryBytes
+			details.CPUUsage = usage.CPUSeconds
+			details.OOMKills = usage.OOMKills
+		}
+		volumes = append(volumes, details)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes
+}
+
+// checkVolumeHealth is done without holding the driver lock, since a hung
+// ceph-fuse mount may take until the stale mount timeout to answer.
+func (d *LocalDriver) checkVolumeHealth(volumes []VolumeDetails) {
+	stale := map[string]bool{}
+	for i := range volumes {
+		mountPoint := volumes[i].ShareMountPoint
+		if mountPoint == "" {
+			continue
+		}
+		if _, checked := stale[mountPoint]; !checked {
+			stale[mountPoint] = d.isStaleMount(mountPoint)
+		}
+		volumes[i].Healthy = !stale[mountPoint] && !volumes[i].Evicted
+	}
+}
+
+type adminError struct {
+	Err  string    `json:"error"`
+	Code ErrorCode `json:"code,omitempty"`
+}
+
+// NewAdminHandler serves the admin API, for requests bearing token:
+//
+//	GET    /volumes                        list volumes
+//	GET    /volumes/<name>                 show a volume
+//	PATCH  /volumes/<name>                 update the opts of a volume, given as a JSON object
+//	DELETE /volumes/<name>                 unmount and remove a volume
+//	POST   /volumes/<name>/unmount         force-unmount a volume (?holder=<id> for a single holder)
+//	POST   /volumes/<name>/remount         remount a volume
+//	POST   /volumes/<name>/heartbeat       record that a holder is alive (?holder=<id>)
+//	POST   /volumes/<name>/rotate-keyring  replace the keyring of a volume, given as {"keyring": ...}
+//	POST   /clients/<id>/rotate-keyring    replace the keyring of every volume of a cephx client
+//	GET    /volumes/<name>/diagnostics     query the admin socket of the volume's ceph-fuse
+//	GET    /events                         stream volume lifecycle events (?volume=<name> for a single volume)
+func NewAdminHandler(logger lager.Logger, driver *LocalDriver, token string) http.Handler {
+	logger = logger.Session("admin")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !authorized(req, token) {
+			logger.Info("unauthorized-request", lager.Data{"method": req.Method, "path": req.URL.Path, "remote_addr": req.RemoteAddr})
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminJSON(logger, w, http.StatusUnauthorized, adminError{Err: "unauthorized"})
+			return
+		}
+
+		requestLogger := logger.Session("request", lager.Data{"method": req.Method, "path": req.URL.Path, "remote_addr": req.RemoteAddr})
+		requestLogger.Info("start")
+		defer requestLogger.Info("end")
+
+		if req.URL.Path == ADMIN_EVENTS_PATH {
+			serveEvents(requestLogger, driver, w, req)
+			return
+		}
+
+		env := driverhttp.NewHttpDriverEnv(requestLogger, req.Context())
+		if strings.HasPrefix(req.URL.Path, ADMIN_CLIENTS_PATH+"/") {
+			serveClients(requestLogger, env, driver, w, req)
+			return
+		}
+		serveAdmin(requestLogger, env, driver, w, req)
+	})
+}
+
+func serveAdmin(logger lager.Logger, env voldriver.Env, driver *LocalDriver, w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != strings.Trim(ADMIN_VOLUMES_PATH, "/") || len(parts) > 3 {
+		writeAdminJSON(logger, w, http.StatusNotFound, adminError{Err: "not found"})
+		return
+	}
+
+	if len(parts) == 1 {
+		if req.Method != "GET" {
+			writeAdminJSON(logger, w, http.StatusMethodNotAllowed, adminError{Err: "method not allowed"})
+			return
+		}
+		writeAdminJSON(logger, w, http.StatusOK, driver.Volumes(env))
+		return
+	}
+
+	name := parts[1]
+	details, ok := driver.VolumeDetails(env, name)
+	if !ok {
+		writeAdminJSON(logger, w, http.StatusNotFound, adminError{Err: fmt.Sprintf("Volume '%s' not found", name), Code: ERR_VOLUME_NOT_FOUND})
+		return
+	}
+
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+
+	var response voldriver.ErrorResponse
+	switch {
+	case action == "" && req.Method == "GET":
+		writeAdminJSON(logger, w, http.StatusOK, details)
+		return
+	case action == "" && req.Method == "PATCH":
+		opts := map[string]interface{}{}
+		if err := json.NewDecoder(req.Body).Decode(&opts); err != nil {
+			writeAdminJSON(logger, w, http.StatusBadRequest, adminError{Err: fmt.Sprintf("Invalid opts (%s)", err.Error()), Code: ERR_INVALID_OPTS})
+			return
+		}
+		response = driver.Update(env, UpdateRequest{Name: name, Opts: opts})
+	case action == "" && req.Method == "DELETE":
+		response = driver.Remove(env, voldriver.RemoveRequest{Name: name})
+	case action == "unmount" && req.Method == "POST":
+		response = driver.ForceUnmount(env, ForceUnmountRequest{Name: name, ID: req.URL.Query().Get("holder")})
+	case action == "remount" && req.Method == "POST":
+		response = driver.Remount(env, RemountRequest{Name: name})
+	case action == "heartbeat" && req.Method == "POST":
+		response = driver.Heartbeat(env, HeartbeatRequest{Name: name, ID: req.URL.Query().Get("holder")})
+	case action == "rotate-keyring" && req.Method == "POST":
+		rotation := cephdriver.KeyringRotation{}
+		if err := json.NewDecoder(req.Body).Decode(&rotation); err != nil {
+			writeAdminJSON(logger, w, http.StatusBadRequest, adminError{Err: fmt.Sprintf("Invalid keyring rotation (%s)", err.Error()), Code: ERR_INVALID_KEYRING})
+			return
+		}
+		response = voldriver.ErrorResponse{Err: driver.RotateKeyring(env, RotateKeyringRequest{Name: name, Keyring: rotation.Keyring}).Err}
+	case action == "diagnostics" && req.Method == "GET":
+		diagnostics := driver.Diagnostics(env, DiagnosticsRequest{Name: name})
+		if err := DecodeError(diagnostics.Err); err != nil {
+			writeAdminJSON(logger, w, adminStatus(err.Code), adminError{Err: err.Message, Code: err.Code})
+			return
+		}
+		writeAdminJSON(logger, w, http.StatusOK, diagnostics.Diagnostics)
+		return
+	case action == "" || action == "unmount" || action == "remount" || action == "heartbeat" || action == "rotate-keyring" || action == "diagnostics":
+		writeAdminJSON(logger, w, http.StatusMethodNotAllowed, adminError{Err: "method not allowed"})
+		return
+	default:
+		writeAdminJSON(logger, w, http.StatusNotFound, adminError{Err: "not found"})
+		return
+	}
+
+	if err := DecodeError(response.Err); err != nil {
+		writeAdminJSON(logger, w, adminStatus(err.Code), adminError{Err: err.Message, Code: err.Code})
+		return
+	}
+
+	if action == "" && req.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	details, _ = driver.VolumeDetails(env, name)
+	writeAdminJSON(logger, w, http.StatusOK, details)
+}
+
+// serveClients rotates the keyring of every volume of a cephx client and
+// answers with those volumes.
+func serveClients(logger lager.Logger, env voldriver.Env, driver *LocalDriver, w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[2] != "rotate-keyring" {
+		writeAdminJSON(logger, w, http.StatusNotFound, adminError{Err: "not found"})
+		return
+	}
+	if req.Method != "POST" {
+		writeAdminJSON(logger, w, http.StatusMethodNotAllowed, adminError{Err: "method not allowed"})
+		return
+	}
+
+	rotation := cephdriver.KeyringRotation{}
+	if err := json.NewDecoder(req.Body).Decode(&rotation); err != nil {
+		writeAdminJSON(logger, w, http.StatusBadRequest, adminError{Err: fmt.Sprintf("Invalid keyring rotation (%s)", err.Error()), Code: ERR_INVALID_KEYRING})
+		return
+	}
+
+	response := driver.RotateKeyring(env, RotateKeyringRequest{ClientID: parts[1], Keyring: rotation.Keyring})
+	if err := DecodeError(response.Err); err != nil {
+		writeAdminJSON(logger, w, adminStatus(err.Code), adminError{Err: err.Message, Code: err.Code})
+		return
+	}
+
+	volumes := []VolumeDetails{}
+	for _, name := range response.Volumes {
+		if details, ok := driver.VolumeDetails(env, name); ok {
+			volumes = append(volumes, details)
+		}
+	}
+	writeAdminJSON(logger, w, http.StatusOK, volumes)
+}
+
+// adminStatus is the HTTP status the admin API answers a driver error with,
+// telling requests that were wrong apart from failures of the driver. An
+// unmount fails when its mount is busy, so it is a conflict too, and admin
+// socket failures are those of ceph-fuse rather than of the driver.
+func adminStatus(code ErrorCode) int {
+	switch code {
+	case ERR_VOLUME_NOT_FOUND:
+		return http.StatusNotFound
+	case ERR_INVALID_VOLUME_NAME, ERR_INVALID_HOLDER_ID, ERR_INVALID_OPTS, ERR_INVALID_KEYRING:
+		return http.StatusBadRequest
+	case ERR_NOT_MOUNTED, ERR_VOLUME_CONFLICT, ERR_MOUNT_PENDING, ERR_UNMOUNT_FAILED:
+		return http.StatusConflict
+	case ERR_OVERLOADED, ERR_TOO_MANY_MOUNTS:
+		return http.StatusServiceUnavailable
+	case ERR_ADMIN_SOCKET_FAILED:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func authorized(req *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	const prefix = "Bearer "
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(token)) == 1
+}
+
+func writeAdminJSON(logger lager.Logger, w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Error("failed-writing-response", err)
+	}
+}
@@ -0,0 +1,237 @@
+package cephlocal_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Admin API", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		testEnv     voldriver.Env
+		handler     http.Handler
+		token       string
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("AdminTest"), context.TODO())
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root"})
+		token = "some-token"
+
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-2")
+	})
+
+	JustBeforeEach(func() {
+		handler = cephlocal.NewAdminHandler(lagertest.NewTestLogger("AdminTest"), driver, token)
+	})
+
+	requestWithBody := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer some-token")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		return requestWithBody(method, path, "")
+	}
+
+	details := func(recorder *httptest.ResponseRecorder) cephlocal.VolumeDetails {
+		volume := cephlocal.VolumeDetails{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &volume)).To(Succeed())
+		return volume
+	}
+
+	It("rejects requests without the token", func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/volumes", nil))
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		req := httptest.NewRequest("GET", "/volumes", nil)
+		req.Header.Set("Authorization", "Bearer other-token")
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	Context("when no token is configured", func() {
+		BeforeEach(func() {
+			token = ""
+		})
+
+		It("rejects every request", func() {
+			req := httptest.NewRequest("GET", "/volumes", nil)
+			req.Header.Set("Authorization", "Bearer ")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	It("lists volumes with their keyrings redacted", func() {
+		recorder := request("GET", "/volumes")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).NotTo(ContainSubstring("some-keyring"))
+
+		volumes := []cephlocal.VolumeDetails{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &volumes)).To(Succeed())
+		Expect(volumes).To(HaveLen(1))
+		Expect(volumes[0].Keyring).To(Equal(cephlocal.REDACTED))
+		Expect(volumes[0].Monitor).To(Equal("some-ip:6789"))
+		Expect(volumes[0].Holders).To(Equal([]string{"container-1", "container-2"}))
+		Expect(volumes[0].MountCount).To(Equal(2))
+		Expect(volumes[0].ShareMountPoint).To(HavePrefix("some-root/shares/"))
+		Expect(volumes[0].KeyPath).To(MatchRegexp(`/tmp/keypath_\d+`))
+		Expect(volumes[0].Healthy).To(BeTrue())
+	})
+
+	It("shows a single volume", func() {
+		recorder := request("GET", "/volumes/volume-name")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(details(recorder).Name).To(Equal(volumeName))
+
+		Expect(request("GET", "/volumes/unknown").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("force-unmounts a single holder lazily", func() {
+		recorder := request("POST", "/volumes/volume-name/unmount?holder=container-1")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(details(recorder).Holders).To(Equal([]string{"container-2"}))
+
+		_, executable, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+		Expect(executable).To(Equal("umount"))
+		Expect(args).To(Equal([]string{"-l", "some-root/volumes/volume-name/container-1"}))
+	})
+
+	It("force-unmounts every holder and the share", func() {
+		recorder := request("POST", "/volumes/volume-name/unmount")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(details(recorder).Holders).To(BeEmpty())
+
+		_, executable, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+		Expect(executable).To(Equal("fusermount"))
+		Expect(args[:2]).To(Equal([]string{"-u", "-z"}))
+	})
+
+	It("reports failures and keeps them as the volume's last error", func() {
+		fakeInvoker.InvokeReturns(nil, errors.New("device busy"))
+		recorder := request("POST", "/volumes/volume-name/unmount?holder=container-1")
+		Expect(recorder.Code).To(Equal(http.StatusConflict))
+		Expect(recorder.Body.String()).To(ContainSubstring("device busy"))
+
+		Expect(details(request("GET", "/volumes/volume-name")).LastError).To(ContainSubstring("device busy"))
+	})
+
+	It("updates the opts of a volume until it is remounted", func() {
+		recorder := requestWithBody("PATCH", "/volumes/volume-name", `{"ip": "other-ip", "read_only": true}`)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(details(recorder).Monitor).To(Equal("other-ip:6789"))
+		Expect(details(recorder).ReadOnly).To(BeTrue())
+		Expect(details(recorder).PendingChanges).To(Equal([]string{"ip", "read_only"}))
+
+		recorder = request("POST", "/volumes/volume-name/remount")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(details(recorder).PendingChanges).To(BeEmpty())
+	})
+
+	It("rejects invalid updates", func() {
+		recorder := requestWithBody("PATCH", "/volumes/volume-name", `{"local_mount_point": "/other"}`)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"error": "Unable to update 'local_mount_point' field of an existing volume", "code": "INVALID_OPTS"}`))
+
+		recorder = requestWithBody("PATCH", "/volumes/volume-name", `not json`)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(recorder.Body.String()).To(ContainSubstring("INVALID_OPTS"))
+	})
+
+	It("rotates the keyring of a volume", func() {
+		invocations := fakeInvoker.InvokeCallCount()
+		recorder := requestWithBody("POST", "/volumes/volume-name/rotate-keyring", `{"keyring": "other-keyring"}`)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).NotTo(ContainSubstring("other-keyring"))
+		Expect(details(recorder).Holders).To(Equal([]string{"container-1", "container-2"}))
+		Expect(invocationsOf(fakeInvoker, "ceph-fuse")).To(Equal(2))
+		Expect(fakeInvoker.InvokeCallCount()).To(BeNumerically(">", invocations))
+
+		recorder = requestWithBody("POST", "/volumes/volume-name/rotate-keyring", `{}`)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"error": "Missing mandatory 'Keyring'", "code": "INVALID_KEYRING"}`))
+	})
+
+	It("rotates the keyring of every volume of a client", func() {
+		createSuccessful(testEnv, driver, "other-volume", map[string]interface{}{"keyring": "[client.app]\n\tkey = old-key\n", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+
+		recorder := requestWithBody("POST", "/clients/app/rotate-keyring", `{"keyring": "[client.app]\n\tkey = new-key\n"}`)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		volumes := []cephlocal.VolumeDetails{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &volumes)).To(Succeed())
+		Expect(volumes).To(HaveLen(1))
+		Expect(volumes[0].Name).To(Equal("other-volume"))
+
+		recorder = requestWithBody("POST", "/clients/nobody/rotate-keyring", `{"keyring": "[client.nobody]\n\tkey = k\n"}`)
+		Expect(recorder.Code).To(Equal(http.StatusNotFound))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"error": "No volumes found for client 'nobody'", "code": "VOLUME_NOT_FOUND"}`))
+
+		Expect(request("GET", "/clients/app/rotate-keyring").Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(request("POST", "/clients/app").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("remounts a volume", func() {
+		invocations := fakeInvoker.InvokeCallCount()
+		recorder := request("POST", "/volumes/volume-name/remount")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(fakeInvoker.InvokeCallCount()).To(BeNumerically(">", invocations))
+	})
+
+	It("records heartbeats of holders", func() {
+		recorder := request("POST", "/volumes/volume-name/heartbeat?holder=container-1")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(details(recorder).LastSeen).To(HaveKey("container-1"))
+
+		recorder = request("POST", "/volumes/volume-name/heartbeat?holder=container-3")
+		Expect(recorder.Code).To(Equal(http.StatusConflict))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"error": "Volume 'volume-name' is not held by 'container-3'", "code": "NOT_MOUNTED"}`))
+	})
+
+	It("removes a volume", func() {
+		Expect(request("DELETE", "/volumes/volume-name").Code).To(Equal(http.StatusNoContent))
+		Expect(request("GET", "/volumes/volume-name").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("reports that diagnostics are unavailable without an admin socket", func() {
+		recorder := request("GET", "/volumes/volume-name/diagnostics")
+		Expect(recorder.Code).To(Equal(http.StatusBadGateway))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"error": "Volume 'volume-name' was mounted without an admin socket", "code": "ADMIN_SOCKET_FAILED"}`))
+	})
+
+	It("rejects unknown routes and methods", func() {
+		Expect(request("GET", "/other").Code).To(Equal(http.StatusNotFound))
+		Expect(request("GET", "/volumes/volume-name/other").Code).To(Equal(http.StatusNotFound))
+		Expect(request("POST", "/volumes").Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(request("GET", "/volumes/volume-name/remount").Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(request("POST", "/volumes/volume-name/diagnostics").Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
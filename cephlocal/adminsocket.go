@@ -0,0 +1,69 @@
+package cephlocal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const ADMIN_SOCKET_TIMEOUT = 5 * time.Second
+
+// ADMIN_SOCKET_MAX_RESPONSE bounds the responses read from an admin socket;
+// a perf dump of ceph-fuse is a few tens of kilobytes.
+const ADMIN_SOCKET_MAX_RESPONSE = 16 * 1024 * 1024
+
+// An AdminSocket runs commands on the admin socket of a ceph daemon, such as
+// "status", "perf dump" or "mds_sessions", and returns their JSON output.
+type AdminSocket interface {
+	Command(path string, prefix string) ([]byte, error)
+}
+
+type adminSocket struct {
+	timeout time.Duration
+}
+
+// NewAdminSocket talks to admin sockets directly, the way the ceph command
+// line does with --admin-daemon, giving up on a command after timeout.
+func NewAdminSocket(timeout time.Duration) AdminSocket {
+	return &adminSocket{timeout: timeout}
+}
+
+// Command sends the command as JSON terminated by a NUL byte; the daemon
+// answers with the length of its output as a big-endian uint32, followed by
+// the output.
+func (a *adminSocket) Command(path string, prefix string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", path, a.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(a.timeout)); err != nil {
+		return nil, err
+	}
+
+	request, err := json.Marshal(map[string]string{"prefix": prefix})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(request, 0)); err != nil {
+		return nil, err
+	}
+
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > ADMIN_SOCKET_MAX_RESPONSE {
+		return nil, fmt.Errorf("response of %d bytes is too large", length)
+	}
+
+	response := make([]byte, length)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
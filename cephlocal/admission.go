@@ -0,0 +1,159 @@
+package cephlocal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	REJECTED_QUEUE_FULL    = "queue_full"
+	REJECTED_QUEUE_TIMEOUT = "queue_timeout"
+	REJECTED_CANCELED      = "canceled"
+	REJECTED_MOUNT_LIMIT   = "mount_limit"
+)
+
+// AdmissionConfig bounds the mount and unmount work the driver takes on, so
+// that a mass restart of a cell does not start hundreds of ceph-fuse
+// processes against the monitors at once. At most MaxConcurrent Mount and
+// Unmount calls run at a time; up to MaxQueued more wait, each for at most
+// QueueTimeout, and further calls are rejected with OVERLOADED. Mounts that
+// would take the number of mounted volumes beyond MaxMountedVolumes are
+// rejected with TOO_MANY_MOUNTS. Zero values leave the respective bound
+// off; without a QueueTimeout, calls wait as long as their request lasts.
+type AdmissionConfig struct {
+	MaxConcurrent     int
+	MaxQueued         int
+	QueueTimeout      time.Duration
+	MaxMountedVolumes int
+}
+
+type admission struct {
+	config AdmissionConfig
+	slots  chan struct{}
+
+	lock     sync.Mutex
+	running  int
+	queued   int
+	rejected map[string]int
+}
+
+func newAdmission(config AdmissionConfig) *admission {
+	a := &admission{config: config, rejected: map[string]int{}}
+	if config.MaxConcurrent > 0 {
+		a.slots = make(chan struct{}, config.MaxConcurrent)
+	}
+	return a
+}
+
+// admit waits for a slot to run a mount or unmount in, and returns the
+// function that gives it back.
+func (a *admission) admit(logger lager.Logger, ctx context.Context) (func(), *Error) {
+	if a.slots == nil {
+		a.started()
+		return a.finished, nil
+	}
+	release := func() {
+		a.finished()
+		<-a.slots
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		a.started()
+		return release, nil
+	default:
+	}
+
+	a.lock.Lock()
+	if a.config.MaxQueued > 0 && a.queued >= a.config.MaxQueued {
+		a.rejected[REJECTED_QUEUE_FULL]++
+		a.lock.Unlock()
+		return nil, newError(ERR_OVERLOADED, "Too many mount and unmount requests in progress (%d running, %d queued)", a.config.MaxConcurrent, a.config.MaxQueued)
+	}
+	a.queued++
+	logger.Info("waiting-for-admission", lager.Data{"queued": a.queued})
+	a.lock.Unlock()
+
+	defer func() {
+		a.lock.Lock()
+		a.queued--
+		a.lock.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if a.config.QueueTimeout > 0 {
+		timer := time.NewTimer(a.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		a.started()
+		return release, nil
+	case <-timeout:
+		a.reject(REJECTED_QUEUE_TIMEOUT)
+		return nil, newError(ERR_OVERLOADED, "Timed out after %s waiting for other mount and unmount requests to finish", a.config.QueueTimeout)
+	case <-ctx.Done():
+		a.reject(REJECTED_CANCELED)
+		return nil, newError(ERR_OVERLOADED, "Request ended while waiting for other mount and unmount requests to finish (%s)", ctx.Err().Error())
+	}
+}
+
+func (a *admission) started() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.running++
+}
+
+func (a *admission) finished() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.running--
+}
+
+func (a *admission) reject(reason string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.rejected[reason]++
+}
+
+// checkMountLimit rejects mounting a volume that is not mounted yet when
+// mounted volumes are already at the limit. It is called with the driver
+// lock held.
+func (d *LocalDriver) checkMountLimit(volume *volumeMetadata) *Error {
+	limit := d.admission.config.MaxMountedVolumes
+	if limit <= 0 || volume.mounted() {
+		return nil
+	}
+
+	mounted := 0
+	for name, other := range d.volumes {
+		if other.mounted() || d.mounting[name] {
+			mounted++
+		}
+	}
+	if mounted < limit {
+		return nil
+	}
+
+	d.admission.reject(REJECTED_MOUNT_LIMIT)
+	return newError(ERR_TOO_MANY_MOUNTS, "Unable to mount another volume: %d of %d volumes are mounted", mounted, limit)
+}
+
+// admissionStats reports the calls running and waiting, and the rejections
+// by reason.
+func (d *LocalDriver) admissionStats() (running int, queued int, rejected map[string]int) {
+	a := d.admission
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rejected = map[string]int{}
+	for reason, count := range a.rejected {
+		rejected[reason] = count
+	}
+	return a.running, a.queued, rejected
+}
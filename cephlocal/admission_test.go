@@ -0,0 +1,240 @@
+package cephlocal_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Admission control", func() {
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		logger      *lagertest.TestLogger
+		testEnv     voldriver.Env
+		config      cephlocal.AdmissionConfig
+		cephFuse    chan error
+	)
+
+	BeforeEach(func() {
+		cephFuse = make(chan error)
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		logger = lagertest.NewTestLogger("AdmissionTest")
+		testEnv = driverhttp.NewHttpDriverEnv(logger, context.TODO())
+		config = cephlocal.AdmissionConfig{}
+	})
+
+	JustBeforeEach(func() {
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root", Admission: config})
+		for _, name := range []string{"volume-1", "volume-2", "volume-3"} {
+			createSuccessful(testEnv, driver, name, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "/" + name})
+		}
+	})
+
+	mount := func(name string, id string) voldriver.MountResponse {
+		return driver.Mount(testEnv, voldriver.MountRequest{Name: name, ID: id})
+	}
+
+	mountInBackground := func(name string, id string) <-chan voldriver.MountResponse {
+		d, env := driver, testEnv
+		responses := make(chan voldriver.MountResponse, 1)
+		go func() {
+			responses <- d.Mount(env, voldriver.MountRequest{Name: name, ID: id})
+		}()
+		return responses
+	}
+
+	scrape := func() string {
+		metrics := cephlocal.NewMetrics()
+		metrics.CollectDriver(driver)
+
+		recorder := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		return recorder.Body.String()
+	}
+
+	Context("with a limit on concurrent mounts", func() {
+		var (
+			first   <-chan voldriver.MountResponse
+			started chan string
+		)
+
+		BeforeEach(func() {
+			config = cephlocal.AdmissionConfig{MaxConcurrent: 1, MaxQueued: 1}
+			started = make(chan string, 3)
+			fakeInvoker.InvokeStub = func(env voldriver.Env, executable string, args []string) ([]byte, error) {
+				if executable == "ceph-fuse" {
+					started <- executable
+					return nil, <-cephFuse
+				}
+				return nil, nil
+			}
+		})
+
+		JustBeforeEach(func() {
+			first = mountInBackground("volume-1", "container-1")
+			Eventually(started).Should(Receive())
+		})
+
+		It("queues further mounts until the running one is done", func() {
+			second := mountInBackground("volume-2", "container-1")
+			Eventually(logger).Should(gbytes.Say("waiting-for-admission"))
+			Consistently(started).ShouldNot(Receive())
+
+			cephFuse <- nil
+			Expect((<-first).Err).To(BeEmpty())
+			cephFuse <- nil
+			Expect((<-second).Err).To(BeEmpty())
+		})
+
+		It("rejects mounts once the queue is full", func() {
+			second := mountInBackground("volume-2", "container-1")
+			Eventually(logger).Should(gbytes.Say("waiting-for-admission"))
+
+			Expect(mount("volume-3", "container-1").Err).To(Equal("Too many mount and unmount requests in progress (1 running, 1 queued) [OVERLOADED]"))
+
+			cephFuse <- nil
+			cephFuse <- nil
+			Eventually(second).Should(Receive())
+			Expect(scrape()).To(ContainSubstring(`cephdriver_admission_rejections_total{reason="queue_full"} 1`))
+		})
+
+		It("rejects queued mounts whose request ends", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			response := driver.Mount(driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("AdmissionTest"), ctx), voldriver.MountRequest{Name: "volume-2", ID: "container-1"})
+			Expect(response.Err).To(Equal("Request ended while waiting for other mount and unmount requests to finish (context canceled) [OVERLOADED]"))
+
+			cephFuse <- nil
+			Eventually(first).Should(Receive())
+		})
+
+		Context("with a queue timeout", func() {
+			BeforeEach(func() {
+				config.QueueTimeout = 10 * time.Millisecond
+			})
+
+			It("rejects mounts that wait too long", func() {
+				Expect(mount("volume-2", "container-1").Err).To(Equal("Timed out after 10ms waiting for other mount and unmount requests to finish [OVERLOADED]"))
+
+				cephFuse <- nil
+				Eventually(first).Should(Receive())
+				Expect(scrape()).To(ContainSubstring(`cephdriver_admission_rejections_total{reason="queue_timeout"} 1`))
+			})
+		})
+	})
+
+	Context("with room for several concurrent mounts", func() {
+		var started chan string
+
+		BeforeEach(func() {
+			config = cephlocal.AdmissionConfig{MaxConcurrent: 2}
+			started = make(chan string, 3)
+			fakeInvoker.InvokeStub = func(env voldriver.Env, executable string, args []string) ([]byte, error) {
+				if executable == "ceph-fuse" {
+					started <- args[len(args)-1]
+					return nil, <-cephFuse
+				}
+				return nil, nil
+			}
+		})
+
+		It("runs that many mounts at once and queues the rest", func() {
+			first := mountInBackground("volume-1", "container-1")
+			second := mountInBackground("volume-2", "container-1")
+			Eventually(started).Should(Receive())
+			Eventually(started).Should(Receive())
+
+			third := mountInBackground("volume-3", "container-1")
+			Eventually(logger).Should(gbytes.Say("waiting-for-admission"))
+			Consistently(started).ShouldNot(Receive())
+			Expect(scrape()).To(ContainSubstring("cephdriver_admission_running 2"))
+			Expect(scrape()).To(ContainSubstring("cephdriver_admission_queue_depth 1"))
+
+			cephFuse <- nil
+			Eventually(started).Should(Receive())
+			cephFuse <- nil
+			cephFuse <- nil
+			for _, responses := range []<-chan voldriver.MountResponse{first, second, third} {
+				Expect((<-responses).Err).To(BeEmpty())
+			}
+			Expect(scrape()).To(ContainSubstring("cephdriver_admission_running 0"))
+		})
+	})
+
+	Context("without a limit on concurrent mounts", func() {
+		BeforeEach(func() {
+			fakeInvoker.InvokeStub = func(env voldriver.Env, executable string, args []string) ([]byte, error) {
+				if executable == "ceph-fuse" {
+					return nil, <-cephFuse
+				}
+				return nil, nil
+			}
+		})
+
+		It("counts the mounts running", func() {
+			first := mountInBackground("volume-1", "container-1")
+			second := mountInBackground("volume-2", "container-1")
+			Eventually(scrape).Should(ContainSubstring("cephdriver_admission_running 2"))
+
+			cephFuse <- nil
+			cephFuse <- nil
+			Eventually(first).Should(Receive())
+			Eventually(second).Should(Receive())
+			Expect(scrape()).To(ContainSubstring("cephdriver_admission_running 0"))
+		})
+	})
+
+	Context("with a limit on mounted volumes", func() {
+		BeforeEach(func() {
+			config = cephlocal.AdmissionConfig{MaxMountedVolumes: 1}
+		})
+
+		It("rejects mounting another volume", func() {
+			Expect(mount("volume-1", "container-1").Err).To(BeEmpty())
+
+			Expect(mount("volume-2", "container-1").Err).To(Equal("Unable to mount another volume: 1 of 1 volumes are mounted [TOO_MANY_MOUNTS]"))
+			Expect(scrape()).To(ContainSubstring(`cephdriver_admission_rejections_total{reason="mount_limit"} 1`))
+		})
+
+		It("still mounts volumes that are mounted already for more holders", func() {
+			Expect(mount("volume-1", "container-1").Err).To(BeEmpty())
+			Expect(mount("volume-1", "container-2").Err).To(BeEmpty())
+		})
+
+		It("counts a volume being mounted against the limit", func() {
+			fakeInvoker.InvokeStub = func(env voldriver.Env, executable string, args []string) ([]byte, error) {
+				if executable == "ceph-fuse" {
+					return nil, <-cephFuse
+				}
+				return nil, nil
+			}
+			first := mountInBackground("volume-1", "container-1")
+			Eventually(fakeInvoker.InvokeCallCount).Should(Equal(1))
+
+			Expect(mount("volume-2", "container-1").Err).To(Equal("Unable to mount another volume: 1 of 1 volumes are mounted [TOO_MANY_MOUNTS]"))
+
+			cephFuse <- nil
+			Expect((<-first).Err).To(BeEmpty())
+		})
+
+		It("mounts another volume once one is unmounted", func() {
+			Expect(mount("volume-1", "container-1").Err).To(BeEmpty())
+			Expect(driver.Unmount(testEnv, voldriver.UnmountRequest{Name: "volume-1", ID: "container-1"}).Err).To(BeEmpty())
+			Expect(mount("volume-2", "container-1").Err).To(BeEmpty())
+		})
+	})
+})
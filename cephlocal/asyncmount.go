@@ -0,0 +1,203 @@
+package cephlocal
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+// DEFAULT_ASYNC_MOUNT_TTL is how long the outcome of a background mount is
+// kept for its holder to poll.
+const DEFAULT_ASYNC_MOUNT_TTL = 10 * time.Minute
+
+// A mountOperation is a mount running in the background for a holder of a
+// volume. Once done it keeps the response until the holder mounts again or
+// the driver's AsyncMountTTL passes, so that the outcome can be polled.
+type mountOperation struct {
+	volumeName string
+	holderID   string
+	env        voldriver.Env
+	request    MountRequest
+	options    cephdriver.MountOptions
+	started    time.Time
+	finished   time.Time
+	done       bool
+	response   voldriver.MountResponse
+}
+
+func mountOperationKey(volumeName string, holderID string) string {
+	return volumeName + "\x00" + holderID
+}
+
+func (op *mountOperation) pendingError() *Error {
+	return newError(ERR_MOUNT_PENDING, "Volume '%s' is still being mounted for '%s' (started %s ago)", op.volumeName, op.holderID, time.Since(op.started).Truncate(time.Millisecond))
+}
+
+// mountAsync starts mounting a volume for a holder in the background and
+// reports it as pending. Mounts for the same holder join the operation in
+// progress, and the first one after it is done returns its outcome; those
+// for a holder that already has the volume mounted answer its mount point
+// straight away. The mounts of a volume run one after another, in a single
+// goroutine per volume, as each would wait for the one before anyway.
+func (d *LocalDriver) mountAsync(env voldriver.Env, mountRequest MountRequest, options cephdriver.MountOptions) voldriver.MountResponse {
+	logger := env.Logger().Session("mount-async", lager.Data{"volume_name": mountRequest.Name, "holder": mountRequest.ID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.operationsLock.Lock()
+	defer d.operationsLock.Unlock()
+	d.expireMountOperations()
+
+	key := mountOperationKey(mountRequest.Name, mountRequest.ID)
+	if op, ok := d.operations[key]; ok {
+		if !op.done {
+			logger.Info("joining-pending-mount")
+			return voldriver.MountResponse{Err: op.pendingError().Encode()}
+		}
+		delete(d.operations, key)
+		logger.Info("returning-mount-outcome", lager.Data{"error": op.response.Err})
+		return op.response
+	}
+
+	started := time.Now()
+	if mountPoint, ok := d.heldMountPoint(logger, mountRequest.Name, mountRequest.ID); ok {
+		logger.Info("mount-volume-already-held")
+		d.publishOperation(EVENT_MOUNT, mountRequest.Name, mountRequest.ID, started, "")
+		return voldriver.MountResponse{Mountpoint: mountPoint}
+	}
+
+	// The mount outlives the request that started it.
+	op := &mountOperation{
+		volumeName: mountRequest.Name,
+		holderID:   mountRequest.ID,
+		env:        driverhttp.NewHttpDriverEnv(logger, context.Background()),
+		request:    mountRequest,
+		options:    options,
+		started:    time.Now(),
+	}
+	d.operations[key] = op
+
+	queue, running := d.mountQueues[mountRequest.Name]
+	d.mountQueues[mountRequest.Name] = append(queue, op)
+	if !running {
+		go d.runMounts(mountRequest.Name)
+	}
+
+	logger.Info("mount-started", lager.Data{"queued": len(queue)})
+	return voldriver.MountResponse{Err: op.pendingError().Encode()}
+}
+
+// heldMountPoint answers the bind mount point of a holder that already has
+// the volume mounted, noting it as seen as a synchronous mount would.
+func (d *LocalDriver) heldMountPoint(logger lager.Logger, volumeName string, holderID string) (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	volume, ok := d.volumes[volumeName]
+	if !ok || !volume.Holders[holderID] {
+		return "", false
+	}
+	volume.seen(holderID, time.Now())
+	d.persist(logger)
+	return volume.bindPath(holderID), true
+}
+
+// runMounts runs the background mounts queued for a volume until none are
+// left.
+func (d *LocalDriver) runMounts(volumeName string) {
+	for {
+		d.operationsLock.Lock()
+		queue := d.mountQueues[volumeName]
+		if len(queue) == 0 {
+			delete(d.mountQueues, volumeName)
+			d.operationsLock.Unlock()
+			return
+		}
+		op := queue[0]
+		d.mountQueues[volumeName] = queue[1:]
+		d.operationsLock.Unlock()
+
+		response := d.mount(op.env, op.request, op.options)
+
+		d.operationsLock.Lock()
+		op.done = true
+		op.finished = time.Now()
+		op.response = response
+		d.operationsLock.Unlock()
+	}
+}
+
+// mountOperationError reports the background mount of the holder a Get or
+// Path stands for while it is in progress, or else if it failed: the holder
+// with the given ID or, without one, the only holder of the volume mounted
+// in the background. It does not wait for the mount.
+func (d *LocalDriver) mountOperationError(volumeName string, holderID string) *Error {
+	d.operationsLock.Lock()
+	defer d.operationsLock.Unlock()
+	d.expireMountOperations()
+
+	var found *mountOperation
+	for _, op := range d.operations {
+		if op.volumeName != volumeName || (holderID != "" && op.holderID != holderID) {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = op
+	}
+
+	if found == nil {
+		return nil
+	}
+	if !found.done {
+		return found.pendingError()
+	}
+	return DecodeError(found.response.Err)
+}
+
+// expireMountOperations forgets the outcomes of background mounts that have
+// not been polled within the TTL. It is called with the operations lock held.
+func (d *LocalDriver) expireMountOperations() {
+	for key, op := range d.operations {
+		if op.done && time.Since(op.finished) > d.asyncMountTTL {
+			delete(d.operations, key)
+		}
+	}
+}
+
+// clearMountOperations forgets the finished mounts of a volume, or of one of
+// its holders, and fails while one is still in progress.
+func (d *LocalDriver) clearMountOperations(volumeName string, holderID string) *Error {
+	d.operationsLock.Lock()
+	defer d.operationsLock.Unlock()
+
+	for key, op := range d.operations {
+		if op.volumeName != volumeName || (holderID != "" && op.holderID != holderID) {
+			continue
+		}
+		if !op.done {
+			return op.pendingError()
+		}
+		delete(d.operations, key)
+	}
+	return nil
+}
+
+func (d *LocalDriver) pendingMounts() int {
+	d.operationsLock.Lock()
+	defer d.operationsLock.Unlock()
+	d.expireMountOperations()
+
+	pending := 0
+	for _, op := range d.operations {
+		if !op.done {
+			pending++
+		}
+	}
+	return pending
+}
@@ -0,0 +1,162 @@
+package cephlocal_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Asynchronous mounts", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		testEnv     voldriver.Env
+		cephFuse    chan error
+		cephFuseRan func() int
+	)
+
+	BeforeEach(func() {
+		var lock sync.Mutex
+		runs := 0
+		cephFuse = make(chan error)
+		cephFuseRan = func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return runs
+		}
+
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeInvoker.InvokeStub = func(env voldriver.Env, executable string, args []string) ([]byte, error) {
+			if executable != "ceph-fuse" {
+				return nil, nil
+			}
+			lock.Lock()
+			runs++
+			lock.Unlock()
+			return nil, <-cephFuse
+		}
+
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("AsyncMountTest"), context.TODO())
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root", AsyncMount: true})
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+	})
+
+	mount := func() voldriver.MountResponse {
+		return driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: "container-1"})
+	}
+
+	It("reports the mount as pending while ceph-fuse starts", func() {
+		Expect(mount().Err).To(MatchRegexp(`^Volume 'volume-name' is still being mounted for 'container-1' \(started .* ago\) \[MOUNT_PENDING\]$`))
+		Eventually(cephFuseRan).Should(Equal(1))
+
+		Expect(driver.Path(testEnv, voldriver.PathRequest{Name: volumeName}).Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		Expect(driver.Get(testEnv, voldriver.GetRequest{Name: volumeName}).Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		Expect(driver.Unmount(testEnv, voldriver.UnmountRequest{Name: volumeName, ID: "container-1"}).Err).To(ContainSubstring("[MOUNT_PENDING]"))
+
+		cephFuse <- nil
+	})
+
+	It("joins repeated mounts to the one in progress", func() {
+		Expect(mount().Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		Expect(mount().Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		Eventually(cephFuseRan).Should(Equal(1))
+
+		cephFuse <- nil
+		Eventually(func() string { return mount().Mountpoint }).Should(Equal("some-root/volumes/volume-name/container-1"))
+		Expect(cephFuseRan()).To(Equal(1))
+
+		Expect(driver.Path(testEnv, voldriver.PathRequest{Name: volumeName}).Mountpoint).To(Equal("some-root/volumes/volume-name/container-1"))
+	})
+
+	It("answers mounts after the outcome has been polled without mounting again", func() {
+		Expect(mount().Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		cephFuse <- nil
+		Eventually(func() string { return mount().Mountpoint }).Should(Equal("some-root/volumes/volume-name/container-1"))
+
+		response := mount()
+		Expect(response.Err).To(BeEmpty())
+		Expect(response.Mountpoint).To(Equal("some-root/volumes/volume-name/container-1"))
+		Expect(driver.PathForHolder(testEnv, cephlocal.PathRequest{Name: volumeName, ID: "container-1"}).Mountpoint).To(Equal("some-root/volumes/volume-name/container-1"))
+		Expect(cephFuseRan()).To(Equal(1))
+	})
+
+	It("reports a failed mount until it is tried again", func() {
+		Expect(mount().Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		cephFuse <- errors.New("connection refused")
+
+		Eventually(func() string { return driver.Path(testEnv, voldriver.PathRequest{Name: volumeName}).Err }).Should(ContainSubstring("connection refused"))
+		Expect(mount().Err).To(ContainSubstring("connection refused"))
+
+		Expect(mount().Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		Eventually(cephFuseRan).Should(Equal(2))
+		cephFuse <- nil
+	})
+
+	It("reports a mount only to the holder it is for", func() {
+		Expect(mount().Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		Eventually(cephFuseRan).Should(Equal(1))
+
+		Expect(driver.GetForHolder(testEnv, cephlocal.GetRequest{Name: volumeName, ID: "container-2"}).Err).To(BeEmpty())
+		Expect(driver.PathForHolder(testEnv, cephlocal.PathRequest{Name: volumeName, ID: "container-2"}).Err).To(Equal("Volume volume-name not mounted [NOT_MOUNTED]"))
+		Expect(driver.PathForHolder(testEnv, cephlocal.PathRequest{Name: volumeName, ID: "container-1"}).Err).To(ContainSubstring("[MOUNT_PENDING]"))
+
+		cephFuse <- nil
+	})
+
+	It("mounts the holders of a volume one after another, with ceph-fuse run once", func() {
+		Expect(mount().Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		Expect(driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: "container-2"}).Err).To(ContainSubstring("[MOUNT_PENDING]"))
+		Eventually(cephFuseRan).Should(Equal(1))
+
+		Expect(driver.Path(testEnv, voldriver.PathRequest{Name: volumeName}).Err).To(Equal("Volume volume-name not mounted [NOT_MOUNTED]"))
+
+		cephFuse <- nil
+		Eventually(func() string { return mount().Mountpoint }).Should(Equal("some-root/volumes/volume-name/container-1"))
+		Eventually(func() string {
+			return driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: "container-2"}).Mountpoint
+		}).Should(Equal("some-root/volumes/volume-name/container-2"))
+		Expect(cephFuseRan()).To(Equal(1))
+	})
+
+	Context("when the outcome of a mount is not polled in time", func() {
+		BeforeEach(func() {
+			driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root", AsyncMount: true, AsyncMountTTL: 50 * time.Millisecond})
+			createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+		})
+
+		It("forgets it", func() {
+			Expect(mount().Err).To(ContainSubstring("[MOUNT_PENDING]"))
+			cephFuse <- errors.New("connection refused")
+			Eventually(func() string { return driver.Path(testEnv, voldriver.PathRequest{Name: volumeName}).Err }).Should(ContainSubstring("connection refused"))
+
+			Eventually(func() string { return driver.Path(testEnv, voldriver.PathRequest{Name: volumeName}).Err }).Should(Equal("Volume volume-name not mounted [NOT_MOUNTED]"))
+			Expect(mount().Err).To(ContainSubstring("[MOUNT_PENDING]"))
+			Eventually(cephFuseRan).Should(Equal(2))
+			cephFuse <- nil
+		})
+	})
+
+	It("mounts anonymous holders synchronously", func() {
+		go func() {
+			cephFuse <- nil
+		}()
+		response := driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName})
+		Expect(response.Err).To(BeEmpty())
+		Expect(response.Mountpoint).To(Equal("some-root/volumes/volume-name/anonymous-1"))
+	})
+})
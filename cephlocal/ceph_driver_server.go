@@ -1,11 +1,19 @@
 package cephlocal
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 
 	"strings"
+	"time"
 
 	"fmt"
 
@@ -15,43 +23,126 @@ import (
 
 	"code.cloudfoundry.org/lager"
 
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
 	"code.cloudfoundry.org/voldriver"
 	"code.cloudfoundry.org/voldriver/driverhttp"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/http_server"
 )
 
+const DEFAULT_DRIVER_NAME = cephdriver.DEFAULT_DRIVER_NAME
+
+const DRIVER_NAME_REGEX string = `^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`
+
 const IPV4_REGEX string = `^(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\:([0-9]{1,4}|[1-5][0-9]{4}|6[0-4][0-9]{3}|65[0-4][0-9]{2}|655[0-2][0-9]|6553[0-5])$`
 
-type fuseArgs []string
+type stringList []string
 
-func (i *fuseArgs) String() string {
+func (i *stringList) String() string {
 	return strings.Join(*i, ", ")
 }
 
-func (i *fuseArgs) Set(value string) error {
+func (i *stringList) Set(value string) error {
 	*i = append(*i, value)
 	return nil
 }
 
 type CephServerConfig struct {
-	AtAddress   string
-	DriversPath string
-	Transport   string
-	FuseArgs    fuseArgs
+	AtAddress         string
+	DriversPath       string
+	Transport         string
+	FuseArgs          stringList
+	DriverName        string
+	Scope             string
+	RootDir           string
+	AllowedMountRoots stringList
+	MetricsAddress    string
+	AdminAddress      string
+	AdminTokenFile    string
+	FuseLogDir        string
+	FuseLogMaxSize    int64
+	FuseLogMaxFiles   int
+	SuperviseFuse     bool
+	RestartFuse       bool
+	FuseMemoryLimit   string
+	FuseCPULimit      string
+	CgroupRoot        string
+
+	// AdminCertFile and AdminKeyFile have the admin API served over TLS;
+	// AdminCAFile then requires clients to present a certificate it signed.
+	// Without them the admin API is served over plain HTTP, which is only
+	// allowed on a loopback AdminAddress unless AdminInsecure is set.
+	AdminCertFile string
+	AdminKeyFile  string
+	AdminCAFile   string
+	AdminInsecure bool
+
+	// FuseLogCheckInterval is how often the ceph-fuse log files are checked
+	// for having grown to FuseLogMaxSize.
+	FuseLogCheckInterval time.Duration
+
+	// EvictionCheckInterval is how often the driver looks for ceph-fuse
+	// clients evicted by the MDS; RemountEvicted has it mount their shares
+	// again.
+	EvictionCheckInterval time.Duration
+	RemountEvicted        bool
+
+	// StaleCheckInterval is how often the driver checks its ceph-fuse mounts
+	// for having gone stale.
+	StaleCheckInterval time.Duration
+
+	// IdleTTL is how long a holder may show no sign of life before it is
+	// unmounted; IdleHeartbeats makes heartbeats the only sign of life.
+	IdleTTL           time.Duration
+	IdleCheckInterval time.Duration
+	IdleHeartbeats    bool
+
+	AsyncMount    bool
+	AsyncMountTTL time.Duration
+
+	MaxConcurrentMounts int
+	MaxQueuedMounts     int
+	MountQueueTimeout   time.Duration
+	MaxMountedVolumes   int
+
+	EventBuffer int
+
+	// WebhookURLs are notified of failed, rejected, stale and force-unmounted
+	// mounts, with payloads signed by the secret in WebhookSecretFile when it
+	// is set. Notifications that cannot be delivered are appended to
+	// WebhookDeadLetterFile, by default under the root directory.
+	WebhookURLs           stringList
+	WebhookSecretFile     string
+	WebhookRetries        int
+	WebhookRetryInterval  time.Duration
+	WebhookDeadLetterFile string
 }
 
 type CephDriverServer interface {
 	Runner(logger lager.Logger) (ifrit.Runner, error)
+	MetricsRunner(logger lager.Logger) (ifrit.Runner, error)
+	AdminRunner(logger lager.Logger) (ifrit.Runner, error)
+	SupervisorRunner(logger lager.Logger) (ifrit.Runner, error)
+	EvictionMonitorRunner(logger lager.Logger) (ifrit.Runner, error)
+	StaleMonitorRunner(logger lager.Logger) (ifrit.Runner, error)
+	LogRotatorRunner(logger lager.Logger) (ifrit.Runner, error)
+	IdleReaperRunner(logger lager.Logger) (ifrit.Runner, error)
+	WebhookNotifierRunner(logger lager.Logger) (ifrit.Runner, error)
 }
 
 type CephDriverServerStruct struct {
-	config CephServerConfig
+	config  CephServerConfig
+	metrics *Metrics
+	driver  *LocalDriver
+	cgroups CgroupConfig
 }
 
 func NewCephDriverServer(config CephServerConfig) CephDriverServer {
 	return &CephDriverServerStruct{
-		config: config,
+		config:  config,
+		metrics: NewMetrics(),
 	}
 }
 
@@ -59,6 +150,19 @@ func (server *CephDriverServerStruct) Runner(logger lager.Logger) (ifrit.Runner,
 	var err error
 	var cephDriverServer ifrit.Runner
 
+	if !server.isValidDriverName(server.driverName()) {
+		return nil, fmt.Errorf("invalid-driver-name %s", server.config.DriverName)
+	}
+
+	if server.config.Scope != "" && !IsValidScope(server.config.Scope) {
+		return nil, fmt.Errorf("invalid-scope %s", server.config.Scope)
+	}
+
+	server.cgroups, err = server.cgroupConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	server.config.Transport = server.DetermineTransport(server.config.AtAddress)
 
 	if server.config.Transport == "tcp" {
@@ -74,6 +178,150 @@ func (server *CephDriverServerStruct) Runner(logger lager.Logger) (ifrit.Runner,
 	return cephDriverServer, nil
 }
 
+// MetricsRunner serves the metrics of the driver created by Runner on
+// MetricsAddress, at /metrics.
+func (server *CephDriverServerStruct) MetricsRunner(logger lager.Logger) (ifrit.Runner, error) {
+	logger = logger.Session("create-metrics-server")
+	logger.Info("start")
+	defer logger.Info("ends")
+
+	if !server.isValidTcpAddress(server.config.MetricsAddress) {
+		return nil, fmt.Errorf("invalid-metrics-address %s", server.config.MetricsAddress)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server.metrics.Handler())
+
+	return http_server.New(server.config.MetricsAddress, mux), nil
+}
+
+// AdminRunner serves the admin API for the driver created by Runner on
+// AdminAddress. Requests must carry the token in AdminTokenFile.
+//
+// The API is served over TLS when AdminCertFile and AdminKeyFile are set.
+// Otherwise AdminAddress must be a loopback address, unless AdminInsecure
+// explicitly allows plain HTTP on any address.
+func (server *CephDriverServerStruct) AdminRunner(logger lager.Logger) (ifrit.Runner, error) {
+	logger = logger.Session("create-admin-server")
+	logger.Info("start")
+	defer logger.Info("ends")
+
+	if server.driver == nil {
+		return nil, errors.New("admin-server-requires-driver-server")
+	}
+
+	if !server.isValidTcpAddress(server.config.AdminAddress) {
+		return nil, fmt.Errorf("invalid-admin-address %s", server.config.AdminAddress)
+	}
+
+	token, err := ioutil.ReadFile(server.config.AdminTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(token)) == "" {
+		return nil, fmt.Errorf("empty-admin-token-file %s", server.config.AdminTokenFile)
+	}
+
+	tlsConfig, err := server.adminTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	handler := NewAdminHandler(logger, server.driver, strings.TrimSpace(string(token)))
+	if tlsConfig != nil {
+		return http_server.NewTLSServer(server.config.AdminAddress, handler, tlsConfig), nil
+	}
+
+	if !server.config.AdminInsecure && !server.isLoopbackTcpAddress(server.config.AdminAddress) {
+		return nil, fmt.Errorf("admin-address-requires-tls %s", server.config.AdminAddress)
+	}
+	logger.Info("serving-without-tls", lager.Data{"address": server.config.AdminAddress})
+	return http_server.New(server.config.AdminAddress, handler), nil
+}
+
+// SupervisorRunner stops the supervision of the ceph-fuse processes of the
+// driver created by Runner when the driver shuts down.
+func (server *CephDriverServerStruct) SupervisorRunner(logger lager.Logger) (ifrit.Runner, error) {
+	if server.driver == nil {
+		return nil, errors.New("supervisor-requires-driver-server")
+	}
+	return server.driver.SupervisorRunner(), nil
+}
+
+// EvictionMonitorRunner periodically checks the driver created by Runner for
+// evicted ceph-fuse clients.
+func (server *CephDriverServerStruct) EvictionMonitorRunner(logger lager.Logger) (ifrit.Runner, error) {
+	if server.driver == nil {
+		return nil, errors.New("eviction-monitor-requires-driver-server")
+	}
+	return server.driver.EvictionMonitorRunner(logger), nil
+}
+
+// StaleMonitorRunner periodically checks the mounts of the driver created by
+// Runner for having gone stale.
+func (server *CephDriverServerStruct) StaleMonitorRunner(logger lager.Logger) (ifrit.Runner, error) {
+	if server.driver == nil {
+		return nil, errors.New("stale-monitor-requires-driver-server")
+	}
+	return server.driver.StaleMonitorRunner(logger), nil
+}
+
+// LogRotatorRunner periodically rotates the ceph-fuse log files of the driver
+// created by Runner.
+func (server *CephDriverServerStruct) LogRotatorRunner(logger lager.Logger) (ifrit.Runner, error) {
+	if server.driver == nil {
+		return nil, errors.New("log-rotator-requires-driver-server")
+	}
+	return server.driver.LogRotatorRunner(logger), nil
+}
+
+// IdleReaperRunner periodically unmounts the idle holders of the driver
+// created by Runner.
+func (server *CephDriverServerStruct) IdleReaperRunner(logger lager.Logger) (ifrit.Runner, error) {
+	if server.driver == nil {
+		return nil, errors.New("idle-reaper-requires-driver-server")
+	}
+	return server.driver.IdleReaperRunner(logger), nil
+}
+
+// WebhookNotifierRunner notifies WebhookURLs of the failures of the driver
+// created by Runner.
+func (server *CephDriverServerStruct) WebhookNotifierRunner(logger lager.Logger) (ifrit.Runner, error) {
+	if server.driver == nil {
+		return nil, errors.New("webhook-notifier-requires-driver-server")
+	}
+
+	for _, webhookURL := range server.config.WebhookURLs {
+		parsed, err := url.Parse(webhookURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid-webhook-url %s", webhookURL)
+		}
+	}
+
+	config := WebhookConfig{
+		URLs:           server.config.WebhookURLs,
+		Retries:        server.config.WebhookRetries,
+		RetryInterval:  server.config.WebhookRetryInterval,
+		DeadLetterFile: server.config.WebhookDeadLetterFile,
+	}
+	if config.DeadLetterFile == "" {
+		config.DeadLetterFile = filepath.Join(server.rootDir(), WEBHOOK_DEAD_LETTER_FILE_NAME)
+	}
+
+	if server.config.WebhookSecretFile != "" {
+		secret, err := ioutil.ReadFile(server.config.WebhookSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Secret = strings.TrimSpace(string(secret))
+		if config.Secret == "" {
+			return nil, fmt.Errorf("empty-webhook-secret-file %s", server.config.WebhookSecretFile)
+		}
+	}
+
+	return server.driver.WebhookNotifierRunner(logger, config), nil
+}
+
 func (server *CephDriverServerStruct) CreateTcpServer(logger lager.Logger, atAddress string, driversPath string, fuseArgs []string) (ifrit.Runner, error) {
 	logger = logger.Session("create-tcp-server")
 	logger.Info("start")
@@ -85,7 +333,7 @@ func (server *CephDriverServerStruct) CreateTcpServer(logger lager.Logger, atAdd
 	}
 
 	spec := voldriver.DriverSpec{
-		Name:    "cephdriver",
+		Name:    server.driverName(),
 		Address: server.protocolify(atAddress, "http"),
 	}
 	specJson, err := json.Marshal(spec)
@@ -93,12 +341,12 @@ func (server *CephDriverServerStruct) CreateTcpServer(logger lager.Logger, atAdd
 		return nil, err
 	}
 
-	err = voldriver.WriteDriverSpec(logger, driversPath, "cephdriver", "json", specJson)
+	err = voldriver.WriteDriverSpec(logger, driversPath, server.driverName(), "json", specJson)
 	if err != nil {
 		return nil, err
 	}
 
-	handler, err := driverhttp.NewHandler(logger, NewLocalDriver(fuseArgs))
+	handler, err := server.newHandler(logger, fuseArgs)
 	if err != nil {
 		return nil, err
 	}
@@ -117,12 +365,12 @@ func (server *CephDriverServerStruct) CreateUnixServer(logger lager.Logger, atAd
 	}
 
 	url := server.protocolify(atAddress, "unix")
-	err = voldriver.WriteDriverSpec(logger, driversPath, "cephdriver", "spec", []byte(url))
+	err = voldriver.WriteDriverSpec(logger, driversPath, server.driverName(), "spec", []byte(url))
 	if err != nil {
 		return nil, err
 	}
 
-	handler, err := driverhttp.NewHandler(logger, NewLocalDriver(fuseArgs))
+	handler, err := server.newHandler(logger, fuseArgs)
 	if err != nil {
 		return nil, err
 	}
@@ -140,6 +388,134 @@ func (server *CephDriverServerStruct) DetermineTransport(address string) string
 
 // Private
 
+func (server *CephDriverServerStruct) driverName() string {
+	if server.config.DriverName == "" {
+		return DEFAULT_DRIVER_NAME
+	}
+	return server.config.DriverName
+}
+
+func (server *CephDriverServerStruct) rootDir() string {
+	if server.config.RootDir == "" {
+		return DEFAULT_ROOT_DIR
+	}
+	return server.config.RootDir
+}
+
+func (server *CephDriverServerStruct) newHandler(logger lager.Logger, fuseArgs []string) (http.Handler, error) {
+	driver, err := server.newLocalDriver(logger, fuseArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := driverhttp.NewHandler(logger, NewInstrumentedDriver(driver, server.metrics))
+	if err != nil {
+		return nil, err
+	}
+
+	handler = NewVolumeHandler(logger, driver, server.metrics, handler)
+	return NewHealthHandler(logger, driver, handler), nil
+}
+
+func (server *CephDriverServerStruct) newLocalDriver(logger lager.Logger, fuseArgs []string) (*LocalDriver, error) {
+	driver := NewLocalDriverWithInvokerAndSystemUtil(NewInstrumentedInvoker(NewStreamingInvoker(), server.metrics), &osshim.OsShim{}, &ioutilshim.IoutilShim{}, LocalDriverConfig{
+		FuseArgs:           fuseArgs,
+		Scope:              server.config.Scope,
+		RootDir:            server.rootDir(),
+		AllowedMountRoots:  server.config.AllowedMountRoots,
+		StateFile:          filepath.Join(server.rootDir(), STATE_FILE_NAME),
+		LogDir:             server.config.FuseLogDir,
+		LogMaxSize:         server.config.FuseLogMaxSize,
+		LogMaxFiles:        server.config.FuseLogMaxFiles,
+		LogCheckInterval:   server.config.FuseLogCheckInterval,
+		Supervisor:         SupervisorConfig{Enabled: server.config.SuperviseFuse, Restart: server.config.RestartFuse},
+		Cgroups:            server.cgroups,
+		AdminSocketDir:     filepath.Join(server.rootDir(), ADMIN_SOCKET_DIR_NAME),
+		Evictions:          EvictionConfig{Interval: server.config.EvictionCheckInterval, Remount: server.config.RemountEvicted},
+		StaleCheckInterval: server.config.StaleCheckInterval,
+		Idle:               IdlePolicy{TTL: server.config.IdleTTL, Interval: server.config.IdleCheckInterval, Heartbeats: server.config.IdleHeartbeats},
+		AsyncMount:         server.config.AsyncMount,
+		AsyncMountTTL:      server.config.AsyncMountTTL,
+		Admission: AdmissionConfig{
+			MaxConcurrent:     server.config.MaxConcurrentMounts,
+			MaxQueued:         server.config.MaxQueuedMounts,
+			QueueTimeout:      server.config.MountQueueTimeout,
+			MaxMountedVolumes: server.config.MaxMountedVolumes,
+		},
+		EventBuffer: server.config.EventBuffer,
+	})
+
+	err := driver.RestoreState(driverhttp.NewHttpDriverEnv(logger, context.Background()))
+	if err != nil {
+		return nil, err
+	}
+
+	server.metrics.CollectDriver(driver)
+	server.driver = driver
+	return driver, nil
+}
+
+func (server *CephDriverServerStruct) cgroupConfig() (CgroupConfig, error) {
+	config := CgroupConfig{Root: server.config.CgroupRoot}
+	var err error
+
+	if server.config.FuseMemoryLimit != "" {
+		config.MemoryLimit, err = cephdriver.ParseMemoryLimit(server.config.FuseMemoryLimit)
+		if err != nil {
+			return CgroupConfig{}, fmt.Errorf("invalid-fuse-memory-limit %s", server.config.FuseMemoryLimit)
+		}
+	}
+
+	if server.config.FuseCPULimit != "" {
+		config.CPULimit, err = cephdriver.ParseCPULimit(server.config.FuseCPULimit)
+		if err != nil {
+			return CgroupConfig{}, fmt.Errorf("invalid-fuse-cpu-limit %s", server.config.FuseCPULimit)
+		}
+	}
+
+	if (config.MemoryLimit > 0 || config.CPULimit > 0) && !server.config.SuperviseFuse {
+		return CgroupConfig{}, errors.New("fuse-limits-require-supervise-fuse")
+	}
+	return config, nil
+}
+
+func (server *CephDriverServerStruct) adminTLSConfig() (*tls.Config, error) {
+	if server.config.AdminCertFile == "" && server.config.AdminKeyFile == "" {
+		if server.config.AdminCAFile != "" {
+			return nil, errors.New("admin-ca-file-requires-admin-cert-file")
+		}
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(server.config.AdminCertFile, server.config.AdminKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if server.config.AdminCAFile != "" {
+		ca, err := ioutil.ReadFile(server.config.AdminCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no-certificates-in-admin-ca-file %s", server.config.AdminCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func (server *CephDriverServerStruct) isValidDriverName(name string) bool {
+	re := regexp.MustCompile(DRIVER_NAME_REGEX)
+	return re.MatchString(name)
+}
+
 func (server *CephDriverServerStruct) protocolify(address string, protocol string) string {
 	if !strings.HasPrefix(address, protocol+"://") {
 		return fmt.Sprintf("%s://%s", protocol, address)
@@ -168,3 +544,12 @@ func (server *CephDriverServerStruct) isValidTcpAddress(address string) bool {
 	matches := re.FindStringSubmatch(address)
 	return len(matches) > 0
 }
+
+func (server *CephDriverServerStruct) isLoopbackTcpAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
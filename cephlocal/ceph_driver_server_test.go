@@ -1,12 +1,28 @@
 package cephlocal_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"code.cloudfoundry.org/voldriver"
+	"github.com/tedsuo/ifrit"
+
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
 
@@ -75,6 +91,296 @@ var _ = Describe("Ceph Driver Server", func() {
 				Expect(runner).NotTo(BeNil())
 			})
 		})
+
+		Context("when a driver name is configured", func() {
+			BeforeEach(func() {
+				cephDriverConfig = cephlocal.CephServerConfig{
+					AtAddress:   "0.0.0.0:9750",
+					DriversPath: tmpDir,
+					DriverName:  "cephdriver-local",
+					Scope:       "local",
+				}
+				cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			})
+
+			It("writes the driver spec under that name", func() {
+				runner, err := cephDriverServer.Runner(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(runner).NotTo(BeNil())
+
+				contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "cephdriver-local.json"))
+				Expect(err).NotTo(HaveOccurred())
+
+				var spec voldriver.DriverSpec
+				Expect(json.Unmarshal(contents, &spec)).To(Succeed())
+				Expect(spec.Name).To(Equal("cephdriver-local"))
+			})
+		})
+
+		Context("when the driver name is invalid", func() {
+			BeforeEach(func() {
+				cephDriverConfig = cephlocal.CephServerConfig{
+					AtAddress:   "0.0.0.0:9750",
+					DriversPath: tmpDir,
+					DriverName:  "../cephdriver",
+				}
+				cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			})
+
+			It("fails creating Runner", func() {
+				runner, err := cephDriverServer.Runner(logger)
+				Expect(err).To(HaveOccurred())
+				Expect(runner).To(BeNil())
+			})
+		})
+
+		Context("when ceph-fuse limits are configured without supervision", func() {
+			BeforeEach(func() {
+				cephDriverConfig = cephlocal.CephServerConfig{
+					AtAddress:       "0.0.0.0:9750",
+					DriversPath:     tmpDir,
+					FuseMemoryLimit: "1G",
+				}
+				cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			})
+
+			It("fails creating Runner", func() {
+				runner, err := cephDriverServer.Runner(logger)
+				Expect(err).To(MatchError("fuse-limits-require-supervise-fuse"))
+				Expect(runner).To(BeNil())
+			})
+		})
+
+		Context("when the scope is invalid", func() {
+			BeforeEach(func() {
+				cephDriverConfig = cephlocal.CephServerConfig{
+					AtAddress:   "0.0.0.0:9750",
+					DriversPath: tmpDir,
+					Scope:       "cluster",
+				}
+				cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			})
+
+			It("fails creating Runner", func() {
+				runner, err := cephDriverServer.Runner(logger)
+				Expect(err).To(HaveOccurred())
+				Expect(runner).To(BeNil())
+			})
+		})
+	})
+
+	Describe("#MetricsRunner", func() {
+		It("creates a ifrit.Runner for a valid address", func() {
+			cephDriverServer = cephlocal.NewCephDriverServer(cephlocal.CephServerConfig{MetricsAddress: "127.0.0.1:9751"}).(*cephlocal.CephDriverServerStruct)
+			runner, err := cephDriverServer.MetricsRunner(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner).NotTo(BeNil())
+		})
+
+		It("fails for an invalid address", func() {
+			cephDriverServer = cephlocal.NewCephDriverServer(cephlocal.CephServerConfig{MetricsAddress: "..."}).(*cephlocal.CephDriverServerStruct)
+			runner, err := cephDriverServer.MetricsRunner(logger)
+			Expect(err).To(HaveOccurred())
+			Expect(runner).To(BeNil())
+		})
+	})
+
+	Describe("#AdminRunner", func() {
+		var tokenFile string
+
+		BeforeEach(func() {
+			tokenFile = filepath.Join(tmpDir, "admin-token")
+			Expect(ioutil.WriteFile(tokenFile, []byte("some-token\n"), 0600)).To(Succeed())
+			cephDriverConfig = cephlocal.CephServerConfig{
+				AtAddress:      "0.0.0.0:9750",
+				DriversPath:    tmpDir,
+				AdminAddress:   "127.0.0.1:9752",
+				AdminTokenFile: tokenFile,
+			}
+		})
+
+		It("creates a ifrit.Runner once the driver server exists", func() {
+			cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			_, err := cephDriverServer.AdminRunner(logger)
+			Expect(err).To(HaveOccurred())
+
+			_, err = cephDriverServer.Runner(logger)
+			Expect(err).NotTo(HaveOccurred())
+			runner, err := cephDriverServer.AdminRunner(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner).NotTo(BeNil())
+		})
+
+		It("fails without a token", func() {
+			Expect(ioutil.WriteFile(tokenFile, []byte("\n"), 0600)).To(Succeed())
+			cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			_, err := cephDriverServer.Runner(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			runner, err := cephDriverServer.AdminRunner(logger)
+			Expect(err).To(HaveOccurred())
+			Expect(runner).To(BeNil())
+		})
+
+		Context("without TLS", func() {
+			BeforeEach(func() {
+				cephDriverConfig.AdminAddress = "0.0.0.0:9752"
+			})
+
+			It("refuses a non-loopback address", func() {
+				cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+				_, err := cephDriverServer.Runner(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				runner, err := cephDriverServer.AdminRunner(logger)
+				Expect(err).To(MatchError("admin-address-requires-tls 0.0.0.0:9752"))
+				Expect(runner).To(BeNil())
+			})
+
+			It("allows a non-loopback address when told to serve insecurely", func() {
+				cephDriverConfig.AdminInsecure = true
+				cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+				_, err := cephDriverServer.Runner(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				runner, err := cephDriverServer.AdminRunner(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(runner).NotTo(BeNil())
+			})
+		})
+
+		Context("with TLS", func() {
+			var certificate tls.Certificate
+
+			BeforeEach(func() {
+				certificate = writeCertificate(tmpDir, "admin")
+				cephDriverConfig.AdminAddress = "0.0.0.0:9753"
+				cephDriverConfig.AdminCertFile = filepath.Join(tmpDir, "admin.crt")
+				cephDriverConfig.AdminKeyFile = filepath.Join(tmpDir, "admin.key")
+				cephDriverConfig.AdminCAFile = filepath.Join(tmpDir, "admin.crt")
+			})
+
+			It("serves the admin API to clients presenting a certificate signed by the CA", func() {
+				cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+				_, err := cephDriverServer.Runner(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				runner, err := cephDriverServer.AdminRunner(logger)
+				Expect(err).NotTo(HaveOccurred())
+				process := ifrit.Invoke(runner)
+				defer func() {
+					process.Signal(os.Interrupt)
+					Eventually(process.Wait()).Should(Receive())
+				}()
+
+				pool := x509.NewCertPool()
+				pool.AddCert(certificate.Leaf)
+				get := func(clientCertificates ...tls.Certificate) (*http.Response, error) {
+					client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: clientCertificates}}}
+					request, err := http.NewRequest("GET", "https://127.0.0.1:9753"+cephlocal.ADMIN_VOLUMES_PATH, nil)
+					Expect(err).NotTo(HaveOccurred())
+					request.Header.Set("Authorization", "Bearer some-token")
+					return client.Do(request)
+				}
+
+				response, err := get(certificate)
+				Expect(err).NotTo(HaveOccurred())
+				response.Body.Close()
+				Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+				_, err = get()
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("fails without a key", func() {
+				cephDriverConfig.AdminKeyFile = ""
+				cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+				_, err := cephDriverServer.Runner(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				runner, err := cephDriverServer.AdminRunner(logger)
+				Expect(err).To(HaveOccurred())
+				Expect(runner).To(BeNil())
+			})
+
+			It("fails with a CA but no certificate", func() {
+				cephDriverConfig.AdminCertFile = ""
+				cephDriverConfig.AdminKeyFile = ""
+				cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+				_, err := cephDriverServer.Runner(logger)
+				Expect(err).NotTo(HaveOccurred())
+
+				runner, err := cephDriverServer.AdminRunner(logger)
+				Expect(err).To(MatchError("admin-ca-file-requires-admin-cert-file"))
+				Expect(runner).To(BeNil())
+			})
+		})
+	})
+
+	Describe("#SupervisorRunner", func() {
+		BeforeEach(func() {
+			cephDriverConfig = cephlocal.CephServerConfig{
+				AtAddress:     "0.0.0.0:9750",
+				DriversPath:   tmpDir,
+				SuperviseFuse: true,
+			}
+		})
+
+		It("creates a ifrit.Runner once the driver server exists", func() {
+			cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			_, err := cephDriverServer.SupervisorRunner(logger)
+			Expect(err).To(HaveOccurred())
+
+			_, err = cephDriverServer.Runner(logger)
+			Expect(err).NotTo(HaveOccurred())
+			runner, err := cephDriverServer.SupervisorRunner(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner).NotTo(BeNil())
+		})
+	})
+
+	Describe("#WebhookNotifierRunner", func() {
+		BeforeEach(func() {
+			cephDriverConfig = cephlocal.CephServerConfig{
+				AtAddress:   "0.0.0.0:9750",
+				DriversPath: tmpDir,
+				WebhookURLs: []string{"https://hooks.example.com/ceph"},
+			}
+		})
+
+		It("creates a ifrit.Runner once the driver server exists", func() {
+			cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			_, err := cephDriverServer.WebhookNotifierRunner(logger)
+			Expect(err).To(HaveOccurred())
+
+			_, err = cephDriverServer.Runner(logger)
+			Expect(err).NotTo(HaveOccurred())
+			runner, err := cephDriverServer.WebhookNotifierRunner(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner).NotTo(BeNil())
+		})
+
+		It("fails with an invalid URL", func() {
+			cephDriverConfig.WebhookURLs = []string{"hooks.example.com"}
+			cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			_, err := cephDriverServer.Runner(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = cephDriverServer.WebhookNotifierRunner(logger)
+			Expect(err).To(MatchError("invalid-webhook-url hooks.example.com"))
+		})
+
+		It("fails with an empty secret file", func() {
+			secretFile := filepath.Join(tmpDir, "webhook-secret")
+			Expect(ioutil.WriteFile(secretFile, []byte("\n"), 0600)).To(Succeed())
+			cephDriverConfig.WebhookSecretFile = secretFile
+			cephDriverServer = cephlocal.NewCephDriverServer(cephDriverConfig).(*cephlocal.CephDriverServerStruct)
+			_, err := cephDriverServer.Runner(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = cephDriverServer.WebhookNotifierRunner(logger)
+			Expect(err).To(HaveOccurred())
+		})
 	})
 
 	Describe("#DetermineTransport", func() {
@@ -163,3 +469,37 @@ var _ = Describe("Ceph Driver Server", func() {
 		})
 	})
 })
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1, usable by
+// both servers and clients, to <name>.crt and <name>.key in dir.
+func writeCertificate(dir string, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	Expect(ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)).To(Succeed())
+
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	Expect(err).NotTo(HaveOccurred())
+	certificate.Leaf, err = x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return certificate
+}
@@ -2,14 +2,16 @@ package cephlocal
 
 import (
 	"fmt"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"code.cloudfoundry.org/cephdriver"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/voldriver"
 
-	"os"
-
 	"code.cloudfoundry.org/goshims/ioutilshim"
 	"code.cloudfoundry.org/goshims/osshim"
 	"code.cloudfoundry.org/voldriver/driverhttp"
@@ -18,84 +20,463 @@ import (
 
 //const MOUNT_CMD = "/var/vcap/jobs/cephdriver/scripts/mount.sh"
 const MOUNT_CMD = "ceph-fuse"
+const FUSERMOUNT_CMD = "fusermount"
+
+const BIND_MOUNT_CMD = "mount"
+const BIND_UNMOUNT_CMD = "umount"
+
+const DEFAULT_ROOT_DIR = "/var/vcap/data/cephdriver"
+
+const (
+	SCOPE_LOCAL  = "local"
+	SCOPE_GLOBAL = "global"
+)
+
+// Mount and Unmount requests that carry no ID are tracked under generated
+// holder IDs with this prefix, so that they keep their counting semantics.
+const ANONYMOUS_HOLDER_PREFIX = "anonymous-"
+
+type LocalDriverConfig struct {
+	FuseArgs          []string
+	Scope             string
+	RootDir           string
+	AllowedMountRoots []string
+
+	// StateFile is where volumes and shares are persisted across restarts;
+	// when empty the driver keeps its state in memory only.
+	StateFile string
+
+	// LogDir is where ceph-fuse writes a log file for each share; when empty
+	// ceph-fuse logs wherever its configuration says. A log file larger than
+	// LogMaxSize bytes is rotated when its share is next mounted, or by the
+	// log rotator, which checks every LogCheckInterval, keeping LogMaxFiles
+	// older files.
+	LogDir           string
+	LogMaxSize       int64
+	LogMaxFiles      int
+	LogCheckInterval time.Duration
+
+	Supervisor SupervisorConfig
+
+	// Cgroups limits the resources of supervised ceph-fuse processes.
+	Cgroups CgroupConfig
+
+	// AdminSocketDir is where each ceph-fuse process gets an admin socket,
+	// queried through AdminSocket for diagnostics; when empty ceph-fuse
+	// places its admin socket wherever its configuration says.
+	AdminSocketDir string
+	AdminSocket    AdminSocket
+
+	// Evictions has the driver look for ceph-fuse clients evicted by the MDS.
+	Evictions EvictionConfig
+
+	// StaleCheckInterval is how often the stale monitor checks the share
+	// mount points, DEFAULT_STALE_CHECK_INTERVAL when zero.
+	StaleCheckInterval time.Duration
+
+	// Idle has the driver unmount holders that no longer show signs of life.
+	Idle IdlePolicy
+
+	// AsyncMount has Mount return at once for holders with an ID, with a
+	// MOUNT_PENDING error while the mount goes on in the background; callers
+	// poll Mount, Get or Path for the outcome. The outcome is kept for
+	// AsyncMountTTL after the mount is done, unless it is polled sooner.
+	AsyncMount    bool
+	AsyncMountTTL time.Duration
+
+	// Admission bounds the mounts and unmounts the driver takes on.
+	Admission AdmissionConfig
+
+	// EventBuffer is the number of events kept for each subscriber that has
+	// yet to read them; further events are dropped for that subscriber.
+	EventBuffer int
+}
 
 type LocalDriver struct { // see voldriver.resources.go
 	rootDir    string
-	logFile    string
 	volumes    map[string]*volumeMetadata
+	shares     map[string]*shareMetadata
 	useInvoker invoker.Invoker
 	os         osshim.Os
 	ioutil     ioutilshim.Ioutil
 	fuseArgs   []string
+	scope      string
+
+	allowedMountRoots []string
+	anonymousHolders  int
+	stateFile         string
+	savedKeyrings     string
+	logDir            string
+	logMaxSize        int64
+	logMaxFiles       int
+	logCheckInterval  time.Duration
+	invocations       uint64
+
+	supervisor   SupervisorConfig
+	supervisors  map[string]*fuseSupervisor
+	supervising  sync.WaitGroup
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	cgroups      CgroupConfig
+
+	adminSocketDir  string
+	adminSocket     AdminSocket
+	diagnosticsLock sync.Mutex
+	diagnostics     map[string]cachedDiagnostics
+
+	evictions EvictionConfig
+	idle      IdlePolicy
+
+	staleCheckInterval time.Duration
+
+	idleReaped int
+
+	asyncMount     bool
+	asyncMountTTL  time.Duration
+	operations     map[string]*mountOperation
+	mountQueues    map[string][]*mountOperation
+	operationsLock sync.Mutex
+
+	probes     map[string]*mountProbe
+	probesLock sync.Mutex
+
+	admission *admission
+	events    *eventHub
+
+	// lock guards the driver's state, which operations arriving concurrently
+	// from the HTTP handler and collectors read and change. It is only held
+	// while the state is read or changed, never while ceph-fuse or mount run:
+	// volumeLocks serialise the operations on each volume, and shareLocks
+	// mounting, binding to and unmounting each share. They are taken in that
+	// order, and before lock.
+	lock        sync.Mutex
+	volumeLocks *keyedLocks
+	shareLocks  *keyedLocks
+
+	// mounting has the volumes being mounted for their first holder, which
+	// count against the mount limit.
+	mounting map[string]bool
 }
 
 type volumeMetadata struct {
-	Keyring          string
+	Keyring          string `json:"-"`
 	IP               string
+	Port             int
 	RemoteMountPoint string
 	LocalMountPoint  string
-	MountCount       int
-	KeyPath          string
+	SubDirectory     string
+	ReadOnly         bool
+	Holders          map[string]bool
+
+	// SubDirectories has the sub-directory of the volume bound for each
+	// holder that asked for one when it mounted the volume.
+	SubDirectories map[string]string `json:",omitempty"`
+
+	// LastSeen is when each holder last showed it was alive, for the idle
+	// policy.
+	LastSeen map[string]time.Time `json:",omitempty"`
+
+	// MemoryLimit and CPULimit are the volume's own limits for its ceph-fuse
+	// process, as given in its options; when empty the driver's defaults apply.
+	MemoryLimit string `json:",omitempty"`
+	CPULimit    string `json:",omitempty"`
+
+	// ManagedMountPoint is set when LocalMountPoint was derived by the driver
+	// under its root rather than supplied by the caller.
+	ManagedMountPoint bool
+
+	// ShareKey identifies the share the holders are bound to. After an update
+	// it may differ from the share the volume's options now describe until the
+	// volume is remounted; PendingChanges lists the options involved.
+	ShareKey       string
+	PendingChanges []string
+
+	// LastError is the most recent failure to mount, unmount or remount the
+	// volume, kept for the admin API; a successful mount or remount clears it.
+	LastError string
+}
+
+type MountRequest = cephdriver.MountRequest
+type GetRequest = cephdriver.GetRequest
+type PathRequest = cephdriver.PathRequest
+type GetResponse = cephdriver.GetResponse
+type VolumeInfo = cephdriver.VolumeInfo
+type HolderInfo = cephdriver.HolderInfo
+
+type StatusRequest struct {
+	Name string
+}
+
+type VolumeStatus struct {
+	Name           string
+	Mountpoint     string
+	Holders        []string
+	PendingChanges []string
+
+	// The ceph-fuse process of a mounted volume, when the driver supervises
+	// ceph-fuse: its PID (0 while it is not running) and how often it has
+	// exited and been restarted.
+	FusePid      int
+	FuseExits    int
+	FuseRestarts int
+	LastFuseExit string
+
+	// The limits of the ceph-fuse process and what its cgroup has accounted
+	// for it, when it runs in one.
+	FuseMemoryLimit int64
+	FuseCPULimit    float64
+	FuseUsage       FuseUsage
+
+	// Whether the ceph-fuse client of a mounted volume has been evicted by
+	// the MDS, how often that happened and why it was last judged evicted.
+	FuseEvicted      bool
+	FuseEvictions    int
+	LastFuseEviction string
+}
+
+type StatusResponse struct {
+	Status VolumeStatus
+	Err    string
+}
+
+func (v *volumeMetadata) mounted() bool {
+	return len(v.Holders) > 0
+}
+
+func (v *volumeMetadata) holderIDs() []string {
+	ids := []string{}
+	for id := range v.Holders {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (v *volumeMetadata) anonymousHolder() (string, bool) {
+	for _, id := range v.holderIDs() {
+		if strings.HasPrefix(id, ANONYMOUS_HOLDER_PREFIX) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// holderFor picks the holder whose mount point a request stands for: the one
+// with the given ID or, without one, the anonymous holder or the only holder.
+func (v *volumeMetadata) holderFor(holderID string) (string, bool) {
+	if holderID != "" {
+		return holderID, v.Holders[holderID]
+	}
+	if id, ok := v.anonymousHolder(); ok {
+		return id, true
+	}
+	if len(v.Holders) == 1 {
+		return v.holderIDs()[0], true
+	}
+	return "", false
+}
+
+// mountPoint is the bind mount of the holder a request stands for, if any.
+func (v *volumeMetadata) mountPoint(holderID string) string {
+	if id, ok := v.holderFor(holderID); ok {
+		return v.bindPath(id)
+	}
+	return ""
+}
+
+func (v *volumeMetadata) mountConfig() cephdriver.MountConfig {
+	config := cephdriver.MountConfig{
+		Keyring:          v.Keyring,
+		IP:               v.IP,
+		Port:             v.Port,
+		RemoteMountPoint: v.RemoteMountPoint,
+		SubDirectory:     v.SubDirectory,
+		ReadOnly:         v.ReadOnly,
+		MemoryLimit:      v.MemoryLimit,
+		CPULimit:         v.CPULimit,
+	}
+	if !v.ManagedMountPoint {
+		config.LocalMountPoint = v.LocalMountPoint
+	}
+	return config
 }
 
 func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
-	return volume.LocalMountPoint == v.LocalMountPoint && volume.RemoteMountPoint == v.RemoteMountPoint && volume.Keyring == v.Keyring && volume.IP == v.IP
+	return volume.LocalMountPoint == v.LocalMountPoint && volume.RemoteMountPoint == v.RemoteMountPoint && volume.Keyring == v.Keyring && volume.IP == v.IP &&
+		volume.Port == v.Port && volume.SubDirectory == v.SubDirectory && volume.ReadOnly == v.ReadOnly &&
+		volume.MemoryLimit == v.MemoryLimit && volume.CPULimit == v.CPULimit
 }
 
-func NewLocalDriver(fuseArgs []string) *LocalDriver {
-	return NewLocalDriverWithInvokerAndSystemUtil(invoker.NewRealInvoker(), &osshim.OsShim{}, &ioutilshim.IoutilShim{}, fuseArgs)
+// bindPath is the per-holder bind mount handed out to containers.
+func (v *volumeMetadata) bindPath(holderID string) string {
+	return filepath.Join(v.LocalMountPoint, holderID)
 }
 
-func NewLocalDriverWithInvokerAndSystemUtil(invoker invoker.Invoker, os osshim.Os, ioutil ioutilshim.Ioutil, fuseArgs []string) *LocalDriver {
-	return &LocalDriver{"_cephdriver/", "/tmp/cephdriver.log", map[string]*volumeMetadata{}, invoker, os, ioutil, fuseArgs}
+func NewLocalDriver(config LocalDriverConfig) *LocalDriver {
+	return NewLocalDriverWithInvokerAndSystemUtil(invoker.NewRealInvoker(), &osshim.OsShim{}, &ioutilshim.IoutilShim{}, config)
+}
+
+func NewLocalDriverWithInvokerAndSystemUtil(invoker invoker.Invoker, os osshim.Os, ioutil ioutilshim.Ioutil, config LocalDriverConfig) *LocalDriver {
+	scope := config.Scope
+	if scope == "" {
+		scope = SCOPE_GLOBAL
+	}
+
+	rootDir := config.RootDir
+	if rootDir == "" {
+		rootDir = DEFAULT_ROOT_DIR
+	}
+
+	logMaxSize := config.LogMaxSize
+	if logMaxSize <= 0 {
+		logMaxSize = DEFAULT_LOG_MAX_SIZE
+	}
+
+	logMaxFiles := config.LogMaxFiles
+	if logMaxFiles <= 0 {
+		logMaxFiles = DEFAULT_LOG_MAX_FILES
+	}
+
+	logCheckInterval := config.LogCheckInterval
+	if logCheckInterval <= 0 {
+		logCheckInterval = DEFAULT_LOG_CHECK_INTERVAL
+	}
+
+	asyncMountTTL := config.AsyncMountTTL
+	if asyncMountTTL <= 0 {
+		asyncMountTTL = DEFAULT_ASYNC_MOUNT_TTL
+	}
+
+	staleCheckInterval := config.StaleCheckInterval
+	if staleCheckInterval <= 0 {
+		staleCheckInterval = DEFAULT_STALE_CHECK_INTERVAL
+	}
+
+	supervisor := config.Supervisor
+	if supervisor.Enabled {
+		supervisor = supervisor.withDefaults()
+	}
+
+	adminSocket := config.AdminSocket
+	if adminSocket == nil {
+		adminSocket = NewAdminSocket(ADMIN_SOCKET_TIMEOUT)
+	}
+
+	return &LocalDriver{
+		rootDir:    rootDir,
+		volumes:    map[string]*volumeMetadata{},
+		shares:     map[string]*shareMetadata{},
+		useInvoker: invoker,
+		os:         os,
+		ioutil:     ioutil,
+		fuseArgs:   config.FuseArgs,
+		scope:      scope,
+
+		allowedMountRoots: config.AllowedMountRoots,
+		stateFile:         config.StateFile,
+		logDir:            config.LogDir,
+		logMaxSize:        logMaxSize,
+		logMaxFiles:       logMaxFiles,
+		logCheckInterval:  logCheckInterval,
+
+		supervisor:  supervisor,
+		supervisors: map[string]*fuseSupervisor{},
+		shutdown:    make(chan struct{}),
+		cgroups:     config.Cgroups.withDefaults(),
+
+		adminSocketDir: config.AdminSocketDir,
+		adminSocket:    adminSocket,
+
+		evictions: config.Evictions.withDefaults(),
+		idle:      config.Idle.withDefaults(),
+
+		staleCheckInterval: staleCheckInterval,
+
+		asyncMount:    config.AsyncMount,
+		asyncMountTTL: asyncMountTTL,
+		operations:    map[string]*mountOperation{},
+		mountQueues:   map[string][]*mountOperation{},
+		probes:        map[string]*mountProbe{},
+
+		admission: newAdmission(config.Admission),
+		events:    newEventHub(config.EventBuffer),
+
+		volumeLocks: newKeyedLocks(),
+		shareLocks:  newKeyedLocks(),
+		mounting:    map[string]bool{},
+	}
+}
+
+func IsValidScope(scope string) bool {
+	return scope == SCOPE_LOCAL || scope == SCOPE_GLOBAL
 }
 
 func (d *LocalDriver) Create(env voldriver.Env, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
-	logger := env.Logger().Session("create", lager.Data{"request": createRequest})
+	defer d.lockVolumes(createRequest.Name)()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	logger := env.Logger().Session("create", lager.Data{"volume_name": createRequest.Name})
 	logger.Info("start")
 	defer logger.Info("end")
+	defer d.persist(logger)
 
-	var (
-		localMountPoint  string
-		remoteMountPoint string
-		ip               string
-		keyring          string
-		err              *voldriver.ErrorResponse
-	)
-
-	ip, err = extractValue(env, "ip", createRequest.Opts)
-	if err != nil {
-		return *err
+	if !isValidVolumeName(createRequest.Name) {
+		logger.Info("invalid-volume-name", lager.Data{"volume_name": createRequest.Name})
+		return voldriver.ErrorResponse{Err: newError(ERR_INVALID_VOLUME_NAME, "Invalid volume name '%s'", createRequest.Name).Encode()}
 	}
 
-	keyring, err = extractValue(env, "keyring", createRequest.Opts)
+	config, err := cephdriver.ParseMountConfig(createRequest.Opts)
 	if err != nil {
-		return *err
+		logger.Info("invalid-opts", lager.Data{"error": err.Error()})
+		return voldriver.ErrorResponse{Err: newError(ERR_INVALID_OPTS, "%s", err.Error()).Encode()}
 	}
 
-	remoteMountPoint, err = extractValue(env, "remote_mount_point", createRequest.Opts)
-	if err != nil {
-		return *err
+	if limitsErr := d.checkLimits(config); limitsErr != nil {
+		logger.Info("unsupported-limits", lager.Data{"error": limitsErr.Message})
+		return voldriver.ErrorResponse{Err: limitsErr.Encode()}
 	}
 
-	localMountPoint, err = extractValue(env, "local_mount_point", createRequest.Opts)
-	if err != nil {
-		return *err
+	if config.LocalMountPoint != "" {
+		allowed, resolveErr := d.isAllowedMountPoint(config.LocalMountPoint)
+		if resolveErr != nil {
+			logger.Error("failed-resolving-local-mount-point", resolveErr)
+		}
+		if !allowed {
+			logger.Info("disallowed-local-mount-point", lager.Data{"local_mount_point": config.LocalMountPoint})
+			return voldriver.ErrorResponse{Err: newError(ERR_INVALID_OPTS, "Invalid 'local_mount_point' field in 'Opts': must be within an allowed mount root").Encode()}
+		}
 	}
 
-	return d.create(env, createRequest.Name, ip, keyring, remoteMountPoint, localMountPoint)
+	return d.create(env, createRequest.Name, config)
 }
 
 func successfullResponse() voldriver.ErrorResponse {
 	return voldriver.ErrorResponse{}
 }
 
-func (d *LocalDriver) create(env voldriver.Env, name, ip, keyring, remotemountpoint, localmountpoint string) voldriver.ErrorResponse {
+func (d *LocalDriver) create(env voldriver.Env, name string, config cephdriver.MountConfig) voldriver.ErrorResponse {
 	var volume *volumeMetadata
 	var ok bool
 	logger := env.Logger()
 
-	newVolume := &volumeMetadata{LocalMountPoint: localmountpoint, RemoteMountPoint: remotemountpoint, Keyring: keyring, IP: ip}
+	newVolume := &volumeMetadata{
+		LocalMountPoint:  config.LocalMountPoint,
+		RemoteMountPoint: config.RemoteMountPoint,
+		Keyring:          config.Keyring,
+		IP:               config.IP,
+		Port:             config.Port,
+		SubDirectory:     config.SubDirectory,
+		ReadOnly:         config.ReadOnly,
+		MemoryLimit:      config.MemoryLimit,
+		CPULimit:         config.CPULimit,
+		Holders:          map[string]bool{},
+	}
+	if config.LocalMountPoint == "" {
+		newVolume.LocalMountPoint = d.volumeMountPoint(name)
+		newVolume.ManagedMountPoint = true
+	}
 
 	if volume, ok = d.volumes[name]; !ok {
 		logger.Info("create-volume", lager.Data{"volume_name": name})
@@ -108,59 +489,83 @@ func (d *LocalDriver) create(env voldriver.Env, name, ip, keyring, remotemountpo
 		return successfullResponse()
 	}
 
-	logger.Info("duplicate-volume-with-different-opts", lager.Data{"volume_name": name, "existing-volume": volume})
-	return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' already exists with different Opts", name)}
+	logger.Info("duplicate-volume-with-different-opts", lager.Data{"volume_name": name, "share_key": volume.ShareKey})
+	return voldriver.ErrorResponse{Err: newError(ERR_VOLUME_CONFLICT, "Volume '%s' already exists with different Opts", name).Encode()}
 
 }
 
-func extractValue(env voldriver.Env, value string, opts map[string]interface{}) (string, *voldriver.ErrorResponse) {
-	var aString interface{}
-	var str string
-	var ok bool
-
-	logger := env.Logger()
+func (d *LocalDriver) Get(env voldriver.Env, getRequest voldriver.GetRequest) voldriver.GetResponse {
+	response := d.GetForHolder(env, GetRequest{Name: getRequest.Name})
+	return voldriver.GetResponse{Volume: voldriver.VolumeInfo{Name: response.Volume.Name, Mountpoint: response.Volume.Mountpoint}, Err: response.Err}
+}
 
-	if aString, ok = opts[value]; !ok {
-		logger.Info("missing-config-value", lager.Data{"key": value})
-		return "", &voldriver.ErrorResponse{Err: "Missing mandatory '" + value + "' field in 'Opts'"}
-	}
-	if str, ok = aString.(string); !ok {
-		logger.Info("missing-" + strings.ToLower(value))
-		return "", &voldriver.ErrorResponse{Err: "Unable to string convert '" + value + "' field in 'Opts'"}
+// GetForHolder is Get for requests that carry the ID of a holder, whose
+// mount point it answers with. The response also lists every holder of the
+// volume with its mount point.
+func (d *LocalDriver) GetForHolder(env voldriver.Env, getRequest GetRequest) GetResponse {
+	if err := d.mountOperationError(getRequest.Name, getRequest.ID); err != nil {
+		return GetResponse{Err: err.Encode()}
 	}
-	return str, nil
-}
 
-func (d *LocalDriver) Get(env voldriver.Env, getRequest voldriver.GetRequest) voldriver.GetResponse {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
 	logger := env.Logger().Session("Get")
 	logger.Info("start")
 	defer logger.Info("end")
 	if volume, ok := d.volumes[getRequest.Name]; ok {
-		logger.Info("get-volume", lager.Data{"volume_name": getRequest.Name})
-		if volume.MountCount > 0 {
-			return voldriver.GetResponse{Volume: voldriver.VolumeInfo{Name: getRequest.Name, Mountpoint: volume.LocalMountPoint}}
+		logger.Info("get-volume", lager.Data{"volume_name": getRequest.Name, "holders": volume.holderIDs(), "pending_changes": volume.PendingChanges})
+		info := VolumeInfo{Name: getRequest.Name, Mountpoint: volume.mountPoint(getRequest.ID)}
+		for _, holderID := range volume.holderIDs() {
+			info.Holders = append(info.Holders, HolderInfo{ID: holderID, Mountpoint: volume.bindPath(holderID)})
 		}
-		return voldriver.GetResponse{Volume: voldriver.VolumeInfo{Name: getRequest.Name}}
+		return GetResponse{Volume: info}
 	}
 	logger.Info("get-volume-not-found", lager.Data{"volume_name": getRequest.Name})
-	return voldriver.GetResponse{Err: fmt.Sprintf("Volume '%s' not found", getRequest.Name)}
+	return GetResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", getRequest.Name).Encode()}
+}
+
+func (d *LocalDriver) Path(env voldriver.Env, pathRequest voldriver.PathRequest) voldriver.PathResponse {
+	return d.PathForHolder(env, PathRequest{Name: pathRequest.Name})
 }
 
-func (d *LocalDriver) Path(env voldriver.Env, getRequest voldriver.PathRequest) voldriver.PathResponse {
+// PathForHolder is Path for requests that carry the ID of a holder, whose
+// mount point it answers with.
+func (d *LocalDriver) PathForHolder(env voldriver.Env, pathRequest PathRequest) voldriver.PathResponse {
+	if err := d.mountOperationError(pathRequest.Name, pathRequest.ID); err != nil {
+		return voldriver.PathResponse{Err: err.Encode()}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
 	logger := env.Logger().Session("Path")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	if volume, ok := d.volumes[getRequest.Name]; ok {
-		if volume.MountCount > 0 {
-			logger.Info("volume-path", lager.Data{"volume_name": getRequest.Name, "volume_path": volume.LocalMountPoint})
-			return voldriver.PathResponse{Mountpoint: volume.LocalMountPoint}
+	volume, ok := d.volumes[pathRequest.Name]
+	if !ok {
+		logger.Info("volume-path-not-found", lager.Data{"volume_name": pathRequest.Name})
+		return voldriver.PathResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", pathRequest.Name).Encode()}
+	}
+
+	if !volume.mounted() {
+		logger.Info("volume-path-not-mounted", lager.Data{"volume_name": pathRequest.Name})
+		return voldriver.PathResponse{Err: newError(ERR_NOT_MOUNTED, "Volume %s not mounted", pathRequest.Name).Encode()}
+	}
+
+	holderID, ok := volume.holderFor(pathRequest.ID)
+	if !ok {
+		logger.Info("volume-path-holder-not-found", lager.Data{"volume_name": pathRequest.Name, "holder": pathRequest.ID})
+		if pathRequest.ID == "" {
+			return voldriver.PathResponse{Err: newError(ERR_NOT_MOUNTED, "Volume '%s' not mounted without an ID", pathRequest.Name).Encode()}
 		}
-		logger.Info("volume-path-not-mounted", lager.Data{"volume_name": getRequest.Name})
-		return voldriver.PathResponse{Err: fmt.Sprintf("Volume %s not mounted", getRequest.Name)}
+		return voldriver.PathResponse{Err: newError(ERR_NOT_MOUNTED, "Volume '%s' not mounted for '%s'", pathRequest.Name, pathRequest.ID).Encode()}
 	}
-	logger.Info("volume-path-not-found", lager.Data{"volume_name": getRequest.Name})
-	return voldriver.PathResponse{Err: fmt.Sprintf("Volume '%s' not found", getRequest.Name)}
+
+	mountPoint := volume.bindPath(holderID)
+	logger.Info("volume-path", lager.Data{"volume_name": pathRequest.Name, "holder": holderID, "volume_path": mountPoint})
+	return voldriver.PathResponse{Mountpoint: mountPoint}
 }
 
 func (d *LocalDriver) Activate(env voldriver.Env) voldriver.ActivateResponse {
@@ -172,20 +577,19 @@ func (d *LocalDriver) Activate(env voldriver.Env) voldriver.ActivateResponse {
 
 func (d *LocalDriver) Capabilities(env voldriver.Env) voldriver.CapabilitiesResponse {
 	return voldriver.CapabilitiesResponse{
-		Capabilities: voldriver.CapabilityInfo{Scope: "global"},
+		Capabilities: voldriver.CapabilityInfo{Scope: d.scope},
 	}
 }
 
 func (d *LocalDriver) List(env voldriver.Env) voldriver.ListResponse {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
 	listResponse := voldriver.ListResponse{}
 	volInfo := voldriver.VolumeInfo{}
 	for volumeName, volume := range d.volumes {
 		volInfo.Name = volumeName
-		if volume.MountCount > 0 {
-			volInfo.Mountpoint = volume.LocalMountPoint
-		} else {
-			volInfo.Mountpoint = ""
-		}
+		volInfo.Mountpoint = volume.mountPoint("")
 		listResponse.Volumes = append(listResponse.Volumes, volInfo)
 	}
 	listResponse.Err = ""
@@ -193,93 +597,194 @@ func (d *LocalDriver) List(env voldriver.Env) voldriver.ListResponse {
 }
 
 func (d *LocalDriver) Mount(env voldriver.Env, mountRequest voldriver.MountRequest) voldriver.MountResponse {
-	logger := env.Logger().Session("Mount")
+	return d.MountWithOpts(env, MountRequest{Name: mountRequest.Name, ID: mountRequest.ID})
+}
+
+// MountWithOpts is Mount for requests that carry 'Opts': a holder may have
+// a sub-directory of the volume bound instead of the whole volume.
+func (d *LocalDriver) MountWithOpts(env voldriver.Env, mountRequest MountRequest) voldriver.MountResponse {
+	if mountRequest.ID != "" && !isValidHolderID(mountRequest.ID) {
+		env.Logger().Info("mount-invalid-holder-id", lager.Data{"volume_name": mountRequest.Name, "holder": mountRequest.ID})
+		return voldriver.MountResponse{Err: invalidHolderIDError(mountRequest.ID).Encode()}
+	}
+
+	options, err := cephdriver.ParseMountOptions(mountRequest.Opts)
+	if err != nil {
+		env.Logger().Info("mount-invalid-opts", lager.Data{"volume_name": mountRequest.Name, "error": err.Error()})
+		return voldriver.MountResponse{Err: newError(ERR_INVALID_OPTS, "%s", err.Error()).Encode()}
+	}
+
+	if d.asyncMount && mountRequest.ID != "" {
+		return d.mountAsync(env, mountRequest, options)
+	}
+	return d.mount(env, mountRequest, options)
+}
+
+func (d *LocalDriver) mount(env voldriver.Env, mountRequest MountRequest, options cephdriver.MountOptions) (response voldriver.MountResponse) {
+	started := time.Now()
+	holderID := mountRequest.ID
+	defer func() {
+		d.publishOperation(EVENT_MOUNT, mountRequest.Name, holderID, started, response.Err)
+	}()
+
+	release, admitErr := d.admission.admit(env.Logger(), env.Context())
+	if admitErr != nil {
+		env.Logger().Info("mount-not-admitted", lager.Data{"volume_name": mountRequest.Name, "error": admitErr.Message})
+		return voldriver.MountResponse{Err: admitErr.Encode()}
+	}
+	defer release()
+
+	defer d.lockVolumes(mountRequest.Name)()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	logger := env.Logger().Session("Mount", lager.Data{"volume_name": mountRequest.Name})
 	logger.Info("start")
 	defer logger.Info("end")
+	defer d.persist(logger)
 	var volume *volumeMetadata
 	var ok bool
 	if volume, ok = d.volumes[mountRequest.Name]; !ok {
 
 		logger.Info("mount-volume-not-found", lager.Data{"volume_name": mountRequest.Name})
-		return voldriver.MountResponse{Err: fmt.Sprintf("Volume '%s' not found", mountRequest.Name)}
+		return voldriver.MountResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", mountRequest.Name).Encode()}
 	}
-	if volume.MountCount > 0 {
-		volume.MountCount++
-		logger.Info("mount-volume-already-mounted", lager.Data{"volume": volume})
-		return voldriver.MountResponse{Mountpoint: volume.LocalMountPoint}
+
+	if holderID == "" {
+		holderID = d.nextAnonymousHolder()
 	}
-	logger.Info("mounting-volume-"+mountRequest.Name, lager.Data{"volume": volume})
-	content := []byte(volume.Keyring)
 
-	volume.KeyPath = fmt.Sprintf("/tmp/keypath_%#v", time.Now().UnixNano())
+	if volume.Holders[holderID] {
+		logger.Info("mount-volume-already-held", lager.Data{"volume_name": mountRequest.Name, "share_key": volume.ShareKey, "holder": holderID})
+		volume.seen(holderID, time.Now())
+		return voldriver.MountResponse{Mountpoint: volume.bindPath(holderID)}
+	}
 
-	err := d.ioutil.WriteFile(volume.KeyPath, content, 0777)
-	if err != nil {
-		logger.Error("Error mounting volume", err)
-		return voldriver.MountResponse{Err: fmt.Sprintf("Error mounting '%s' (%s)", mountRequest.Name, err.Error())}
+	if err := d.checkMountLimit(volume); err != nil {
+		logger.Info("mount-limit-reached", lager.Data{"error": err.Message})
+		return voldriver.MountResponse{Err: err.Encode()}
+	}
+
+	if !volume.mounted() {
+		d.mounting[mountRequest.Name] = true
+		defer delete(d.mounting, mountRequest.Name)
 	}
 
-	err = d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm)
+	logger.Info("mounting-volume-"+mountRequest.Name, lager.Data{"volume_name": mountRequest.Name, "share_key": volume.ShareKey, "holder": holderID})
+	mountPoint, err := d.bind(driverhttp.EnvWithLogger(logger, env), volume, holderID, options.SubDirectory)
 	if err != nil {
-		logger.Error("failed-creating-localmountpoint", err)
-		return voldriver.MountResponse{Err: fmt.Sprintf("Unable to create local mount point for volume '%s'", mountRequest.Name)}
+		logger.Error("Error mounting volume", err)
+		mountErr := wrapError(err, ERR_MOUNT_FAILED, "Error mounting '%s' (%s)", mountRequest.Name, err.Error())
+		volume.LastError = mountErr.Message
+		return voldriver.MountResponse{Err: mountErr.Encode()}
 	}
 
-	cmdArgs := []string{"-k", volume.KeyPath, "-m", fmt.Sprintf("%s:6789", volume.IP), "-r", volume.RemoteMountPoint, volume.LocalMountPoint}
+	volume.Holders[holderID] = true
+	volume.seen(holderID, time.Now())
+	volume.LastError = ""
+
+	return voldriver.MountResponse{Mountpoint: mountPoint}
+}
 
-	if len(d.fuseArgs) > 0 {
-		cmdArgs = append(d.fuseArgs, cmdArgs...)
+func (d *LocalDriver) Unmount(env voldriver.Env, unmountRequest voldriver.UnmountRequest) (response voldriver.ErrorResponse) {
+	started := time.Now()
+	holderID := unmountRequest.ID
+	defer func() {
+		d.publishOperation(EVENT_UNMOUNT, unmountRequest.Name, holderID, started, response.Err)
+	}()
+
+	if unmountRequest.ID != "" {
+		if !isValidHolderID(unmountRequest.ID) {
+			env.Logger().Info("unmount-invalid-holder-id", lager.Data{"volume_name": unmountRequest.Name, "holder": unmountRequest.ID})
+			return voldriver.ErrorResponse{Err: invalidHolderIDError(unmountRequest.ID).Encode()}
+		}
+		if err := d.clearMountOperations(unmountRequest.Name, unmountRequest.ID); err != nil {
+			return voldriver.ErrorResponse{Err: err.Encode()}
+		}
 	}
 
-	if err := d.callCeph(env, cmdArgs); err != nil {
-		logger.Error("Error mounting volume", err)
-		return voldriver.MountResponse{Err: fmt.Sprintf("Error mounting '%s' (%s)", mountRequest.Name, err.Error())}
+	release, admitErr := d.admission.admit(env.Logger(), env.Context())
+	if admitErr != nil {
+		env.Logger().Info("unmount-not-admitted", lager.Data{"volume_name": unmountRequest.Name, "error": admitErr.Message})
+		return voldriver.ErrorResponse{Err: admitErr.Encode()}
 	}
+	defer release()
 
-	volume.MountCount = 1
+	defer d.lockVolumes(unmountRequest.Name)()
 
-	return voldriver.MountResponse{Mountpoint: volume.LocalMountPoint}
-}
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
-func (d *LocalDriver) Unmount(env voldriver.Env, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
-	logger := env.Logger().Session("Unmount")
+	logger := env.Logger().Session("Unmount", lager.Data{"volume_name": unmountRequest.Name})
 	logger.Info("start")
 	defer logger.Info("end")
+	defer d.persist(logger)
 
 	var volume *volumeMetadata
 	var ok bool
 	if volume, ok = d.volumes[unmountRequest.Name]; !ok {
 		logger.Info("unmount-volume-not-found", lager.Data{"volume_name": unmountRequest.Name})
-		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' is unknown", unmountRequest.Name)}
+		return voldriver.ErrorResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' is unknown", unmountRequest.Name).Encode()}
 	}
-	if volume.MountCount == 0 {
+	if !volume.mounted() {
 		logger.Info("unmount-volume-not-mounted", lager.Data{"volume_name": unmountRequest.Name})
-		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' not mounted", unmountRequest.Name)}
+		return voldriver.ErrorResponse{Err: newError(ERR_NOT_MOUNTED, "Volume '%s' not mounted", unmountRequest.Name).Encode()}
 	}
-	return d.unmount(driverhttp.EnvWithLogger(logger, env), volume, unmountRequest.Name)
+
+	if holderID == "" {
+		if holderID, ok = volume.anonymousHolder(); !ok {
+			logger.Info("unmount-volume-no-anonymous-holder", lager.Data{"volume_name": unmountRequest.Name})
+			return voldriver.ErrorResponse{Err: newError(ERR_NOT_MOUNTED, "Volume '%s' not mounted without an ID", unmountRequest.Name).Encode()}
+		}
+	}
+
+	if !volume.Holders[holderID] {
+		logger.Info("unmount-volume-holder-not-found", lager.Data{"volume_name": unmountRequest.Name, "holder": holderID})
+		return voldriver.ErrorResponse{}
+	}
+
+	if err := d.release(driverhttp.EnvWithLogger(logger, env), volume, unmountRequest.Name, holderID); err != nil {
+		return voldriver.ErrorResponse{Err: err.Encode()}
+	}
+	return voldriver.ErrorResponse{}
 }
 
 func (d *LocalDriver) Remove(env voldriver.Env, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
-	logger := env.Logger().Session("remove", lager.Data{"volume": removeRequest})
+	if err := d.clearMountOperations(removeRequest.Name, ""); err != nil {
+		return voldriver.ErrorResponse{Err: err.Encode()}
+	}
+
+	defer d.lockVolumes(removeRequest.Name)()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	logger := env.Logger().Session("remove", lager.Data{"volume_name": removeRequest.Name})
 	logger.Info("start")
 	defer logger.Info("end")
+	defer d.persist(logger)
 
 	if removeRequest.Name == "" {
-		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+		return voldriver.ErrorResponse{Err: newError(ERR_INVALID_VOLUME_NAME, "Missing mandatory 'volume_name'").Encode()}
 	}
 
-	var response voldriver.ErrorResponse
 	var vol *volumeMetadata
 	var exists bool
 	if vol, exists = d.volumes[removeRequest.Name]; !exists {
 		logger.Error("failed-volume-removal", fmt.Errorf(fmt.Sprintf("Volume %s not found", removeRequest.Name)))
-		return voldriver.ErrorResponse{fmt.Sprintf("Volume '%s' not found", removeRequest.Name)}
+		return voldriver.ErrorResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", removeRequest.Name).Encode()}
+	}
+
+	for _, holderID := range vol.holderIDs() {
+		if err := d.release(driverhttp.EnvWithLogger(logger, env), vol, removeRequest.Name, holderID); err != nil {
+			return voldriver.ErrorResponse{Err: err.Encode()}
+		}
 	}
 
-	for vol.MountCount > 0 {
-		response = d.unmount(driverhttp.EnvWithLogger(logger, env), vol, removeRequest.Name)
-		if response.Err != "" {
-			return response
+	if vol.ManagedMountPoint {
+		if err := d.os.Remove(vol.LocalMountPoint); err != nil && !d.os.IsNotExist(err) {
+			logger.Error("failed-deleting-volume-mountpoint", err)
 		}
 	}
 
@@ -288,45 +793,93 @@ func (d *LocalDriver) Remove(env voldriver.Env, removeRequest voldriver.RemoveRe
 	return voldriver.ErrorResponse{}
 }
 
-func (d *LocalDriver) unmount(env voldriver.Env, volume *volumeMetadata, volumeName string) voldriver.ErrorResponse {
-	logger := env.Logger()
-	logger.Info("umount-found-volume", lager.Data{"metadata": volume})
+// Status is an extended Get that also reports the holders of a volume.
+func (d *LocalDriver) Status(env voldriver.Env, statusRequest StatusRequest) StatusResponse {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
-	if volume.MountCount > 1 {
-		volume.MountCount--
-		logger.Info("unmount-volume-in-use", lager.Data{"metadata": volume})
-		return voldriver.ErrorResponse{}
-	}
+	logger := env.Logger().Session("status")
+	logger.Info("start")
+	defer logger.Info("end")
 
-	cmdArgs := []string{"-u", volume.LocalMountPoint}
-	_, err := d.useInvoker.Invoke(env, "fusermount", cmdArgs)
-	if err != nil {
-		logger.Error("error-invoking-fusermount", err)
-		return voldriver.ErrorResponse{Err: fmt.Sprintf("Error unmounting '%s' (%s)", volumeName, err.Error())}
+	volume, ok := d.volumes[statusRequest.Name]
+	if !ok {
+		logger.Info("status-volume-not-found", lager.Data{"volume_name": statusRequest.Name})
+		return StatusResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", statusRequest.Name).Encode()}
 	}
-	volume.MountCount = 0
-	err = d.os.Remove(volume.KeyPath)
-	if err != nil {
-		logger.Error("error-deleting-key-file", err)
-		return voldriver.ErrorResponse{Err: fmt.Sprintf("Error unmounting '%s' (%s)", volumeName, err.Error())}
+
+	status := VolumeStatus{Name: statusRequest.Name, Mountpoint: volume.mountPoint(""), Holders: volume.holderIDs(), PendingChanges: volume.PendingChanges}
+	if share, ok := d.shares[volume.ShareKey]; ok {
+		status.FusePid = share.Pid
+		status.FuseExits = share.Exits
+		status.FuseRestarts = share.Restarts
+		status.LastFuseExit = share.LastExit
+		status.FuseMemoryLimit = share.MemoryLimit
+		status.FuseCPULimit = share.CPULimit
+		status.FuseUsage = d.fuseUsage(share)
+		status.FuseEvicted = share.Evicted
+		status.FuseEvictions = share.Evictions
+		status.LastFuseEviction = share.LastEviction
 	}
-	err = d.os.Remove(volume.LocalMountPoint)
-	if err != nil {
-		logger.Error("error-deleting-local-mountpoint", err)
-		return voldriver.ErrorResponse{Err: fmt.Sprintf("Error unmounting '%s' (%s)", volumeName, err.Error())}
+	return StatusResponse{Status: status}
+}
+
+// ReapHolders releases every holder for which isAlive returns false, unmounting
+// volumes whose last holder goes away. Anonymous holders are never reaped.
+func (d *LocalDriver) ReapHolders(env voldriver.Env, isAlive func(holderID string) bool) voldriver.ErrorResponse {
+	logger := env.Logger().Session("reap-holders")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	_, errs := d.reap(driverhttp.EnvWithLogger(logger, env), 0, "", func(volume *volumeMetadata, holderID string) bool {
+		return isAlive(holderID)
+	})
+	if len(errs) > 0 {
+		return voldriver.ErrorResponse{Err: newError(ERR_UNMOUNT_FAILED, "%s", strings.Join(errs, "; ")).Encode()}
 	}
 	return voldriver.ErrorResponse{}
 }
 
+// volumeNames lists the volumes in order, for operations that go through
+// them one at a time.
+func (d *LocalDriver) volumeNames() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	names := []string{}
+	for name := range d.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *LocalDriver) nextAnonymousHolder() string {
+	d.anonymousHolders++
+	return fmt.Sprintf("%s%d", ANONYMOUS_HOLDER_PREFIX, d.anonymousHolders)
+}
+
+func (d *LocalDriver) release(env voldriver.Env, volume *volumeMetadata, volumeName string, holderID string) *Error {
+	logger := env.Logger()
+	logger.Info("umount-found-volume", lager.Data{"volume_name": volumeName, "share_key": volume.ShareKey, "holder": holderID})
+
+	if err := d.unbind(env, volume, holderID, false); err != nil {
+		logger.Error("error-unmounting-volume", err)
+		unmountErr := newError(ERR_UNMOUNT_FAILED, "Error unmounting '%s' (%s)", volumeName, err.Error())
+		volume.LastError = unmountErr.Message
+		return unmountErr
+	}
+	return nil
+}
+
 func (d *LocalDriver) callCeph(env voldriver.Env, args []string) error {
 	logger := env.Logger().Session("call-ceph")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	logger.Info(fmt.Sprintf("invoke-ceph-fuse: %s %#v", MOUNT_CMD, args))
-
-	output, err := d.useInvoker.Invoke(env, MOUNT_CMD, args)
-	logger.Debug(fmt.Sprintf("ceph-fuse-output: %s", string(output)))
-
-	return err
+	output, err := d.invoke(driverhttp.EnvWithLogger(logger, env), MOUNT_CMD, args)
+	if err != nil {
+		return cephError(env.Context(), output, err)
+	}
+	return nil
 }
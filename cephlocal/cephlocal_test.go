@@ -2,6 +2,10 @@ package cephlocal_test
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
@@ -31,6 +35,8 @@ var _ = Describe("cephlocal", func() {
 		testCtx     context.Context
 		testEnv     voldriver.Env
 		fuseArgs    []string
+		scope       string
+		mountRoots  []string
 	)
 
 	BeforeEach(func() {
@@ -38,13 +44,15 @@ var _ = Describe("cephlocal", func() {
 		fakeOs = new(os_fake.FakeOs)
 		fakeIoutil = new(ioutil_fake.FakeIoutil)
 		fuseArgs = nil
+		scope = ""
+		mountRoots = nil
 		testLogger = lagertest.NewTestLogger("CephdriverTest")
 		testCtx = context.TODO()
 		testEnv = driverhttp.NewHttpDriverEnv(testLogger, testCtx)
 	})
 
 	JustBeforeEach(func() {
-		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, fakeIoutil, fuseArgs)
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, fakeIoutil, cephlocal.LocalDriverConfig{FuseArgs: fuseArgs, Scope: scope, RootDir: "some-root", AllowedMountRoots: mountRoots})
 
 	})
 
@@ -58,6 +66,25 @@ var _ = Describe("cephlocal", func() {
 
 	})
 
+	Describe(".Capabilities", func() {
+
+		It("should advertise global scope by default", func() {
+			response := driver.Capabilities(testEnv)
+			Expect(response.Capabilities.Scope).To(Equal("global"))
+		})
+
+		Context("when a local scope is configured", func() {
+			BeforeEach(func() {
+				scope = "local"
+			})
+
+			It("should advertise local scope", func() {
+				response := driver.Capabilities(testEnv)
+				Expect(response.Capabilities.Scope).To(Equal("local"))
+			})
+		})
+	})
+
 	Describe("Create and Get", func() {
 
 		var (
@@ -67,7 +94,7 @@ var _ = Describe("cephlocal", func() {
 		Context("when creating a volume", func() {
 			Context("when successful", func() {
 				BeforeEach(func() {
-					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint", "remote_mount_point": "some-remote-mountpoint"}
+					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
 				})
 
 				JustBeforeEach(func() {
@@ -86,49 +113,113 @@ var _ = Describe("cephlocal", func() {
 						opts = map[string]interface{}{}
 					})
 					It("should error with missing remote_mount_point", func() {
-						opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint"}
+						opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip"}
 						createRequest := voldriver.CreateRequest{Name: "some-volume-name", Opts: opts}
 						createResponse = driver.Create(testEnv, createRequest)
-						Expect(createResponse.Err).To(Equal("Missing mandatory 'remote_mount_point' field in 'Opts'"))
-					})
-					It("should error with missing local_mount_point", func() {
-						opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remotemountpoint"}
-						createRequest := voldriver.CreateRequest{Name: "some-volume-name", Opts: opts}
-						createResponse = driver.Create(testEnv, createRequest)
-						Expect(createResponse.Err).To(Equal("Missing mandatory 'local_mount_point' field in 'Opts'"))
+						Expect(createResponse.Err).To(Equal("Missing mandatory 'remote_mount_point' field in 'Opts' [INVALID_OPTS]"))
 					})
 					It("should error with missing keyring", func() {
-						opts = map[string]interface{}{"ip": "some-ip", "remote_mount_point": "some-remotemountpoint", "local_mount_point": "some-localmoutnpoint"}
+						opts = map[string]interface{}{"ip": "some-ip", "remote_mount_point": "some-remotemountpoint"}
 						createRequest := voldriver.CreateRequest{Name: "some-volume-name", Opts: opts}
 						createResponse = driver.Create(testEnv, createRequest)
-						Expect(createResponse.Err).To(Equal("Missing mandatory 'keyring' field in 'Opts'"))
+						Expect(createResponse.Err).To(Equal("Missing mandatory 'keyring' field in 'Opts' [INVALID_OPTS]"))
 					})
 					It("should error with missing ip", func() {
-						opts = map[string]interface{}{"keyring": "some-keyring", "remote_mount_point": "some-remotemountpoint", "local_mount_point": "some-localmoutnpoint"}
+						opts = map[string]interface{}{"keyring": "some-keyring", "remote_mount_point": "some-remotemountpoint"}
 						createRequest := voldriver.CreateRequest{Name: "some-volume-name", Opts: opts}
 						createResponse = driver.Create(testEnv, createRequest)
-						Expect(createResponse.Err).To(Equal("Missing mandatory 'ip' field in 'Opts'"))
+						Expect(createResponse.Err).To(Equal("Missing mandatory 'ip' field in 'Opts' [INVALID_OPTS]"))
 					})
 					It("should not be able to retrieve volume", func() {
 						getUnsuccessful(testEnv, driver, "some-volume-name")
 					})
 				})
+
+				Context("when opts contain unknown keys", func() {
+					It("should error with a suggestion", func() {
+						opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mountpoint": "some-remotemountpoint"}
+						createRequest := voldriver.CreateRequest{Name: "some-volume-name", Opts: opts}
+						createResponse = driver.Create(testEnv, createRequest)
+						Expect(createResponse.Err).To(Equal("Missing mandatory 'remote_mount_point' field in 'Opts'; Unknown 'remote_mountpoint' field in 'Opts' (did you mean 'remote_mount_point'?) [INVALID_OPTS]"))
+					})
+				})
+
+				Context("when the volume name is not a valid path component", func() {
+					It("should error", func() {
+						opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remotemountpoint"}
+						createRequest := voldriver.CreateRequest{Name: "../some-volume-name", Opts: opts}
+						createResponse = driver.Create(testEnv, createRequest)
+						Expect(createResponse.Err).To(Equal("Invalid volume name '../some-volume-name' [INVALID_VOLUME_NAME]"))
+					})
+				})
+
+				Context("when sub_directory escapes the share", func() {
+					It("should error", func() {
+						opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remotemountpoint", "sub_directory": "../other"}
+						createRequest := voldriver.CreateRequest{Name: "some-volume-name", Opts: opts}
+						createResponse = driver.Create(testEnv, createRequest)
+						Expect(createResponse.Err).To(Equal("Invalid 'sub_directory' field in 'Opts': must be a relative path without '..' [INVALID_OPTS]"))
+					})
+				})
+			})
+			Context("when a local_mount_point is given", func() {
+				BeforeEach(func() {
+					mountRoots = []string{"/var/vcap/data/volumes"}
+					fakeOs.IsNotExistStub = os.IsNotExist
+					fakeOs.LstatReturns(nil, os.ErrNotExist)
+				})
+
+				It("accepts a mount point within an allowed root", func() {
+					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remotemountpoint", "local_mount_point": "/var/vcap/data/volumes/mine"}
+					createSuccessful(testEnv, driver, "some-volume-name", opts)
+
+					mountResponse := driver.Mount(testEnv, voldriver.MountRequest{Name: "some-volume-name", ID: "container-1"})
+					Expect(mountResponse.Err).To(Equal(""))
+					Expect(mountResponse.Mountpoint).To(Equal("/var/vcap/data/volumes/mine/container-1"))
+				})
+
+				It("rejects a mount point outside the allowed roots", func() {
+					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remotemountpoint", "local_mount_point": "/var/vcap/data/volumes/../../../etc"}
+					createResponse = driver.Create(testEnv, voldriver.CreateRequest{Name: "some-volume-name", Opts: opts})
+					Expect(createResponse.Err).To(Equal("Invalid 'local_mount_point' field in 'Opts': must be within an allowed mount root [INVALID_OPTS]"))
+				})
+
+				It("rejects a relative mount point", func() {
+					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remotemountpoint", "local_mount_point": "volumes/mine"}
+					createResponse = driver.Create(testEnv, voldriver.CreateRequest{Name: "some-volume-name", Opts: opts})
+					Expect(createResponse.Err).To(Equal("Invalid 'local_mount_point' field in 'Opts': must be within an allowed mount root [INVALID_OPTS]"))
+				})
+
+				It("rejects a mount point that escapes through a symlink", func() {
+					fakeOs.LstatStub = func(name string) (os.FileInfo, error) {
+						if name == "/var/vcap/data/volumes/link" {
+							return symlinkInfo{}, nil
+						}
+						return nil, nil
+					}
+					fakeOs.ReadlinkReturns("/etc", nil)
+
+					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remotemountpoint", "local_mount_point": "/var/vcap/data/volumes/link/mine"}
+					createResponse = driver.Create(testEnv, voldriver.CreateRequest{Name: "some-volume-name", Opts: opts})
+					Expect(createResponse.Err).To(Equal("Invalid 'local_mount_point' field in 'Opts': must be within an allowed mount root [INVALID_OPTS]"))
+				})
 			})
+
 			Context("when volume already exists", func() {
 				JustBeforeEach(func() {
-					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint", "remote_mount_point": "some-remote-mountpoint"}
+					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
 					createRequest := voldriver.CreateRequest{Name: "some-volume-name", Opts: opts}
 					createResponse = driver.Create(testEnv, createRequest)
 					Expect(createResponse.Err).To(Equal(""))
 				})
 				It("fails when given different metadata.", func() {
-					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint", "remote_mount_point": "someother-remote-mountpoint"}
+					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "someother-remote-mountpoint"}
 					createRequest := voldriver.CreateRequest{Name: "some-volume-name", Opts: opts}
 					createResponse = driver.Create(testEnv, createRequest)
-					Expect(createResponse.Err).To(Equal("Volume 'some-volume-name' already exists with different Opts"))
+					Expect(createResponse.Err).To(Equal("Volume 'some-volume-name' already exists with different Opts [VOLUME_CONFLICT]"))
 				})
 				It("succeeds when given same metadata", func() {
-					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint", "remote_mount_point": "some-remote-mountpoint"}
+					opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
 					createRequest := voldriver.CreateRequest{Name: "some-volume-name", Opts: opts}
 					createResponse = driver.Create(testEnv, createRequest)
 					Expect(createResponse.Err).To(Equal(""))
@@ -146,7 +237,7 @@ var _ = Describe("cephlocal", func() {
 		Context("when there is a created/attached volume", func() {
 			BeforeEach(func() {
 				volumeName = "volume-name"
-				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint", "remote_mount_point": "some-remote-mountpoint"}
+				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
 			})
 
 			JustBeforeEach(func() {
@@ -165,16 +256,16 @@ var _ = Describe("cephlocal", func() {
 					fakeInvoker.InvokeReturns(nil, nil)
 					mountSuccessful(testEnv, driver, volumeName)
 
-					Expect(fakeOs.MkdirAllCallCount()).To(Equal(1))
-					path, _ := fakeOs.MkdirAllArgsForCall(0)
-					Expect(path).To(Equal("some-localmountpoint"))
+					Expect(fakeOs.MkdirAllCallCount()).To(Equal(2))
+					path, _ := fakeOs.MkdirAllArgsForCall(1)
+					Expect(path).To(Equal("some-root/volumes/volume-name/anonymous-1"))
 				})
 
 				It("should list the volume with an empty mountpoint for unmounted volumes", func() {
 					listResponse := driver.List(testEnv)
 					Expect(listResponse.Err).To(Equal(""))
 					Expect(listResponse.Volumes[0].Name).To(Equal("volume-name"))
-					Expect(listResponse.Volumes[0].Mountpoint).To(Equal("some-localmountpoint"))
+					Expect(listResponse.Volumes[0].Mountpoint).To(Equal("some-root/volumes/volume-name/anonymous-1"))
 				})
 			})
 		})
@@ -197,7 +288,7 @@ var _ = Describe("cephlocal", func() {
 		Context("when there is a created/attached volume", func() {
 			BeforeEach(func() {
 				volumeName = "volume-name"
-				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint", "remote_mount_point": "some-remote-mountpoint"}
+				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
 			})
 
 			JustBeforeEach(func() {
@@ -217,9 +308,9 @@ var _ = Describe("cephlocal", func() {
 					fakeInvoker.InvokeReturns(nil, nil)
 					mountSuccessful(testEnv, driver, volumeName)
 
-					Expect(fakeOs.MkdirAllCallCount()).To(Equal(1))
-					path, _ := fakeOs.MkdirAllArgsForCall(0)
-					Expect(path).To(Equal("some-localmountpoint"))
+					Expect(fakeOs.MkdirAllCallCount()).To(Equal(2))
+					path, _ := fakeOs.MkdirAllArgsForCall(1)
+					Expect(path).To(Equal("some-root/volumes/volume-name/anonymous-1"))
 				})
 
 				It("should return Path correctly", func() {
@@ -228,7 +319,7 @@ var _ = Describe("cephlocal", func() {
 					})
 
 					Expect(pathResponse.Err).To(Equal(""))
-					Expect(pathResponse.Mountpoint).To(Equal("some-localmountpoint"))
+					Expect(pathResponse.Mountpoint).To(Equal("some-root/volumes/volume-name/anonymous-1"))
 				})
 			})
 		})
@@ -244,7 +335,7 @@ var _ = Describe("cephlocal", func() {
 
 			BeforeEach(func() {
 				volumeName = "volume-name"
-				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint", "remote_mount_point": "some-remote-mountpoint"}
+				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
 			})
 
 			JustBeforeEach(func() {
@@ -254,7 +345,7 @@ var _ = Describe("cephlocal", func() {
 			It("should report an error for volume name mismatch", func() {
 				mountRequest := voldriver.MountRequest{Name: "garbage"}
 				mountResponse = driver.Mount(testEnv, mountRequest)
-				Expect(mountResponse.Err).To(Equal("Volume 'garbage' not found"))
+				Expect(mountResponse.Err).To(Equal("Volume 'garbage' not found [VOLUME_NOT_FOUND]"))
 				Expect(mountResponse.Mountpoint).To(Equal(""))
 			})
 
@@ -262,14 +353,14 @@ var _ = Describe("cephlocal", func() {
 				fakeIoutil.WriteFileReturns(fmt.Errorf("error writing file"))
 				mountRequest := voldriver.MountRequest{Name: volumeName}
 				mountResponse = driver.Mount(testEnv, mountRequest)
-				Expect(mountResponse.Err).To(Equal(fmt.Sprintf("Error mounting '%s' (error writing file)", volumeName)))
+				Expect(mountResponse.Err).To(Equal(fmt.Sprintf("Error mounting '%s' (error writing file) [MOUNT_FAILED]", volumeName)))
 			})
 
 			It("should report an error if CLI invocation fails", func() {
 				fakeInvoker.InvokeReturns([]byte("error"), fmt.Errorf("invocation fails"))
 				mountRequest := voldriver.MountRequest{Name: volumeName}
 				mountResponse = driver.Mount(testEnv, mountRequest)
-				Expect(mountResponse.Err).To(Equal(fmt.Sprintf("Error mounting '%s' (invocation fails)", volumeName)))
+				Expect(mountResponse.Err).To(Equal(fmt.Sprintf("Error mounting '%s' (invocation fails) [MOUNT_FAILED]", volumeName)))
 			})
 
 			Context("when the mount completes successfully", func() {
@@ -277,9 +368,11 @@ var _ = Describe("cephlocal", func() {
 					fakeInvoker.InvokeReturns(nil, nil)
 					mountSuccessful(testEnv, driver, volumeName)
 
-					Expect(fakeOs.MkdirAllCallCount()).To(Equal(1))
+					Expect(fakeOs.MkdirAllCallCount()).To(Equal(2))
 					path, _ := fakeOs.MkdirAllArgsForCall(0)
-					Expect(path).To(Equal("some-localmountpoint"))
+					Expect(path).To(HavePrefix("some-root/shares/"))
+					path, _ = fakeOs.MkdirAllArgsForCall(1)
+					Expect(path).To(Equal("some-root/volumes/volume-name/anonymous-1"))
 				})
 
 				It("invokes Ceph with the correct args", func() {
@@ -291,26 +384,261 @@ var _ = Describe("cephlocal", func() {
 					Expect(args[3]).To(Equal("some-ip:6789"))
 					Expect(args[4]).To(Equal("-r"))
 					Expect(args[5]).To(Equal("some-remote-mountpoint"))
-					Expect(args[6]).To(Equal("some-localmountpoint"))
+					Expect(args[6]).To(HavePrefix("some-root/shares/"))
+				})
+
+				It("bind mounts the share into the holder mountpoint", func() {
+					_, _, cephArgs := fakeInvoker.InvokeArgsForCall(0)
+					_, cmd, args := fakeInvoker.InvokeArgsForCall(1)
+					Expect(cmd).To(Equal("mount"))
+					Expect(args).To(Equal([]string{"--bind", cephArgs[6], "some-root/volumes/volume-name/anonymous-1"}))
 				})
 
 				It("creates a keyfile", func() {
 					Expect(fakeIoutil.WriteFileCallCount()).To(Equal(1))
 				})
 
+				It("does not log the keyring", func() {
+					mountSuccessful(testEnv, driver, volumeName)
+					unmountSuccessful(testEnv, driver, volumeName)
+					Expect(testLogger.(*lagertest.TestLogger).Buffer().Contents()).NotTo(ContainSubstring("some-keyring"))
+				})
+
 				It("can get the volume and it is mounted path", func() {
 					getResponse := getSuccessful(testEnv, driver, volumeName)
-					Expect(getResponse.Volume.Mountpoint).To(Equal("some-localmountpoint"))
+					Expect(getResponse.Volume.Mountpoint).To(Equal("some-root/volumes/volume-name/anonymous-1"))
 				})
 
-				It("should return mountpoint", func() {
+				It("should return a new mountpoint for another holder", func() {
 					mountResponse = driver.Mount(testEnv, voldriver.MountRequest{
 						Name: volumeName,
 					})
 
-					Expect(mountResponse.Mountpoint).To(Equal("some-localmountpoint"))
+					Expect(mountResponse.Mountpoint).To(Equal("some-root/volumes/volume-name/anonymous-2"))
 					By("not calling ceph executable again.")
-					Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+					Expect(invocationsOf(fakeInvoker, "ceph-fuse")).To(Equal(1))
+					Expect(invocationsOf(fakeInvoker, "mount")).To(Equal(2))
+				})
+
+				It("should report an error if the bind mount fails", func() {
+					fakeInvoker.InvokeReturns(nil, fmt.Errorf("bind fails"))
+					mountResponse = driver.Mount(testEnv, voldriver.MountRequest{
+						Name: volumeName,
+					})
+					Expect(mountResponse.Err).To(Equal(fmt.Sprintf("Error mounting '%s' (bind fails) [MOUNT_FAILED]", volumeName)))
+
+					By("keeping the share mounted for the existing holder")
+					Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(0))
+				})
+			})
+
+			Context("when a monitor port and read_only are given", func() {
+				BeforeEach(func() {
+					opts["port"] = float64(6790)
+					opts["read_only"] = true
+				})
+
+				It("mounts the share from that port and binds it read-only", func() {
+					mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+					_, _, cephArgs := fakeInvoker.InvokeArgsForCall(0)
+					Expect(cephArgs[3]).To(Equal("some-ip:6790"))
+
+					_, cmd, args := fakeInvoker.InvokeArgsForCall(1)
+					Expect(cmd).To(Equal("mount"))
+					Expect(args).To(Equal([]string{"--bind", "-o", "ro", cephArgs[6], "some-root/volumes/volume-name/container-1"}))
+				})
+			})
+
+			Context("when another volume refers to the same share", func() {
+				var bindRoot func(source string, share string) string
+
+				BeforeEach(func() {
+					bindRoot = func(source string, share string) string {
+						return "/" + strings.TrimPrefix(source, share+"/")
+					}
+
+					// The mount table shows the share where ceph-fuse mounted it,
+					// and each bind mount of it showing the directory it was bound
+					// from.
+					fakeIoutil.ReadFileStub = func(filename string) ([]byte, error) {
+						if filename != "/proc/self/mountinfo" {
+							return nil, nil
+						}
+						share := ""
+						mountInfo := ""
+						for i := 0; i < fakeInvoker.InvokeCallCount(); i++ {
+							_, cmd, args := fakeInvoker.InvokeArgsForCall(i)
+							switch cmd {
+							case "ceph-fuse":
+								share = args[6]
+								mountInfo += fmt.Sprintf("100 20 0:50 / %s rw - fuse.ceph-fuse ceph-fuse rw\n", share)
+							case "mount":
+								source, target := args[len(args)-2], args[len(args)-1]
+								mountInfo += fmt.Sprintf("101 20 0:50 %s %s rw - fuse.ceph-fuse ceph-fuse rw\n", bindRoot(source, share), target)
+							}
+						}
+						return []byte(mountInfo), nil
+					}
+				})
+
+				JustBeforeEach(func() {
+					otherOpts := map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint", "sub_directory": "some/sub-dir"}
+					createSuccessful(testEnv, driver, "other-volume", otherOpts)
+
+					mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+					mountResponse = driver.Mount(testEnv, voldriver.MountRequest{Name: "other-volume", ID: "container-2"})
+					Expect(mountResponse.Err).To(Equal(""))
+					Expect(mountResponse.Mountpoint).To(Equal("some-root/volumes/other-volume/container-2"))
+				})
+
+				It("mounts the share only once", func() {
+					Expect(invocationsOf(fakeInvoker, "ceph-fuse")).To(Equal(1))
+				})
+
+				It("bind mounts the sub directory of the share", func() {
+					_, _, cephArgs := fakeInvoker.InvokeArgsForCall(0)
+					_, cmd, args := fakeInvoker.InvokeArgsForCall(2)
+					Expect(cmd).To(Equal("mount"))
+					Expect(args).To(Equal([]string{"--bind", cephArgs[6] + "/some/sub-dir", "some-root/volumes/other-volume/container-2"}))
+				})
+
+				It("bind mounts the sub directory a holder asks for within the volume's", func() {
+					mountResponse = driver.(*cephlocal.LocalDriver).MountWithOpts(testEnv, cephlocal.MountRequest{Name: "other-volume", ID: "container-3", Opts: map[string]interface{}{"sub_directory": "app/data"}})
+					Expect(mountResponse.Err).To(Equal(""))
+
+					_, _, cephArgs := fakeInvoker.InvokeArgsForCall(0)
+					_, _, args := fakeInvoker.InvokeArgsForCall(3)
+					Expect(args).To(Equal([]string{"--bind", cephArgs[6] + "/some/sub-dir/app/data", "some-root/volumes/other-volume/container-3"}))
+				})
+
+				It("follows symlinks in the sub directory that stay within the share", func() {
+					fakeOs.LstatStub = func(name string) (os.FileInfo, error) {
+						if filepath.Base(name) == "current" {
+							return symlinkInfo{}, nil
+						}
+						return nil, nil
+					}
+					fakeOs.ReadlinkReturns("../releases/2", nil)
+
+					mountResponse = driver.(*cephlocal.LocalDriver).MountWithOpts(testEnv, cephlocal.MountRequest{Name: "other-volume", ID: "container-3", Opts: map[string]interface{}{"sub_directory": "current"}})
+					Expect(mountResponse.Err).To(Equal(""))
+
+					_, _, cephArgs := fakeInvoker.InvokeArgsForCall(0)
+					_, _, args := fakeInvoker.InvokeArgsForCall(3)
+					Expect(args[1]).To(Equal(cephArgs[6] + "/some/releases/2"))
+				})
+
+				It("refuses sub directories that lead out of the share through a symlink", func() {
+					fakeOs.LstatStub = func(name string) (os.FileInfo, error) {
+						if filepath.Base(name) == "escape" {
+							return symlinkInfo{}, nil
+						}
+						return nil, nil
+					}
+					fakeOs.ReadlinkReturns("/etc", nil)
+
+					mountResponse = driver.(*cephlocal.LocalDriver).MountWithOpts(testEnv, cephlocal.MountRequest{Name: "other-volume", ID: "container-3", Opts: map[string]interface{}{"sub_directory": "escape"}})
+					_, _, cephArgs := fakeInvoker.InvokeArgsForCall(0)
+					Expect(mountResponse.Err).To(Equal("Error mounting 'other-volume' (Invalid sub-directory 'some/sub-dir/escape': some/sub-dir/escape leads out of " + cephArgs[6] + ") [INVALID_OPTS]"))
+					Expect(invocationsOf(fakeInvoker, "mount")).To(Equal(2))
+				})
+
+				It("undoes the bind of a sub directory that was swapped for a symlink out of the share while it was bound", func() {
+					bindRoot = func(source string, share string) string {
+						if strings.HasSuffix(source, "/app/data") {
+							return "/etc"
+						}
+						return "/" + strings.TrimPrefix(source, share+"/")
+					}
+
+					mountResponse = driver.(*cephlocal.LocalDriver).MountWithOpts(testEnv, cephlocal.MountRequest{Name: "other-volume", ID: "container-3", Opts: map[string]interface{}{"sub_directory": "app/data"}})
+					Expect(mountResponse.Err).To(Equal("Error mounting 'other-volume' (Invalid sub-directory 'some/sub-dir/app/data': it changed while it was being bound) [INVALID_OPTS]"))
+
+					_, cmd, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+					Expect(cmd).To(Equal("umount"))
+					Expect(args).To(Equal([]string{"-l", "some-root/volumes/other-volume/container-3"}))
+
+					By("not recording the holder")
+					getResponse := getSuccessful(testEnv, driver, "other-volume")
+					Expect(getResponse.Volume.Mountpoint).To(Equal("some-root/volumes/other-volume/container-2"))
+				})
+
+				It("undoes the bind of a sub directory when the mount table cannot be read", func() {
+					fakeIoutil.ReadFileReturns(nil, fmt.Errorf("no mountinfo"))
+					fakeIoutil.ReadFileStub = nil
+
+					mountResponse = driver.(*cephlocal.LocalDriver).MountWithOpts(testEnv, cephlocal.MountRequest{Name: "other-volume", ID: "container-3", Opts: map[string]interface{}{"sub_directory": "app/data"}})
+					Expect(mountResponse.Err).To(Equal("Error mounting 'other-volume' (Invalid sub-directory 'some/sub-dir/app/data': it changed while it was being bound) [INVALID_OPTS]"))
+					Expect(invocationsOf(fakeInvoker, "umount")).To(Equal(1))
+				})
+
+				It("rejects invalid mount opts", func() {
+					mountResponse = driver.(*cephlocal.LocalDriver).MountWithOpts(testEnv, cephlocal.MountRequest{Name: "other-volume", ID: "container-3", Opts: map[string]interface{}{"sub_directory": "../other"}})
+					Expect(mountResponse.Err).To(Equal("Invalid 'sub_directory' field in 'Opts': must be a relative path without '..' [INVALID_OPTS]"))
+				})
+
+				It("unmounts the share when the last bind goes away", func() {
+					unmountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+					Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(0))
+
+					unmountResponse := driver.Unmount(testEnv, voldriver.UnmountRequest{Name: "other-volume", ID: "container-2"})
+					Expect(unmountResponse.Err).To(Equal(""))
+					Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(1))
+				})
+			})
+
+			Context("when ceph-fuse is slow to mount the share of a volume", func() {
+				var (
+					unblock chan struct{}
+					release func()
+					mounted chan voldriver.MountResponse
+				)
+
+				JustBeforeEach(func() {
+					createSuccessful(testEnv, driver, "other-volume", map[string]interface{}{"keyring": "other-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+
+					unblock = make(chan struct{})
+					once := sync.Once{}
+					release = func() { once.Do(func() { close(unblock) }) }
+					fakeInvoker.InvokeStub = func(env voldriver.Env, executable string, args []string) ([]byte, error) {
+						if key, _, _ := fakeIoutil.WriteFileArgsForCall(0); executable == "ceph-fuse" && args[1] == key {
+							<-unblock
+						}
+						return nil, nil
+					}
+
+					mounted = make(chan voldriver.MountResponse, 1)
+					go func() {
+						mounted <- driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: "container-1"})
+					}()
+					Eventually(fakeInvoker.InvokeCallCount).Should(Equal(1))
+				})
+
+				AfterEach(func() {
+					release()
+					Eventually(mounted).Should(Receive())
+				})
+
+				It("answers for other volumes meanwhile", func() {
+					getResponse := driver.Get(testEnv, voldriver.GetRequest{Name: "other-volume"})
+					Expect(getResponse.Err).To(Equal(""))
+
+					mountResponse := driver.Mount(testEnv, voldriver.MountRequest{Name: "other-volume", ID: "container-2"})
+					Expect(mountResponse.Err).To(Equal(""))
+					Consistently(mounted).ShouldNot(Receive())
+				})
+
+				It("makes other mounts of the volume wait for it", func() {
+					otherMounted := make(chan voldriver.MountResponse, 1)
+					go func() {
+						otherMounted <- driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: "container-2"})
+					}()
+					Consistently(otherMounted).ShouldNot(Receive())
+
+					release()
+					Eventually(otherMounted).Should(Receive(Equal(voldriver.MountResponse{Mountpoint: "some-root/volumes/volume-name/container-2"})))
+					Expect(invocationsOf(fakeInvoker, "ceph-fuse")).To(Equal(1))
 				})
 			})
 
@@ -325,9 +653,7 @@ var _ = Describe("cephlocal", func() {
 					fakeInvoker.InvokeReturns(nil, nil)
 					mountSuccessful(testEnv, driver, volumeName)
 
-					Expect(fakeOs.MkdirAllCallCount()).To(Equal(1))
-					path, _ := fakeOs.MkdirAllArgsForCall(0)
-					Expect(path).To(Equal("some-localmountpoint"))
+					Expect(fakeOs.MkdirAllCallCount()).To(Equal(2))
 				})
 
 				It("invokes Ceph with the correct args", func() {
@@ -341,7 +667,7 @@ var _ = Describe("cephlocal", func() {
 					Expect(args[5]).To(Equal("some-ip:6789"))
 					Expect(args[6]).To(Equal("-r"))
 					Expect(args[7]).To(Equal("some-remote-mountpoint"))
-					Expect(args[8]).To(Equal("some-localmountpoint"))
+					Expect(args[8]).To(HavePrefix("some-root/shares/"))
 				})
 			})
 
@@ -357,7 +683,7 @@ var _ = Describe("cephlocal", func() {
 		Context("when there is a created/attached volume", func() {
 			BeforeEach(func() {
 				volumeName = "volume-name"
-				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint", "remote_mount_point": "some-remote-mountpoint"}
+				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
 			})
 
 			JustBeforeEach(func() {
@@ -367,19 +693,19 @@ var _ = Describe("cephlocal", func() {
 			It("should report an error for volume name mismatch", func() {
 				unmountRequest := voldriver.UnmountRequest{Name: "garbage"}
 				unmountResponse = driver.Unmount(testEnv, unmountRequest)
-				Expect(unmountResponse.Err).To(Equal("Volume 'garbage' is unknown"))
+				Expect(unmountResponse.Err).To(Equal("Volume 'garbage' is unknown [VOLUME_NOT_FOUND]"))
 			})
 
 			It("should error when volume is not mounted", func() {
 				unmountRequest := voldriver.UnmountRequest{Name: volumeName}
 				unmountResponse = driver.Unmount(testEnv, unmountRequest)
 
-				Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Volume '%s' not mounted", volumeName)))
+				Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Volume '%s' not mounted [NOT_MOUNTED]", volumeName)))
 			})
 			It("should error when volume is not created", func() {
 				unmountRequest := voldriver.UnmountRequest{Name: "non-existent-volume"}
 				unmountResponse = driver.Unmount(testEnv, unmountRequest)
-				Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Volume '%s' is unknown", "non-existent-volume")))
+				Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Volume '%s' is unknown [VOLUME_NOT_FOUND]", "non-existent-volume")))
 			})
 
 			Context("when volume mounted", func() {
@@ -393,13 +719,13 @@ var _ = Describe("cephlocal", func() {
 					fakeOs.RemoveReturns(fmt.Errorf("file deletion failed"))
 					unmountRequest := voldriver.UnmountRequest{Name: volumeName}
 					unmountResponse = driver.Unmount(testEnv, unmountRequest)
-					Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Error unmounting '%s' (file deletion failed)", volumeName)))
+					Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Error unmounting '%s' (file deletion failed) [UNMOUNT_FAILED]", volumeName)))
 				})
 				It("should report an error if CLI invocation fails", func() {
 					fakeInvoker.InvokeReturns([]byte("error"), fmt.Errorf("invocation fails"))
 					unmountRequest := voldriver.UnmountRequest{Name: volumeName}
 					unmountResponse = driver.Unmount(testEnv, unmountRequest)
-					Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Error unmounting '%s' (invocation fails)", volumeName)))
+					Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Error unmounting '%s' (invocation fails) [UNMOUNT_FAILED]", volumeName)))
 				})
 
 				Context("when fusermount -u successful", func() {
@@ -408,18 +734,21 @@ var _ = Describe("cephlocal", func() {
 
 						unmountSuccessful(testEnv, driver, volumeName)
 
-						Expect(fakeInvoker.InvokeCallCount()).To(Equal(2)) // mount and umount commands
-						_, cmd, _ := fakeInvoker.InvokeArgsForCall(1)
+						Expect(fakeInvoker.InvokeCallCount()).To(Equal(4)) // mount, bind, unbind and umount commands
+						_, cmd, _ := fakeInvoker.InvokeArgsForCall(2)
+						Expect(cmd).To(Equal("umount"))
+						_, cmd, _ = fakeInvoker.InvokeArgsForCall(3)
 						Expect(cmd).To(Equal("fusermount"))
 					})
 					It("only gets volume name, without Mountpoint", func() {
 						getResponse := getSuccessful(testEnv, driver, volumeName)
 						Expect(getResponse.Volume.Mountpoint).To(Equal(""))
 					})
-					It("removes keyfile and local mountpoint directory", func() {
-						Expect(fakeOs.RemoveCallCount()).To(Equal(2))
-						mountPointPath := fakeOs.RemoveArgsForCall(1)
-						Expect(mountPointPath).To(Equal("some-localmountpoint"))
+					It("removes bind mountpoint, keyfile and share mountpoint directory", func() {
+						Expect(fakeOs.RemoveCallCount()).To(Equal(3))
+						Expect(fakeOs.RemoveArgsForCall(0)).To(Equal("some-root/volumes/volume-name/anonymous-1"))
+						Expect(fakeOs.RemoveArgsForCall(1)).To(MatchRegexp(`/tmp/keypath_\d+`))
+						Expect(fakeOs.RemoveArgsForCall(2)).To(HavePrefix("some-root/shares/"))
 					})
 				})
 
@@ -430,7 +759,133 @@ var _ = Describe("cephlocal", func() {
 					})
 					It("can still get the volume and it is mounted path", func() {
 						getResponse := getSuccessful(testEnv, driver, volumeName)
-						Expect(getResponse.Volume.Mountpoint).To(Equal("some-localmountpoint"))
+						Expect(getResponse.Volume.Mountpoint).To(Equal("some-root/volumes/volume-name/anonymous-2"))
+					})
+				})
+			})
+
+			Context("when volume mounted by callers with IDs", func() {
+				JustBeforeEach(func() {
+					mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+					mountSuccessfulWithID(testEnv, driver, volumeName, "container-2")
+				})
+
+				It("reports the holders in the volume status", func() {
+					statusResponse := driver.(*cephlocal.LocalDriver).Status(testEnv, cephlocal.StatusRequest{Name: volumeName})
+					Expect(statusResponse.Err).To(Equal(""))
+					Expect(statusResponse.Status.Holders).To(Equal([]string{"container-1", "container-2"}))
+					Expect(statusResponse.Status.Mountpoint).To(Equal(""))
+				})
+
+				It("answers Get and Path with the mount point of the holder asked for", func() {
+					localDriver := driver.(*cephlocal.LocalDriver)
+					getResponse := localDriver.GetForHolder(testEnv, cephlocal.GetRequest{Name: volumeName, ID: "container-2"})
+					Expect(getResponse.Err).To(Equal(""))
+					Expect(getResponse.Volume.Mountpoint).To(Equal("some-root/volumes/volume-name/container-2"))
+
+					pathResponse := localDriver.PathForHolder(testEnv, cephlocal.PathRequest{Name: volumeName, ID: "container-1"})
+					Expect(pathResponse.Err).To(Equal(""))
+					Expect(pathResponse.Mountpoint).To(Equal("some-root/volumes/volume-name/container-1"))
+
+					pathResponse = localDriver.PathForHolder(testEnv, cephlocal.PathRequest{Name: volumeName, ID: "container-3"})
+					Expect(pathResponse.Err).To(Equal("Volume 'volume-name' not mounted for 'container-3' [NOT_MOUNTED]"))
+				})
+
+				It("lists the holders and their mount points in the response to Get", func() {
+					getResponse := driver.(*cephlocal.LocalDriver).GetForHolder(testEnv, cephlocal.GetRequest{Name: volumeName})
+					Expect(getResponse.Err).To(Equal(""))
+					Expect(getResponse.Volume.Holders).To(Equal([]cephlocal.HolderInfo{
+						{ID: "container-1", Mountpoint: "some-root/volumes/volume-name/container-1"},
+						{ID: "container-2", Mountpoint: "some-root/volumes/volume-name/container-2"},
+					}))
+				})
+
+				It("does not answer Get, Path or List with the mount point of any one holder without an ID", func() {
+					Expect(getSuccessful(testEnv, driver, volumeName).Volume.Mountpoint).To(Equal(""))
+					Expect(driver.List(testEnv).Volumes[0].Mountpoint).To(Equal(""))
+
+					pathResponse := driver.Path(testEnv, voldriver.PathRequest{Name: volumeName})
+					Expect(pathResponse.Err).To(Equal("Volume 'volume-name' not mounted without an ID [NOT_MOUNTED]"))
+				})
+
+				It("does not add a holder for a retried mount", func() {
+					mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+					Expect(invocationsOf(fakeInvoker, "mount")).To(Equal(2))
+
+					unmountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+					unmountSuccessfulWithID(testEnv, driver, volumeName, "container-2")
+					Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(1))
+				})
+
+				It("does not unmount the volume for a retried unmount", func() {
+					unmountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+					unmountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+					Expect(invocationsOf(fakeInvoker, "umount")).To(Equal(1))
+					Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(0))
+
+					getResponse := getSuccessful(testEnv, driver, volumeName)
+					Expect(getResponse.Volume.Mountpoint).To(Equal("some-root/volumes/volume-name/container-2"))
+				})
+
+				It("unmounts the volume when the last holder unmounts", func() {
+					unmountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+					unmountSuccessfulWithID(testEnv, driver, volumeName, "container-2")
+
+					Expect(fakeInvoker.InvokeCallCount()).To(Equal(6))
+					_, cmd, _ := fakeInvoker.InvokeArgsForCall(5)
+					Expect(cmd).To(Equal("fusermount"))
+
+					getResponse := getSuccessful(testEnv, driver, volumeName)
+					Expect(getResponse.Volume.Mountpoint).To(Equal(""))
+				})
+
+				It("rejects holder IDs that cannot name a bind mount", func() {
+					for _, holderID := range []string{"../../etc", "some/holder", "..", "anonymous-1"} {
+						mountResponse := driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: holderID})
+						Expect(mountResponse.Err).To(Equal(fmt.Sprintf("Invalid holder ID '%s' [INVALID_HOLDER_ID]", holderID)))
+
+						unmountResponse = driver.Unmount(testEnv, voldriver.UnmountRequest{Name: volumeName, ID: holderID})
+						Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Invalid holder ID '%s' [INVALID_HOLDER_ID]", holderID)))
+					}
+					Expect(invocationsOf(fakeInvoker, "mount")).To(Equal(2))
+				})
+
+				It("errors on an unmount without an ID", func() {
+					unmountResponse = driver.Unmount(testEnv, voldriver.UnmountRequest{Name: volumeName})
+					Expect(unmountResponse.Err).To(Equal(fmt.Sprintf("Volume '%s' not mounted without an ID [NOT_MOUNTED]", volumeName)))
+				})
+
+				Context("when reaping holders", func() {
+					var reapResponse voldriver.ErrorResponse
+
+					It("releases holders that are no longer alive", func() {
+						reapResponse = driver.(*cephlocal.LocalDriver).ReapHolders(testEnv, func(holderID string) bool {
+							return holderID == "container-2"
+						})
+						Expect(reapResponse.Err).To(Equal(""))
+
+						statusResponse := driver.(*cephlocal.LocalDriver).Status(testEnv, cephlocal.StatusRequest{Name: volumeName})
+						Expect(statusResponse.Status.Holders).To(Equal([]string{"container-2"}))
+						Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(0))
+					})
+
+					It("unmounts the volume when no holders are alive", func() {
+						reapResponse = driver.(*cephlocal.LocalDriver).ReapHolders(testEnv, func(holderID string) bool {
+							return false
+						})
+						Expect(reapResponse.Err).To(Equal(""))
+
+						getResponse := getSuccessful(testEnv, driver, volumeName)
+						Expect(getResponse.Volume.Mountpoint).To(Equal(""))
+						Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(1))
+					})
+
+					It("reports unmount failures", func() {
+						fakeInvoker.InvokeReturns([]byte("error"), fmt.Errorf("invocation fails"))
+						reapResponse = driver.(*cephlocal.LocalDriver).ReapHolders(testEnv, func(holderID string) bool {
+							return false
+						})
+						Expect(reapResponse.Err).To(ContainSubstring(fmt.Sprintf("Error unmounting '%s' (invocation fails)", volumeName)))
 					})
 				})
 			})
@@ -445,19 +900,19 @@ var _ = Describe("cephlocal", func() {
 			removeResponse := driver.Remove(testEnv, voldriver.RemoveRequest{
 				Name: "",
 			})
-			Expect(removeResponse.Err).To(Equal("Missing mandatory 'volume_name'"))
+			Expect(removeResponse.Err).To(Equal("Missing mandatory 'volume_name' [INVALID_VOLUME_NAME]"))
 		})
 
 		It("should fail if no volume was created", func() {
 			removeResponse := driver.Remove(testEnv, voldriver.RemoveRequest{
 				Name: volumeName,
 			})
-			Expect(removeResponse.Err).To(Equal("Volume 'volume-name' not found"))
+			Expect(removeResponse.Err).To(Equal("Volume 'volume-name' not found [VOLUME_NOT_FOUND]"))
 		})
 
 		Context("when there is a created/attached volume", func() {
 			BeforeEach(func() {
-				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "local_mount_point": "some-localmountpoint", "remote_mount_point": "some-remote-mountpoint"}
+				opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
 			})
 			JustBeforeEach(func() {
 				createSuccessful(testEnv, driver, volumeName, opts)
@@ -480,9 +935,10 @@ var _ = Describe("cephlocal", func() {
 					})
 					Expect(removeResponse.Err).To(Equal(""))
 					getUnsuccessful(testEnv, driver, volumeName)
-					Expect(fakeOs.RemoveCallCount()).To(Equal(2))
-					mountPointPath := fakeOs.RemoveArgsForCall(1)
-					Expect(mountPointPath).To(Equal("some-localmountpoint"))
+					Expect(fakeOs.RemoveCallCount()).To(Equal(4))
+					Expect(fakeOs.RemoveArgsForCall(0)).To(Equal("some-root/volumes/volume-name/anonymous-1"))
+					Expect(fakeOs.RemoveArgsForCall(3)).To(Equal("some-root/volumes/volume-name"))
+					Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(1))
 				})
 				Context("when unmount fails", func() {
 					JustBeforeEach(func() {
@@ -492,7 +948,7 @@ var _ = Describe("cephlocal", func() {
 						removeResponse := driver.Remove(testEnv, voldriver.RemoveRequest{
 							Name: volumeName,
 						})
-						Expect(removeResponse.Err).To(Equal("Error unmounting '" + volumeName + "' (invocation fails)"))
+						Expect(removeResponse.Err).To(Equal("Error unmounting '" + volumeName + "' (invocation fails) [UNMOUNT_FAILED]"))
 					})
 				})
 			})
@@ -511,7 +967,7 @@ func getUnsuccessful(env voldriver.Env, localDriver voldriver.Driver, volumeName
 		Name: volumeName,
 	})
 
-	Expect(getResponse.Err).To(Equal("Volume '" + volumeName + "' not found"))
+	Expect(getResponse.Err).To(Equal("Volume '" + volumeName + "' not found [VOLUME_NOT_FOUND]"))
 	Expect(getResponse.Volume.Name).To(Equal(""))
 }
 
@@ -530,7 +986,7 @@ func mountSuccessful(env voldriver.Env, localDriver voldriver.Driver, volumeName
 		Name: volumeName,
 	})
 	Expect(mountResponse.Err).To(Equal(""))
-	Expect(mountResponse.Mountpoint).To(Equal("some-localmountpoint"))
+	Expect(mountResponse.Mountpoint).To(HavePrefix("some-root/volumes/" + volumeName + "/anonymous-"))
 }
 
 func unmountSuccessful(env voldriver.Env, localDriver voldriver.Driver, volumeName string) {
@@ -539,3 +995,35 @@ func unmountSuccessful(env voldriver.Env, localDriver voldriver.Driver, volumeNa
 	})
 	Expect(unmountResponse.Err).To(Equal(""))
 }
+
+func mountSuccessfulWithID(env voldriver.Env, localDriver voldriver.Driver, volumeName string, id string) {
+	mountResponse := localDriver.Mount(env, voldriver.MountRequest{
+		Name: volumeName,
+		ID:   id,
+	})
+	Expect(mountResponse.Err).To(Equal(""))
+	Expect(mountResponse.Mountpoint).To(Equal("some-root/volumes/" + volumeName + "/" + id))
+}
+
+func unmountSuccessfulWithID(env voldriver.Env, localDriver voldriver.Driver, volumeName string, id string) {
+	unmountResponse := localDriver.Unmount(env, voldriver.UnmountRequest{
+		Name: volumeName,
+		ID:   id,
+	})
+	Expect(unmountResponse.Err).To(Equal(""))
+}
+
+func invocationsOf(fakeInvoker *voldriverfakes.FakeInvoker, executable string) int {
+	count := 0
+	for i := 0; i < fakeInvoker.InvokeCallCount(); i++ {
+		_, cmd, _ := fakeInvoker.InvokeArgsForCall(i)
+		if cmd == executable {
+			count++
+		}
+	}
+	return count
+}
+
+type symlinkInfo struct{ os.FileInfo }
+
+func (symlinkInfo) Mode() os.FileMode { return os.ModeSymlink }
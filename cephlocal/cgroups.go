@@ -0,0 +1,207 @@
+package cephlocal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/lager"
+)
+
+const DEFAULT_CGROUP_ROOT = "/sys/fs/cgroup/cephdriver"
+
+const CGROUP2_FSTYPE = "cgroup2"
+
+// CPU_MAX_PERIOD is the period, in microseconds, over which cpu.max limits
+// the CPU time of a group; the kernel refuses quotas below CPU_MAX_MIN_QUOTA.
+const (
+	CPU_MAX_PERIOD    = 100000
+	CPU_MAX_MIN_QUOTA = 1000
+)
+
+// CgroupConfig limits the ceph-fuse processes the driver supervises. Each
+// ceph-fuse whose share has a limit, either these defaults or the volume's
+// own 'memory_limit' and 'cpu_limit', is placed into its own cgroup v2 group
+// under Root. A zero limit leaves the resource unlimited.
+type CgroupConfig struct {
+	Root        string
+	MemoryLimit int64
+	CPULimit    float64
+}
+
+// FuseUsage is what the cgroup of a ceph-fuse process has accounted for it.
+type FuseUsage struct {
+	MemoryBytes int64
+	CPUSeconds  float64
+	OOMKills    int
+}
+
+func (c CgroupConfig) withDefaults() CgroupConfig {
+	if c.Root == "" {
+		c.Root = DEFAULT_CGROUP_ROOT
+	}
+	return c
+}
+
+// fuseLimits resolves the limits of the ceph-fuse process mounting a
+// volume's share. The volume's options were validated when it was created.
+func (d *LocalDriver) fuseLimits(volume *volumeMetadata) (int64, float64) {
+	memoryLimit, cpuLimit := d.cgroups.MemoryLimit, d.cgroups.CPULimit
+	if volume.MemoryLimit != "" {
+		memoryLimit, _ = cephdriver.ParseMemoryLimit(volume.MemoryLimit)
+	}
+	if volume.CPULimit != "" {
+		cpuLimit, _ = cephdriver.ParseCPULimit(volume.CPULimit)
+	}
+	return memoryLimit, cpuLimit
+}
+
+// checkLimits rejects per-volume limits the driver is unable to apply, since
+// only the ceph-fuse processes it supervises can be placed into a cgroup.
+func (d *LocalDriver) checkLimits(config cephdriver.MountConfig) *Error {
+	if d.supervisor.Enabled {
+		return nil
+	}
+	if config.MemoryLimit != "" {
+		return newError(ERR_INVALID_OPTS, "Unable to apply 'memory_limit' field in 'Opts': ceph-fuse is not supervised by the driver")
+	}
+	if config.CPULimit != "" {
+		return newError(ERR_INVALID_OPTS, "Unable to apply 'cpu_limit' field in 'Opts': ceph-fuse is not supervised by the driver")
+	}
+	return nil
+}
+
+// limitFuse places the ceph-fuse process of a share into the share's cgroup,
+// creating it with the share's limits.
+func (d *LocalDriver) limitFuse(logger lager.Logger, share *shareMetadata, pid int) error {
+	if share.MemoryLimit == 0 && share.CPULimit == 0 {
+		return nil
+	}
+
+	group := filepath.Join(d.cgroups.Root, "ceph-fuse-"+share.Key)
+	logger.Info("limiting-ceph-fuse", lager.Data{"cgroup": group, "pid": pid, "memory_limit": share.MemoryLimit, "cpu_limit": share.CPULimit})
+
+	if err := d.os.MkdirAll(group, os.ModePerm); err != nil {
+		return err
+	}
+	share.Cgroup = group
+
+	type file struct{ name, contents string }
+	files := []file{}
+	for _, dir := range d.cgroupAncestors() {
+		files = append(files, file{filepath.Join(dir, "cgroup.subtree_control"), "+memory +cpu"})
+	}
+	files = append(files,
+		file{filepath.Join(group, "memory.max"), memoryMax(share.MemoryLimit)},
+		file{filepath.Join(group, "cpu.max"), cpuMax(share.CPULimit)},
+		file{filepath.Join(group, "cgroup.procs"), strconv.Itoa(pid)},
+	)
+	for _, file := range files {
+		if err := d.ioutil.WriteFile(file.name, []byte(file.contents), 0644); err != nil {
+			return fmt.Errorf("failed writing %s (%s)", file.name, err.Error())
+		}
+	}
+	return nil
+}
+
+// cgroupAncestors lists the groups that must enable the memory and cpu
+// controllers for them to reach the groups under the cgroup root, from the
+// top of the cgroup v2 hierarchy down to the root itself, as a group only has
+// the controllers its parent enables. Without a cgroup2 mount above the root
+// only the root is listed.
+func (d *LocalDriver) cgroupAncestors() []string {
+	root := filepath.Clean(d.cgroups.Root)
+
+	hierarchy := ""
+	if contents, err := d.ioutil.ReadFile(PROC_MOUNTINFO); err == nil {
+		for mountPoint, fsType := range parseMountInfo(string(contents)) {
+			if fsType == CGROUP2_FSTYPE && strings.HasPrefix(root, strings.TrimSuffix(mountPoint, "/")+"/") && len(mountPoint) > len(hierarchy) {
+				hierarchy = mountPoint
+			}
+		}
+	}
+	if hierarchy == "" {
+		return []string{root}
+	}
+
+	ancestors := []string{}
+	for dir := root; dir != hierarchy; dir = filepath.Dir(dir) {
+		ancestors = append([]string{dir}, ancestors...)
+	}
+	return append([]string{hierarchy}, ancestors...)
+}
+
+// releaseCgroup removes the cgroup of a share whose ceph-fuse process failed
+// to start.
+func (d *LocalDriver) releaseCgroup(logger lager.Logger, share *shareMetadata) {
+	d.removeCgroup(logger, share.Cgroup)
+	share.Cgroup = ""
+}
+
+// removeCgroup removes the cgroup of a ceph-fuse process that has exited.
+func (d *LocalDriver) removeCgroup(logger lager.Logger, group string) {
+	if group == "" {
+		return
+	}
+	if err := d.os.Remove(group); err != nil && !d.os.IsNotExist(err) {
+		logger.Error("failed-removing-cgroup", err, lager.Data{"cgroup": group})
+	}
+}
+
+// fuseUsage reads what the cgroup of a share has accounted for its ceph-fuse
+// process. Files that cannot be read are reported as zero.
+func (d *LocalDriver) fuseUsage(share *shareMetadata) FuseUsage {
+	usage := FuseUsage{}
+	if share.Cgroup == "" {
+		return usage
+	}
+
+	if contents, err := d.ioutil.ReadFile(filepath.Join(share.Cgroup, "memory.current")); err == nil {
+		usage.MemoryBytes, _ = strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	}
+
+	if contents, err := d.ioutil.ReadFile(filepath.Join(share.Cgroup, "cpu.stat")); err == nil {
+		usec, _ := strconv.ParseInt(flatKey(contents, "usage_usec"), 10, 64)
+		usage.CPUSeconds = float64(usec) / 1e6
+	}
+
+	if contents, err := d.ioutil.ReadFile(filepath.Join(share.Cgroup, "memory.events")); err == nil {
+		usage.OOMKills, _ = strconv.Atoi(flatKey(contents, "oom_kill"))
+	}
+	return usage
+}
+
+// flatKey looks up a key in a flat keyed cgroup file such as cpu.stat.
+func flatKey(contents []byte, key string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+func memoryMax(limit int64) string {
+	if limit <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+func cpuMax(limit float64) string {
+	if limit <= 0 {
+		return fmt.Sprintf("max %d", CPU_MAX_PERIOD)
+	}
+	quota := int64(limit * CPU_MAX_PERIOD)
+	if quota < CPU_MAX_MIN_QUOTA {
+		quota = CPU_MAX_MIN_QUOTA
+	}
+	return fmt.Sprintf("%d %d", quota, CPU_MAX_PERIOD)
+}
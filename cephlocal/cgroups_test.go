@@ -0,0 +1,233 @@
+package cephlocal_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ceph-fuse cgroups", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver       *cephlocal.LocalDriver
+		fakeOs       *os_fake.FakeOs
+		fakeIoutil   *ioutil_fake.FakeIoutil
+		fakeLauncher *fakeFuseLauncher
+		testEnv      voldriver.Env
+		config       cephlocal.LocalDriverConfig
+		opts         map[string]interface{}
+		cgroupMounts string
+		mounting     bool
+	)
+
+	BeforeEach(func() {
+		fakeOs = new(os_fake.FakeOs)
+		fakeIoutil = new(ioutil_fake.FakeIoutil)
+		fakeLauncher = &fakeFuseLauncher{}
+		cgroupMounts = ""
+		mounting = true
+		fakeIoutil.ReadFileStub = func(path string) ([]byte, error) {
+			switch {
+			case path == cephlocal.PROC_MOUNTINFO && mounting:
+				return append([]byte(cgroupMounts), fakeLauncher.mountInfo()...), nil
+			case path == cephlocal.PROC_MOUNTINFO:
+				return []byte(cgroupMounts), nil
+			case strings.HasSuffix(path, "/memory.current"):
+				return []byte("104857600\n"), nil
+			case strings.HasSuffix(path, "/cpu.stat"):
+				return []byte("usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n"), nil
+			case strings.HasSuffix(path, "/memory.events"):
+				return []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), nil
+			}
+			return nil, errors.New("no such file")
+		}
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("CgroupsTest"), context.TODO())
+		config = cephlocal.LocalDriverConfig{
+			RootDir:    "some-root",
+			Supervisor: cephlocal.SupervisorConfig{Enabled: true, Launcher: fakeLauncher},
+			Cgroups:    cephlocal.CgroupConfig{Root: "some-cgroups", MemoryLimit: 512 << 20},
+		}
+		opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "/"}
+	})
+
+	JustBeforeEach(func() {
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(new(voldriverfakes.FakeInvoker), fakeOs, fakeIoutil, config)
+	})
+
+	AfterEach(func() {
+		driver.StopSupervising()
+	})
+
+	written := func() map[string]string {
+		files := map[string]string{}
+		for i := 0; i < fakeIoutil.WriteFileCallCount(); i++ {
+			path, contents, _ := fakeIoutil.WriteFileArgsForCall(i)
+			if strings.HasPrefix(path, "some-cgroups/") {
+				files[path] = string(contents)
+			}
+		}
+		return files
+	}
+
+	removed := func() []string {
+		removed := []string{}
+		for i := 0; i < fakeOs.RemoveCallCount(); i++ {
+			removed = append(removed, fakeOs.RemoveArgsForCall(i))
+		}
+		return removed
+	}
+
+	cgroupOf := func() string {
+		for path := range written() {
+			if filepath.Base(path) == "cgroup.procs" {
+				return filepath.Dir(path)
+			}
+		}
+		return ""
+	}
+
+	Context("with the default limits", func() {
+		JustBeforeEach(func() {
+			createSuccessful(testEnv, driver, volumeName, opts)
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		})
+
+		It("places ceph-fuse into a cgroup of its own", func() {
+			group := cgroupOf()
+			Expect(group).To(HavePrefix("some-cgroups/ceph-fuse-"))
+			Expect(written()).To(Equal(map[string]string{
+				"some-cgroups/cgroup.subtree_control": "+memory +cpu",
+				group + "/memory.max":                 "536870912",
+				group + "/cpu.max":                    "max 100000",
+				group + "/cgroup.procs":               "1000",
+			}))
+		})
+
+		It("reports the usage of the cgroup", func() {
+			status := driver.Status(testEnv, cephlocal.StatusRequest{Name: volumeName}).Status
+			Expect(status.FuseMemoryLimit).To(Equal(int64(512 << 20)))
+			Expect(status.FuseUsage).To(Equal(cephlocal.FuseUsage{MemoryBytes: 100 << 20, CPUSeconds: 2.5, OOMKills: 1}))
+		})
+
+		It("removes the cgroup once ceph-fuse exits after the unmount", func() {
+			group := cgroupOf()
+			unmountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+			fakeLauncher.Process(0).Exit(nil)
+
+			Eventually(removed).Should(ContainElement(group))
+		})
+	})
+
+	Context("when the cgroup root is nested in the cgroup hierarchy", func() {
+		BeforeEach(func() {
+			cgroupMounts = "30 20 0:26 / /sys/fs/cgroup rw - cgroup2 cgroup2 rw\n"
+			config.Cgroups.Root = "/sys/fs/cgroup/system.slice/cephdriver"
+		})
+
+		It("enables the controllers in each group above the cgroup root", func() {
+			createSuccessful(testEnv, driver, volumeName, opts)
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+			enabled := []string{}
+			for i := 0; i < fakeIoutil.WriteFileCallCount(); i++ {
+				path, contents, _ := fakeIoutil.WriteFileArgsForCall(i)
+				if filepath.Base(path) == "cgroup.subtree_control" {
+					Expect(string(contents)).To(Equal("+memory +cpu"))
+					enabled = append(enabled, filepath.Dir(path))
+				}
+			}
+			Expect(enabled).To(Equal([]string{"/sys/fs/cgroup", "/sys/fs/cgroup/system.slice", "/sys/fs/cgroup/system.slice/cephdriver"}))
+		})
+	})
+
+	Context("when the volume overrides the limits", func() {
+		BeforeEach(func() {
+			opts["cpu_limit"] = 0.5
+			opts["memory_limit"] = "1G"
+		})
+
+		It("applies the volume's limits", func() {
+			createSuccessful(testEnv, driver, volumeName, opts)
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+			group := cgroupOf()
+			Expect(written()).To(HaveKeyWithValue(group+"/memory.max", "1073741824"))
+			Expect(written()).To(HaveKeyWithValue(group+"/cpu.max", "50000 100000"))
+		})
+	})
+
+	Context("without limits", func() {
+		BeforeEach(func() {
+			config.Cgroups = cephlocal.CgroupConfig{}
+		})
+
+		It("leaves ceph-fuse in the driver's cgroup", func() {
+			createSuccessful(testEnv, driver, volumeName, opts)
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+			Expect(written()).To(BeEmpty())
+			Expect(driver.Status(testEnv, cephlocal.StatusRequest{Name: volumeName}).Status.FuseUsage).To(Equal(cephlocal.FuseUsage{}))
+		})
+	})
+
+	Context("when ceph-fuse cannot be placed into its cgroup", func() {
+		BeforeEach(func() {
+			fakeIoutil.WriteFileStub = func(path string, _ []byte, _ os.FileMode) error {
+				if filepath.Base(path) == "cgroup.procs" {
+					return errors.New("permission denied")
+				}
+				return nil
+			}
+		})
+
+		It("fails the mount and stops ceph-fuse", func() {
+			createSuccessful(testEnv, driver, volumeName, opts)
+			mountResponse := driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: "container-1"})
+			Expect(mountResponse.Err).To(ContainSubstring("cgroup.procs (permission denied)"))
+			Expect(fakeLauncher.Process(0).exit).To(BeEmpty())
+			Expect(removed()).To(ContainElement(HavePrefix("some-cgroups/ceph-fuse-")))
+			Expect(driver.Status(testEnv, cephlocal.StatusRequest{Name: volumeName}).Status.FuseUsage).To(Equal(cephlocal.FuseUsage{}))
+		})
+	})
+
+	Context("when ceph-fuse exits before mounting", func() {
+		BeforeEach(func() {
+			fakeLauncher.exitEarly = true
+			mounting = false
+		})
+
+		It("fails the mount and removes the cgroup", func() {
+			createSuccessful(testEnv, driver, volumeName, opts)
+			mountResponse := driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: "container-1"})
+			Expect(mountResponse.Err).To(ContainSubstring("ceph-fuse exited before mounting"))
+			Expect(removed()).To(ContainElement(HavePrefix("some-cgroups/ceph-fuse-")))
+		})
+	})
+
+	Context("when ceph-fuse is not supervised", func() {
+		BeforeEach(func() {
+			config.Supervisor = cephlocal.SupervisorConfig{}
+			opts["memory_limit"] = "1G"
+		})
+
+		It("rejects per-volume limits", func() {
+			createResponse := driver.Create(testEnv, voldriver.CreateRequest{Name: volumeName, Opts: opts})
+			Expect(createResponse.Err).To(Equal("Unable to apply 'memory_limit' field in 'Opts': ceph-fuse is not supervised by the driver [INVALID_OPTS]"))
+		})
+	})
+})
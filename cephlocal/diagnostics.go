@@ -0,0 +1,224 @@
+package cephlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+)
+
+// ADMIN_SOCKET_DIR_NAME is the directory under the driver root in which each
+// ceph-fuse process gets its admin socket.
+const ADMIN_SOCKET_DIR_NAME = "sockets"
+
+// FUSE_DIAGNOSTICS_TTL is how long metrics reuse what the admin socket of a
+// ceph-fuse process answered.
+const FUSE_DIAGNOSTICS_TTL = 15 * time.Second
+
+type DiagnosticsRequest struct {
+	Name string
+}
+
+type MDSSession = cephdriver.MDSSession
+type FuseDiagnostics = cephdriver.FuseDiagnostics
+type VolumeDiagnostics = cephdriver.VolumeDiagnostics
+
+type DiagnosticsResponse struct {
+	Diagnostics VolumeDiagnostics
+	Err         string
+}
+
+// Diagnostics queries the admin socket of the ceph-fuse process mounting a
+// volume. The driver lock is not held while the socket answers.
+func (d *LocalDriver) Diagnostics(env voldriver.Env, diagnosticsRequest DiagnosticsRequest) DiagnosticsResponse {
+	logger := env.Logger().Session("diagnostics", lager.Data{"volume_name": diagnosticsRequest.Name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	socket, err := d.volumeAdminSocket(diagnosticsRequest.Name)
+	if err != nil {
+		logger.Info("diagnostics-unavailable", lager.Data{"error": err.Message})
+		return DiagnosticsResponse{Err: err.Encode()}
+	}
+
+	diagnostics, queryErr := d.queryFuse(socket)
+	if queryErr != nil {
+		logger.Error("failed-querying-admin-socket", queryErr, lager.Data{"admin_socket": socket})
+		return DiagnosticsResponse{Err: newError(ERR_ADMIN_SOCKET_FAILED, "Error querying the admin socket of '%s' (%s)", diagnosticsRequest.Name, queryErr.Error()).Encode()}
+	}
+
+	return DiagnosticsResponse{Diagnostics: VolumeDiagnostics{Name: diagnosticsRequest.Name, AdminSocket: socket, FuseDiagnostics: diagnostics}}
+}
+
+func (d *LocalDriver) volumeAdminSocket(name string) (string, *Error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	volume, ok := d.volumes[name]
+	if !ok {
+		return "", newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", name)
+	}
+
+	share, ok := d.shares[volume.ShareKey]
+	if !volume.mounted() || !ok {
+		return "", newError(ERR_NOT_MOUNTED, "Volume '%s' not mounted", name)
+	}
+
+	if share.AdminSocket == "" {
+		return "", newError(ERR_ADMIN_SOCKET_FAILED, "Volume '%s' was mounted without an admin socket", name)
+	}
+	return share.AdminSocket, nil
+}
+
+// adminSocketArgs gives the ceph-fuse process of a share an admin socket in
+// the driver's socket directory. The directory is only accessible to the
+// driver, since the admin socket also accepts commands that change the
+// client's configuration.
+func (d *LocalDriver) adminSocketArgs(logger lager.Logger, share *shareMetadata) []string {
+	if d.adminSocketDir == "" {
+		return nil
+	}
+
+	if err := d.os.MkdirAll(d.adminSocketDir, 0700); err != nil {
+		logger.Error("failed-creating-admin-socket-dir", err)
+		return nil
+	}
+
+	share.AdminSocket = filepath.Join(d.adminSocketDir, fmt.Sprintf("ceph-fuse-%s.asok", share.Key))
+	return []string{"--admin-socket", share.AdminSocket}
+}
+
+// shareAdminSockets lists the admin sockets of the mounted shares by share key.
+func (d *LocalDriver) shareAdminSockets() map[string]string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	sockets := map[string]string{}
+	for key, share := range d.shares {
+		if share.AdminSocket != "" {
+			sockets[key] = share.AdminSocket
+		}
+	}
+	return sockets
+}
+
+// cachedDiagnostics is what the admin socket of a share answered, or failed
+// to, at a time.
+type cachedDiagnostics struct {
+	diagnostics FuseDiagnostics
+	err         error
+	at          time.Time
+}
+
+// cachedFuseDiagnostics returns the diagnostics of each share with an admin
+// socket, querying at once the sockets whose last answer is older than
+// FUSE_DIAGNOSTICS_TTL, so that a scrape neither queries every ceph-fuse
+// each time nor waits for them one after the other. The driver lock is not
+// held while the sockets answer.
+func (d *LocalDriver) cachedFuseDiagnostics() map[string]cachedDiagnostics {
+	sockets := d.shareAdminSockets()
+
+	d.diagnosticsLock.Lock()
+	defer d.diagnosticsLock.Unlock()
+
+	cache := map[string]cachedDiagnostics{}
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	for key, socket := range sockets {
+		if cached, ok := d.diagnostics[key]; ok && time.Since(cached.at) < FUSE_DIAGNOSTICS_TTL {
+			cache[key] = cached
+			continue
+		}
+
+		wg.Add(1)
+		go func(key, socket string) {
+			defer wg.Done()
+			diagnostics, err := d.queryFuse(socket)
+
+			lock.Lock()
+			defer lock.Unlock()
+			cache[key] = cachedDiagnostics{diagnostics: diagnostics, err: err, at: time.Now()}
+		}(key, socket)
+	}
+	wg.Wait()
+
+	d.diagnostics = cache
+	return cache
+}
+
+type clientStatus struct {
+	ID          int64 `json:"id"`
+	InodeCount  int64 `json:"inode_count"`
+	DentryCount int64 `json:"dentry_count"`
+	Blacklisted bool  `json:"blacklisted"`
+	Blocklisted bool  `json:"blocklisted"`
+}
+
+type mdsSessions struct {
+	Sessions []MDSSession `json:"sessions"`
+}
+
+func (d *LocalDriver) queryFuse(socket string) (FuseDiagnostics, error) {
+	diagnostics := FuseDiagnostics{MDSSessions: []MDSSession{}, PerfCounters: map[string]float64{}}
+
+	status := clientStatus{}
+	if err := d.adminSocketCommand(socket, "status", &status); err != nil {
+		return FuseDiagnostics{}, err
+	}
+	diagnostics.ClientID = status.ID
+	diagnostics.Blocklisted = status.Blacklisted || status.Blocklisted
+	diagnostics.InodeCount = status.InodeCount
+	diagnostics.DentryCount = status.DentryCount
+
+	sessions := mdsSessions{}
+	if err := d.adminSocketCommand(socket, "mds_sessions", &sessions); err != nil {
+		return FuseDiagnostics{}, err
+	}
+	if sessions.Sessions != nil {
+		diagnostics.MDSSessions = sessions.Sessions
+	}
+	sort.Slice(diagnostics.MDSSessions, func(i, j int) bool { return diagnostics.MDSSessions[i].MDS < diagnostics.MDSSessions[j].MDS })
+
+	perf := map[string]interface{}{}
+	if err := d.adminSocketCommand(socket, "perf dump", &perf); err != nil {
+		return FuseDiagnostics{}, err
+	}
+	flattenCounters("", perf, diagnostics.PerfCounters)
+
+	return diagnostics, nil
+}
+
+func (d *LocalDriver) adminSocketCommand(socket string, prefix string, response interface{}) error {
+	output, err := d.adminSocket.Command(socket, prefix)
+	if err != nil {
+		return fmt.Errorf("%s: %s", prefix, err.Error())
+	}
+	if err := json.Unmarshal(output, response); err != nil {
+		return fmt.Errorf("%s: %s", prefix, err.Error())
+	}
+	return nil
+}
+
+// flattenCounters collects the numbers in a perf dump, which nests counters
+// in sections and averages in objects of their own, under dotted names.
+func flattenCounters(prefix string, values map[string]interface{}, counters map[string]float64) {
+	for name, value := range values {
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		switch v := value.(type) {
+		case float64:
+			counters[name] = v
+		case map[string]interface{}:
+			flattenCounters(name, v, counters)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package cephlocal_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeAdminSocket struct {
+	lock      sync.Mutex
+	responses map[string]string
+	err       error
+	commands  []string
+}
+
+func (s *fakeAdminSocket) Command(path string, prefix string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.commands = append(s.commands, prefix)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []byte(s.responses[prefix]), nil
+}
+
+var _ = Describe("Diagnostics", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		adminSocket *fakeAdminSocket
+		testEnv     voldriver.Env
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		adminSocket = &fakeAdminSocket{responses: map[string]string{
+			"status":       `{"id": 4157, "inode_count": 120, "dentry_count": 118, "blacklisted": false, "mds_epoch": 12}`,
+			"mds_sessions": `{"id": 4157, "sessions": [{"mds": 1, "state": "opening", "num_caps": 0}, {"mds": 0, "state": "open", "num_caps": 42, "seq": 7}]}`,
+			"perf dump":    `{"client": {"reply": {"avgcount": 10, "sum": 0.5, "avgtime": 0.05}, "inodes": 120}, "objectcacher-libcephfs": {"cache_ops_hit": 3}}`,
+		}}
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("DiagnosticsTest"), context.TODO())
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{
+			RootDir:        "some-root",
+			AdminSocketDir: "some-root/sockets",
+			AdminSocket:    adminSocket,
+		})
+
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+	})
+
+	Context("when the volume is mounted", func() {
+		BeforeEach(func() {
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		})
+
+		It("gives ceph-fuse an admin socket", func() {
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args[0]).To(Equal("--admin-socket"))
+			Expect(args[1]).To(MatchRegexp(`^some-root/sockets/ceph-fuse-[0-9a-f]+\.asok$`))
+		})
+
+		It("reports the client, its MDS sessions and its perf counters", func() {
+			response := driver.Diagnostics(testEnv, cephlocal.DiagnosticsRequest{Name: volumeName})
+			Expect(response.Err).To(BeEmpty())
+
+			diagnostics := response.Diagnostics
+			Expect(diagnostics.Name).To(Equal(volumeName))
+			Expect(diagnostics.AdminSocket).To(HavePrefix("some-root/sockets/"))
+			Expect(diagnostics.ClientID).To(Equal(int64(4157)))
+			Expect(diagnostics.Blocklisted).To(BeFalse())
+			Expect(diagnostics.InodeCount).To(Equal(int64(120)))
+			Expect(diagnostics.DentryCount).To(Equal(int64(118)))
+			Expect(diagnostics.MDSSessions).To(Equal([]cephlocal.MDSSession{{MDS: 0, State: "open", NumCaps: 42}, {MDS: 1, State: "opening"}}))
+			Expect(diagnostics.PerfCounters).To(Equal(map[string]float64{
+				"client.reply.avgcount":                float64(10),
+				"client.reply.sum":                     0.5,
+				"client.reply.avgtime":                 0.05,
+				"client.inodes":                        float64(120),
+				"objectcacher-libcephfs.cache_ops_hit": float64(3),
+			}))
+		})
+
+		scrape := func(metrics *cephlocal.Metrics) string {
+			recorder := httptest.NewRecorder()
+			metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			return recorder.Body.String()
+		}
+
+		It("feeds the counters into the metrics", func() {
+			metrics := cephlocal.NewMetrics()
+			metrics.CollectDriver(driver)
+			body := scrape(metrics)
+
+			Expect(body).To(MatchRegexp(`cephdriver_fuse_admin_socket_up\{share="[0-9a-f]+"\} 1`))
+			Expect(body).To(MatchRegexp(`cephdriver_fuse_mds_sessions\{share="[0-9a-f]+",state="open"\} 1`))
+			Expect(body).To(MatchRegexp(`cephdriver_fuse_caps\{share="[0-9a-f]+"\} 42`))
+			Expect(body).To(MatchRegexp(`cephdriver_fuse_cached_inodes\{share="[0-9a-f]+"\} 120`))
+			Expect(body).To(ContainSubstring("# TYPE cephdriver_fuse_mds_replies_total counter"))
+			Expect(body).To(MatchRegexp(`cephdriver_fuse_mds_replies_total\{share="[0-9a-f]+"\} 10`))
+			Expect(body).To(MatchRegexp(`cephdriver_fuse_cache_hits_total\{share="[0-9a-f]+"\} 3`))
+			Expect(body).NotTo(ContainSubstring("client.inodes"))
+			Expect(body).NotTo(ContainSubstring("cephdriver_fuse_cache_misses_total"))
+		})
+
+		It("reuses what the admin socket answered across scrapes", func() {
+			metrics := cephlocal.NewMetrics()
+			metrics.CollectDriver(driver)
+			scrape(metrics)
+			queries := len(adminSocket.commands)
+
+			Expect(scrape(metrics)).To(MatchRegexp(`cephdriver_fuse_caps\{share="[0-9a-f]+"\} 42`))
+			Expect(adminSocket.commands).To(HaveLen(queries))
+		})
+
+		Context("when the admin socket does not answer", func() {
+			BeforeEach(func() {
+				adminSocket.err = errors.New("connection refused")
+			})
+
+			It("errors", func() {
+				response := driver.Diagnostics(testEnv, cephlocal.DiagnosticsRequest{Name: volumeName})
+				Expect(response.Err).To(Equal("Error querying the admin socket of 'volume-name' (status: connection refused) [ADMIN_SOCKET_FAILED]"))
+			})
+		})
+	})
+
+	Context("when the volume is not mounted", func() {
+		It("errors", func() {
+			response := driver.Diagnostics(testEnv, cephlocal.DiagnosticsRequest{Name: volumeName})
+			Expect(response.Err).To(Equal("Volume 'volume-name' not mounted [NOT_MOUNTED]"))
+		})
+	})
+})
+
+var _ = Describe("AdminSocket", func() {
+	var (
+		tmpDir   string
+		listener net.Listener
+		received chan string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "admin-socket-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		listener, err = net.Listen("unix", filepath.Join(tmpDir, "ceph-fuse.asok"))
+		Expect(err).NotTo(HaveOccurred())
+
+		received = make(chan string, 1)
+		go func(listener net.Listener, received chan<- string) {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			request := []byte{}
+			buf := make([]byte, 1)
+			for {
+				_, err := conn.Read(buf)
+				Expect(err).NotTo(HaveOccurred())
+				if buf[0] == 0 {
+					break
+				}
+				request = append(request, buf[0])
+			}
+			received <- string(request)
+
+			response := []byte(`{"id": 4157}`)
+			Expect(binary.Write(conn, binary.BigEndian, uint32(len(response)))).To(Succeed())
+			_, err = conn.Write(response)
+			Expect(err).NotTo(HaveOccurred())
+		}(listener, received)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("sends the command and reads the length-prefixed response", func() {
+		output, err := cephlocal.NewAdminSocket(time.Second).Command(filepath.Join(tmpDir, "ceph-fuse.asok"), "status")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(output)).To(Equal(`{"id": 4157}`))
+		Expect(<-received).To(Equal(`{"prefix":"status"}`))
+	})
+
+	It("fails when nothing listens on the socket", func() {
+		_, err := cephlocal.NewAdminSocket(time.Second).Command(filepath.Join(tmpDir, "missing.asok"), "status")
+		Expect(err).To(HaveOccurred())
+	})
+})
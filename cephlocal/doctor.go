@@ -0,0 +1,297 @@
+package cephlocal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/invoker"
+)
+
+const (
+	PROC_FILESYSTEMS = "/proc/filesystems"
+	PROC_MOUNTINFO   = "/proc/self/mountinfo"
+	PROC_DIR         = "/proc"
+)
+
+const CEPH_FUSE_FSTYPE = "fuse.ceph-fuse"
+
+const DEFAULT_DOCTOR_TIMEOUT = 5 * time.Second
+
+type DoctorConfig struct {
+	RootDir  string
+	Monitors []string
+	Timeout  time.Duration
+}
+
+type Dialer func(network, address string, timeout time.Duration) (net.Conn, error)
+
+// Doctor runs the preflight checks an operator would otherwise do by hand on
+// a cell where mounts fail. It looks at the cell through the same shims as a
+// driver using the same root directory, and reads that driver's state file.
+type Doctor struct {
+	driver   *LocalDriver
+	dial     Dialer
+	monitors []string
+	timeout  time.Duration
+}
+
+func NewDoctor(config DoctorConfig) *Doctor {
+	return NewDoctorWithInvokerAndSystemUtil(invoker.NewRealInvoker(), &osshim.OsShim{}, &ioutilshim.IoutilShim{}, net.DialTimeout, config)
+}
+
+func NewDoctorWithInvokerAndSystemUtil(invoker invoker.Invoker, os osshim.Os, ioutil ioutilshim.Ioutil, dial Dialer, config DoctorConfig) *Doctor {
+	rootDir := config.RootDir
+	if rootDir == "" {
+		rootDir = DEFAULT_ROOT_DIR
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_DOCTOR_TIMEOUT
+	}
+
+	return &Doctor{
+		driver: NewLocalDriverWithInvokerAndSystemUtil(invoker, os, ioutil, LocalDriverConfig{
+			RootDir:   rootDir,
+			StateFile: filepath.Join(rootDir, STATE_FILE_NAME),
+		}),
+		dial:     dial,
+		monitors: config.Monitors,
+		timeout:  timeout,
+	}
+}
+
+func (doc *Doctor) Run(env voldriver.Env) HealthReport {
+	logger := env.Logger().Session("doctor")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	checks := []HealthCheck{
+		doc.checkFuseModule(),
+		doc.checkFuseDevice(),
+		doc.checkCephFuse(env),
+		doc.driver.checkExecutable(FUSERMOUNT_CMD),
+		doc.checkKeyDirectory(),
+	}
+	for _, monitor := range doc.monitors {
+		checks = append(checks, doc.checkMonitor(monitor))
+	}
+	checks = append(checks, doc.checkStateFile(env))
+
+	report := HealthReport{Healthy: true}
+	for _, check := range checks {
+		if !check.Healthy {
+			logger.Info("failed-check", lager.Data{"check": check.Name, "message": check.Message})
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	return report
+}
+
+func (doc *Doctor) checkFuseModule() HealthCheck {
+	check := HealthCheck{Name: "fuse_module"}
+
+	contents, err := doc.driver.ioutil.ReadFile(PROC_FILESYSTEMS)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == "fuse" {
+			check.Healthy = true
+			return check
+		}
+	}
+	check.Message = fmt.Sprintf("fuse is not listed in %s; is the fuse kernel module loaded?", PROC_FILESYSTEMS)
+	return check
+}
+
+func (doc *Doctor) checkFuseDevice() HealthCheck {
+	check := HealthCheck{Name: "fuse_device"}
+
+	info, err := doc.driver.os.Stat(FUSE_DEVICE)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	if info == nil || info.Mode()&os.ModeCharDevice == 0 {
+		check.Message = fmt.Sprintf("%s is not a character device", FUSE_DEVICE)
+		return check
+	}
+
+	check = doc.driver.checkFuseDevice()
+	if check.Healthy {
+		check.Message = info.Mode().String()
+	}
+	return check
+}
+
+func (doc *Doctor) checkCephFuse(env voldriver.Env) HealthCheck {
+	check := doc.driver.checkExecutable(MOUNT_CMD)
+	if !check.Healthy {
+		return check
+	}
+
+	output, err := doc.driver.useInvoker.Invoke(env, MOUNT_CMD, []string{"--version"})
+	if err != nil {
+		check.Healthy = false
+		check.Message = fmt.Sprintf("%s --version failed (%s)", MOUNT_CMD, err.Error())
+		return check
+	}
+	check.Message = strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	return check
+}
+
+// checkKeyDirectory makes sure keyrings can be written to KEY_DIR and that
+// other users cannot replace them there.
+func (doc *Doctor) checkKeyDirectory() HealthCheck {
+	check := HealthCheck{Name: "key_directory"}
+
+	info, err := doc.driver.os.Stat(KEY_DIR)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	if info == nil || !info.IsDir() {
+		check.Message = fmt.Sprintf("%s is not a directory", KEY_DIR)
+		return check
+	}
+	if info.Mode()&0002 != 0 && info.Mode()&os.ModeSticky == 0 {
+		check.Message = fmt.Sprintf("%s is world writable without the sticky bit (%s)", KEY_DIR, info.Mode().String())
+		return check
+	}
+
+	probe := filepath.Join(KEY_DIR, fmt.Sprintf("keypath_doctor_%d", time.Now().UnixNano()))
+	if err := doc.driver.ioutil.WriteFile(probe, []byte{}, 0600); err != nil {
+		check.Message = fmt.Sprintf("unable to write keyrings to %s (%s)", KEY_DIR, err.Error())
+		return check
+	}
+	doc.driver.os.Remove(probe)
+
+	check.Healthy = true
+	check.Message = info.Mode().String()
+	return check
+}
+
+func (doc *Doctor) checkMonitor(monitor string) HealthCheck {
+	check := HealthCheck{Name: "monitor " + monitor}
+
+	address := monitor
+	if _, _, err := net.SplitHostPort(monitor); err != nil {
+		address = net.JoinHostPort(monitor, strconv.Itoa(cephdriver.DEFAULT_MONITOR_PORT))
+	}
+
+	conn, err := doc.dial("tcp", address, doc.timeout)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	conn.Close()
+
+	check.Healthy = true
+	check.Message = address
+	return check
+}
+
+// checkStateFile compares the mounts recorded in the state file with the
+// kernel's mount table: every share must be a ceph-fuse mount, every holder
+// must have its bind mount, and no ceph-fuse mount under the shares
+// directory may be unknown to the driver.
+func (doc *Doctor) checkStateFile(env voldriver.Env) HealthCheck {
+	check := HealthCheck{Name: "state_file"}
+
+	if err := doc.driver.loadState(env.Logger()); err != nil {
+		check.Message = fmt.Sprintf("unable to read %s (%s)", doc.driver.stateFile, err.Error())
+		return check
+	}
+
+	contents, err := doc.driver.ioutil.ReadFile(PROC_MOUNTINFO)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	mounts := parseMountInfo(string(contents))
+
+	problems := []string{}
+	shareMountPoints := map[string]bool{}
+	for _, share := range doc.driver.shares {
+		shareMountPoints[share.MountPoint] = true
+		if mounts[share.MountPoint] != CEPH_FUSE_FSTYPE {
+			problems = append(problems, fmt.Sprintf("share %s is not mounted", share.MountPoint))
+		}
+	}
+	for name, volume := range doc.driver.volumes {
+		for _, holderID := range volume.holderIDs() {
+			if _, ok := mounts[volume.bindPath(holderID)]; !ok {
+				problems = append(problems, fmt.Sprintf("volume %s is not bound for holder %s", name, holderID))
+			}
+		}
+	}
+
+	sharesDir := filepath.Join(doc.driver.rootDir, "shares") + string(filepath.Separator)
+	for mountPoint, fsType := range mounts {
+		if fsType != CEPH_FUSE_FSTYPE || !strings.HasPrefix(mountPoint, sharesDir) {
+			continue
+		}
+		if !shareMountPoints[mountPoint] {
+			problems = append(problems, fmt.Sprintf("share %s is mounted but not in the state file", mountPoint))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		check.Message = strings.Join(problems, "; ")
+		return check
+	}
+
+	check.Healthy = true
+	check.Message = fmt.Sprintf("%d volumes, %d shares", len(doc.driver.volumes), len(doc.driver.shares))
+	return check
+}
+
+// parseMountInfo maps the mount points in a /proc/<pid>/mountinfo table to
+// their filesystem types.
+func parseMountInfo(contents string) map[string]string {
+	mounts := map[string]string{}
+	for _, line := range strings.Split(contents, "\n") {
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "-" && len(fields) > 4 && i+1 < len(fields) {
+				mounts[unescapeMountInfo(fields[4])] = fields[i+1]
+				break
+			}
+		}
+	}
+	return mounts
+}
+
+// unescapeMountInfo decodes the octal escapes the kernel uses for spaces,
+// tabs, newlines and backslashes in mount points.
+func unescapeMountInfo(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package cephlocal_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Doctor", func() {
+	const state = `{"volumes":{"volume-name":{"LocalMountPoint":"/root/volumes/volume-name","Holders":{"container-1":true},"ShareKey":"abc"}},"shares":{"abc":{"Key":"abc","MountPoint":"/root/shares/abc"}}}`
+
+	var (
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeOs      *os_fake.FakeOs
+		fakeIoutil  *ioutil_fake.FakeIoutil
+		testEnv     voldriver.Env
+		files       map[string]string
+		dialed      []string
+		dialErr     error
+		monitors    []string
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeOs = new(os_fake.FakeOs)
+		fakeIoutil = new(ioutil_fake.FakeIoutil)
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("DoctorTest"), context.TODO())
+		dialed = nil
+		dialErr = nil
+		monitors = nil
+
+		files = map[string]string{
+			"/proc/filesystems": "nodev\tsysfs\nnodev\tfuse\n",
+			"/proc/self/mountinfo": "100 20 0:50 / /root/shares/abc rw,nosuid - fuse.ceph-fuse ceph-fuse rw\n" +
+				"101 20 0:50 / /root/volumes/volume-name/container-1 rw - fuse.ceph-fuse ceph-fuse rw\n",
+			"/root/state.json": state,
+		}
+		fakeIoutil.ReadFileStub = func(path string) ([]byte, error) {
+			if contents, ok := files[path]; ok {
+				return []byte(contents), nil
+			}
+			return nil, os.ErrNotExist
+		}
+
+		fakeOs.IsNotExistStub = os.IsNotExist
+		fakeOs.GetenvReturns("/usr/bin")
+		fakeOs.StatStub = func(path string) (os.FileInfo, error) {
+			switch path {
+			case "/dev/fuse":
+				return fileInfo{mode: os.ModeDevice | os.ModeCharDevice | 0666}, nil
+			case "/tmp":
+				return fileInfo{mode: os.ModeDir | os.ModeSticky | 0777}, nil
+			}
+			return fileInfo{mode: 0755}, nil
+		}
+		fakeInvoker.InvokeReturns([]byte("ceph version 10.2.3\n"), nil)
+	})
+
+	run := func() (cephlocal.HealthReport, map[string]cephlocal.HealthCheck) {
+		dial := func(network, address string, timeout time.Duration) (net.Conn, error) {
+			dialed = append(dialed, address)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+		doctor := cephlocal.NewDoctorWithInvokerAndSystemUtil(fakeInvoker, fakeOs, fakeIoutil, dial, cephlocal.DoctorConfig{RootDir: "/root", Monitors: monitors})
+		report := doctor.Run(testEnv)
+
+		byName := map[string]cephlocal.HealthCheck{}
+		for _, check := range report.Checks {
+			byName[check.Name] = check
+		}
+		return report, byName
+	}
+
+	It("passes on a healthy cell", func() {
+		report, checks := run()
+		Expect(report.Healthy).To(BeTrue())
+		Expect(checks["ceph-fuse"].Message).To(Equal("ceph version 10.2.3"))
+		Expect(checks["state_file"].Message).To(Equal("1 volumes, 1 shares"))
+	})
+
+	It("fails without the fuse kernel module", func() {
+		files["/proc/filesystems"] = "nodev\tsysfs\n"
+		_, checks := run()
+		Expect(checks["fuse_module"].Healthy).To(BeFalse())
+	})
+
+	It("fails when the key directory is world writable without the sticky bit", func() {
+		fakeOs.StatStub = nil
+		fakeOs.StatReturns(fileInfo{mode: os.ModeDir | 0777}, nil)
+		_, checks := run()
+		Expect(checks["key_directory"].Message).To(Equal("/tmp is world writable without the sticky bit (drwxrwxrwx)"))
+	})
+
+	It("checks every monitor, on the default port when none is given", func() {
+		monitors = []string{"10.0.0.1", "10.0.0.2:3300"}
+		_, checks := run()
+		Expect(dialed).To(Equal([]string{"10.0.0.1:6789", "10.0.0.2:3300"}))
+		Expect(checks["monitor 10.0.0.1"].Healthy).To(BeTrue())
+
+		dialErr = errors.New("i/o timeout")
+		report, checks := run()
+		Expect(report.Healthy).To(BeFalse())
+		Expect(checks["monitor 10.0.0.2:3300"].Message).To(Equal("i/o timeout"))
+	})
+
+	Context("when the state file and the mount table disagree", func() {
+		BeforeEach(func() {
+			files["/proc/self/mountinfo"] = "102 20 0:51 / /root/shares/def rw - fuse.ceph-fuse ceph-fuse rw\n"
+		})
+
+		It("lists missing and unknown mounts", func() {
+			_, checks := run()
+			Expect(checks["state_file"].Healthy).To(BeFalse())
+			Expect(checks["state_file"].Message).To(Equal("share /root/shares/abc is not mounted; share /root/shares/def is mounted but not in the state file; volume volume-name is not bound for holder container-1"))
+		})
+	})
+
+	It("decodes escaped mount points", func() {
+		files["/root/state.json"] = `{"shares":{"abc":{"Key":"abc","MountPoint":"/root/shares/a b"}}}`
+		files["/proc/self/mountinfo"] = "100 20 0:50 / /root/shares/a\\040b rw - fuse.ceph-fuse ceph-fuse rw\n"
+		_, checks := run()
+		Expect(checks["state_file"].Message).To(Equal("0 volumes, 1 shares"))
+	})
+})
@@ -0,0 +1,77 @@
+package cephlocal
+
+import (
+	"context"
+	"regexp"
+
+	"code.cloudfoundry.org/cephdriver"
+)
+
+// The error codes and their encoding live in the cephdriver package, so that
+// clients can decode driver errors without importing the driver.
+type ErrorCode = cephdriver.ErrorCode
+
+const (
+	ERR_INVALID_VOLUME_NAME = cephdriver.ERR_INVALID_VOLUME_NAME
+	ERR_INVALID_HOLDER_ID   = cephdriver.ERR_INVALID_HOLDER_ID
+	ERR_INVALID_OPTS        = cephdriver.ERR_INVALID_OPTS
+	ERR_INVALID_KEYRING     = cephdriver.ERR_INVALID_KEYRING
+	ERR_VOLUME_NOT_FOUND    = cephdriver.ERR_VOLUME_NOT_FOUND
+	ERR_VOLUME_CONFLICT     = cephdriver.ERR_VOLUME_CONFLICT
+	ERR_NOT_MOUNTED         = cephdriver.ERR_NOT_MOUNTED
+	ERR_AUTH_FAILED         = cephdriver.ERR_AUTH_FAILED
+	ERR_MOUNT_TIMEOUT       = cephdriver.ERR_MOUNT_TIMEOUT
+	ERR_MOUNT_FAILED        = cephdriver.ERR_MOUNT_FAILED
+	ERR_MOUNT_PENDING       = cephdriver.ERR_MOUNT_PENDING
+	ERR_UNMOUNT_FAILED      = cephdriver.ERR_UNMOUNT_FAILED
+	ERR_REMOUNT_FAILED      = cephdriver.ERR_REMOUNT_FAILED
+	ERR_ADMIN_SOCKET_FAILED = cephdriver.ERR_ADMIN_SOCKET_FAILED
+	ERR_OVERLOADED          = cephdriver.ERR_OVERLOADED
+	ERR_TOO_MANY_MOUNTS     = cephdriver.ERR_TOO_MANY_MOUNTS
+	ERR_UNKNOWN             = cephdriver.ERR_UNKNOWN
+)
+
+type Error = cephdriver.Error
+
+func IsRetryable(code ErrorCode) bool {
+	return cephdriver.IsRetryable(code)
+}
+
+func DecodeError(encoded string) *Error {
+	return cephdriver.DecodeError(encoded)
+}
+
+func newError(code ErrorCode, format string, args ...interface{}) *Error {
+	return cephdriver.NewError(code, format, args...)
+}
+
+// wrapError returns an error with the given message for a failure caused by
+// err, keeping the code of err when it has one.
+func wrapError(err error, code ErrorCode, format string, args ...interface{}) *Error {
+	if cause, ok := err.(*Error); ok {
+		code = cause.Code
+	}
+	return newError(code, format, args...)
+}
+
+var (
+	cephTimeoutPattern = regexp.MustCompile(`(?i)timed out|timeout`)
+	// cephAuthPattern matches the ways ceph-fuse reports the monitors
+	// rejecting its key, and not its failures to use local files, such as
+	// the keyring file or the mount point.
+	cephAuthPattern = regexp.MustCompile(`(?i)authentication error|error -13\b|\bEACCES\b|-1 \(EPERM\)|mount failed with \((1|13)\) (operation not permitted|permission denied)`)
+)
+
+// cephError classifies a failed ceph-fuse invocation by its output, so that
+// an unreachable cluster can be told apart from a key it rejects.
+func cephError(ctx context.Context, output []byte, err error) error {
+	code := ERR_MOUNT_FAILED
+	details := string(output) + " " + err.Error()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded || cephTimeoutPattern.MatchString(details):
+		code = ERR_MOUNT_TIMEOUT
+	case cephAuthPattern.MatchString(details):
+		code = ERR_AUTH_FAILED
+	}
+	return &Error{Code: code, Message: err.Error(), Retryable: IsRetryable(code)}
+}
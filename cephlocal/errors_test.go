@@ -0,0 +1,101 @@
+package cephlocal_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Errors", func() {
+	Describe("ceph-fuse failures", func() {
+		var (
+			driver      *cephlocal.LocalDriver
+			fakeInvoker *voldriverfakes.FakeInvoker
+			testEnv     voldriver.Env
+		)
+
+		BeforeEach(func() {
+			fakeInvoker = new(voldriverfakes.FakeInvoker)
+			testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("ErrorsTest"), context.TODO())
+			driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root"})
+			createSuccessful(testEnv, driver, "volume-name", map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "/"})
+		})
+
+		mountError := func() *cephlocal.Error {
+			return cephlocal.DecodeError(driver.Mount(testEnv, voldriver.MountRequest{Name: "volume-name", ID: "container-1"}).Err)
+		}
+
+		It("reports a rejected key as an authentication failure", func() {
+			fakeInvoker.InvokeReturns([]byte("ceph mount failed with (1) Operation not permitted"), errors.New("exit status 1"))
+
+			err := mountError()
+			Expect(err.Code).To(Equal(cephlocal.ERR_AUTH_FAILED))
+			Expect(err.Retryable).To(BeFalse())
+			Expect(err.Message).To(Equal("Error mounting 'volume-name' (exit status 1)"))
+		})
+
+		It("reports the other ways ceph-fuse tells of a rejected key as authentication failures", func() {
+			for _, output := range []string{
+				"ceph mount failed with (13) Permission denied",
+				"monclient(hunting): authentication error (13) Permission denied",
+				"monclient: authenticate failed: error -13",
+				"auth: handshake with mon.a failed: EACCES",
+				"monclient(hunting): handle_auth_reply_more returned -1 (EPERM)",
+			} {
+				fakeInvoker.InvokeReturns([]byte(output), errors.New("exit status 1"))
+				Expect(mountError().Code).To(Equal(cephlocal.ERR_AUTH_FAILED), output)
+			}
+		})
+
+		It("does not report failures to use local files as authentication failures", func() {
+			for _, output := range []string{
+				"fuse: bad mount point `some-root/shares/author-uploads': No such file or directory",
+				"auth: unable to find a keyring on /etc/ceph/keyring: (2) No such file or directory",
+				"failed to write keyring /var/vcap/data/keyring: (13) Permission denied",
+				"fusermount: failed to open /dev/fuse: Operation not permitted",
+				"fuse: failed to open /etc/fuse.conf: Permission denied",
+			} {
+				fakeInvoker.InvokeReturns([]byte(output), errors.New("exit status 1"))
+				Expect(mountError().Code).To(Equal(cephlocal.ERR_MOUNT_FAILED), output)
+			}
+		})
+
+		It("reports an unreachable cluster as a timeout", func() {
+			fakeInvoker.InvokeReturns([]byte("ceph mount failed with (110) Connection timed out"), errors.New("exit status 1"))
+
+			err := mountError()
+			Expect(err.Code).To(Equal(cephlocal.ERR_MOUNT_TIMEOUT))
+			Expect(err.Retryable).To(BeTrue())
+		})
+
+		It("reports an expired request as a timeout", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+			defer cancel()
+			<-ctx.Done()
+			testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("ErrorsTest"), ctx)
+			fakeInvoker.InvokeReturns(nil, errors.New("signal: killed"))
+
+			Expect(mountError().Code).To(Equal(cephlocal.ERR_MOUNT_TIMEOUT))
+		})
+
+		It("reports other failures as retryable mount failures", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("exit status 1"))
+
+			err := mountError()
+			Expect(err.Code).To(Equal(cephlocal.ERR_MOUNT_FAILED))
+			Expect(err.Retryable).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,278 @@
+package cephlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/lager"
+)
+
+const DEFAULT_EVENT_BUFFER = 256
+
+const ADMIN_EVENTS_PATH = cephdriver.ADMIN_EVENTS_PATH
+
+const (
+	EVENT_MOUNT         = "mount"
+	EVENT_UNMOUNT       = "unmount"
+	EVENT_FORCE_UNMOUNT = "force_unmount"
+	EVENT_REMOUNT       = "remount"
+	EVENT_IDLE_UNMOUNT  = "idle_unmount"
+	EVENT_STALE         = "stale"
+	EVENT_EVICTED       = "evicted"
+)
+
+const (
+	OUTCOME_SUCCEEDED = "succeeded"
+	OUTCOME_FAILED    = "failed"
+	OUTCOME_DETECTED  = "detected"
+	OUTCOME_RECOVERED = "recovered"
+)
+
+type Event = cephdriver.Event
+
+// EventSubscription receives the events of a driver into a buffer of its
+// own. Events that arrive while the buffer is full are dropped rather than
+// holding up the driver; those the subscription keeps are set aside instead,
+// for its reader to take with Missed.
+type EventSubscription struct {
+	hub     *eventHub
+	events  chan Event
+	dropped int
+	keep    func(Event) bool
+	missed  []Event
+}
+
+type eventHub struct {
+	lock        sync.Mutex
+	buffer      int
+	sequence    uint64
+	subscribers map[*EventSubscription]bool
+	dropped     int
+
+	// stale holds the share mount points last seen stale.
+	stale map[string]bool
+}
+
+func newEventHub(buffer int) *eventHub {
+	if buffer <= 0 {
+		buffer = DEFAULT_EVENT_BUFFER
+	}
+	return &eventHub{buffer: buffer, subscribers: map[*EventSubscription]bool{}, stale: map[string]bool{}}
+}
+
+// SubscribeEvents starts receiving the events of the driver. The
+// subscription must be closed once it is no longer read.
+func (d *LocalDriver) SubscribeEvents() *EventSubscription {
+	return d.subscribeEvents(nil)
+}
+
+// subscribeEvents subscribes to the events of the driver, setting aside the
+// dropped events for which keep returns true.
+func (d *LocalDriver) subscribeEvents(keep func(Event) bool) *EventSubscription {
+	h := d.events
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := &EventSubscription{hub: h, events: make(chan Event, h.buffer), keep: keep}
+	h.subscribers[s] = true
+	return s
+}
+
+// Events is closed when the subscription is.
+func (s *EventSubscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped is the number of events this subscription missed.
+func (s *EventSubscription) Dropped() int {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+	return s.dropped
+}
+
+// Missed returns the dropped events the subscription kept since it was
+// last called.
+func (s *EventSubscription) Missed() []Event {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+
+	missed := s.missed
+	s.missed = nil
+	return missed
+}
+
+func (s *EventSubscription) Close() {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+
+	if s.hub.subscribers[s] {
+		delete(s.hub.subscribers, s)
+		close(s.events)
+	}
+}
+
+// publish hands an event to every subscriber without waiting for any of
+// them, so it is safe to call with the driver lock held.
+func (d *LocalDriver) publish(event Event) {
+	h := d.events
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.sequence++
+	event.Sequence = h.sequence
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	for s := range h.subscribers {
+		select {
+		case s.events <- event:
+		default:
+			s.dropped++
+			h.dropped++
+			if s.keep != nil && s.keep(event) {
+				s.missed = append(s.missed, event)
+			}
+		}
+	}
+}
+
+// publishOperation publishes the outcome of an operation that started at
+// started and answered with the encoded error errString.
+func (d *LocalDriver) publishOperation(operation string, volumeName string, holderID string, started time.Time, errString string) {
+	event := Event{
+		Volume:    volumeName,
+		Operation: operation,
+		Outcome:   OUTCOME_SUCCEEDED,
+		Holder:    holderID,
+		Duration:  time.Since(started).Seconds(),
+	}
+	if err := DecodeError(errString); err != nil {
+		event.Outcome = OUTCOME_FAILED
+		event.Error = err.Message
+		event.Code = err.Code
+	}
+	d.publish(event)
+}
+
+// staleChanged publishes a share mount point going stale or recovering, for
+// each volume mounted from it. It takes the driver lock, so it must be
+// called without it, as the stale checks are.
+func (d *LocalDriver) staleChanged(mountPoint string, stale bool) {
+	h := d.events
+	h.lock.Lock()
+	if h.stale[mountPoint] == stale {
+		h.lock.Unlock()
+		return
+	}
+	if stale {
+		h.stale[mountPoint] = true
+	} else {
+		delete(h.stale, mountPoint)
+	}
+	h.lock.Unlock()
+
+	outcome := OUTCOME_RECOVERED
+	if stale {
+		outcome = OUTCOME_DETECTED
+	}
+	for _, name := range d.shareVolumes(mountPoint) {
+		d.publish(Event{Volume: name, Operation: EVENT_STALE, Outcome: outcome})
+	}
+}
+
+// forgetStale drops the stale state of a share mount point that is no
+// longer mounted. It is called with the driver lock held.
+func (d *LocalDriver) forgetStale(mountPoint string) {
+	d.events.lock.Lock()
+	defer d.events.lock.Unlock()
+	delete(d.events.stale, mountPoint)
+}
+
+func (d *LocalDriver) shareVolumes(mountPoint string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	names := []string{}
+	for name, volume := range d.volumes {
+		if share, ok := d.shares[volume.ShareKey]; ok && share.MountPoint == mountPoint && volume.mounted() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *LocalDriver) eventStats() (subscribers int, dropped int) {
+	h := d.events
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.subscribers), h.dropped
+}
+
+// serveEvents streams the events of the driver, optionally only those of the
+// volume named by ?volume=, until the request ends. Events are written as
+// newline-delimited JSON, or as server-sent events when the client accepts
+// text/event-stream.
+func serveEvents(logger lager.Logger, driver *LocalDriver, w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeAdminJSON(logger, w, http.StatusMethodNotAllowed, adminError{Err: "method not allowed"})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAdminJSON(logger, w, http.StatusInternalServerError, adminError{Err: "streaming not supported"})
+		return
+	}
+
+	volumeName := req.URL.Query().Get("volume")
+	sse := strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+
+	subscription := driver.SubscribeEvents()
+	defer subscription.Close()
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	logger.Info("streaming-events", lager.Data{"volume_name": volumeName, "sse": sse})
+	for {
+		select {
+		case <-req.Context().Done():
+			logger.Info("stream-ended", lager.Data{"dropped": subscription.Dropped()})
+			return
+		case event := <-subscription.Events():
+			if volumeName != "" && event.Volume != volumeName {
+				continue
+			}
+
+			body, err := json.Marshal(event)
+			if err != nil {
+				logger.Error("failed-encoding-event", err)
+				continue
+			}
+			if sse {
+				_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Operation, body)
+			} else {
+				_, err = fmt.Fprintf(w, "%s\n", body)
+			}
+			if err != nil {
+				logger.Error("failed-writing-event", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
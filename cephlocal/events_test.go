@@ -0,0 +1,217 @@
+package cephlocal_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+	"github.com/tedsuo/ifrit"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Events", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver       *cephlocal.LocalDriver
+		fakeInvoker  *voldriverfakes.FakeInvoker
+		fakeOs       *os_fake.FakeOs
+		testEnv      voldriver.Env
+		subscription *cephlocal.EventSubscription
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeOs = new(os_fake.FakeOs)
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("EventsTest"), context.TODO())
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root", EventBuffer: 2, StaleCheckInterval: 10 * time.Millisecond})
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+
+		subscription = driver.SubscribeEvents()
+	})
+
+	AfterEach(func() {
+		subscription.Close()
+	})
+
+	It("publishes the outcome of mounts and unmounts", func() {
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		Expect(driver.Unmount(testEnv, voldriver.UnmountRequest{Name: volumeName, ID: "container-1"}).Err).To(BeEmpty())
+
+		var event cephlocal.Event
+		Expect(subscription.Events()).To(Receive(&event))
+		Expect(event.Sequence).To(Equal(uint64(1)))
+		Expect(event.Volume).To(Equal(volumeName))
+		Expect(event.Operation).To(Equal(cephlocal.EVENT_MOUNT))
+		Expect(event.Outcome).To(Equal(cephlocal.OUTCOME_SUCCEEDED))
+		Expect(event.Holder).To(Equal("container-1"))
+		Expect(event.Duration).To(BeNumerically(">", 0))
+
+		Expect(subscription.Events()).To(Receive(&event))
+		Expect(event.Sequence).To(Equal(uint64(2)))
+		Expect(event.Operation).To(Equal(cephlocal.EVENT_UNMOUNT))
+		Expect(event.Outcome).To(Equal(cephlocal.OUTCOME_SUCCEEDED))
+	})
+
+	It("publishes failed mounts with their error", func() {
+		fakeInvoker.InvokeReturns(nil, errors.New("connection refused"))
+		driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName})
+
+		var event cephlocal.Event
+		Expect(subscription.Events()).To(Receive(&event))
+		Expect(event.Outcome).To(Equal(cephlocal.OUTCOME_FAILED))
+		Expect(event.Holder).To(Equal("anonymous-1"))
+		Expect(event.Code).To(Equal(cephlocal.ERR_MOUNT_FAILED))
+		Expect(event.Error).To(ContainSubstring("connection refused"))
+	})
+
+	It("publishes mounts going stale and recovering once", func() {
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		Eventually(subscription.Events()).Should(Receive())
+
+		fakeOs.StatReturns(nil, &os.PathError{Op: "stat", Path: "some-root/shares", Err: syscall.ENOTCONN})
+		driver.Health(testEnv)
+		driver.Health(testEnv)
+
+		var event cephlocal.Event
+		Expect(subscription.Events()).To(Receive(&event))
+		Expect(event.Operation).To(Equal(cephlocal.EVENT_STALE))
+		Expect(event.Outcome).To(Equal(cephlocal.OUTCOME_DETECTED))
+		Expect(subscription.Events()).NotTo(Receive())
+
+		fakeOs.StatReturns(nil, nil)
+		driver.Health(testEnv)
+
+		Expect(subscription.Events()).To(Receive(&event))
+		Expect(event.Operation).To(Equal(cephlocal.EVENT_STALE))
+		Expect(event.Outcome).To(Equal(cephlocal.OUTCOME_RECOVERED))
+	})
+
+	It("checks for stale mounts in the stale monitor without being asked", func() {
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		Eventually(subscription.Events()).Should(Receive())
+
+		fakeOs.StatReturns(nil, &os.PathError{Op: "stat", Path: "some-root/shares", Err: syscall.ENOTCONN})
+		process := ifrit.Invoke(driver.StaleMonitorRunner(lagertest.NewTestLogger("EventsTest")))
+		defer func() {
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive())
+		}()
+
+		var event cephlocal.Event
+		Eventually(subscription.Events()).Should(Receive(&event))
+		Expect(event.Operation).To(Equal(cephlocal.EVENT_STALE))
+		Expect(event.Outcome).To(Equal(cephlocal.OUTCOME_DETECTED))
+		Expect(driver.CheckStaleMounts(testEnv)).To(Equal(1))
+	})
+
+	It("drops events for subscribers that fall behind without holding up the driver", func() {
+		for _, holderID := range []string{"container-1", "container-2", "container-3"} {
+			mountSuccessfulWithID(testEnv, driver, volumeName, holderID)
+		}
+
+		Expect(subscription.Dropped()).To(Equal(1))
+
+		var event cephlocal.Event
+		Expect(subscription.Events()).To(Receive(&event))
+		Expect(event.Holder).To(Equal("container-1"))
+		Expect(subscription.Events()).To(Receive(&event))
+		Expect(event.Holder).To(Equal("container-2"))
+		Expect(subscription.Events()).NotTo(Receive())
+	})
+
+	It("stops publishing to closed subscriptions", func() {
+		subscription.Close()
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+		Expect(subscription.Events()).To(BeClosed())
+	})
+
+	Describe("the admin event stream", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(cephlocal.NewAdminHandler(lagertest.NewTestLogger("EventsTest"), driver, "some-token"))
+			createSuccessful(testEnv, driver, "other-volume", map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "other-remote-mountpoint"})
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		stream := func(path string, accept string) (*bufio.Scanner, func()) {
+			ctx, cancel := context.WithCancel(context.Background())
+			req, err := http.NewRequest("GET", server.URL+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			req = req.WithContext(ctx)
+			req.Header.Set("Authorization", "Bearer some-token")
+			req.Header.Set("Accept", accept)
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			return bufio.NewScanner(resp.Body), func() {
+				cancel()
+				resp.Body.Close()
+			}
+		}
+
+		It("streams the events of a volume as newline-delimited JSON", func() {
+			scanner, stop := stream("/events?volume="+volumeName, "")
+			defer stop()
+
+			mountSuccessfulWithID(testEnv, driver, "other-volume", "container-1")
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+			Expect(scanner.Scan()).To(BeTrue())
+			event := cephlocal.Event{}
+			Expect(json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+			Expect(event.Volume).To(Equal(volumeName))
+			Expect(event.Operation).To(Equal(cephlocal.EVENT_MOUNT))
+			Expect(event.Holder).To(Equal("container-1"))
+		})
+
+		It("streams server-sent events when asked to", func() {
+			scanner, stop := stream("/events", "text/event-stream")
+			defer stop()
+
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+			lines := []string{}
+			for len(lines) < 3 && scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			Expect(lines[0]).To(MatchRegexp(`^id: \d+$`))
+			Expect(lines[1]).To(Equal("event: mount"))
+			Expect(lines[2]).To(HavePrefix(`data: {"sequence":`))
+		})
+
+		It("rejects other methods", func() {
+			req, err := http.NewRequest("POST", server.URL+"/events", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer some-token")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
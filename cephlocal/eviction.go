@@ -0,0 +1,246 @@
+package cephlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"github.com/tedsuo/ifrit"
+)
+
+const DEFAULT_EVICTION_CHECK_INTERVAL = 30 * time.Second
+
+// EvictionConfig has the driver look for ceph-fuse clients the MDS has
+// evicted every Interval. An evicted client keeps its mount, which then
+// hangs or fails with EIO until it is mounted again. With Remount set, the
+// driver mounts the share of an evicted client again with a new client and
+// moves the bind mounts of its holders onto it.
+type EvictionConfig struct {
+	Interval time.Duration
+	Remount  bool
+}
+
+func (c EvictionConfig) withDefaults() EvictionConfig {
+	if c.Interval <= 0 {
+		c.Interval = DEFAULT_EVICTION_CHECK_INTERVAL
+	}
+	return c
+}
+
+type evictionTarget struct {
+	key         string
+	mountPoint  string
+	adminSocket string
+	evicted     bool
+}
+
+// CheckEvictions looks for shares whose ceph-fuse client has been evicted,
+// either because the client reports itself blocklisted or rejected by an MDS
+// on its admin socket, or because its mount point fails with the errors of
+// an evicted client. Shares found evicted earlier whose client no longer
+// looks evicted, as when its blocklisting has expired and it has
+// reconnected, are marked as recovered. The checks are done without holding
+// the driver lock. It returns the number of evictions found.
+func (d *LocalDriver) CheckEvictions(env voldriver.Env) int {
+	logger := env.Logger().Session("check-evictions")
+	logger.Debug("start")
+	defer logger.Debug("end")
+
+	found := 0
+	for _, target := range d.evictionTargets() {
+		reason := d.detectEviction(target)
+		if target.evicted && reason == "" {
+			d.shareRecovered(logger, target.key)
+			continue
+		}
+		if !target.evicted {
+			if reason == "" || !d.shareEvicted(logger, target.key, reason) {
+				continue
+			}
+			found++
+		}
+
+		if d.evictions.Remount {
+			d.remountEvicted(logger, target.key)
+		}
+	}
+	return found
+}
+
+func (d *LocalDriver) evictionTargets() []evictionTarget {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	targets := []evictionTarget{}
+	for key, share := range d.shares {
+		targets = append(targets, evictionTarget{key: key, mountPoint: share.MountPoint, adminSocket: share.AdminSocket, evicted: share.Evicted})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].key < targets[j].key })
+	return targets
+}
+
+// detectEviction returns why the client of a share looks evicted, or an
+// empty string when it does not. A client that cannot be asked over its
+// admin socket is judged by its mount point alone.
+func (d *LocalDriver) detectEviction(target evictionTarget) string {
+	if target.adminSocket != "" {
+		status := clientStatus{}
+		if err := d.adminSocketCommand(target.adminSocket, "status", &status); err == nil {
+			if status.Blacklisted || status.Blocklisted {
+				return "client is blocklisted"
+			}
+
+			sessions := mdsSessions{}
+			if err := d.adminSocketCommand(target.adminSocket, "mds_sessions", &sessions); err == nil {
+				for _, session := range sessions.Sessions {
+					if session.State == "rejected" {
+						return fmt.Sprintf("session with mds.%d was rejected", session.MDS)
+					}
+				}
+			}
+		}
+	}
+
+	// An evicted client fails with EIO, or with ESHUTDOWN once it learns
+	// that it is blocklisted.
+	switch errno := mountErrno(d.statMount(target.mountPoint)); errno {
+	case syscall.EIO, syscall.ESHUTDOWN:
+		return fmt.Sprintf("mount point fails with '%s'", errno.Error())
+	}
+	return ""
+}
+
+// shareEvicted marks a share as evicted, recording the eviction against the
+// volumes mounted from it, and reports whether the share was still mounted.
+func (d *LocalDriver) shareEvicted(logger lager.Logger, key string, reason string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	share, ok := d.shares[key]
+	if !ok || share.Evicted {
+		return false
+	}
+
+	share.Evicted = true
+	share.Evictions++
+	share.LastEviction = reason
+
+	volumeNames := []string{}
+	for name, volume := range d.volumes {
+		if volume.ShareKey != key || !volume.mounted() {
+			continue
+		}
+		volumeNames = append(volumeNames, name)
+		volume.LastError = fmt.Sprintf("ceph-fuse client was evicted by the MDS (%s)", reason)
+	}
+	sort.Strings(volumeNames)
+
+	for _, name := range volumeNames {
+		d.publish(Event{Volume: name, Operation: EVENT_EVICTED, Outcome: OUTCOME_DETECTED, Error: reason})
+	}
+
+	logger.Error("client-evicted", errors.New(reason), lager.Data{"share": share.MountPoint, "volumes": volumeNames, "evictions": share.Evictions})
+	d.persist(logger)
+	return true
+}
+
+// shareRecovered clears the evicted mark of a share whose client no longer
+// looks evicted.
+func (d *LocalDriver) shareRecovered(logger lager.Logger, key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	share, ok := d.shares[key]
+	if !ok || !share.Evicted {
+		return
+	}
+	share.Evicted = false
+
+	volumeNames := []string{}
+	for name, volume := range d.volumes {
+		if volume.ShareKey == key && volume.mounted() {
+			volumeNames = append(volumeNames, name)
+		}
+	}
+	sort.Strings(volumeNames)
+
+	for _, name := range volumeNames {
+		d.publish(Event{Volume: name, Operation: EVENT_EVICTED, Outcome: OUTCOME_RECOVERED})
+	}
+
+	logger.Info("client-recovered", lager.Data{"share": share.MountPoint, "volumes": volumeNames})
+	d.persist(logger)
+}
+
+// remountEvicted mounts an evicted share again. A supervised ceph-fuse
+// process is let go first, so that its exit is not taken for a crash.
+func (d *LocalDriver) remountEvicted(logger lager.Logger, key string) {
+	defer d.shareLocks.lock(key)()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	share, ok := d.shares[key]
+	if !ok || !share.Evicted {
+		return
+	}
+
+	logger = logger.Session("remount-evicted", lager.Data{"share": share.MountPoint})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if d.supervisor.Enabled {
+		d.stopFuse(logger, share)
+		share.Pid = 0
+	}
+
+	env := driverhttp.NewHttpDriverEnv(logger, context.Background())
+	if err := d.reconnectShare(env, share); err != nil {
+		logger.Error("failed-remounting-evicted-share", err)
+		d.persist(logger)
+		return
+	}
+
+	d.persist(logger)
+	logger.Info("remounted-evicted-share", lager.Data{"pid": share.Pid, "evictions": share.Evictions})
+}
+
+// EvictionMonitorRunner checks for evicted clients every interval of the
+// driver's EvictionConfig until it is signalled.
+func (d *LocalDriver) EvictionMonitorRunner(logger lager.Logger) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		env := driverhttp.NewHttpDriverEnv(logger.Session("eviction-monitor"), context.Background())
+		ticker := time.NewTicker(d.evictions.Interval)
+		defer ticker.Stop()
+
+		close(ready)
+		for {
+			select {
+			case <-ticker.C:
+				d.CheckEvictions(env)
+			case <-signals:
+				return nil
+			}
+		}
+	})
+}
+
+func (d *LocalDriver) evictionStats() (evicted int, evictions int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, share := range d.shares {
+		if share.Evicted {
+			evicted++
+		}
+		evictions += share.Evictions
+	}
+	return evicted, evictions
+}
@@ -0,0 +1,167 @@
+package cephlocal_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"syscall"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Evictions", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeOs      *os_fake.FakeOs
+		adminSocket *fakeAdminSocket
+		testEnv     voldriver.Env
+		config      cephlocal.LocalDriverConfig
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeOs = new(os_fake.FakeOs)
+		adminSocket = &fakeAdminSocket{responses: map[string]string{
+			"status":       `{"id": 4157, "blacklisted": false}`,
+			"mds_sessions": `{"id": 4157, "sessions": [{"mds": 0, "state": "open", "num_caps": 42}]}`,
+		}}
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("EvictionsTest"), context.TODO())
+		config = cephlocal.LocalDriverConfig{
+			RootDir:        "some-root",
+			AdminSocketDir: "some-root/sockets",
+			AdminSocket:    adminSocket,
+		}
+	})
+
+	JustBeforeEach(func() {
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, new(ioutil_fake.FakeIoutil), config)
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+	})
+
+	status := func() cephlocal.VolumeStatus {
+		response := driver.Status(testEnv, cephlocal.StatusRequest{Name: volumeName})
+		Expect(response.Err).To(BeEmpty())
+		return response.Status
+	}
+
+	It("leaves a healthy client alone", func() {
+		Expect(driver.CheckEvictions(testEnv)).To(Equal(0))
+		Expect(status().FuseEvicted).To(BeFalse())
+	})
+
+	Context("when the client reports itself blocklisted", func() {
+		BeforeEach(func() {
+			adminSocket.responses["status"] = `{"id": 4157, "blacklisted": true}`
+		})
+
+		It("marks the volume as evicted", func() {
+			Expect(driver.CheckEvictions(testEnv)).To(Equal(1))
+
+			volumeStatus := status()
+			Expect(volumeStatus.FuseEvicted).To(BeTrue())
+			Expect(volumeStatus.FuseEvictions).To(Equal(1))
+			Expect(volumeStatus.LastFuseEviction).To(Equal("client is blocklisted"))
+
+			details, ok := driver.VolumeDetails(testEnv, volumeName)
+			Expect(ok).To(BeTrue())
+			Expect(details.Evicted).To(BeTrue())
+			Expect(details.Healthy).To(BeFalse())
+			Expect(details.LastError).To(Equal("ceph-fuse client was evicted by the MDS (client is blocklisted)"))
+		})
+
+		It("counts each eviction once", func() {
+			Expect(driver.CheckEvictions(testEnv)).To(Equal(1))
+			Expect(driver.CheckEvictions(testEnv)).To(Equal(0))
+			Expect(status().FuseEvictions).To(Equal(1))
+		})
+
+		It("clears the mark once the client no longer looks evicted", func() {
+			Expect(driver.CheckEvictions(testEnv)).To(Equal(1))
+
+			adminSocket.responses["status"] = `{"id": 4157, "blacklisted": false}`
+			Expect(driver.CheckEvictions(testEnv)).To(Equal(0))
+
+			volumeStatus := status()
+			Expect(volumeStatus.FuseEvicted).To(BeFalse())
+			Expect(volumeStatus.FuseEvictions).To(Equal(1))
+
+			details, _ := driver.VolumeDetails(testEnv, volumeName)
+			Expect(details.Healthy).To(BeTrue())
+		})
+
+		It("reports the eviction in the metrics", func() {
+			driver.CheckEvictions(testEnv)
+
+			metrics := cephlocal.NewMetrics()
+			metrics.CollectDriver(driver)
+
+			recorder := httptest.NewRecorder()
+			metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			body := recorder.Body.String()
+
+			Expect(body).To(ContainSubstring("cephdriver_fuse_evictions_total 1"))
+			Expect(body).To(ContainSubstring("cephdriver_evicted_shares 1"))
+		})
+
+		Context("when evicted shares are remounted", func() {
+			BeforeEach(func() {
+				config.Evictions = cephlocal.EvictionConfig{Remount: true}
+			})
+
+			It("mounts the share again and moves the bind mount onto it", func() {
+				invocations := fakeInvoker.InvokeCallCount()
+				Expect(driver.CheckEvictions(testEnv)).To(Equal(1))
+
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(invocations + 4))
+				_, cmd, args := fakeInvoker.InvokeArgsForCall(invocations)
+				Expect(cmd).To(Equal("fusermount"))
+				Expect(args[:2]).To(Equal([]string{"-u", "-z"}))
+				_, cmd, _ = fakeInvoker.InvokeArgsForCall(invocations + 1)
+				Expect(cmd).To(Equal("ceph-fuse"))
+				_, cmd, args = fakeInvoker.InvokeArgsForCall(invocations + 2)
+				Expect(cmd).To(Equal("umount"))
+				Expect(args).To(Equal([]string{"-l", "some-root/volumes/volume-name/container-1"}))
+				_, cmd, _ = fakeInvoker.InvokeArgsForCall(invocations + 3)
+				Expect(cmd).To(Equal("mount"))
+
+				volumeStatus := status()
+				Expect(volumeStatus.FuseEvicted).To(BeFalse())
+				Expect(volumeStatus.FuseEvictions).To(Equal(1))
+			})
+		})
+	})
+
+	Context("when an MDS has rejected the client's session", func() {
+		BeforeEach(func() {
+			adminSocket.responses["mds_sessions"] = `{"id": 4157, "sessions": [{"mds": 0, "state": "open"}, {"mds": 1, "state": "rejected"}]}`
+		})
+
+		It("marks the volume as evicted", func() {
+			Expect(driver.CheckEvictions(testEnv)).To(Equal(1))
+			Expect(status().LastFuseEviction).To(Equal("session with mds.1 was rejected"))
+		})
+	})
+
+	Context("when the mount point fails with EIO", func() {
+		It("marks the volume as evicted", func() {
+			fakeOs.StatReturns(nil, &os.PathError{Op: "stat", Path: "some-root/shares/some-share", Err: syscall.EIO})
+
+			Expect(driver.CheckEvictions(testEnv)).To(Equal(1))
+			Expect(status().LastFuseEviction).To(Equal("mount point fails with 'input/output error'"))
+		})
+	})
+})
@@ -0,0 +1,184 @@
+package cephlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+const FUSE_DEVICE = "/dev/fuse"
+
+const (
+	HEALTH_PATH = "/health"
+	READY_PATH  = "/ready"
+)
+
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message,omitempty"`
+}
+
+type HealthReport struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []HealthCheck `json:"checks"`
+}
+
+// Health checks everything the driver needs to mount volumes: that its state
+// can be persisted, that ceph-fuse and fusermount can be run, that the fuse
+// device can be opened and that none of its ceph-fuse mounts have gone stale.
+func (d *LocalDriver) Health(env voldriver.Env) HealthReport {
+	logger := env.Logger().Session("health")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	report := HealthReport{Healthy: true}
+	for _, check := range []HealthCheck{
+		d.checkStateStore(),
+		d.checkExecutable(MOUNT_CMD),
+		d.checkExecutable(FUSERMOUNT_CMD),
+		d.checkFuseDevice(),
+		d.checkMounts(),
+	} {
+		if !check.Healthy {
+			logger.Info("unhealthy", lager.Data{"check": check.Name, "message": check.Message})
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	return report
+}
+
+func (d *LocalDriver) checkStateStore() HealthCheck {
+	check := HealthCheck{Name: "state_store", Healthy: true}
+	if d.stateFile == "" {
+		check.Message = "state is not persisted"
+		return check
+	}
+
+	if err := d.probeStateDir(); err != nil {
+		check.Healthy = false
+		check.Message = fmt.Sprintf("unable to write %s (%s)", filepath.Dir(d.stateFile), err.Error())
+	}
+	return check
+}
+
+// probeStateDir checks that files can be written next to the state file,
+// with a temporary file rather than the state file itself, which only
+// changes with the state.
+func (d *LocalDriver) probeStateDir() error {
+	probe, err := d.ioutil.TempFile(filepath.Dir(d.stateFile), ".health-")
+	if err != nil {
+		return err
+	}
+	defer d.os.Remove(probe.Name())
+
+	if err := probe.Sync(); err != nil {
+		probe.Close()
+		return err
+	}
+	return probe.Close()
+}
+
+func (d *LocalDriver) checkExecutable(name string) HealthCheck {
+	check := HealthCheck{Name: name, Healthy: true}
+
+	path, err := d.findExecutable(name)
+	if err != nil {
+		check.Healthy = false
+		check.Message = err.Error()
+		return check
+	}
+	check.Message = path
+	return check
+}
+
+// findExecutable looks name up in PATH the way exec.LookPath does, through
+// the os shim.
+func (d *LocalDriver) findExecutable(name string) (string, error) {
+	for _, dir := range filepath.SplitList(d.os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, name)
+
+		info, err := d.os.Stat(path)
+		if err != nil || info == nil || info.IsDir() {
+			continue
+		}
+		if info.Mode()&0111 == 0 {
+			return "", fmt.Errorf("%s is not executable", path)
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("%s not found in PATH", name)
+}
+
+func (d *LocalDriver) checkFuseDevice() HealthCheck {
+	check := HealthCheck{Name: "fuse_device", Healthy: true}
+
+	file, err := d.os.OpenFile(FUSE_DEVICE, os.O_RDWR, 0)
+	if err != nil {
+		check.Healthy = false
+		check.Message = err.Error()
+		return check
+	}
+	if file != nil {
+		file.Close()
+	}
+	return check
+}
+
+func (d *LocalDriver) checkMounts() HealthCheck {
+	check := HealthCheck{Name: "mounts", Healthy: true}
+
+	_, _, _, shareMountPoints := d.mountStats()
+
+	stale := []string{}
+	for _, mountPoint := range shareMountPoints {
+		if d.isStaleMount(mountPoint) {
+			stale = append(stale, mountPoint)
+		}
+	}
+
+	if len(stale) > 0 {
+		check.Healthy = false
+		check.Message = fmt.Sprintf("stale mounts: %s", strings.Join(stale, ", "))
+	}
+	return check
+}
+
+// NewHealthHandler serves the driver's health report next to the voldriver
+// API: /health always answers with the report, while /ready answers with
+// 503 Service Unavailable unless every check passes.
+func NewHealthHandler(logger lager.Logger, driver *LocalDriver, handler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(HEALTH_PATH, healthHandler(logger, driver, false))
+	mux.Handle(READY_PATH, healthHandler(logger, driver, true))
+	mux.Handle("/", handler)
+	return mux
+}
+
+func healthHandler(logger lager.Logger, driver *LocalDriver, ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := driver.Health(driverhttp.NewHttpDriverEnv(logger, req.Context()))
+
+		status := http.StatusOK
+		if ready && !report.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			logger.Error("failed-writing-health-report", err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package cephlocal_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	var (
+		driver     *cephlocal.LocalDriver
+		fakeOs     *os_fake.FakeOs
+		fakeIoutil *ioutil_fake.FakeIoutil
+		testEnv    voldriver.Env
+	)
+
+	BeforeEach(func() {
+		fakeOs = new(os_fake.FakeOs)
+		fakeIoutil = new(ioutil_fake.FakeIoutil)
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("HealthTest"), context.TODO())
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(new(voldriverfakes.FakeInvoker), fakeOs, fakeIoutil, cephlocal.LocalDriverConfig{RootDir: "some-root", StateFile: "some-root/state.json"})
+
+		fakeOs.GetenvReturns("/usr/bin")
+		fakeOs.StatReturns(fileInfo{mode: 0755}, nil)
+
+		fakeIoutil.TempFileStub = func(dir string, prefix string) (*os.File, error) {
+			return ioutil.TempFile("", prefix)
+		}
+	})
+
+	AfterEach(func() {
+		for i := 0; i < fakeOs.RemoveCallCount(); i++ {
+			os.Remove(fakeOs.RemoveArgsForCall(i))
+		}
+	})
+
+	checks := func(report cephlocal.HealthReport) map[string]cephlocal.HealthCheck {
+		byName := map[string]cephlocal.HealthCheck{}
+		for _, check := range report.Checks {
+			byName[check.Name] = check
+		}
+		return byName
+	}
+
+	It("is healthy when every check passes", func() {
+		report := driver.Health(testEnv)
+		Expect(report.Healthy).To(BeTrue())
+		Expect(checks(report)).To(HaveLen(5))
+		Expect(checks(report)["ceph-fuse"].Message).To(Equal("/usr/bin/ceph-fuse"))
+		Expect(fakeOs.OpenFileCallCount()).To(Equal(1))
+		path, _, _ := fakeOs.OpenFileArgsForCall(0)
+		Expect(path).To(Equal("/dev/fuse"))
+	})
+
+	It("probes the state store with a temporary file next to the state file", func() {
+		report := driver.Health(testEnv)
+		Expect(checks(report)["state_store"].Healthy).To(BeTrue())
+
+		Expect(fakeIoutil.TempFileCallCount()).To(Equal(1))
+		dir, _ := fakeIoutil.TempFileArgsForCall(0)
+		Expect(dir).To(Equal("some-root"))
+		Expect(fakeOs.RemoveCallCount()).To(Equal(1))
+		Expect(fakeIoutil.WriteFileCallCount()).To(Equal(0))
+		Expect(fakeOs.RenameCallCount()).To(Equal(0))
+	})
+
+	It("reports a state store that cannot be written", func() {
+		fakeIoutil.TempFileStub = nil
+		fakeIoutil.TempFileReturns(nil, errors.New("read-only file system"))
+		report := driver.Health(testEnv)
+		Expect(report.Healthy).To(BeFalse())
+		Expect(checks(report)["state_store"].Healthy).To(BeFalse())
+		Expect(checks(report)["state_store"].Message).To(Equal("unable to write some-root (read-only file system)"))
+	})
+
+	It("reports binaries that are not executable", func() {
+		fakeOs.StatReturns(fileInfo{mode: 0644}, nil)
+		report := driver.Health(testEnv)
+		Expect(checks(report)["fusermount"].Healthy).To(BeFalse())
+		Expect(checks(report)["fusermount"].Message).To(Equal("/usr/bin/fusermount is not executable"))
+	})
+
+	It("reports binaries that are missing", func() {
+		fakeOs.StatReturns(nil, errors.New("not found"))
+		report := driver.Health(testEnv)
+		Expect(checks(report)["ceph-fuse"].Message).To(Equal("ceph-fuse not found in PATH"))
+	})
+
+	It("reports an inaccessible fuse device", func() {
+		fakeOs.OpenFileReturns(nil, errors.New("permission denied"))
+		report := driver.Health(testEnv)
+		Expect(checks(report)["fuse_device"].Healthy).To(BeFalse())
+	})
+
+	It("reports stale mounts", func() {
+		createSuccessful(testEnv, driver, "volume-name", map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+		mountSuccessfulWithID(testEnv, driver, "volume-name", "container-1")
+
+		fakeOs.StatReturns(nil, &os.PathError{Op: "stat", Path: "some-root/shares", Err: syscall.ENOTCONN})
+		report := driver.Health(testEnv)
+		Expect(checks(report)["mounts"].Healthy).To(BeFalse())
+		Expect(checks(report)["mounts"].Message).To(HavePrefix("stale mounts: some-root/shares/"))
+	})
+
+	It("checks a hung mount with a single stat at a time", func() {
+		createSuccessful(testEnv, driver, "volume-name", map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+		mountSuccessfulWithID(testEnv, driver, "volume-name", "container-1")
+
+		hung := make(chan struct{})
+		defer close(hung)
+		shareStats := int32(0)
+		fakeOs.StatStub = func(name string) (os.FileInfo, error) {
+			if strings.HasPrefix(name, "some-root/shares/") {
+				atomic.AddInt32(&shareStats, 1)
+				<-hung
+			}
+			return fileInfo{mode: 0755}, nil
+		}
+
+		report := driver.Health(testEnv)
+		Expect(checks(report)["mounts"].Healthy).To(BeFalse())
+
+		started := time.Now()
+		report = driver.Health(testEnv)
+		Expect(checks(report)["mounts"].Healthy).To(BeFalse())
+		Expect(time.Since(started)).To(BeNumerically("<", cephlocal.STALE_MOUNT_TIMEOUT))
+		Expect(atomic.LoadInt32(&shareStats)).To(Equal(int32(1)))
+	})
+
+	Describe("NewHealthHandler", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			handler = cephlocal.NewHealthHandler(lagertest.NewTestLogger("HealthTest"), driver, http.NotFoundHandler())
+		})
+
+		serve := func(path string) (int, cephlocal.HealthReport) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+			report := cephlocal.HealthReport{}
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &report)).To(Succeed())
+			return recorder.Code, report
+		}
+
+		It("serves the report on /health even when unhealthy", func() {
+			fakeOs.OpenFileReturns(nil, errors.New("permission denied"))
+			code, report := serve("/health")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(report.Healthy).To(BeFalse())
+		})
+
+		It("fails /ready when unhealthy", func() {
+			code, _ := serve("/ready")
+			Expect(code).To(Equal(http.StatusOK))
+
+			fakeOs.OpenFileReturns(nil, errors.New("permission denied"))
+			code, report := serve("/ready")
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(checks(report)["fuse_device"].Message).To(Equal("permission denied"))
+		})
+
+		It("passes other requests to the driver handler", func() {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/VolumeDriver.Mount", nil))
+			Expect(recorder.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
+
+type fileInfo struct {
+	os.FileInfo
+	name string
+	mode os.FileMode
+	size int64
+}
+
+func (f fileInfo) Name() string      { return f.name }
+func (f fileInfo) Mode() os.FileMode { return f.mode }
+func (f fileInfo) IsDir() bool       { return f.mode.IsDir() }
+func (f fileInfo) Size() int64       { return f.size }
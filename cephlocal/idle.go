@@ -0,0 +1,315 @@
+package cephlocal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"github.com/tedsuo/ifrit"
+)
+
+const DEFAULT_IDLE_CHECK_INTERVAL = time.Minute
+
+// IdlePolicy has the driver unmount holders that have shown no sign of life
+// for longer than TTL, so that apps deleted without their Unmount arriving do
+// not keep ceph-fuse running forever. A holder shows life when it is mounted,
+// when it calls Heartbeat and, unless Heartbeats is set, for as long as its
+// bind mount is mounted into another mount namespace, as a container's is.
+// Holders bound from the same directory of a share cannot be told apart that
+// way, so unless every one of them is accounted for they have to heartbeat.
+// Anonymous holders are never reaped. The policy is applied every Interval; a
+// zero TTL disables it.
+type IdlePolicy struct {
+	TTL        time.Duration
+	Interval   time.Duration
+	Heartbeats bool
+}
+
+func (p IdlePolicy) withDefaults() IdlePolicy {
+	if p.Interval <= 0 {
+		p.Interval = DEFAULT_IDLE_CHECK_INTERVAL
+	}
+	return p
+}
+
+type HeartbeatRequest struct {
+	Name string
+	ID   string
+}
+
+// Heartbeat records that the holder of a volume is still alive.
+func (d *LocalDriver) Heartbeat(env voldriver.Env, heartbeatRequest HeartbeatRequest) voldriver.ErrorResponse {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	logger := env.Logger().Session("heartbeat", lager.Data{"volume_name": heartbeatRequest.Name, "holder": heartbeatRequest.ID})
+	logger.Debug("start")
+	defer logger.Debug("end")
+
+	volume, ok := d.volumes[heartbeatRequest.Name]
+	if !ok {
+		logger.Info("heartbeat-volume-not-found")
+		return voldriver.ErrorResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", heartbeatRequest.Name).Encode()}
+	}
+	if !volume.Holders[heartbeatRequest.ID] {
+		logger.Info("heartbeat-holder-not-found")
+		return voldriver.ErrorResponse{Err: newError(ERR_NOT_MOUNTED, "Volume '%s' is not held by '%s'", heartbeatRequest.Name, heartbeatRequest.ID).Encode()}
+	}
+
+	volume.seen(heartbeatRequest.ID, time.Now())
+	return voldriver.ErrorResponse{}
+}
+
+// ReapIdle unmounts the holders that have been idle for longer than the TTL
+// of the idle policy, and returns how many it unmounted. Holders restored
+// from a state without a last sighting are counted as seen now.
+func (d *LocalDriver) ReapIdle(env voldriver.Env) int {
+	logger := env.Logger().Session("reap-idle")
+	logger.Debug("start")
+	defer logger.Debug("end")
+
+	isAlive := func(volume *volumeMetadata, holderID string) bool { return false }
+	if !d.idle.Heartbeats {
+		own, elsewhere, err := d.mountSources()
+		if err != nil {
+			logger.Error("failed-reading-mount-namespaces", err)
+			return 0
+		}
+		inUse := d.bindMountsInUse(own, elsewhere)
+		isAlive = func(volume *volumeMetadata, holderID string) bool {
+			return inUse[volume.bindPath(holderID)]
+		}
+	}
+
+	reaped, _ := d.reap(driverhttp.EnvWithLogger(logger, env), d.idle.TTL, EVENT_IDLE_UNMOUNT, isAlive)
+	if reaped > 0 {
+		d.lock.Lock()
+		d.idleReaped += reaped
+		d.lock.Unlock()
+	}
+	return reaped
+}
+
+// reap releases the holders isAlive gives up on, once they have shown no
+// life for longer than ttl, and publishes their unmount as operation when it
+// is set. It returns how many holders it released, and why it could not
+// release others.
+func (d *LocalDriver) reap(env voldriver.Env, ttl time.Duration, operation string, isAlive func(volume *volumeMetadata, holderID string) bool) (int, []string) {
+	reaped := 0
+	errs := []string{}
+	for _, name := range d.volumeNames() {
+		volumeReaped, volumeErrs := d.reapVolume(env, name, ttl, operation, isAlive)
+		reaped += volumeReaped
+		errs = append(errs, volumeErrs...)
+	}
+	return reaped, errs
+}
+
+func (d *LocalDriver) reapVolume(env voldriver.Env, name string, ttl time.Duration, operation string, isAlive func(volume *volumeMetadata, holderID string) bool) (int, []string) {
+	defer d.lockVolumes(name)()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	logger := env.Logger()
+
+	volume, ok := d.volumes[name]
+	if !ok {
+		return 0, nil
+	}
+
+	now := time.Now()
+	reaped := 0
+	errs := []string{}
+	for _, holderID := range volume.holderIDs() {
+		if strings.HasPrefix(holderID, ANONYMOUS_HOLDER_PREFIX) {
+			continue
+		}
+
+		if isAlive(volume, holderID) {
+			volume.seen(holderID, now)
+			continue
+		}
+
+		idle := time.Duration(0)
+		if ttl > 0 {
+			lastSeen, ok := volume.LastSeen[holderID]
+			if !ok {
+				volume.seen(holderID, now)
+				continue
+			}
+			if idle = now.Sub(lastSeen); idle <= ttl {
+				continue
+			}
+		}
+
+		logger.Info("reaping-holder", lager.Data{"volume_name": name, "holder": holderID, "idle": idle.String()})
+		started := time.Now()
+		err := d.release(env, volume, name, holderID)
+		if operation != "" {
+			errString := ""
+			if err != nil {
+				errString = err.Encode()
+			}
+			d.publishOperation(operation, name, holderID, started, errString)
+		}
+		if err != nil {
+			logger.Error("failed-reaping-holder", err, lager.Data{"volume_name": name, "holder": holderID})
+			errs = append(errs, err.Message)
+			continue
+		}
+		reaped++
+	}
+
+	if reaped > 0 || len(errs) > 0 {
+		d.persist(logger)
+	}
+	return reaped, errs
+}
+
+// mountSources returns the source of each mount point of the driver's mount
+// namespace, and in how many other mount namespaces each of those sources is
+// mounted too, as the bind mount of a holder is into the namespace of its
+// container. Mounts are told apart by their device and the directory of its
+// file system they show. A namespace copied from the driver's, as a service
+// with a private /tmp has, shows its mounts at the same mount points, and so
+// does not count.
+func (d *LocalDriver) mountSources() (map[string]mountSource, map[mountSource]int, error) {
+	ownNamespace, err := d.os.Readlink(filepath.Join(PROC_DIR, "self", "ns", "mnt"))
+	if err != nil {
+		return nil, nil, err
+	}
+	contents, err := d.ioutil.ReadFile(PROC_MOUNTINFO)
+	if err != nil {
+		return nil, nil, err
+	}
+	own := parseMountSources(string(contents))
+
+	processes, err := d.ioutil.ReadDir(PROC_DIR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	elsewhere := map[mountSource]int{}
+	namespaces := map[string]bool{ownNamespace: true}
+	for _, process := range processes {
+		if _, err := strconv.Atoi(process.Name()); err != nil {
+			continue
+		}
+
+		// Processes may exit, or belong to users the driver cannot look at.
+		namespace, err := d.os.Readlink(filepath.Join(PROC_DIR, process.Name(), "ns", "mnt"))
+		if err != nil || namespaces[namespace] {
+			continue
+		}
+		contents, err := d.ioutil.ReadFile(filepath.Join(PROC_DIR, process.Name(), "mountinfo"))
+		if err != nil {
+			continue
+		}
+		namespaces[namespace] = true
+
+		sources := map[mountSource]bool{}
+		for mountPoint, source := range parseMountSources(string(contents)) {
+			if own[mountPoint] != source {
+				sources[source] = true
+			}
+		}
+		for source := range sources {
+			elsewhere[source]++
+		}
+	}
+	return own, elsewhere, nil
+}
+
+// bindMountsInUse tells which bind mounts of holders are mounted into other
+// mount namespaces, keyed by the mount point of each. Bind mounts of the same
+// source cannot be told apart, so they count as in use only when at least as
+// many other namespaces mount their source as holders are bound from it; when
+// fewer do, some of those holders are gone but which is unknown, and only
+// their heartbeats keep them.
+func (d *LocalDriver) bindMountsInUse(own map[string]mountSource, elsewhere map[mountSource]int) map[string]bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	bound := map[mountSource][]string{}
+	for _, volume := range d.volumes {
+		for _, holderID := range volume.holderIDs() {
+			bindPath := volume.bindPath(holderID)
+			if source, ok := own[bindPath]; ok {
+				bound[source] = append(bound[source], bindPath)
+			}
+		}
+	}
+
+	inUse := map[string]bool{}
+	for source, bindPaths := range bound {
+		if elsewhere[source] < len(bindPaths) {
+			continue
+		}
+		for _, bindPath := range bindPaths {
+			inUse[bindPath] = true
+		}
+	}
+	return inUse
+}
+
+// A mountSource is the device of a mount and the directory of its file
+// system the mount shows.
+type mountSource struct {
+	device string
+	root   string
+}
+
+// parseMountSources returns the source of each mount point in the contents
+// of a mountinfo file.
+func parseMountSources(contents string) map[string]mountSource {
+	mounts := map[string]mountSource{}
+	for _, line := range strings.Split(contents, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		mounts[unescapeMountInfo(fields[4])] = mountSource{device: fields[2], root: unescapeMountInfo(fields[3])}
+	}
+	return mounts
+}
+
+// IdleReaperRunner applies the idle policy of the driver every interval
+// until it is signalled.
+func (d *LocalDriver) IdleReaperRunner(logger lager.Logger) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		env := driverhttp.NewHttpDriverEnv(logger.Session("idle-reaper"), context.Background())
+		ticker := time.NewTicker(d.idle.Interval)
+		defer ticker.Stop()
+
+		close(ready)
+		for {
+			select {
+			case <-ticker.C:
+				d.ReapIdle(env)
+			case <-signals:
+				return nil
+			}
+		}
+	})
+}
+
+func (d *LocalDriver) idleStats() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.idleReaped
+}
+
+func (v *volumeMetadata) seen(holderID string, at time.Time) {
+	if v.LastSeen == nil {
+		v.LastSeen = map[string]time.Time{}
+	}
+	v.LastSeen[holderID] = at
+}
@@ -0,0 +1,218 @@
+package cephlocal_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Idle policy", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeOs      *os_fake.FakeOs
+		fakeIoutil  *ioutil_fake.FakeIoutil
+		testEnv     voldriver.Env
+		policy      cephlocal.IdlePolicy
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeOs = new(os_fake.FakeOs)
+		fakeIoutil = new(ioutil_fake.FakeIoutil)
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("IdleTest"), context.TODO())
+		policy = cephlocal.IdlePolicy{TTL: time.Nanosecond}
+	})
+
+	JustBeforeEach(func() {
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, fakeIoutil, cephlocal.LocalDriverConfig{RootDir: "some-root", Idle: policy})
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		time.Sleep(time.Millisecond)
+	})
+
+	holders := func() []string {
+		response := driver.Status(testEnv, cephlocal.StatusRequest{Name: volumeName})
+		Expect(response.Err).To(BeEmpty())
+		return response.Status.Holders
+	}
+
+	Context("when liveness is judged by bind mounts", func() {
+		const ownMounts = "100 20 0:50 /shared some-root/volumes/volume-name/container-1 rw - fuse.ceph-fuse ceph-fuse rw\n"
+
+		var mountInfo map[string]string
+
+		BeforeEach(func() {
+			mountInfo = map[string]string{"/proc/self/mountinfo": ownMounts}
+			namespaces := map[string]string{"/proc/self/ns/mnt": "mnt:[1]", "/proc/1/ns/mnt": "mnt:[1]", "/proc/42/ns/mnt": "mnt:[2]", "/proc/43/ns/mnt": "mnt:[2]"}
+
+			fakeIoutil.ReadFileStub = func(filename string) ([]byte, error) {
+				contents, ok := mountInfo[filename]
+				if !ok {
+					return nil, errors.New("no such file or directory")
+				}
+				return []byte(contents), nil
+			}
+			fakeIoutil.ReadDirReturns([]os.FileInfo{fileInfo{name: "1"}, fileInfo{name: "42"}, fileInfo{name: "43"}, fileInfo{name: "self"}}, nil)
+			fakeOs.ReadlinkStub = func(name string) (string, error) {
+				namespace, ok := namespaces[name]
+				if !ok {
+					return "", errors.New("no such file or directory")
+				}
+				return namespace, nil
+			}
+		})
+
+		It("keeps holders whose bind mount is mounted in another mount namespace", func() {
+			mountInfo["/proc/42/mountinfo"] = "200 30 0:50 /shared /var/vcap/data/volume rw - fuse.ceph-fuse ceph-fuse rw\n"
+
+			Expect(driver.ReapIdle(testEnv)).To(Equal(0))
+			Expect(holders()).To(Equal([]string{"container-1"}))
+		})
+
+		It("reads the mounts of each mount namespace once", func() {
+			mountInfo["/proc/42/mountinfo"] = ""
+			mountInfo["/proc/43/mountinfo"] = ""
+			driver.ReapIdle(testEnv)
+
+			read := []string{}
+			for i := 0; i < fakeIoutil.ReadFileCallCount(); i++ {
+				read = append(read, fakeIoutil.ReadFileArgsForCall(i))
+			}
+			Expect(read).To(Equal([]string{"/proc/self/mountinfo", "/proc/42/mountinfo"}))
+		})
+
+		It("unmounts holders whose bind mount is only mounted by the driver once they have been idle for the TTL", func() {
+			mountInfo["/proc/42/mountinfo"] = ""
+
+			Expect(driver.ReapIdle(testEnv)).To(Equal(1))
+			Expect(holders()).To(BeEmpty())
+
+			_, executable, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+			Expect(executable).To(Equal("fusermount"))
+			Expect(args[0]).To(Equal("-u"))
+		})
+
+		It("does not count namespaces that copy the mounts of the driver", func() {
+			mountInfo["/proc/42/mountinfo"] = strings.Replace(ownMounts, "100 20", "300 40", 1)
+
+			Expect(driver.ReapIdle(testEnv)).To(Equal(1))
+			Expect(holders()).To(BeEmpty())
+		})
+
+		It("counts reaped holders in the metrics", func() {
+			driver.ReapIdle(testEnv)
+
+			metrics := cephlocal.NewMetrics()
+			metrics.CollectDriver(driver)
+
+			recorder := httptest.NewRecorder()
+			metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(recorder.Body.String()).To(ContainSubstring("cephdriver_idle_reaped_total 1"))
+		})
+
+		It("reaps nothing when the mount table cannot be read", func() {
+			delete(mountInfo, "/proc/self/mountinfo")
+
+			Expect(driver.ReapIdle(testEnv)).To(Equal(0))
+			Expect(holders()).To(Equal([]string{"container-1"}))
+		})
+
+		Context("when two holders are bound from the same directory of a share", func() {
+			BeforeEach(func() {
+				policy.TTL = 100 * time.Millisecond
+				mountInfo["/proc/self/mountinfo"] = ownMounts + "101 20 0:50 /shared some-root/volumes/volume-name/container-2 rw - fuse.ceph-fuse ceph-fuse rw\n"
+				mountInfo["/proc/42/mountinfo"] = "200 30 0:50 /shared /var/vcap/data/volume rw - fuse.ceph-fuse ceph-fuse rw\n"
+
+				fakeIoutil.ReadDirReturns([]os.FileInfo{fileInfo{name: "42"}, fileInfo{name: "44"}}, nil)
+				readlink := fakeOs.ReadlinkStub
+				fakeOs.ReadlinkStub = func(name string) (string, error) {
+					if name == "/proc/44/ns/mnt" {
+						return "mnt:[3]", nil
+					}
+					return readlink(name)
+				}
+			})
+
+			JustBeforeEach(func() {
+				mountSuccessfulWithID(testEnv, driver, volumeName, "container-2")
+				time.Sleep(150 * time.Millisecond)
+			})
+
+			It("keeps both while as many other mount namespaces mount their source", func() {
+				mountInfo["/proc/44/mountinfo"] = "300 40 0:50 /shared /var/vcap/data/volume rw - fuse.ceph-fuse ceph-fuse rw\n"
+
+				Expect(driver.ReapIdle(testEnv)).To(Equal(0))
+				Expect(holders()).To(ConsistOf("container-1", "container-2"))
+			})
+
+			It("leaves it to heartbeats to tell the live holder from the dead one when fewer do", func() {
+				Expect(driver.Heartbeat(testEnv, cephlocal.HeartbeatRequest{Name: volumeName, ID: "container-1"}).Err).To(BeEmpty())
+
+				Expect(driver.ReapIdle(testEnv)).To(Equal(1))
+				Expect(holders()).To(Equal([]string{"container-1"}))
+			})
+		})
+
+		It("never reaps anonymous holders", func() {
+			mountResponse := driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName})
+			Expect(mountResponse.Err).To(BeEmpty())
+			time.Sleep(time.Millisecond)
+
+			Expect(driver.ReapIdle(testEnv)).To(Equal(1))
+			Expect(holders()).To(Equal([]string{"anonymous-1"}))
+		})
+	})
+
+	Context("when liveness is judged by heartbeats", func() {
+		BeforeEach(func() {
+			policy = cephlocal.IdlePolicy{TTL: time.Hour, Heartbeats: true}
+		})
+
+		It("keeps holders that heartbeat within the TTL", func() {
+			Expect(driver.Heartbeat(testEnv, cephlocal.HeartbeatRequest{Name: volumeName, ID: "container-1"}).Err).To(BeEmpty())
+
+			Expect(driver.ReapIdle(testEnv)).To(Equal(0))
+			Expect(holders()).To(Equal([]string{"container-1"}))
+			Expect(fakeIoutil.ReadFileCallCount()).To(Equal(0))
+		})
+
+		Context("when the TTL has passed", func() {
+			BeforeEach(func() {
+				policy.TTL = time.Nanosecond
+			})
+
+			It("unmounts holders even though their bind mount is present", func() {
+				fakeIoutil.ReadFileReturns([]byte("100 20 0:50 / some-root/volumes/volume-name/container-1 rw - fuse.ceph-fuse ceph-fuse rw\n"), nil)
+
+				Expect(driver.ReapIdle(testEnv)).To(Equal(1))
+				Expect(holders()).To(BeEmpty())
+			})
+		})
+
+		It("rejects heartbeats of unknown holders", func() {
+			response := driver.Heartbeat(testEnv, cephlocal.HeartbeatRequest{Name: volumeName, ID: "container-2"})
+			Expect(response.Err).To(Equal("Volume 'volume-name' is not held by 'container-2' [NOT_MOUNTED]"))
+
+			response = driver.Heartbeat(testEnv, cephlocal.HeartbeatRequest{Name: "unknown", ID: "container-1"})
+			Expect(response.Err).To(Equal("Volume 'unknown' not found [VOLUME_NOT_FOUND]"))
+		})
+	})
+})
@@ -0,0 +1,95 @@
+package cephlocal
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyedLocks hands out a mutex per key, so that operations on one volume or
+// share exclude each other without holding up operations on the others.
+// A key's mutex is dropped once nobody holds or waits for it.
+type keyedLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: map[string]*keyedLock{}}
+}
+
+// lock takes the mutexes of keys, in order so that callers taking several
+// never deadlock, and returns the function that gives them back.
+func (k *keyedLocks) lock(keys ...string) func() {
+	keys = uniqueSorted(keys)
+
+	held := []*keyedLock{}
+	for _, key := range keys {
+		k.mutex.Lock()
+		l, ok := k.locks[key]
+		if !ok {
+			l = &keyedLock{}
+			k.locks[key] = l
+		}
+		l.refs++
+		k.mutex.Unlock()
+
+		l.Lock()
+		held = append(held, l)
+	}
+
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+
+			k.mutex.Lock()
+			held[i].refs--
+			if held[i].refs == 0 {
+				delete(k.locks, keys[i])
+			}
+			k.mutex.Unlock()
+		}
+	}
+}
+
+func uniqueSorted(keys []string) []string {
+	set := map[string]bool{}
+	unique := []string{}
+	for _, key := range keys {
+		if key != "" && !set[key] {
+			set[key] = true
+			unique = append(unique, key)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// lockVolumes takes the locks of volumes, which serialise the operations on
+// each of them. It must be called without the state lock held.
+func (d *LocalDriver) lockVolumes(names ...string) func() {
+	return d.volumeLocks.lock(names...)
+}
+
+// lockShares takes the locks of shares, which serialise mounting, binding
+// to, unbinding from and unmounting each of them, while the state lock is
+// held. The state lock is let go while waiting, so whatever the caller read
+// under it must be read again.
+func (d *LocalDriver) lockShares(keys ...string) func() {
+	d.lock.Unlock()
+	defer d.lock.Lock()
+	return d.shareLocks.lock(keys...)
+}
+
+// unlocked runs fn without the state lock, for calls that take long such as
+// running ceph-fuse or mount. The caller holds the lock of the volume or
+// share fn works on, so that no other operation changes it meanwhile.
+func (d *LocalDriver) unlocked(fn func()) {
+	d.lock.Unlock()
+	defer d.lock.Lock()
+	fn()
+}
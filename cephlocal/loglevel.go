@@ -0,0 +1,53 @@
+package cephlocal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const LOG_LEVEL_PATH = "/log-level"
+
+// NewLogLevelHandler logs the changes made to sink through the log-level
+// endpoint of the debug server handler, once the handler has made them. A
+// change to a level that hides info messages is logged as an error, so that
+// lowering the level from info still shows up in the driver's log.
+func NewLogLevelHandler(logger lager.Logger, sink *lager.ReconfigurableSink, handler http.Handler) http.Handler {
+	logger = logger.Session("log-level")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != LOG_LEVEL_PATH {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logger.Error("failed-reading-request", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		from := sink.GetMinLevel()
+		handler.ServeHTTP(w, req)
+		to := sink.GetMinLevel()
+
+		if to == from {
+			if _, err := lager.LogLevelFromString(strings.ToLower(string(body))); err != nil {
+				logger.Info("unknown-log-level", lager.Data{"level": string(body), "remote_addr": req.RemoteAddr})
+			}
+			return
+		}
+
+		data := lager.Data{"from": from.String(), "to": to.String(), "remote_addr": req.RemoteAddr}
+		if to > lager.INFO {
+			logger.Error("changed-log-level", nil, data)
+			return
+		}
+		logger.Info("changed-log-level", data)
+	})
+}
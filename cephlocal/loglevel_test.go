@@ -0,0 +1,79 @@
+package cephlocal_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/debugserver"
+	"code.cloudfoundry.org/lager"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("NewLogLevelHandler", func() {
+	var (
+		buffer  *gbytes.Buffer
+		sink    *lager.ReconfigurableSink
+		handler http.Handler
+	)
+
+	BeforeEach(func() {
+		buffer = gbytes.NewBuffer()
+		sink = lager.NewReconfigurableSink(lager.NewWriterSink(buffer, lager.DEBUG), lager.INFO)
+		logger := lager.NewLogger("LogLevelTest")
+		logger.RegisterSink(sink)
+
+		handler = cephlocal.NewLogLevelHandler(logger, sink, debugserver.Handler(sink))
+	})
+
+	setLevel := func(level string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", cephlocal.LOG_LEVEL_PATH, strings.NewReader(level)))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+	}
+
+	It("raises the log level and logs the change", func() {
+		setLevel("debug")
+		Expect(sink.GetMinLevel()).To(Equal(lager.DEBUG))
+		Expect(buffer).To(gbytes.Say(`"message":"LogLevelTest.log-level.changed-log-level".*"from":"info".*"to":"debug"`))
+	})
+
+	It("logs the change as an error when lowering the log level hides info messages", func() {
+		setLevel("error")
+		Expect(sink.GetMinLevel()).To(Equal(lager.ERROR))
+		Expect(buffer).To(gbytes.Say(`"message":"LogLevelTest.log-level.changed-log-level","log_level":2,.*"from":"info".*"to":"error"`))
+	})
+
+	It("logs changes made with the short names the debug server accepts", func() {
+		setLevel("0")
+		Expect(sink.GetMinLevel()).To(Equal(lager.DEBUG))
+		Expect(buffer).To(gbytes.Say(`"message":"LogLevelTest.log-level.changed-log-level".*"to":"debug"`))
+	})
+
+	It("logs nothing when the debug server does not change the level", func() {
+		logger := lager.NewLogger("LogLevelTest")
+		logger.RegisterSink(sink)
+		handler = cephlocal.NewLogLevelHandler(logger, sink, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+		setLevel("debug")
+		Expect(sink.GetMinLevel()).To(Equal(lager.INFO))
+		Expect(buffer.Contents()).NotTo(ContainSubstring("log-level"))
+	})
+
+	It("leaves the level alone for unknown levels", func() {
+		setLevel("verbose")
+		Expect(sink.GetMinLevel()).To(Equal(lager.INFO))
+		Expect(buffer).To(gbytes.Say("unknown-log-level"))
+	})
+
+	It("passes other requests to the debug server", func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/pprof/", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+	})
+})
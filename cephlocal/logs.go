@@ -0,0 +1,217 @@
+package cephlocal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/invoker"
+	"github.com/tedsuo/ifrit"
+)
+
+const DEFAULT_LOG_MAX_SIZE = 10 * 1024 * 1024
+const DEFAULT_LOG_MAX_FILES = 5
+const DEFAULT_LOG_CHECK_INTERVAL = time.Minute
+
+// A StreamingInvoker runs commands, handing their output to a writer as the
+// command produces it rather than once it exits.
+type StreamingInvoker interface {
+	invoker.Invoker
+	Stream(env voldriver.Env, executable string, args []string, output io.Writer) error
+}
+
+type streamingInvoker struct{}
+
+// NewStreamingInvoker runs commands directly, with their standard output and
+// standard error combined.
+func NewStreamingInvoker() StreamingInvoker {
+	return &streamingInvoker{}
+}
+
+func (i *streamingInvoker) Invoke(env voldriver.Env, executable string, args []string) ([]byte, error) {
+	output := &bytes.Buffer{}
+	err := i.Stream(env, executable, args, output)
+	return output.Bytes(), err
+}
+
+func (i *streamingInvoker) Stream(env voldriver.Env, executable string, args []string, output io.Writer) error {
+	cmd := exec.CommandContext(env.Context(), executable, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd.Run()
+}
+
+// stream runs a command through an invoker, handing its output to a writer
+// as it is produced when the invoker can, and once the command exits
+// otherwise.
+func stream(useInvoker invoker.Invoker, env voldriver.Env, executable string, args []string, output io.Writer) error {
+	if streaming, ok := useInvoker.(StreamingInvoker); ok {
+		return streaming.Stream(env, executable, args, output)
+	}
+	out, err := useInvoker.Invoke(env, executable, args)
+	output.Write(out)
+	return err
+}
+
+// invoke runs a command and logs its output one line at a time as the
+// command writes it, tagged with a sequence number for the invocation so
+// that the lines of concurrent commands can be told apart.
+func (d *LocalDriver) invoke(env voldriver.Env, executable string, args []string) ([]byte, error) {
+	invocation := atomic.AddUint64(&d.invocations, 1)
+	logger := env.Logger().Session("invoke", lager.Data{"executable": executable, "invocation": invocation})
+	logger.Info("start", lager.Data{"args": args})
+	defer logger.Info("end")
+
+	var output bytes.Buffer
+	lines := &outputLogger{logger: logger}
+	err := stream(d.useInvoker, env, executable, args, io.MultiWriter(&output, lines))
+	lines.flush()
+
+	if err != nil {
+		logger.Error("failed", err)
+	}
+	return output.Bytes(), err
+}
+
+// outputLogger logs each line written to it.
+type outputLogger struct {
+	logger  lager.Logger
+	partial []byte
+}
+
+func (w *outputLogger) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.log(w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+}
+
+// flush logs the last line of output when it has no newline.
+func (w *outputLogger) flush() {
+	w.log(w.partial)
+	w.partial = nil
+}
+
+func (w *outputLogger) log(line []byte) {
+	if len(line) > 0 {
+		w.logger.Info("output", lager.Data{"line": string(line)})
+	}
+}
+
+// shareLogFile is the file ceph-fuse logs to for the share with the given
+// key, or "" when the driver has no log directory. It does not depend on the
+// share being mounted, so that the log of a failed mount can still be found.
+func (d *LocalDriver) shareLogFile(key string) string {
+	if d.logDir == "" {
+		return ""
+	}
+	return filepath.Join(d.logDir, fmt.Sprintf("ceph-fuse-%s.log", key))
+}
+
+// rotateLog moves a log file that has grown to the maximum size aside,
+// keeping at most the configured number of older files as <path>.1 (newest)
+// to <path>.<n> (oldest). It reports whether the file was moved.
+func (d *LocalDriver) rotateLog(logger lager.Logger, path string) bool {
+	info, err := d.os.Stat(path)
+	if err != nil || info.Size() < d.logMaxSize {
+		return false
+	}
+
+	logger.Info("rotating-log", lager.Data{"log_file": path, "size": info.Size()})
+
+	oldest := fmt.Sprintf("%s.%d", path, d.logMaxFiles)
+	if err := d.os.Remove(oldest); err != nil && !d.os.IsNotExist(err) {
+		logger.Error("failed-removing-old-log", err, lager.Data{"log_file": oldest})
+	}
+
+	for i := d.logMaxFiles - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", path, i)
+		if err := d.os.Rename(from, fmt.Sprintf("%s.%d", path, i+1)); err != nil && !d.os.IsNotExist(err) {
+			logger.Error("failed-rotating-log", err, lager.Data{"log_file": from})
+		}
+	}
+
+	if err := d.os.Rename(path, path+".1"); err != nil {
+		logger.Error("failed-rotating-log", err, lager.Data{"log_file": path})
+		return false
+	}
+	return true
+}
+
+// logArgs prepares the log file of a share and returns the ceph-fuse
+// arguments that direct its log there.
+func (d *LocalDriver) logArgs(logger lager.Logger, key string) []string {
+	logFile := d.shareLogFile(key)
+	if logFile == "" {
+		return nil
+	}
+
+	if err := d.os.MkdirAll(d.logDir, os.ModePerm); err != nil {
+		logger.Error("failed-creating-log-dir", err)
+		return nil
+	}
+	d.rotateLog(logger, logFile)
+	return []string{"--log-file", logFile}
+}
+
+// RotateLogs rotates the log files of mounted shares that have grown to the
+// maximum size, and has their ceph-fuse reopen its log through its admin
+// socket. Shares without an admin socket have their log rotated when they
+// are next mounted instead. It returns the number of logs rotated.
+func (d *LocalDriver) RotateLogs(env voldriver.Env) int {
+	logger := env.Logger().Session("rotate-logs")
+	logger.Debug("start")
+	defer logger.Debug("end")
+
+	if d.logDir == "" {
+		return 0
+	}
+
+	rotated := 0
+	for key, socket := range d.shareAdminSockets() {
+		logFile := d.shareLogFile(key)
+		if !d.rotateLog(logger, logFile) {
+			continue
+		}
+		rotated++
+
+		if _, err := d.adminSocket.Command(socket, "log reopen"); err != nil {
+			logger.Error("failed-reopening-log", err, lager.Data{"log_file": logFile, "admin_socket": socket})
+		}
+	}
+	return rotated
+}
+
+// LogRotatorRunner rotates the log files of mounted shares every log check
+// interval of the driver until it is signalled.
+func (d *LocalDriver) LogRotatorRunner(logger lager.Logger) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		env := driverhttp.NewHttpDriverEnv(logger.Session("log-rotator"), context.Background())
+		ticker := time.NewTicker(d.logCheckInterval)
+		defer ticker.Stop()
+
+		close(ready)
+		for {
+			select {
+			case <-ticker.C:
+				d.RotateLogs(env)
+			case <-signals:
+				return nil
+			}
+		}
+	})
+}
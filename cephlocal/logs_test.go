@@ -0,0 +1,221 @@
+package cephlocal_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/invoker"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+// streamingInvoker writes part of the output of ceph-fuse, and the rest once
+// it is released.
+type streamingInvoker struct {
+	*voldriverfakes.FakeInvoker
+	release chan struct{}
+}
+
+func (i *streamingInvoker) Stream(env voldriver.Env, executable string, args []string, output io.Writer) error {
+	if executable != cephlocal.MOUNT_CMD {
+		out, err := i.Invoke(env, executable, args)
+		output.Write(out)
+		return err
+	}
+	output.Write([]byte("ceph-fuse[1]: starting ceph client\nceph-fuse[1]: starting "))
+	<-i.release
+	output.Write([]byte("fuse"))
+	return nil
+}
+
+var _ = Describe("ceph-fuse logs", func() {
+	var (
+		driver      *cephlocal.LocalDriver
+		useInvoker  invoker.Invoker
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeOs      *os_fake.FakeOs
+		logger      *lagertest.TestLogger
+		testEnv     voldriver.Env
+		config      cephlocal.LocalDriverConfig
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		useInvoker = fakeInvoker
+		fakeOs = new(os_fake.FakeOs)
+		fakeOs.StatReturns(nil, errors.New("no such file"))
+		fakeOs.IsNotExistReturns(true)
+		logger = lagertest.NewTestLogger("LogsTest")
+		testEnv = driverhttp.NewHttpDriverEnv(logger, context.TODO())
+		config = cephlocal.LocalDriverConfig{RootDir: "some-root", LogDir: "some-logs", LogMaxSize: 100, LogMaxFiles: 2}
+	})
+
+	JustBeforeEach(func() {
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(useInvoker, fakeOs, new(ioutil_fake.FakeIoutil), config)
+		createSuccessful(testEnv, driver, "volume-name", map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "/"})
+	})
+
+	cephFuseArgs := func() []string {
+		for i := 0; i < fakeInvoker.InvokeCallCount(); i++ {
+			_, executable, args := fakeInvoker.InvokeArgsForCall(i)
+			if executable == cephlocal.MOUNT_CMD {
+				return args
+			}
+		}
+		return nil
+	}
+
+	It("passes a log file under the log directory to ceph-fuse", func() {
+		mountSuccessfulWithID(testEnv, driver, "volume-name", "container-1")
+
+		args := cephFuseArgs()
+		Expect(args[0]).To(Equal("--log-file"))
+		Expect(args[1]).To(HavePrefix("some-logs/ceph-fuse-"))
+		Expect(args[1]).To(HaveSuffix(".log"))
+
+		details, _ := driver.VolumeDetails(testEnv, "volume-name")
+		Expect(details.LogFile).To(Equal(args[1]))
+	})
+
+	Context("without a log directory", func() {
+		BeforeEach(func() {
+			config.LogDir = ""
+		})
+
+		It("leaves ceph-fuse logging alone", func() {
+			mountSuccessfulWithID(testEnv, driver, "volume-name", "container-1")
+			Expect(cephFuseArgs()).NotTo(ContainElement("--log-file"))
+		})
+	})
+
+	Context("when the log file has reached its maximum size", func() {
+		BeforeEach(func() {
+			fakeOs.StatStub = func(path string) (os.FileInfo, error) {
+				if strings.HasSuffix(path, ".log") {
+					return fileInfo{size: 100}, nil
+				}
+				return nil, errors.New("no such file")
+			}
+		})
+
+		It("rotates it before mounting", func() {
+			mountSuccessfulWithID(testEnv, driver, "volume-name", "container-1")
+			logFile := cephFuseArgs()[1]
+
+			Expect(fakeOs.RemoveArgsForCall(0)).To(Equal(logFile + ".2"))
+			Expect(fakeOs.RenameCallCount()).To(Equal(2))
+			from, to := fakeOs.RenameArgsForCall(0)
+			Expect([]string{from, to}).To(Equal([]string{logFile + ".1", logFile + ".2"}))
+			from, to = fakeOs.RenameArgsForCall(1)
+			Expect([]string{from, to}).To(Equal([]string{logFile, logFile + ".1"}))
+		})
+	})
+
+	It("logs the output of failed commands line by line", func() {
+		fakeInvoker.InvokeReturns([]byte("ceph-fuse[1]: starting ceph client\nceph mount failed with (110) Connection timed out\n"), errors.New("exit status 1"))
+
+		mountResponse := driver.Mount(testEnv, voldriver.MountRequest{Name: "volume-name", ID: "container-1"})
+		Expect(mountResponse.Err).NotTo(BeEmpty())
+
+		Expect(logger).To(gbytes.Say(`"line":"ceph-fuse\[1\]: starting ceph client"`))
+		Expect(logger).To(gbytes.Say(`"line":"ceph mount failed with \(110\) Connection timed out"`))
+		Expect(string(logger.Buffer().Contents())).To(ContainSubstring(`"volume_name":"volume-name"`))
+	})
+
+	Context("when the invoker streams the output of commands", func() {
+		var release chan struct{}
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			useInvoker = &streamingInvoker{FakeInvoker: fakeInvoker, release: release}
+		})
+
+		It("logs each line as the command writes it", func() {
+			mounted := make(chan voldriver.MountResponse)
+			go func() {
+				mounted <- driver.Mount(testEnv, voldriver.MountRequest{Name: "volume-name", ID: "container-1"})
+			}()
+
+			Eventually(logger).Should(gbytes.Say(`"line":"ceph-fuse\[1\]: starting ceph client"`))
+			Consistently(mounted).ShouldNot(Receive())
+
+			close(release)
+			Expect((<-mounted).Err).To(BeEmpty())
+			Expect(logger).To(gbytes.Say(`"line":"ceph-fuse\[1\]: starting fuse"`))
+		})
+	})
+
+	Context("when a mounted share's log file has reached its maximum size", func() {
+		var adminSocket *fakeAdminSocket
+
+		BeforeEach(func() {
+			adminSocket = &fakeAdminSocket{}
+			config.AdminSocketDir = "some-root/sockets"
+			config.AdminSocket = adminSocket
+			config.LogCheckInterval = 10 * time.Millisecond
+		})
+
+		JustBeforeEach(func() {
+			mountSuccessfulWithID(testEnv, driver, "volume-name", "container-1")
+			fakeOs.StatStub = func(path string) (os.FileInfo, error) {
+				if strings.HasSuffix(path, ".log") {
+					return fileInfo{size: 100}, nil
+				}
+				return nil, errors.New("no such file")
+			}
+		})
+
+		It("rotates it and has ceph-fuse reopen it", func() {
+			logFile := cephFuseArgs()[1]
+
+			Expect(driver.RotateLogs(testEnv)).To(Equal(1))
+			from, to := fakeOs.RenameArgsForCall(fakeOs.RenameCallCount() - 1)
+			Expect([]string{from, to}).To(Equal([]string{logFile, logFile + ".1"}))
+			Expect(adminSocket.commands).To(Equal([]string{"log reopen"}))
+		})
+
+		It("rotates it in the background", func() {
+			process := ifrit.Invoke(driver.LogRotatorRunner(logger))
+			defer func() {
+				process.Signal(os.Interrupt)
+				Eventually(process.Wait()).Should(Receive())
+			}()
+
+			Eventually(func() int {
+				adminSocket.lock.Lock()
+				defer adminSocket.lock.Unlock()
+				return len(adminSocket.commands)
+			}).Should(BeNumerically(">", 0))
+		})
+	})
+
+	Context("when a mounted share's log file is below its maximum size", func() {
+		It("leaves it alone", func() {
+			mountSuccessfulWithID(testEnv, driver, "volume-name", "container-1")
+			Expect(driver.RotateLogs(testEnv)).To(Equal(0))
+			Expect(fakeOs.RenameCallCount()).To(Equal(0))
+		})
+	})
+
+	It("runs commands with their output streamed", func() {
+		output, err := cephlocal.NewStreamingInvoker().Invoke(testEnv, "sh", []string{"-c", "echo out; echo err >&2"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(output)).To(Equal("out\nerr\n"))
+	})
+})
@@ -0,0 +1,371 @@
+package cephlocal
+
+import (
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/invoker"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const METRICS_NAMESPACE = "cephdriver"
+
+const (
+	OUTCOME_SUCCESS = "success"
+	OUTCOME_ERROR   = "error"
+)
+
+// Commands that could not be started, or were killed before exiting, are
+// labelled with this exit code.
+const EXIT_CODE_NONE = "none"
+
+// Metrics records the driver's voldriver operations and the commands it
+// invokes, and serves them together with the state of the volumes of the
+// driver being collected in the Prometheus exposition format.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	operations        *prometheus.CounterVec
+	operationDuration *prometheus.HistogramVec
+	commandDuration   *prometheus.HistogramVec
+	driver            *driverCollector
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "operations_total",
+			Help:      "Number of voldriver operations handled, by operation and outcome.",
+		}, []string{"operation", "outcome"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "operation_duration_seconds",
+			Help:      "Time taken to handle voldriver operations, by operation and outcome.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"operation", "outcome"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "command_duration_seconds",
+			Help:      "Time taken by ceph-fuse, fusermount and mount commands, by executable and exit code.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"executable", "exit_code"}),
+		driver: &driverCollector{},
+	}
+
+	m.registry.MustRegister(m.operations, m.operationDuration, m.commandDuration, m.driver)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// CollectDriver reports the volumes, holders and shares of driver from now
+// on, in place of any driver collected before.
+func (m *Metrics) CollectDriver(driver *LocalDriver) {
+	m.driver.setDriver(driver)
+}
+
+func (m *Metrics) observeOperation(operation string, err string, start time.Time) {
+	outcome := OUTCOME_SUCCESS
+	if err != "" {
+		outcome = OUTCOME_ERROR
+	}
+	m.operations.WithLabelValues(operation, outcome).Inc()
+	m.operationDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeCommand(executable string, err error, start time.Time) {
+	m.commandDuration.WithLabelValues(executable, exitCode(err)).Observe(time.Since(start).Seconds())
+}
+
+func exitCode(err error) string {
+	if err == nil {
+		return "0"
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+		return strconv.Itoa(exitErr.ExitCode())
+	}
+	return EXIT_CODE_NONE
+}
+
+type driverCollector struct {
+	lock   sync.Mutex
+	driver *LocalDriver
+}
+
+var (
+	volumesDesc        = prometheus.NewDesc(METRICS_NAMESPACE+"_volumes", "Number of volumes registered with the driver.", nil, nil)
+	mountedVolumesDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_mounted_volumes", "Number of volumes with at least one holder.", nil, nil)
+	holdersDesc        = prometheus.NewDesc(METRICS_NAMESPACE+"_holders", "Number of holders across all volumes.", nil, nil)
+	staleMountsDesc    = prometheus.NewDesc(METRICS_NAMESPACE+"_stale_mounts", "Number of ceph-fuse mounts that no longer respond.", nil, nil)
+	fuseProcessesDesc  = prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_processes", "Number of ceph-fuse processes supervised by the driver.", nil, nil)
+	fuseExitsDesc      = prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_exits_total", "Number of times a supervised ceph-fuse process exited while its share was mounted.", nil, nil)
+	fuseRestartsDesc   = prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_restarts_total", "Number of times a share was mounted again after its ceph-fuse process exited.", nil, nil)
+	fuseEvictionsDesc  = prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_evictions_total", "Number of times the MDS evicted the ceph-fuse client of a mounted share.", nil, nil)
+	evictedSharesDesc  = prometheus.NewDesc(METRICS_NAMESPACE+"_evicted_shares", "Number of shares whose ceph-fuse client is evicted and not yet mounted again.", nil, nil)
+	idleReapedDesc     = prometheus.NewDesc(METRICS_NAMESPACE+"_idle_reaped_total", "Number of holders unmounted by the idle policy.", nil, nil)
+	pendingMountsDesc  = prometheus.NewDesc(METRICS_NAMESPACE+"_pending_mounts", "Number of asynchronous mounts in progress.", nil, nil)
+
+	admissionRunningDesc    = prometheus.NewDesc(METRICS_NAMESPACE+"_admission_running", "Number of mount and unmount calls admitted and running.", nil, nil)
+	admissionQueueDepthDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_admission_queue_depth", "Number of mount and unmount calls waiting to be admitted.", nil, nil)
+	admissionRejectedDesc   = prometheus.NewDesc(METRICS_NAMESPACE+"_admission_rejections_total", "Number of mount and unmount calls rejected by admission control, by reason.", []string{"reason"}, nil)
+	eventSubscribersDesc    = prometheus.NewDesc(METRICS_NAMESPACE+"_event_subscribers", "Number of consumers streaming volume lifecycle events.", nil, nil)
+	eventsDroppedDesc       = prometheus.NewDesc(METRICS_NAMESPACE+"_events_dropped_total", "Number of volume lifecycle events dropped for consumers that fell behind.", nil, nil)
+
+	fuseAdminSocketUpDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_admin_socket_up", "Whether the admin socket of a share's ceph-fuse process answered.", []string{"share"}, nil)
+	fuseMDSSessionsDesc   = prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_mds_sessions", "Number of MDS sessions of a share's ceph-fuse client, by session state.", []string{"share", "state"}, nil)
+	fuseCapsDesc          = prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_caps", "Number of capabilities a share's ceph-fuse client holds across its MDS sessions.", []string{"share"}, nil)
+	fuseInodesDesc        = prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_cached_inodes", "Number of inodes in the cache of a share's ceph-fuse client.", []string{"share"}, nil)
+	fuseDentriesDesc      = prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_cached_dentries", "Number of dentries in the cache of a share's ceph-fuse client.", []string{"share"}, nil)
+)
+
+// fusePerfCounters are the perf dump counters of ceph-fuse exported for each
+// share, by their dotted name in the dump; the dump itself says neither which
+// are counters nor which are gauges.
+var fusePerfCounters = []struct {
+	counter   string
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+}{
+	{"client.reply.avgcount", prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_mds_replies_total", "Number of replies a share's ceph-fuse client has had from the MDS.", []string{"share"}, nil), prometheus.CounterValue},
+	{"client.reply.sum", prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_mds_reply_seconds_total", "Time a share's ceph-fuse client has spent waiting for replies from the MDS.", []string{"share"}, nil), prometheus.CounterValue},
+	{"objecter.op_active", prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_osd_ops_in_flight", "Number of operations a share's ceph-fuse client has in flight to the OSDs.", []string{"share"}, nil), prometheus.GaugeValue},
+	{"objecter.op_laggy", prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_osd_ops_laggy", "Number of operations of a share's ceph-fuse client waiting on OSDs that are laggy.", []string{"share"}, nil), prometheus.GaugeValue},
+	{"objecter.op_r", prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_osd_reads_total", "Number of read operations a share's ceph-fuse client has sent to the OSDs.", []string{"share"}, nil), prometheus.CounterValue},
+	{"objecter.op_w", prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_osd_writes_total", "Number of write operations a share's ceph-fuse client has sent to the OSDs.", []string{"share"}, nil), prometheus.CounterValue},
+	{"objectcacher-libcephfs.cache_ops_hit", prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_cache_hits_total", "Number of reads the object cache of a share's ceph-fuse client answered.", []string{"share"}, nil), prometheus.CounterValue},
+	{"objectcacher-libcephfs.cache_ops_miss", prometheus.NewDesc(METRICS_NAMESPACE+"_fuse_cache_misses_total", "Number of reads the object cache of a share's ceph-fuse client had to pass on to the OSDs.", []string{"share"}, nil), prometheus.CounterValue},
+}
+
+func (c *driverCollector) setDriver(driver *LocalDriver) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.driver = driver
+}
+
+func (c *driverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumesDesc
+	ch <- mountedVolumesDesc
+	ch <- holdersDesc
+	ch <- staleMountsDesc
+	ch <- fuseProcessesDesc
+	ch <- fuseExitsDesc
+	ch <- fuseRestartsDesc
+	ch <- fuseEvictionsDesc
+	ch <- evictedSharesDesc
+	ch <- idleReapedDesc
+	ch <- pendingMountsDesc
+	ch <- admissionRunningDesc
+	ch <- admissionQueueDepthDesc
+	ch <- admissionRejectedDesc
+	ch <- eventSubscribersDesc
+	ch <- eventsDroppedDesc
+	ch <- fuseAdminSocketUpDesc
+	ch <- fuseMDSSessionsDesc
+	ch <- fuseCapsDesc
+	ch <- fuseInodesDesc
+	ch <- fuseDentriesDesc
+	for _, counter := range fusePerfCounters {
+		ch <- counter.desc
+	}
+}
+
+func (c *driverCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	driver := c.driver
+	c.lock.Unlock()
+
+	if driver == nil {
+		return
+	}
+
+	volumes, mounted, holders, shareMountPoints := driver.mountStats()
+
+	// Share mount points are checked without holding the driver lock, as a
+	// hung ceph-fuse mount may take until the stale mount timeout to answer.
+	stale := 0
+	for _, mountPoint := range shareMountPoints {
+		if driver.isStaleMount(mountPoint) {
+			stale++
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(volumesDesc, prometheus.GaugeValue, float64(volumes))
+	ch <- prometheus.MustNewConstMetric(mountedVolumesDesc, prometheus.GaugeValue, float64(mounted))
+	ch <- prometheus.MustNewConstMetric(holdersDesc, prometheus.GaugeValue, float64(holders))
+	ch <- prometheus.MustNewConstMetric(staleMountsDesc, prometheus.GaugeValue, float64(stale))
+
+	running, exits, restarts := driver.fuseStats()
+	ch <- prometheus.MustNewConstMetric(fuseProcessesDesc, prometheus.GaugeValue, float64(running))
+	ch <- prometheus.MustNewConstMetric(fuseExitsDesc, prometheus.CounterValue, float64(exits))
+	ch <- prometheus.MustNewConstMetric(fuseRestartsDesc, prometheus.CounterValue, float64(restarts))
+
+	evicted, evictions := driver.evictionStats()
+	ch <- prometheus.MustNewConstMetric(fuseEvictionsDesc, prometheus.CounterValue, float64(evictions))
+	ch <- prometheus.MustNewConstMetric(evictedSharesDesc, prometheus.GaugeValue, float64(evicted))
+	ch <- prometheus.MustNewConstMetric(idleReapedDesc, prometheus.CounterValue, float64(driver.idleStats()))
+	ch <- prometheus.MustNewConstMetric(pendingMountsDesc, prometheus.GaugeValue, float64(driver.pendingMounts()))
+
+	admitted, queued, rejected := driver.admissionStats()
+	ch <- prometheus.MustNewConstMetric(admissionRunningDesc, prometheus.GaugeValue, float64(admitted))
+	ch <- prometheus.MustNewConstMetric(admissionQueueDepthDesc, prometheus.GaugeValue, float64(queued))
+	for reason, count := range rejected {
+		ch <- prometheus.MustNewConstMetric(admissionRejectedDesc, prometheus.CounterValue, float64(count), reason)
+	}
+
+	subscribers, dropped := driver.eventStats()
+	ch <- prometheus.MustNewConstMetric(eventSubscribersDesc, prometheus.GaugeValue, float64(subscribers))
+	ch <- prometheus.MustNewConstMetric(eventsDroppedDesc, prometheus.CounterValue, float64(dropped))
+
+	for key, cached := range driver.cachedFuseDiagnostics() {
+		if cached.err != nil {
+			ch <- prometheus.MustNewConstMetric(fuseAdminSocketUpDesc, prometheus.GaugeValue, 0, key)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(fuseAdminSocketUpDesc, prometheus.GaugeValue, 1, key)
+		collectFuseDiagnostics(ch, key, cached.diagnostics)
+	}
+}
+
+func collectFuseDiagnostics(ch chan<- prometheus.Metric, key string, diagnostics FuseDiagnostics) {
+	sessions := map[string]int{}
+	caps := int64(0)
+	for _, session := range diagnostics.MDSSessions {
+		sessions[session.State]++
+		caps += session.NumCaps
+	}
+	for state, count := range sessions {
+		ch <- prometheus.MustNewConstMetric(fuseMDSSessionsDesc, prometheus.GaugeValue, float64(count), key, state)
+	}
+
+	ch <- prometheus.MustNewConstMetric(fuseCapsDesc, prometheus.GaugeValue, float64(caps), key)
+	ch <- prometheus.MustNewConstMetric(fuseInodesDesc, prometheus.GaugeValue, float64(diagnostics.InodeCount), key)
+	ch <- prometheus.MustNewConstMetric(fuseDentriesDesc, prometheus.GaugeValue, float64(diagnostics.DentryCount), key)
+
+	for _, counter := range fusePerfCounters {
+		if value, ok := diagnostics.PerfCounters[counter.counter]; ok {
+			ch <- prometheus.MustNewConstMetric(counter.desc, counter.valueType, value, key)
+		}
+	}
+}
+
+func (d *LocalDriver) mountStats() (volumes int, mounted int, holders int, shareMountPoints []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, volume := range d.volumes {
+		volumes++
+		if volume.mounted() {
+			mounted++
+		}
+		holders += len(volume.Holders)
+	}
+
+	for _, share := range d.shares {
+		shareMountPoints = append(shareMountPoints, share.MountPoint)
+	}
+	return volumes, mounted, holders, shareMountPoints
+}
+
+type instrumentedInvoker struct {
+	invoker invoker.Invoker
+	metrics *Metrics
+}
+
+// NewInstrumentedInvoker times every command run through invoker.
+func NewInstrumentedInvoker(invoker invoker.Invoker, metrics *Metrics) invoker.Invoker {
+	return &instrumentedInvoker{invoker: invoker, metrics: metrics}
+}
+
+func (i *instrumentedInvoker) Invoke(env voldriver.Env, executable string, args []string) ([]byte, error) {
+	start := time.Now()
+	output, err := i.invoker.Invoke(env, executable, args)
+	i.metrics.observeCommand(executable, err, start)
+	return output, err
+}
+
+func (i *instrumentedInvoker) Stream(env voldriver.Env, executable string, args []string, output io.Writer) error {
+	start := time.Now()
+	err := stream(i.invoker, env, executable, args, output)
+	i.metrics.observeCommand(executable, err, start)
+	return err
+}
+
+type instrumentedDriver struct {
+	driver  voldriver.Driver
+	metrics *Metrics
+}
+
+// NewInstrumentedDriver counts and times every voldriver operation handled
+// by driver.
+func NewInstrumentedDriver(driver voldriver.Driver, metrics *Metrics) voldriver.Driver {
+	return &instrumentedDriver{driver: driver, metrics: metrics}
+}
+
+func (i *instrumentedDriver) Activate(env voldriver.Env) voldriver.ActivateResponse {
+	defer i.metrics.observeOperation("activate", "", time.Now())
+	return i.driver.Activate(env)
+}
+
+func (i *instrumentedDriver) Capabilities(env voldriver.Env) voldriver.CapabilitiesResponse {
+	defer i.metrics.observeOperation("capabilities", "", time.Now())
+	return i.driver.Capabilities(env)
+}
+
+func (i *instrumentedDriver) Create(env voldriver.Env, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	start := time.Now()
+	response := i.driver.Create(env, createRequest)
+	i.metrics.observeOperation("create", response.Err, start)
+	return response
+}
+
+func (i *instrumentedDriver) Get(env voldriver.Env, getRequest voldriver.GetRequest) voldriver.GetResponse {
+	start := time.Now()
+	response := i.driver.Get(env, getRequest)
+	i.metrics.observeOperation("get", response.Err, start)
+	return response
+}
+
+func (i *instrumentedDriver) List(env voldriver.Env) voldriver.ListResponse {
+	start := time.Now()
+	response := i.driver.List(env)
+	i.metrics.observeOperation("list", response.Err, start)
+	return response
+}
+
+func (i *instrumentedDriver) Mount(env voldriver.Env, mountRequest voldriver.MountRequest) voldriver.MountResponse {
+	start := time.Now()
+	response := i.driver.Mount(env, mountRequest)
+	i.metrics.observeOperation("mount", response.Err, start)
+	return response
+}
+
+func (i *instrumentedDriver) Path(env voldriver.Env, pathRequest voldriver.PathRequest) voldriver.PathResponse {
+	start := time.Now()
+	response := i.driver.Path(env, pathRequest)
+	i.metrics.observeOperation("path", response.Err, start)
+	return response
+}
+
+func (i *instrumentedDriver) Unmount(env voldriver.Env, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
+	start := time.Now()
+	response := i.driver.Unmount(env, unmountRequest)
+	i.metrics.observeOperation("unmount", response.Err, start)
+	return response
+}
+
+func (i *instrumentedDriver) Remove(env voldriver.Env, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
+	start := time.Now()
+	response := i.driver.Remove(env, removeRequest)
+	i.metrics.observeOperation("remove", response.Err, start)
+	return response
+}
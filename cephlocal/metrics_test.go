@@ -0,0 +1,98 @@
+package cephlocal_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"syscall"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	const volumeName = "volume-name"
+
+	var (
+		metrics     *cephlocal.Metrics
+		localDriver *cephlocal.LocalDriver
+		driver      voldriver.Driver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeOs      *os_fake.FakeOs
+		testEnv     voldriver.Env
+	)
+
+	BeforeEach(func() {
+		metrics = cephlocal.NewMetrics()
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeOs = new(os_fake.FakeOs)
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("MetricsTest"), context.TODO())
+
+		localDriver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(cephlocal.NewInstrumentedInvoker(fakeInvoker, metrics), fakeOs, new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root"})
+		metrics.CollectDriver(localDriver)
+		driver = cephlocal.NewInstrumentedDriver(localDriver, metrics)
+	})
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body, err := ioutil.ReadAll(recorder.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return string(body)
+	}
+
+	It("counts operations by outcome", func() {
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+		getUnsuccessful(testEnv, driver, "unknown")
+
+		body := scrape()
+		Expect(body).To(ContainSubstring(`cephdriver_operations_total{operation="create",outcome="success"} 1`))
+		Expect(body).To(ContainSubstring(`cephdriver_operations_total{operation="get",outcome="error"} 1`))
+		Expect(body).To(ContainSubstring(`cephdriver_operation_duration_seconds_count{operation="create",outcome="success"} 1`))
+	})
+
+	It("times invoked commands by exit code", func() {
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+		fakeInvoker.InvokeReturns(nil, errors.New("not started"))
+		driver.Unmount(testEnv, voldriver.UnmountRequest{Name: volumeName, ID: "container-1"})
+
+		body := scrape()
+		Expect(body).To(ContainSubstring(`cephdriver_command_duration_seconds_count{executable="ceph-fuse",exit_code="0"} 1`))
+		Expect(body).To(ContainSubstring(`cephdriver_command_duration_seconds_count{executable="umount",exit_code="none"} 1`))
+	})
+
+	Context("when a volume is mounted", func() {
+		BeforeEach(func() {
+			createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+			createSuccessful(testEnv, driver, "other-volume", map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-2")
+		})
+
+		It("reports the volumes and holders", func() {
+			body := scrape()
+			Expect(body).To(ContainSubstring("cephdriver_volumes 2"))
+			Expect(body).To(ContainSubstring("cephdriver_mounted_volumes 1"))
+			Expect(body).To(ContainSubstring("cephdriver_holders 2"))
+			Expect(body).To(ContainSubstring("cephdriver_stale_mounts 0"))
+		})
+
+		It("reports ceph-fuse mounts that are no longer connected as stale", func() {
+			fakeOs.StatReturns(nil, &os.PathError{Op: "stat", Path: "some-root/shares", Err: syscall.ENOTCONN})
+			Expect(scrape()).To(ContainSubstring("cephdriver_stale_mounts 1"))
+		})
+	})
+})
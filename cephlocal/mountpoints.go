@@ -0,0 +1,161 @@
+package cephlocal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const VOLUME_NAME_REGEX string = `^[a-zA-Z0-9][a-zA-Z0-9_.@-]*$`
+
+const maxSymlinkHops = 40
+
+func isValidVolumeName(name string) bool {
+	re := regexp.MustCompile(VOLUME_NAME_REGEX)
+	return re.MatchString(name)
+}
+
+// isValidHolderID reports whether the ID a caller holds a volume under can
+// name its bind mount under the volume's mount point: like a volume name it
+// may not contain separators or be '..', and it may not pass for a holder ID
+// the driver generated for a caller without one.
+func isValidHolderID(id string) bool {
+	return isValidVolumeName(id) && !strings.HasPrefix(id, ANONYMOUS_HOLDER_PREFIX)
+}
+
+func invalidHolderIDError(id string) *Error {
+	return newError(ERR_INVALID_HOLDER_ID, "Invalid holder ID '%s'", id)
+}
+
+// volumeMountPoint is the driver-managed directory that holds the bind mounts of a volume.
+func (d *LocalDriver) volumeMountPoint(name string) string {
+	return filepath.Join(d.rootDir, "volumes", name)
+}
+
+// isAllowedMountPoint reports whether a caller-supplied mount point lies within
+// one of the allowed mount roots once '..' and symlinks have been resolved.
+func (d *LocalDriver) isAllowedMountPoint(path string) (bool, error) {
+	if !filepath.IsAbs(path) {
+		return false, nil
+	}
+
+	resolved, err := d.resolvePath(path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, root := range d.allowedMountRoots {
+		resolvedRoot, err := d.resolvePath(root)
+		if err != nil {
+			return false, err
+		}
+		if resolved != resolvedRoot && strings.HasPrefix(resolved, resolvedRoot+string(filepath.Separator)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// resolvePath cleans an absolute path and resolves the symlinks of every
+// component that exists, leaving components that do not exist yet as they are.
+func (d *LocalDriver) resolvePath(path string) (string, error) {
+	hops := 0
+	resolved := string(filepath.Separator)
+	remaining := strings.Split(filepath.Clean(path), string(filepath.Separator))
+
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		info, err := d.os.Lstat(next)
+		if err != nil {
+			if d.os.IsNotExist(err) {
+				resolved = filepath.Join(append([]string{next}, remaining...)...)
+				break
+			}
+			return "", err
+		}
+
+		if info == nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+
+		target, err := d.os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = string(filepath.Separator)
+		}
+		remaining = append(strings.Split(target, string(filepath.Separator)), remaining...)
+	}
+
+	return filepath.Clean(resolved), nil
+}
+
+// resolveBeneath resolves the symlinks in a path relative to root the way
+// openat2's RESOLVE_BENEATH does: neither '..' nor a symlink may lead out of
+// root, so absolute symlinks are refused. Every component must exist.
+func (d *LocalDriver) resolveBeneath(root string, path string) (string, error) {
+	hops := 0
+	resolved := []string{}
+	remaining := strings.Split(filepath.Clean(path), string(filepath.Separator))
+
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			if len(resolved) == 0 {
+				return "", fmt.Errorf("%s leads out of %s", path, root)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		next := filepath.Join(append([]string{root}, append(resolved, component)...)...)
+		info, err := d.os.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+
+		if info == nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, component)
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+
+		target, err := d.os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			return "", fmt.Errorf("%s leads out of %s", path, root)
+		}
+		remaining = append(strings.Split(target, string(filepath.Separator)), remaining...)
+	}
+
+	return filepath.Join(append([]string{root}, resolved...)...), nil
+}
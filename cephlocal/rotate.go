@@ -0,0 +1,168 @@
+package cephlocal
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+const KEYRING_CLIENT_REGEX string = `(?m)^\s*\[client\.([^\]]+)\]\s*$`
+
+type RotateKeyringRequest struct {
+	// Name selects a single volume. It is ignored when ClientID is set.
+	Name string
+	// ClientID selects every volume whose keyring belongs to this cephx client.
+	ClientID string
+	Keyring  string
+}
+
+type RotateKeyringResponse struct {
+	// Volumes are the volumes whose keyring was replaced.
+	Volumes []string
+	Err     string
+}
+
+type rotation struct {
+	name           string
+	volume         *volumeMetadata
+	keyring        string
+	pendingChanges []string
+	remounted      bool
+}
+
+// keyringClientID returns the cephx client a keyring holds a key for, if any.
+func keyringClientID(keyring string) string {
+	re := regexp.MustCompile(KEYRING_CLIENT_REGEX)
+	matches := re.FindStringSubmatch(keyring)
+	if len(matches) < 2 {
+		return ""
+	}
+	return matches[1]
+}
+
+// RotateKeyring replaces the keyring of the selected volumes and remounts
+// the mounted ones onto a share using the new key, keeping their holders'
+// mount points. If any volume fails to mount with the new key, every volume
+// rotated so far is put back on its old keyring.
+func (d *LocalDriver) RotateKeyring(env voldriver.Env, rotateRequest RotateKeyringRequest) RotateKeyringResponse {
+	logger := env.Logger().Session("rotate-keyring", lager.Data{"volume_name": rotateRequest.Name, "client_id": rotateRequest.ClientID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if rotateRequest.Keyring == "" {
+		return RotateKeyringResponse{Err: newError(ERR_INVALID_KEYRING, "Missing mandatory 'Keyring'").Encode()}
+	}
+
+	if rotateRequest.ClientID != "" && keyringClientID(rotateRequest.Keyring) != rotateRequest.ClientID {
+		logger.Info("keyring-client-mismatch", lager.Data{"keyring_client_id": keyringClientID(rotateRequest.Keyring)})
+		return RotateKeyringResponse{Err: newError(ERR_INVALID_KEYRING, "Keyring is not for client '%s'", rotateRequest.ClientID).Encode()}
+	}
+
+	names, unlock, errResponse := d.lockVolumesToRotate(rotateRequest)
+	if errResponse.Err != "" {
+		logger.Info("no-volumes-to-rotate")
+		return RotateKeyringResponse{Err: errResponse.Err}
+	}
+	defer unlock()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	defer d.persist(logger)
+
+	env = driverhttp.EnvWithLogger(logger, env)
+	rotations := []*rotation{}
+	for _, name := range names {
+		volume := d.volumes[name]
+		r := &rotation{name: name, volume: volume, keyring: volume.Keyring, pendingChanges: volume.PendingChanges}
+		rotations = append(rotations, r)
+
+		response := d.update(env, UpdateRequest{Name: name, Opts: map[string]interface{}{"keyring": rotateRequest.Keyring}})
+		if response.Err != "" {
+			d.rollbackRotations(env, rotations)
+			return RotateKeyringResponse{Err: response.Err}
+		}
+
+		if !volume.mounted() {
+			continue
+		}
+
+		if err := d.remount(env, volume); err != nil {
+			logger.Error("failed-remounting-with-new-keyring", err, lager.Data{"volume_name": name})
+			d.rollbackRotations(env, rotations)
+			return RotateKeyringResponse{Err: wrapError(err, ERR_REMOUNT_FAILED, "Error rotating keyring of '%s' (%s)", name, err.Error()).Encode()}
+		}
+		r.remounted = true
+	}
+
+	logger.Info("rotated-keyring", lager.Data{"volumes": names})
+	return RotateKeyringResponse{Volumes: names}
+}
+
+// lockVolumesToRotate takes the locks of the volumes to rotate. Since they
+// are chosen under the state lock, which has to be let go to take them, they
+// are chosen again once held until the choice holds still.
+func (d *LocalDriver) lockVolumesToRotate(rotateRequest RotateKeyringRequest) ([]string, func(), voldriver.ErrorResponse) {
+	for {
+		d.lock.Lock()
+		names, errResponse := d.volumesToRotate(rotateRequest)
+		d.lock.Unlock()
+		if errResponse.Err != "" {
+			return nil, nil, errResponse
+		}
+
+		unlock := d.lockVolumes(names...)
+
+		d.lock.Lock()
+		locked, errResponse := d.volumesToRotate(rotateRequest)
+		d.lock.Unlock()
+		if errResponse.Err == "" && reflect.DeepEqual(names, locked) {
+			return names, unlock, errResponse
+		}
+		unlock()
+	}
+}
+
+func (d *LocalDriver) volumesToRotate(rotateRequest RotateKeyringRequest) ([]string, voldriver.ErrorResponse) {
+	if rotateRequest.ClientID == "" {
+		if _, ok := d.volumes[rotateRequest.Name]; !ok {
+			return nil, voldriver.ErrorResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", rotateRequest.Name).Encode()}
+		}
+		return []string{rotateRequest.Name}, voldriver.ErrorResponse{}
+	}
+
+	names := []string{}
+	for name, volume := range d.volumes {
+		if keyringClientID(volume.Keyring) == rotateRequest.ClientID {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, voldriver.ErrorResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "No volumes found for client '%s'", rotateRequest.ClientID).Encode()}
+	}
+
+	sort.Strings(names)
+	return names, voldriver.ErrorResponse{}
+}
+
+func (d *LocalDriver) rollbackRotations(env voldriver.Env, rotations []*rotation) {
+	logger := env.Logger()
+
+	for _, r := range rotations {
+		logger.Info("rolling-back-keyring", lager.Data{"volume_name": r.name})
+		r.volume.Keyring = r.keyring
+
+		if !r.remounted {
+			r.volume.PendingChanges = r.pendingChanges
+			continue
+		}
+
+		if err := d.remount(env, r.volume); err != nil {
+			logger.Error("failed-rolling-back-keyring", err, lager.Data{"volume_name": r.name})
+			r.volume.PendingChanges = mergeChanges(r.volume.PendingChanges, []string{"keyring"})
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package cephlocal_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RotateKeyring", func() {
+	const (
+		oldKeyring = "[client.app]\n\tkey = old-key\n"
+		newKeyring = "[client.app]\n\tkey = new-key\n"
+	)
+
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeIoutil  *ioutil_fake.FakeIoutil
+		testEnv     voldriver.Env
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeIoutil = new(ioutil_fake.FakeIoutil)
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("RotateTest"), context.TODO())
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), fakeIoutil, cephlocal.LocalDriverConfig{RootDir: "some-root"})
+
+		createSuccessful(testEnv, driver, "volume-a", map[string]interface{}{"keyring": oldKeyring, "ip": "some-ip", "remote_mount_point": "/a"})
+		createSuccessful(testEnv, driver, "volume-b", map[string]interface{}{"keyring": oldKeyring, "ip": "some-ip", "remote_mount_point": "/b"})
+		createSuccessful(testEnv, driver, "volume-c", map[string]interface{}{"keyring": "[client.other]\n\tkey = other-key\n", "ip": "some-ip", "remote_mount_point": "/c"})
+
+		mountSuccessfulWithID(testEnv, driver, "volume-a", "container-1")
+	})
+
+	statusOf := func(name string) cephlocal.VolumeStatus {
+		return driver.Status(testEnv, cephlocal.StatusRequest{Name: name}).Status
+	}
+
+	It("requires a keyring", func() {
+		rotateResponse := driver.RotateKeyring(testEnv, cephlocal.RotateKeyringRequest{Name: "volume-a"})
+		Expect(rotateResponse.Err).To(Equal("Missing mandatory 'Keyring' [INVALID_KEYRING]"))
+	})
+
+	It("reports an error for an unknown volume", func() {
+		rotateResponse := driver.RotateKeyring(testEnv, cephlocal.RotateKeyringRequest{Name: "unknown", Keyring: newKeyring})
+		Expect(rotateResponse.Err).To(Equal("Volume 'unknown' not found [VOLUME_NOT_FOUND]"))
+	})
+
+	It("rejects a keyring for a different client", func() {
+		rotateResponse := driver.RotateKeyring(testEnv, cephlocal.RotateKeyringRequest{ClientID: "other", Keyring: newKeyring})
+		Expect(rotateResponse.Err).To(Equal("Keyring is not for client 'other' [INVALID_KEYRING]"))
+	})
+
+	Context("when rotating a single mounted volume", func() {
+		It("remounts the share with the new key behind the same mount point", func() {
+			rotateResponse := driver.RotateKeyring(testEnv, cephlocal.RotateKeyringRequest{Name: "volume-a", Keyring: newKeyring})
+			Expect(rotateResponse.Err).To(Equal(""))
+
+			Expect(invocationsOf(fakeInvoker, "ceph-fuse")).To(Equal(2))
+			Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(1))
+
+			_, keyring, _ := fakeIoutil.WriteFileArgsForCall(1)
+			Expect(string(keyring)).To(Equal(newKeyring))
+
+			Expect(statusOf("volume-a").Holders).To(Equal([]string{"container-1"}))
+			Expect(statusOf("volume-a").PendingChanges).To(BeEmpty())
+		})
+	})
+
+	Context("when rotating every volume of a client", func() {
+		It("rotates only the volumes using that client", func() {
+			rotateResponse := driver.RotateKeyring(testEnv, cephlocal.RotateKeyringRequest{ClientID: "app", Keyring: newKeyring})
+			Expect(rotateResponse.Err).To(Equal(""))
+
+			createSuccessful(testEnv, driver, "volume-a", map[string]interface{}{"keyring": newKeyring, "ip": "some-ip", "remote_mount_point": "/a"})
+			createSuccessful(testEnv, driver, "volume-b", map[string]interface{}{"keyring": newKeyring, "ip": "some-ip", "remote_mount_point": "/b"})
+
+			createSuccessful(testEnv, driver, "volume-c", map[string]interface{}{"keyring": "[client.other]\n\tkey = other-key\n", "ip": "some-ip", "remote_mount_point": "/c"})
+		})
+
+		It("reports an error when no volume uses the client", func() {
+			rotateResponse := driver.RotateKeyring(testEnv, cephlocal.RotateKeyringRequest{ClientID: "nobody", Keyring: "[client.nobody]\n\tkey = k\n"})
+			Expect(rotateResponse.Err).To(Equal("No volumes found for client 'nobody' [VOLUME_NOT_FOUND]"))
+		})
+	})
+
+	Context("when the new key fails to authenticate", func() {
+		BeforeEach(func() {
+			mountSuccessfulWithID(testEnv, driver, "volume-b", "container-2")
+
+			fakeInvoker.InvokeStub = func(env voldriver.Env, executable string, args []string) ([]byte, error) {
+				if executable == "ceph-fuse" && strings.Contains(args[5], "/b") {
+					_, keyring, _ := fakeIoutil.WriteFileArgsForCall(fakeIoutil.WriteFileCallCount() - 1)
+					if string(keyring) == newKeyring {
+						return []byte("ceph mount failed with (1) Operation not permitted"), fmt.Errorf("exit status 1")
+					}
+				}
+				return nil, nil
+			}
+		})
+
+		It("rolls every rotated volume back to the old keyring", func() {
+			rotateResponse := driver.RotateKeyring(testEnv, cephlocal.RotateKeyringRequest{ClientID: "app", Keyring: newKeyring})
+			Expect(rotateResponse.Err).To(Equal("Error rotating keyring of 'volume-b' (exit status 1) [AUTH_FAILED]"))
+
+			By("remounting volume-a with the old key")
+			_, keyring, _ := fakeIoutil.WriteFileArgsForCall(fakeIoutil.WriteFileCallCount() - 1)
+			Expect(string(keyring)).To(Equal(oldKeyring))
+
+			Expect(statusOf("volume-a").PendingChanges).To(BeEmpty())
+			Expect(statusOf("volume-b").PendingChanges).To(BeEmpty())
+			Expect(statusOf("volume-b").Holders).To(Equal([]string{"container-2"}))
+
+			createSuccessful(testEnv, driver, "volume-a", map[string]interface{}{"keyring": oldKeyring, "ip": "some-ip", "remote_mount_point": "/a"})
+		})
+	})
+})
@@ -0,0 +1,468 @@
+package cephlocal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+)
+
+const STALE_MOUNT_TIMEOUT = 5 * time.Second
+
+// KEY_DIR is where the keyring of each share is written for ceph-fuse.
+const KEY_DIR = "/tmp"
+
+// A share is a single ceph-fuse mount of a remote directory, kept under the
+// driver root and bind mounted into the mount point of every holder of every
+// volume that refers to it.
+type shareMetadata struct {
+	Key              string
+	IP               string
+	Port             int
+	RemoteMountPoint string
+	Keyring          string `json:"-"`
+	KeyPath          string
+	MountPoint       string
+	Binds            map[string]bool
+
+	// Pid is the ceph-fuse process of the share when the driver supervises
+	// ceph-fuse, or 0 when it is not running. Exits counts the times it
+	// exited while the share was mounted; Restarts, the times it was started
+	// again.
+	Pid      int    `json:",omitempty"`
+	Exits    int    `json:",omitempty"`
+	Restarts int    `json:",omitempty"`
+	LastExit string `json:",omitempty"`
+
+	// MemoryLimit and CPULimit are the limits of the ceph-fuse process, which
+	// runs in the cgroup Cgroup when it has any.
+	MemoryLimit int64   `json:",omitempty"`
+	CPULimit    float64 `json:",omitempty"`
+	Cgroup      string  `json:",omitempty"`
+
+	AdminSocket string `json:",omitempty"`
+
+	// Evicted is set while the ceph-fuse client of the share is known to
+	// have been evicted by the MDS, for the reason in LastEviction.
+	// Evictions counts the evictions seen while the share was mounted.
+	Evicted      bool   `json:",omitempty"`
+	Evictions    int    `json:",omitempty"`
+	LastEviction string `json:",omitempty"`
+}
+
+// shareKey identifies the share of a volume. Volumes with their own limits
+// get a ceph-fuse process of their own.
+func shareKey(volume *volumeMetadata) string {
+	id := fmt.Sprintf("%s\x00%d\x00%s\x00%s", volume.IP, volume.Port, volume.RemoteMountPoint, volume.Keyring)
+	if volume.MemoryLimit != "" || volume.CPULimit != "" {
+		id += fmt.Sprintf("\x00%s\x00%s", volume.MemoryLimit, volume.CPULimit)
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (d *LocalDriver) bind(env voldriver.Env, volume *volumeMetadata, holderID string, subDirectory string) (string, error) {
+	logger := env.Logger().Session("bind", lager.Data{"holder": holderID, "sub_directory": subDirectory})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	key := volume.ShareKey
+	if key == "" {
+		key = shareKey(volume)
+	}
+	defer d.lockShares(key)()
+
+	// While a volume is mounted, new holders join the share its existing
+	// holders are bound to, even if the volume has since been updated.
+	share, ok := d.shares[volume.ShareKey]
+	if !ok {
+		var err error
+		share, err = d.acquireShare(env, volume)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	target := volume.bindPath(holderID)
+
+	err := d.os.MkdirAll(target, os.ModePerm)
+	if err != nil {
+		logger.Error("failed-creating-bind-mountpoint", err)
+		d.releaseShare(env, share, false)
+		return "", err
+	}
+
+	err = d.mountBind(env, volume, share, holderID, subDirectory)
+	if err != nil {
+		logger.Error("failed-bind-mounting", err)
+		d.os.Remove(target)
+		d.releaseShare(env, share, false)
+		return "", err
+	}
+
+	volume.ShareKey = share.Key
+	if subDirectory != "" {
+		if volume.SubDirectories == nil {
+			volume.SubDirectories = map[string]string{}
+		}
+		volume.SubDirectories[holderID] = subDirectory
+	}
+	return target, nil
+}
+
+// mountBind bind mounts the share of a volume, or the sub-directory of it the
+// volume and the holder ask for, onto the mount point of the holder.
+func (d *LocalDriver) mountBind(env voldriver.Env, volume *volumeMetadata, share *shareMetadata, holderID string, subDirectory string) error {
+	dir := filepath.Join(volume.SubDirectory, subDirectory)
+	target := volume.bindPath(holderID)
+	readOnly := volume.ReadOnly
+
+	var err error
+	d.unlocked(func() {
+		err = d.invokeBind(env, share.MountPoint, dir, target, readOnly)
+	})
+	if err != nil {
+		return err
+	}
+
+	share.Binds[target] = true
+	return nil
+}
+
+// invokeBind bind mounts dir within the mount point of a share onto target.
+// It resolves dir on the share, so it runs without the state lock.
+func (d *LocalDriver) invokeBind(env voldriver.Env, shareMountPoint string, dir string, target string, readOnly bool) error {
+	source := shareMountPoint
+	if dir != "" {
+		var err error
+		source, err = d.resolveBeneath(shareMountPoint, dir)
+		if err != nil {
+			if !d.os.IsNotExist(err) {
+				err = newError(ERR_INVALID_OPTS, "Invalid sub-directory '%s': %s", dir, err.Error())
+			}
+			return err
+		}
+	}
+
+	bindArgs := []string{"--bind", source, target}
+	if readOnly {
+		bindArgs = []string{"--bind", "-o", "ro", source, target}
+	}
+
+	_, err := d.useInvoker.Invoke(env, BIND_MOUNT_CMD, bindArgs)
+	if err != nil || dir == "" {
+		return err
+	}
+	return d.checkBind(env, shareMountPoint, source, dir, target)
+}
+
+// checkBind makes sure the bind mount of a sub-directory shows the directory
+// it was resolved to. A symlink swapped in on the share between resolving the
+// sub-directory and binding it would have the bind show another directory, on
+// the share or off it, so such a bind is undone. Without a mount table to
+// compare with the bind is undone as well.
+func (d *LocalDriver) checkBind(env voldriver.Env, shareMountPoint string, source string, dir string, target string) error {
+	logger := env.Logger()
+
+	contents, err := d.ioutil.ReadFile(PROC_MOUNTINFO)
+	if err == nil {
+		mounts := parseMountSources(string(contents))
+		share, shareFound := mounts[shareMountPoint]
+		bind, bindFound := mounts[target]
+		expected := mountSource{device: share.device, root: filepath.Join(share.root, strings.TrimPrefix(source, shareMountPoint))}
+		if shareFound && bindFound && bind == expected {
+			return nil
+		}
+		logger.Info("bind-shows-other-directory", lager.Data{"source": source, "target": target, "device": bind.device, "root": bind.root})
+	} else {
+		logger.Error("failed-reading-mountinfo", err)
+	}
+
+	if _, err := d.useInvoker.Invoke(env, BIND_UNMOUNT_CMD, []string{"-l", target}); err != nil {
+		logger.Error("failed-undoing-bind", err, lager.Data{"target": target})
+	}
+	return newError(ERR_INVALID_OPTS, "Invalid sub-directory '%s': it changed while it was being bound", dir)
+}
+
+// unbind releases the bind mount of a holder. A lazy unbind detaches mounts
+// that are still busy instead of failing, which is how stuck mounts are
+// forcibly removed.
+func (d *LocalDriver) unbind(env voldriver.Env, volume *volumeMetadata, holderID string, lazy bool) error {
+	logger := env.Logger().Session("unbind", lager.Data{"holder": holderID, "lazy": lazy})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	defer d.lockShares(volume.ShareKey)()
+
+	target := volume.bindPath(holderID)
+
+	unmountArgs := []string{target}
+	if lazy {
+		unmountArgs = []string{"-l", target}
+	}
+
+	var err error
+	d.unlocked(func() {
+		_, err = d.useInvoker.Invoke(env, BIND_UNMOUNT_CMD, unmountArgs)
+	})
+	if err != nil {
+		logger.Error("failed-unmounting-bind", err)
+		return err
+	}
+
+	delete(volume.Holders, holderID)
+	delete(volume.LastSeen, holderID)
+	delete(volume.SubDirectories, holderID)
+
+	share, ok := d.shares[volume.ShareKey]
+	if ok {
+		delete(share.Binds, target)
+	}
+
+	if !volume.mounted() {
+		volume.ShareKey = ""
+		volume.PendingChanges = nil
+	}
+
+	err = d.os.Remove(target)
+	if err != nil {
+		logger.Error("failed-deleting-bind-mountpoint", err)
+		return err
+	}
+
+	if !ok {
+		return nil
+	}
+	return d.releaseShare(env, share, lazy)
+}
+
+func (d *LocalDriver) acquireShare(env voldriver.Env, volume *volumeMetadata) (*shareMetadata, error) {
+	logger := env.Logger()
+
+	key := shareKey(volume)
+	if share, ok := d.shares[key]; ok {
+		logger.Info("share-already-mounted", lager.Data{"share": share.MountPoint})
+		return share, nil
+	}
+
+	share := &shareMetadata{
+		Key:              key,
+		IP:               volume.IP,
+		Port:             volume.Port,
+		RemoteMountPoint: volume.RemoteMountPoint,
+		Keyring:          volume.Keyring,
+		KeyPath:          filepath.Join(KEY_DIR, fmt.Sprintf("keypath_%#v", time.Now().UnixNano())),
+		MountPoint:       filepath.Join(d.rootDir, "shares", key),
+		Binds:            map[string]bool{},
+	}
+	if d.supervisor.Enabled {
+		share.MemoryLimit, share.CPULimit = d.fuseLimits(volume)
+	}
+	logger.Info("mounting-share", lager.Data{"share": share.MountPoint})
+
+	err := d.ioutil.WriteFile(share.KeyPath, []byte(share.Keyring), 0600)
+	if err != nil {
+		logger.Error("failed-writing-key-file", err)
+		return nil, err
+	}
+
+	err = d.os.MkdirAll(share.MountPoint, os.ModePerm)
+	if err != nil {
+		logger.Error("failed-creating-share-mountpoint", err)
+		d.os.Remove(share.KeyPath)
+		return nil, err
+	}
+
+	cmdArgs := d.cephFuseArgs(logger, share)
+	if d.supervisor.Enabled {
+		err = d.startSupervisedFuse(env, share, cmdArgs)
+	} else {
+		d.unlocked(func() {
+			err = d.callCeph(env, cmdArgs)
+		})
+	}
+	if err != nil {
+		d.os.Remove(share.KeyPath)
+		return nil, err
+	}
+
+	d.shares[key] = share
+	return share, nil
+}
+
+func (d *LocalDriver) cephFuseArgs(logger lager.Logger, share *shareMetadata) []string {
+	cmdArgs := []string{"-k", share.KeyPath, "-m", fmt.Sprintf("%s:%d", share.IP, share.Port), "-r", share.RemoteMountPoint, share.MountPoint}
+	cmdArgs = append(d.adminSocketArgs(logger, share), cmdArgs...)
+	cmdArgs = append(d.logArgs(logger, share.Key), cmdArgs...)
+
+	if len(d.fuseArgs) > 0 {
+		cmdArgs = append(append([]string{}, d.fuseArgs...), cmdArgs...)
+	}
+	return cmdArgs
+}
+
+// releaseShare unmounts the ceph-fuse mount of a share once nothing is bound to it.
+func (d *LocalDriver) releaseShare(env voldriver.Env, share *shareMetadata, lazy bool) error {
+	logger := env.Logger()
+
+	if len(share.Binds) > 0 {
+		logger.Info("share-in-use", lager.Data{"share": share.MountPoint, "binds": len(share.Binds)})
+		return nil
+	}
+
+	fusermountArgs := []string{"-u", share.MountPoint}
+	if lazy {
+		fusermountArgs = []string{"-u", "-z", share.MountPoint}
+	}
+
+	var err error
+	d.unlocked(func() {
+		_, err = d.invoke(env, FUSERMOUNT_CMD, fusermountArgs)
+	})
+	if err != nil {
+		logger.Error("error-invoking-fusermount", err)
+		return err
+	}
+	d.stopFuse(logger, share)
+	delete(d.shares, share.Key)
+	d.forgetStale(share.MountPoint)
+
+	err = d.os.Remove(share.KeyPath)
+	if err != nil {
+		logger.Error("error-deleting-key-file", err)
+		return err
+	}
+
+	err = d.os.Remove(share.MountPoint)
+	if err != nil {
+		logger.Error("error-deleting-share-mountpoint", err)
+		return err
+	}
+	return nil
+}
+
+// reconnectShare mounts a share whose ceph-fuse mount has gone bad again in
+// place, with a new ceph-fuse process, and moves the bind mounts of its
+// holders onto the new mount.
+func (d *LocalDriver) reconnectShare(env voldriver.Env, share *shareMetadata) error {
+	logger := env.Logger()
+
+	// The old mount is left behind disconnected.
+	d.unlocked(func() {
+		if _, err := d.invoke(env, FUSERMOUNT_CMD, []string{"-u", "-z", share.MountPoint}); err != nil {
+			logger.Info("failed-detaching-share", lager.Data{"error": err.Error()})
+		}
+	})
+
+	var err error
+	cmdArgs := d.cephFuseArgs(logger, share)
+	if d.supervisor.Enabled {
+		err = d.startSupervisedFuse(env, share, cmdArgs)
+	} else {
+		d.unlocked(func() {
+			err = d.callCeph(env, cmdArgs)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	share.Evicted = false
+
+	type bind struct {
+		volume   *volumeMetadata
+		holderID string
+	}
+	binds := []bind{}
+	for _, volume := range d.volumes {
+		if volume.ShareKey != share.Key {
+			continue
+		}
+		for _, holderID := range volume.holderIDs() {
+			binds = append(binds, bind{volume: volume, holderID: holderID})
+		}
+	}
+
+	// Bind mounts still refer to the old mount, so each is made again.
+	for _, b := range binds {
+		target := b.volume.bindPath(b.holderID)
+		d.unlocked(func() {
+			if _, err := d.useInvoker.Invoke(env, BIND_UNMOUNT_CMD, []string{"-l", target}); err != nil {
+				logger.Error("failed-detaching-bind", err, lager.Data{"holder": b.holderID})
+			}
+		})
+		if err := d.mountBind(env, b.volume, share, b.holderID, b.volume.SubDirectories[b.holderID]); err != nil {
+			logger.Error("failed-restoring-bind", err, lager.Data{"holder": b.holderID})
+			b.volume.LastError = fmt.Sprintf("Error restoring bind mount of '%s' after remounting its share (%s)", b.holderID, err.Error())
+		}
+	}
+	return nil
+}
+
+// isStaleMount reports whether a ceph-fuse mount point has stopped answering,
+// either because the fuse daemon is gone or because it did not respond to a
+// stat within STALE_MOUNT_TIMEOUT. A mount point going stale or recovering is
+// published as an event.
+func (d *LocalDriver) isStaleMount(mountPoint string) bool {
+	err := d.statMount(mountPoint)
+	stale := err == errMountTimeout || mountErrno(err) == syscall.ENOTCONN || (err != nil && d.os.IsNotExist(err))
+	d.staleChanged(mountPoint, stale)
+	return stale
+}
+
+var errMountTimeout = errors.New("mount point did not answer in time")
+
+// A mountProbe is a stat of a mount point that is under way.
+type mountProbe struct {
+	started time.Time
+	done    chan struct{}
+	err     error
+}
+
+// statMount stats a mount point, giving up after STALE_MOUNT_TIMEOUT since a
+// hung ceph-fuse mount may never answer. The stat of a hung mount never
+// returns, so at most one is under way per mount point: later checks wait
+// for the same one, and give up once it has been under way for
+// STALE_MOUNT_TIMEOUT.
+func (d *LocalDriver) statMount(mountPoint string) error {
+	d.probesLock.Lock()
+	probe, ok := d.probes[mountPoint]
+	if !ok {
+		probe = &mountProbe{started: time.Now(), done: make(chan struct{})}
+		d.probes[mountPoint] = probe
+		go func() {
+			_, err := d.os.Stat(mountPoint)
+
+			d.probesLock.Lock()
+			delete(d.probes, mountPoint)
+			d.probesLock.Unlock()
+
+			probe.err = err
+			close(probe.done)
+		}()
+	}
+	d.probesLock.Unlock()
+
+	select {
+	case <-probe.done:
+		return probe.err
+	case <-time.After(STALE_MOUNT_TIMEOUT - time.Since(probe.started)):
+		return errMountTimeout
+	}
+}
+
+func mountErrno(err error) syscall.Errno {
+	if pathErr, ok := err.(*os.PathError); ok {
+		if errno, ok := pathErr.Err.(syscall.Errno); ok {
+			return errno
+		}
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package cephlocal
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"github.com/tedsuo/ifrit"
+)
+
+const DEFAULT_STALE_CHECK_INTERVAL = 30 * time.Second
+
+// CheckStaleMounts checks every share mount point, so that mounts going
+// stale or recovering are published whether or not anyone asks for the
+// health of the driver. The mount points are checked at once, without
+// holding the driver lock. It returns the number of stale mounts.
+func (d *LocalDriver) CheckStaleMounts(env voldriver.Env) int {
+	logger := env.Logger().Session("check-stale-mounts")
+	logger.Debug("start")
+	defer logger.Debug("end")
+
+	_, _, _, shareMountPoints := d.mountStats()
+
+	var (
+		lock  sync.Mutex
+		wg    sync.WaitGroup
+		stale []string
+	)
+	for _, mountPoint := range shareMountPoints {
+		wg.Add(1)
+		go func(mountPoint string) {
+			defer wg.Done()
+			if d.isStaleMount(mountPoint) {
+				lock.Lock()
+				stale = append(stale, mountPoint)
+				lock.Unlock()
+			}
+		}(mountPoint)
+	}
+	wg.Wait()
+
+	if len(stale) > 0 {
+		logger.Info("stale-mounts", lager.Data{"mount_points": stale})
+	}
+	return len(stale)
+}
+
+// StaleMonitorRunner checks the share mount points every stale check
+// interval of the driver until it is signalled.
+func (d *LocalDriver) StaleMonitorRunner(logger lager.Logger) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		env := driverhttp.NewHttpDriverEnv(logger.Session("stale-monitor"), context.Background())
+		ticker := time.NewTicker(d.staleCheckInterval)
+		defer ticker.Stop()
+
+		close(ready)
+		for {
+			select {
+			case <-ticker.C:
+				d.CheckStaleMounts(env)
+			case <-signals:
+				return nil
+			}
+		}
+	})
+}
@@ -0,0 +1,283 @@
+package cephlocal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+const STATE_FILE_NAME = "state.json"
+
+// KEYRINGS_FILE_NAME is the file next to the state file in which the driver
+// keeps the keyrings of its volumes and shares.
+const KEYRINGS_FILE_NAME = "keyrings.json"
+
+// driverState is what the driver keeps in its state file, so that a restarted
+// driver still knows about its volumes and the ceph-fuse mounts that outlived
+// the previous process. Keyrings are kept out of it, in a keyrings file of
+// their own, so that the state file can be read and passed around when
+// troubleshooting.
+type driverState struct {
+	Volumes          map[string]*volumeMetadata `json:"volumes"`
+	Shares           map[string]*shareMetadata  `json:"shares"`
+	AnonymousHolders int                        `json:"anonymous_holders"`
+}
+
+// driverKeyrings is what the driver keeps in its keyrings file: the keyring
+// of each volume and share, by name and key.
+type driverKeyrings struct {
+	Volumes map[string]string `json:"volumes"`
+	Shares  map[string]string `json:"shares"`
+}
+
+// RestoreState loads the volumes and shares recorded in the state file and
+// brings them in line with the kernel's mount table: holders whose bind mount
+// is gone are dropped, shares left with nothing bound to them are unmounted,
+// and shares whose ceph-fuse mount is gone while holders are still bound to
+// it are mounted again. A missing state file leaves the driver empty.
+func (d *LocalDriver) RestoreState(env voldriver.Env) error {
+	logger := env.Logger().Session("restore-state", lager.Data{"state_file": d.stateFile})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.loadState(logger); err != nil {
+		return err
+	}
+	if len(d.volumes) == 0 && len(d.shares) == 0 {
+		return nil
+	}
+
+	remount := d.reconcileState(driverhttp.EnvWithLogger(logger, env))
+
+	if d.supervisor.Enabled {
+		d.adoptFuseProcesses(logger)
+	}
+
+	for _, share := range remount {
+		logger.Info("remounting-share", lager.Data{"share": share.MountPoint})
+		if err := d.ioutil.WriteFile(share.KeyPath, []byte(share.Keyring), 0600); err != nil {
+			logger.Error("failed-writing-key-file", err, lager.Data{"share": share.MountPoint})
+			continue
+		}
+		if err := d.reconnectShare(env, share); err != nil {
+			logger.Error("failed-remounting-share", err, lager.Data{"share": share.MountPoint})
+		}
+	}
+
+	d.persist(logger)
+	logger.Info("restored-state", lager.Data{"volumes": len(d.volumes), "shares": len(d.shares)})
+	return nil
+}
+
+// loadState reads the state and keyrings files into the driver.
+func (d *LocalDriver) loadState(logger lager.Logger) error {
+	if d.stateFile == "" {
+		return nil
+	}
+
+	contents, err := d.ioutil.ReadFile(d.stateFile)
+	if err != nil {
+		if d.os.IsNotExist(err) {
+			logger.Info("no-state-file")
+			return nil
+		}
+		logger.Error("failed-reading-state-file", err)
+		return err
+	}
+
+	state := driverState{}
+	if err := json.Unmarshal(contents, &state); err != nil {
+		logger.Error("failed-parsing-state-file", err)
+		return err
+	}
+
+	keyrings, err := d.loadKeyrings(logger)
+	if err != nil {
+		return err
+	}
+
+	for name, volume := range state.Volumes {
+		if volume.Holders == nil {
+			volume.Holders = map[string]bool{}
+		}
+		volume.Keyring = keyrings.Volumes[name]
+	}
+	for key, share := range state.Shares {
+		if share.Binds == nil {
+			share.Binds = map[string]bool{}
+		}
+		share.Keyring = keyrings.Shares[key]
+	}
+
+	if state.Volumes != nil {
+		d.volumes = state.Volumes
+	}
+	if state.Shares != nil {
+		d.shares = state.Shares
+	}
+	d.anonymousHolders = state.AnonymousHolders
+	return nil
+}
+
+// loadKeyrings reads the keyrings file. A missing one leaves the volumes and
+// shares without their keyrings.
+func (d *LocalDriver) loadKeyrings(logger lager.Logger) (driverKeyrings, error) {
+	keyrings := driverKeyrings{}
+
+	contents, err := d.ioutil.ReadFile(d.keyringsFile())
+	if err != nil {
+		if d.os.IsNotExist(err) {
+			logger.Info("no-keyrings-file")
+			return keyrings, nil
+		}
+		logger.Error("failed-reading-keyrings-file", err)
+		return keyrings, err
+	}
+
+	if err := json.Unmarshal(contents, &keyrings); err != nil {
+		logger.Error("failed-parsing-keyrings-file", err)
+		return keyrings, err
+	}
+	return keyrings, nil
+}
+
+// reconcileState drops the holders and shares of a restored state that are
+// no longer mounted, and returns the shares whose ceph-fuse mount is gone
+// while holders are still bound to them. Their processes are not adopted.
+// Without a mount table to compare with the state is left as it is.
+func (d *LocalDriver) reconcileState(env voldriver.Env) []*shareMetadata {
+	logger := env.Logger()
+
+	contents, err := d.ioutil.ReadFile(PROC_MOUNTINFO)
+	if err != nil {
+		logger.Error("failed-reading-mountinfo", err)
+		return nil
+	}
+	mounts := parseMountInfo(string(contents))
+
+	for name, volume := range d.volumes {
+		share := d.shares[volume.ShareKey]
+		for _, holderID := range volume.holderIDs() {
+			target := volume.bindPath(holderID)
+			if _, ok := mounts[target]; ok {
+				continue
+			}
+
+			logger.Info("dropping-unbound-holder", lager.Data{"volume_name": name, "holder": holderID})
+			delete(volume.Holders, holderID)
+			delete(volume.LastSeen, holderID)
+			delete(volume.SubDirectories, holderID)
+			if share != nil {
+				delete(share.Binds, target)
+			}
+			d.os.Remove(target)
+		}
+		if !volume.mounted() {
+			volume.ShareKey = ""
+			volume.PendingChanges = nil
+		}
+	}
+
+	remount := []*shareMetadata{}
+	for key, share := range d.shares {
+		mounted := mounts[share.MountPoint] == CEPH_FUSE_FSTYPE
+
+		switch {
+		case len(share.Binds) == 0 && mounted:
+			logger.Info("unmounting-unused-share", lager.Data{"share": share.MountPoint})
+			share.Pid = 0
+			if err := d.releaseShare(env, share, true); err != nil {
+				logger.Error("failed-unmounting-unused-share", err, lager.Data{"share": share.MountPoint})
+			}
+		case len(share.Binds) == 0:
+			logger.Info("dropping-unmounted-share", lager.Data{"share": share.MountPoint})
+			delete(d.shares, key)
+			d.removeCgroup(logger, share.Cgroup)
+			d.os.Remove(share.KeyPath)
+			d.os.Remove(share.MountPoint)
+		case !mounted:
+			logger.Info("share-not-mounted", lager.Data{"share": share.MountPoint, "binds": len(share.Binds)})
+			share.Pid = 0
+			remount = append(remount, share)
+		}
+	}
+	return remount
+}
+
+// persist records the driver's state after an operation. Failures are only
+// logged, since the operation itself has already taken effect; they surface
+// through the state store health check.
+func (d *LocalDriver) persist(logger lager.Logger) {
+	if err := d.saveState(); err != nil {
+		logger.Error("failed-persisting-state", err)
+	}
+}
+
+// saveState writes the state file through a temporary file, so that a crash
+// never leaves a partially written state behind.
+func (d *LocalDriver) saveState() error {
+	if d.stateFile == "" {
+		return nil
+	}
+
+	if err := d.os.MkdirAll(filepath.Dir(d.stateFile), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := d.saveKeyrings(); err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(driverState{Volumes: d.volumes, Shares: d.shares, AnonymousHolders: d.anonymousHolders})
+	if err != nil {
+		return err
+	}
+	return d.writeFile(d.stateFile, contents)
+}
+
+// saveKeyrings writes the keyrings file when the keyrings have changed since
+// it was last written.
+func (d *LocalDriver) saveKeyrings() error {
+	keyrings := driverKeyrings{Volumes: map[string]string{}, Shares: map[string]string{}}
+	for name, volume := range d.volumes {
+		keyrings.Volumes[name] = volume.Keyring
+	}
+	for key, share := range d.shares {
+		keyrings.Shares[key] = share.Keyring
+	}
+
+	contents, err := json.Marshal(keyrings)
+	if err != nil {
+		return err
+	}
+	if string(contents) == d.savedKeyrings {
+		return nil
+	}
+
+	if err := d.writeFile(d.keyringsFile(), contents); err != nil {
+		return err
+	}
+	d.savedKeyrings = string(contents)
+	return nil
+}
+
+func (d *LocalDriver) keyringsFile() string {
+	return filepath.Join(filepath.Dir(d.stateFile), KEYRINGS_FILE_NAME)
+}
+
+// writeFile writes a file only its owner can read through a temporary
+// file, so that a crash never leaves it partially written.
+func (d *LocalDriver) writeFile(path string, contents []byte) error {
+	tmpFile := path + ".tmp"
+	if err := d.ioutil.WriteFile(tmpFile, contents, 0600); err != nil {
+		return err
+	}
+	return d.os.Rename(tmpFile, path)
+}
@@ -0,0 +1,195 @@
+package cephlocal_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("State", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeOs      *os_fake.FakeOs
+		fakeIoutil  *ioutil_fake.FakeIoutil
+		testEnv     voldriver.Env
+		config      cephlocal.LocalDriverConfig
+		files       map[string]string
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeOs = new(os_fake.FakeOs)
+		fakeIoutil = new(ioutil_fake.FakeIoutil)
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("StateTest"), context.TODO())
+		config = cephlocal.LocalDriverConfig{RootDir: "some-root", StateFile: "some-root/state.json"}
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, fakeIoutil, config)
+
+		files = map[string]string{}
+		fakeIoutil.ReadFileStub = func(path string) ([]byte, error) {
+			if contents, ok := files[path]; ok {
+				return []byte(contents), nil
+			}
+			return nil, os.ErrNotExist
+		}
+		fakeOs.IsNotExistStub = os.IsNotExist
+	})
+
+	lastWritten := func(path string) []byte {
+		for i := fakeIoutil.WriteFileCallCount() - 1; i >= 0; i-- {
+			written, contents, perm := fakeIoutil.WriteFileArgsForCall(i)
+			if written == path+".tmp" {
+				Expect(perm).To(Equal(os.FileMode(0600)))
+				return contents
+			}
+		}
+		Fail(path + " was never written")
+		return nil
+	}
+
+	writes := func(path string) int {
+		count := 0
+		for i := 0; i < fakeIoutil.WriteFileCallCount(); i++ {
+			if written, _, _ := fakeIoutil.WriteFileArgsForCall(i); written == path+".tmp" {
+				count++
+			}
+		}
+		return count
+	}
+
+	invoked := func(executable string, args ...string) bool {
+		for i := 0; i < fakeInvoker.InvokeCallCount(); i++ {
+			_, invokedExecutable, invokedArgs := fakeInvoker.InvokeArgsForCall(i)
+			if invokedExecutable == executable && reflect.DeepEqual(invokedArgs, args) {
+				return true
+			}
+		}
+		return false
+	}
+
+	shareMountPoint := func() string {
+		for i := 0; i < fakeInvoker.InvokeCallCount(); i++ {
+			_, executable, args := fakeInvoker.InvokeArgsForCall(i)
+			if executable == cephlocal.MOUNT_CMD {
+				return args[len(args)-1]
+			}
+		}
+		Fail("ceph-fuse was never invoked")
+		return ""
+	}
+
+	restart := func(mountInfo string) *cephlocal.LocalDriver {
+		files["some-root/state.json"] = string(lastWritten("some-root/state.json"))
+		files["some-root/keyrings.json"] = string(lastWritten("some-root/keyrings.json"))
+		files[cephlocal.PROC_MOUNTINFO] = mountInfo
+
+		restarted := cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, fakeIoutil, config)
+		Expect(restarted.RestoreState(testEnv)).To(Succeed())
+		return restarted
+	}
+
+	holders := func(driver *cephlocal.LocalDriver) []string {
+		statusResponse := driver.Status(testEnv, cephlocal.StatusRequest{Name: volumeName})
+		Expect(statusResponse.Err).To(Equal(""))
+		return statusResponse.Status.Holders
+	}
+
+	It("writes the state through a temporary file after each operation", func() {
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+
+		Expect(fakeOs.RenameCallCount()).To(Equal(2))
+		from, to := fakeOs.RenameArgsForCall(1)
+		Expect(from).To(Equal("some-root/state.json.tmp"))
+		Expect(to).To(Equal("some-root/state.json"))
+		Expect(string(lastWritten("some-root/state.json"))).To(ContainSubstring(`"volume-name"`))
+	})
+
+	It("keeps keyrings out of the state file, in a file of their own", func() {
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+		Expect(string(lastWritten("some-root/state.json"))).NotTo(ContainSubstring("some-keyring"))
+		Expect(string(lastWritten("some-root/keyrings.json"))).To(ContainSubstring(`"volume-name":"some-keyring"`))
+
+		keyringWrites := writes("some-root/keyrings.json")
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-2")
+		Expect(writes("some-root/keyrings.json")).To(Equal(keyringWrites))
+	})
+
+	Context("when a volume is mounted", func() {
+		BeforeEach(func() {
+			createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		})
+
+		It("restores volumes and holders from the state file", func() {
+			restarted := restart(fmt.Sprintf("100 20 0:50 / %s rw - fuse.ceph-fuse ceph-fuse rw\n101 20 0:50 / some-root/volumes/volume-name/container-1 rw - fuse.ceph-fuse ceph-fuse rw\n", shareMountPoint()))
+			Expect(holders(restarted)).To(Equal([]string{"container-1"}))
+
+			invocations := fakeInvoker.InvokeCallCount()
+			mountSuccessfulWithID(testEnv, restarted, volumeName, "container-2")
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(invocations + 1))
+		})
+
+		It("drops holders whose bind mount is gone and unmounts the shares left unused", func() {
+			restarted := restart(fmt.Sprintf("100 20 0:50 / %s rw - fuse.ceph-fuse ceph-fuse rw\n", shareMountPoint()))
+			Expect(holders(restarted)).To(BeEmpty())
+			Expect(invoked(cephlocal.FUSERMOUNT_CMD, "-u", "-z", shareMountPoint())).To(BeTrue())
+			Expect(string(lastWritten("some-root/state.json"))).NotTo(ContainSubstring("container-1"))
+		})
+
+		It("forgets shares that are no longer mounted", func() {
+			restarted := restart("")
+			Expect(holders(restarted)).To(BeEmpty())
+			Expect(invoked(cephlocal.FUSERMOUNT_CMD, "-u", "-z", shareMountPoint())).To(BeFalse())
+			Expect(string(lastWritten("some-root/state.json"))).To(ContainSubstring(`"shares":{}`))
+		})
+
+		It("mounts a share again when its ceph-fuse mount is gone while holders are bound to it", func() {
+			ceph := fakeInvoker.InvokeCallCount()
+			written := fakeIoutil.WriteFileCallCount()
+			restarted := restart("101 20 0:50 / some-root/volumes/volume-name/container-1 rw - fuse.ceph-fuse ceph-fuse rw\n")
+			Expect(holders(restarted)).To(Equal([]string{"container-1"}))
+
+			keyrings := []string{}
+			for i := written; i < fakeIoutil.WriteFileCallCount(); i++ {
+				_, contents, _ := fakeIoutil.WriteFileArgsForCall(i)
+				keyrings = append(keyrings, string(contents))
+			}
+			Expect(keyrings).To(ContainElement("some-keyring"))
+
+			mounts := 0
+			for i := ceph; i < fakeInvoker.InvokeCallCount(); i++ {
+				if _, executable, _ := fakeInvoker.InvokeArgsForCall(i); executable == cephlocal.MOUNT_CMD {
+					mounts++
+				}
+			}
+			Expect(mounts).To(Equal(1))
+		})
+	})
+
+	It("starts empty when there is no state file", func() {
+		Expect(driver.RestoreState(testEnv)).To(Succeed())
+		Expect(driver.List(testEnv).Volumes).To(BeEmpty())
+	})
+
+	It("fails on a corrupt state file", func() {
+		files["some-root/state.json"] = "{"
+		Expect(driver.RestoreState(testEnv)).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,537 @@
+package cephlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"github.com/tedsuo/ifrit"
+)
+
+const (
+	DEFAULT_FUSE_READY_TIMEOUT = 30 * time.Second
+	DEFAULT_FUSE_MIN_BACKOFF   = time.Second
+	DEFAULT_FUSE_MAX_BACKOFF   = time.Minute
+
+	FUSE_READY_POLL_INTERVAL  = 100 * time.Millisecond
+	FUSE_OUTPUT_POLL_INTERVAL = 100 * time.Millisecond
+	FUSE_STOP_TIMEOUT         = 10 * time.Second
+	ADOPTED_POLL_INTERVAL     = time.Second
+)
+
+// A FuseProcess is a ceph-fuse process running in the foreground.
+type FuseProcess interface {
+	Pid() int
+	// Wait blocks until the process exits; it is called at most once.
+	Wait() error
+	Kill() error
+}
+
+// A FuseLauncher starts ceph-fuse processes, with their output logged and
+// appended to outputFile when it is set, and takes over the ones started by
+// an earlier instance of the driver for a mount point.
+type FuseLauncher interface {
+	Start(env voldriver.Env, executable string, args []string, outputFile string) (FuseProcess, error)
+	Adopt(pid int, mountPoint string) (FuseProcess, error)
+}
+
+// SupervisorConfig makes the driver run ceph-fuse in the foreground rather
+// than let it daemonize, so that it knows the PID of the process behind each
+// share and notices when it exits. With Restart set, a share whose ceph-fuse
+// exits is mounted again after a backoff between MinBackoff and MaxBackoff,
+// and the bind mounts of its holders are moved onto the new mount.
+type SupervisorConfig struct {
+	Enabled      bool
+	Restart      bool
+	ReadyTimeout time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+
+	// Launcher starts the ceph-fuse processes; ceph-fuse is run directly
+	// when nil.
+	Launcher FuseLauncher
+}
+
+func (c SupervisorConfig) withDefaults() SupervisorConfig {
+	if c.ReadyTimeout <= 0 {
+		c.ReadyTimeout = DEFAULT_FUSE_READY_TIMEOUT
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = DEFAULT_FUSE_MIN_BACKOFF
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = DEFAULT_FUSE_MAX_BACKOFF
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = c.MinBackoff
+	}
+	if c.Launcher == nil {
+		c.Launcher = NewFuseLauncher()
+	}
+	return c
+}
+
+// fuseSupervisor watches the ceph-fuse process of one share.
+type fuseSupervisor struct {
+	process FuseProcess
+	cgroup  string
+	exited  chan error
+	release chan struct{}
+}
+
+func newFuseSupervisor(process FuseProcess, cgroup string) *fuseSupervisor {
+	s := &fuseSupervisor{process: process, cgroup: cgroup, exited: make(chan error, 1), release: make(chan struct{})}
+	go func() {
+		s.exited <- process.Wait()
+	}()
+	return s
+}
+
+// startSupervisedFuse runs ceph-fuse in the foreground and waits for its
+// mount to appear.
+func (d *LocalDriver) startSupervisedFuse(env voldriver.Env, share *shareMetadata, args []string) error {
+	logger := env.Logger().Session("start-supervised-fuse", lager.Data{"share": share.MountPoint})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	var process FuseProcess
+	var err error
+	outputFile := d.shareLogFile(share.Key)
+	d.unlocked(func() {
+		process, err = d.supervisor.Launcher.Start(env, MOUNT_CMD, append([]string{"-f"}, args...), outputFile)
+	})
+	if err != nil {
+		logger.Error("failed-starting-ceph-fuse", err)
+		return err
+	}
+	if err := d.limitFuse(logger, share, process.Pid()); err != nil {
+		logger.Error("failed-limiting-ceph-fuse", err, lager.Data{"pid": process.Pid()})
+		process.Kill()
+		d.unlocked(func() {
+			process.Wait()
+		})
+		d.releaseCgroup(logger, share)
+		return err
+	}
+	s := newFuseSupervisor(process, share.Cgroup)
+
+	mountPoint := share.MountPoint
+	d.unlocked(func() {
+		err = d.waitForFuseMount(env, s, mountPoint)
+	})
+	if err != nil {
+		logger.Error("failed-waiting-for-mount", err, lager.Data{"pid": process.Pid()})
+		d.releaseCgroup(logger, share)
+		return err
+	}
+
+	logger.Info("ceph-fuse-started", lager.Data{"pid": process.Pid()})
+	share.Pid = process.Pid()
+	d.watchFuse(logger, share.Key, s)
+	return nil
+}
+
+func (d *LocalDriver) waitForFuseMount(env voldriver.Env, s *fuseSupervisor, mountPoint string) error {
+	deadline := time.After(d.supervisor.ReadyTimeout)
+	for {
+		if d.isFuseMounted(mountPoint) {
+			return nil
+		}
+
+		select {
+		case err := <-s.exited:
+			return cephError(env.Context(), nil, fmt.Errorf("ceph-fuse exited before mounting (%s)", exitDescription(err)))
+		case <-deadline:
+			s.process.Kill()
+			<-s.exited
+			return newError(ERR_MOUNT_TIMEOUT, "ceph-fuse did not mount within %s", d.supervisor.ReadyTimeout)
+		case <-env.Context().Done():
+			s.process.Kill()
+			<-s.exited
+			return cephError(env.Context(), nil, env.Context().Err())
+		case <-time.After(FUSE_READY_POLL_INTERVAL):
+		}
+	}
+}
+
+func (d *LocalDriver) isFuseMounted(mountPoint string) bool {
+	contents, err := d.ioutil.ReadFile(PROC_MOUNTINFO)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(parseMountInfo(string(contents))[mountPoint], "fuse")
+}
+
+// watchFuse records the exit of a share's ceph-fuse process, unless the
+// share is released first or the driver stops supervising.
+func (d *LocalDriver) watchFuse(logger lager.Logger, key string, s *fuseSupervisor) {
+	d.supervisors[key] = s
+
+	select {
+	case <-d.shutdown:
+		return
+	default:
+	}
+	d.supervising.Add(1)
+
+	go func() {
+		defer d.supervising.Done()
+
+		select {
+		case err := <-s.exited:
+			d.fuseExited(logger, key, s, err)
+		case <-s.release:
+			select {
+			case <-s.exited:
+			case <-time.After(FUSE_STOP_TIMEOUT):
+				logger.Info("killing-ceph-fuse", lager.Data{"pid": s.process.Pid()})
+				s.process.Kill()
+				<-s.exited
+			}
+			d.removeCgroup(logger, s.cgroup)
+		case <-d.shutdown:
+		}
+	}()
+}
+
+// stopFuse stops watching the ceph-fuse process of a share that has been
+// unmounted; the process exits by itself once its mount is gone, and its
+// cgroup is removed then.
+func (d *LocalDriver) stopFuse(logger lager.Logger, share *shareMetadata) {
+	if s, ok := d.supervisors[share.Key]; ok {
+		delete(d.supervisors, share.Key)
+		close(s.release)
+		return
+	}
+	d.removeCgroup(logger, share.Cgroup)
+}
+
+func (d *LocalDriver) fuseExited(logger lager.Logger, key string, s *fuseSupervisor, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// A process released by stopFuse may be seen exiting here rather than
+	// after its release.
+	if d.supervisors[key] != s {
+		d.removeCgroup(logger, s.cgroup)
+		return
+	}
+	delete(d.supervisors, key)
+
+	share, ok := d.shares[key]
+	if !ok {
+		return
+	}
+
+	share.Exits++
+	share.LastExit = exitDescription(err)
+	logger.Error("ceph-fuse-exited", err, lager.Data{"share": share.MountPoint, "pid": share.Pid, "exits": share.Exits})
+	share.Pid = 0
+	d.persist(logger)
+
+	if d.supervisor.Restart {
+		d.restartFuse(logger, key)
+	}
+}
+
+// restartFuse mounts a share whose ceph-fuse has exited again, retrying with
+// an exponential backoff until it succeeds, the share is released, or the
+// driver stops supervising.
+func (d *LocalDriver) restartFuse(logger lager.Logger, key string) {
+	logger = logger.Session("restart-fuse", lager.Data{"share_key": key})
+
+	select {
+	case <-d.shutdown:
+		return
+	default:
+	}
+	d.supervising.Add(1)
+
+	go func() {
+		defer d.supervising.Done()
+
+		backoff := d.supervisor.MinBackoff
+		for {
+			select {
+			case <-d.shutdown:
+				return
+			case <-time.After(backoff):
+			}
+
+			done, err := d.remountShare(logger, key)
+			if done {
+				return
+			}
+
+			logger.Error("failed-restarting-ceph-fuse", err, lager.Data{"backoff": backoff.String()})
+			backoff *= 2
+			if backoff > d.supervisor.MaxBackoff {
+				backoff = d.supervisor.MaxBackoff
+			}
+		}
+	}()
+}
+
+func (d *LocalDriver) remountShare(logger lager.Logger, key string) (bool, error) {
+	defer d.shareLocks.lock(key)()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	share, ok := d.shares[key]
+	if !ok || d.supervisors[key] != nil {
+		return true, nil
+	}
+
+	logger.Info("restarting-ceph-fuse", lager.Data{"share": share.MountPoint})
+	env := driverhttp.NewHttpDriverEnv(logger, context.Background())
+
+	if err := d.reconnectShare(env, share); err != nil {
+		return false, err
+	}
+
+	share.Restarts++
+	d.persist(logger)
+	logger.Info("restarted-ceph-fuse", lager.Data{"pid": share.Pid, "restarts": share.Restarts})
+	return true, nil
+}
+
+// adoptFuseProcesses resumes supervising the ceph-fuse processes recorded in
+// the restored state. Processes that are gone are treated as having exited.
+func (d *LocalDriver) adoptFuseProcesses(logger lager.Logger) {
+	for key, share := range d.shares {
+		if share.Pid == 0 {
+			continue
+		}
+
+		process, err := d.supervisor.Launcher.Adopt(share.Pid, share.MountPoint)
+		if err != nil {
+			logger.Info("ceph-fuse-gone", lager.Data{"share": share.MountPoint, "pid": share.Pid})
+			share.Exits++
+			share.LastExit = "exited while the driver was not running"
+			share.Pid = 0
+			if d.supervisor.Restart {
+				d.restartFuse(logger, key)
+			}
+			continue
+		}
+
+		logger.Info("adopted-ceph-fuse", lager.Data{"share": share.MountPoint, "pid": share.Pid})
+		d.watchFuse(logger, key, newFuseSupervisor(process, share.Cgroup))
+	}
+}
+
+// SupervisorRunner stops the supervision of ceph-fuse processes when the
+// driver shuts down. The processes themselves are left running, so that
+// mounts survive a restart of the driver, which adopts them again.
+func (d *LocalDriver) SupervisorRunner() ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		close(ready)
+		<-signals
+		d.StopSupervising()
+		return nil
+	})
+}
+
+func (d *LocalDriver) StopSupervising() {
+	d.shutdownOnce.Do(func() {
+		close(d.shutdown)
+	})
+	d.supervising.Wait()
+}
+
+func (d *LocalDriver) fuseStats() (running int, exits int, restarts int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	running = len(d.supervisors)
+	for _, share := range d.shares {
+		exits += share.Exits
+		restarts += share.Restarts
+	}
+	return running, exits, restarts
+}
+
+func exitDescription(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+type fuseLauncher struct{}
+
+// NewFuseLauncher starts ceph-fuse in its own process group, so that signals
+// meant for the driver do not unmount volumes. Its output goes straight to a
+// file rather than through the driver, so that it never depends on the
+// driver to keep running; the driver follows the file, and logs each line
+// ceph-fuse writes to it for as long as the process runs. Without an output
+// file, a temporary file that is deleted straight away stands in for it.
+func NewFuseLauncher() FuseLauncher {
+	return &fuseLauncher{}
+}
+
+func (l *fuseLauncher) Start(env voldriver.Env, executable string, args []string, outputFile string) (FuseProcess, error) {
+	output, err := openFuseOutput(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	info, err := output.Stat()
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(executable, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if err := cmd.Start(); err != nil {
+		output.Close()
+		return nil, err
+	}
+
+	env.Logger().Info("started-ceph-fuse", lager.Data{"pid": cmd.Process.Pid, "output": outputFile})
+	process := &startedProcess{cmd: cmd, exited: make(chan struct{}), followed: make(chan struct{})}
+	lines := &outputLogger{logger: env.Logger().Session("fuse-output", lager.Data{"executable": executable, "pid": cmd.Process.Pid})}
+	go process.follow(output, info.Size(), lines)
+	return process, nil
+}
+
+// openFuseOutput opens the file ceph-fuse appends its output to, which the
+// driver reads back.
+func openFuseOutput(outputFile string) (*os.File, error) {
+	if outputFile != "" {
+		return os.OpenFile(outputFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	}
+
+	output, err := ioutil.TempFile("", "ceph-fuse-output")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(output.Name()); err != nil {
+		output.Close()
+		return nil, err
+	}
+	return output, nil
+}
+
+// Adopt takes over the ceph-fuse process of mountPoint. The PID comes from
+// the state file, and may have been reused by another process since, so the
+// command line of the process has to show it is that ceph-fuse.
+func (l *fuseLauncher) Adopt(pid int, mountPoint string) (FuseProcess, error) {
+	if !isFuseProcess(pid, mountPoint) {
+		return nil, fmt.Errorf("process %d is not the ceph-fuse of %s", pid, mountPoint)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	return &adoptedProcess{process: process, mountPoint: mountPoint}, nil
+}
+
+// isFuseProcess reports whether the process pid runs ceph-fuse for
+// mountPoint.
+func isFuseProcess(pid int, mountPoint string) bool {
+	contents, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+
+	args := strings.Split(strings.TrimRight(string(contents), "\x00"), "\x00")
+	if filepath.Base(args[0]) != MOUNT_CMD {
+		return false
+	}
+	for _, arg := range args[1:] {
+		if arg == mountPoint {
+			return true
+		}
+	}
+	return false
+}
+
+type startedProcess struct {
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	followed chan struct{}
+}
+
+func (p *startedProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+// Wait returns once the process has exited and the last of its output has
+// been logged.
+func (p *startedProcess) Wait() error {
+	err := p.cmd.Wait()
+	close(p.exited)
+	<-p.followed
+	return err
+}
+
+// follow logs the output the process appends to output from offset on,
+// until the process exits.
+func (p *startedProcess) follow(output *os.File, offset int64, lines *outputLogger) {
+	defer close(p.followed)
+	defer output.Close()
+
+	buffer := make([]byte, 32*1024)
+	read := func() {
+		for {
+			n, err := output.ReadAt(buffer, offset)
+			lines.Write(buffer[:n])
+			offset += int64(n)
+			if err != nil || n == 0 {
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-p.exited:
+			read()
+			lines.flush()
+			return
+		case <-time.After(FUSE_OUTPUT_POLL_INTERVAL):
+			read()
+		}
+	}
+}
+
+func (p *startedProcess) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+// adoptedProcess is a process the driver did not start, and so cannot wait
+// for; it is polled instead, until it is gone or its PID runs something else.
+type adoptedProcess struct {
+	process    *os.Process
+	mountPoint string
+}
+
+func (p *adoptedProcess) Pid() int {
+	return p.process.Pid
+}
+
+func (p *adoptedProcess) Wait() error {
+	for isFuseProcess(p.process.Pid, p.mountPoint) {
+		time.Sleep(ADOPTED_POLL_INTERVAL)
+	}
+	return errors.New("process exited")
+}
+
+func (p *adoptedProcess) Kill() error {
+	return p.process.Kill()
+}
@@ -0,0 +1,350 @@
+package cephlocal_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+type fakeFuseProcess struct {
+	pid  int
+	exit chan error
+}
+
+func newFakeFuseProcess(pid int) *fakeFuseProcess {
+	return &fakeFuseProcess{pid: pid, exit: make(chan error, 1)}
+}
+
+func (p *fakeFuseProcess) Pid() int    { return p.pid }
+func (p *fakeFuseProcess) Wait() error { return <-p.exit }
+
+func (p *fakeFuseProcess) Kill() error {
+	p.Exit(errors.New("signal: killed"))
+	return nil
+}
+
+func (p *fakeFuseProcess) Exit(err error) {
+	select {
+	case p.exit <- err:
+	default:
+	}
+}
+
+type fakeFuseLauncher struct {
+	lock      sync.Mutex
+	starts    [][]string
+	outputs   []string
+	processes []*fakeFuseProcess
+	adopted   []int
+	adoptErr  error
+	exitEarly bool
+}
+
+func (l *fakeFuseLauncher) Start(env voldriver.Env, executable string, args []string, outputFile string) (cephlocal.FuseProcess, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	process := newFakeFuseProcess(1000 + len(l.processes))
+	if l.exitEarly {
+		process.Exit(errors.New("exit status 1"))
+	}
+	l.starts = append(l.starts, args)
+	l.outputs = append(l.outputs, outputFile)
+	l.processes = append(l.processes, process)
+	return process, nil
+}
+
+func (l *fakeFuseLauncher) Adopt(pid int, mountPoint string) (cephlocal.FuseProcess, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.adopted = append(l.adopted, pid)
+	if l.adoptErr != nil {
+		return nil, l.adoptErr
+	}
+	process := newFakeFuseProcess(pid)
+	l.processes = append(l.processes, process)
+	return process, nil
+}
+
+func (l *fakeFuseLauncher) StartCount() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.starts)
+}
+
+func (l *fakeFuseLauncher) Process(i int) *fakeFuseProcess {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.processes[i]
+}
+
+// mountInfo lists the mount point of every ceph-fuse started so far.
+func (l *fakeFuseLauncher) mountInfo() []byte {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	lines := ""
+	for i, args := range l.starts {
+		lines += fmt.Sprintf("%d 20 0:50 / %s rw - fuse.ceph-fuse ceph-fuse rw\n", 100+i, args[len(args)-1])
+	}
+	return []byte(lines)
+}
+
+var _ = Describe("Supervised ceph-fuse", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver       *cephlocal.LocalDriver
+		fakeInvoker  *voldriverfakes.FakeInvoker
+		fakeOs       *os_fake.FakeOs
+		fakeIoutil   *ioutil_fake.FakeIoutil
+		fakeLauncher *fakeFuseLauncher
+		testEnv      voldriver.Env
+		config       cephlocal.LocalDriverConfig
+		stateFile    string
+		mountInfo    string
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeOs = new(os_fake.FakeOs)
+		fakeIoutil = new(ioutil_fake.FakeIoutil)
+		fakeLauncher = &fakeFuseLauncher{}
+		stateFile = ""
+		mountInfo = ""
+		fakeIoutil.ReadFileStub = func(path string) ([]byte, error) {
+			switch path {
+			case cephlocal.PROC_MOUNTINFO:
+				return append([]byte(mountInfo), fakeLauncher.mountInfo()...), nil
+			case "some-root/state.json":
+				if stateFile != "" {
+					return []byte(stateFile), nil
+				}
+			}
+			return nil, os.ErrNotExist
+		}
+		fakeOs.IsNotExistStub = os.IsNotExist
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("SupervisorTest"), context.TODO())
+		config = cephlocal.LocalDriverConfig{
+			RootDir:    "some-root",
+			Supervisor: cephlocal.SupervisorConfig{Enabled: true, MinBackoff: time.Millisecond, Launcher: fakeLauncher},
+		}
+	})
+
+	JustBeforeEach(func() {
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, fakeIoutil, config)
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "/"})
+	})
+
+	AfterEach(func() {
+		driver.StopSupervising()
+	})
+
+	status := func() cephlocal.VolumeStatus {
+		return driver.Status(testEnv, cephlocal.StatusRequest{Name: volumeName}).Status
+	}
+
+	invoked := func(executable string, args ...string) bool {
+		for i := 0; i < fakeInvoker.InvokeCallCount(); i++ {
+			_, cmd, cmdArgs := fakeInvoker.InvokeArgsForCall(i)
+			if cmd == executable && strings.Join(cmdArgs, " ") == strings.Join(args, " ") {
+				return true
+			}
+		}
+		return false
+	}
+
+	It("runs ceph-fuse in the foreground and records its PID", func() {
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+		Expect(fakeLauncher.StartCount()).To(Equal(1))
+		Expect(fakeLauncher.starts[0][0]).To(Equal("-f"))
+		Expect(invoked(cephlocal.MOUNT_CMD)).To(BeFalse())
+		Expect(status().FusePid).To(Equal(1000))
+	})
+
+	Context("with a log directory", func() {
+		BeforeEach(func() {
+			config.LogDir = "some-log-dir"
+			fakeOs.StatReturns(nil, os.ErrNotExist)
+		})
+
+		It("sends the output of ceph-fuse to the log file of its share", func() {
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+			Expect(fakeLauncher.outputs).To(HaveLen(1))
+			Expect(fakeLauncher.outputs[0]).To(MatchRegexp(`^some-log-dir/ceph-fuse-[0-9a-f]+\.log$`))
+		})
+	})
+
+	Context("when ceph-fuse exits before mounting", func() {
+		BeforeEach(func() {
+			fakeLauncher.exitEarly = true
+			fakeIoutil.ReadFileReturns(nil, errors.New("no such file"))
+			fakeIoutil.ReadFileStub = nil
+		})
+
+		It("fails the mount", func() {
+			mountResponse := driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: "container-1"})
+			Expect(mountResponse.Err).To(Equal("Error mounting 'volume-name' (ceph-fuse exited before mounting (exit status 1)) [MOUNT_FAILED]"))
+		})
+	})
+
+	Context("when ceph-fuse exits while the volume is mounted", func() {
+		JustBeforeEach(func() {
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+			fakeLauncher.Process(0).Exit(errors.New("signal: segmentation fault"))
+		})
+
+		It("records the exit", func() {
+			Eventually(func() int { return status().FuseExits }).Should(Equal(1))
+			Expect(status().FusePid).To(Equal(0))
+			Expect(status().LastFuseExit).To(Equal("signal: segmentation fault"))
+			Expect(fakeLauncher.StartCount()).To(Equal(1))
+		})
+
+		Context("with restarts", func() {
+			BeforeEach(func() {
+				config.Supervisor.Restart = true
+			})
+
+			It("mounts the share again and restores the bind mounts", func() {
+				Eventually(func() int { return status().FuseRestarts }).Should(Equal(1))
+				Expect(fakeLauncher.StartCount()).To(Equal(2))
+				Expect(status().FusePid).To(Equal(1001))
+
+				shareMountPoint := fakeLauncher.starts[0][len(fakeLauncher.starts[0])-1]
+				Expect(invoked(cephlocal.FUSERMOUNT_CMD, "-u", "-z", shareMountPoint)).To(BeTrue())
+				Expect(invoked(cephlocal.BIND_UNMOUNT_CMD, "-l", "some-root/volumes/volume-name/container-1")).To(BeTrue())
+			})
+		})
+	})
+
+	Context("when the share is unmounted", func() {
+		BeforeEach(func() {
+			config.Supervisor.Restart = true
+		})
+
+		It("stops watching ceph-fuse", func() {
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+			unmountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+
+			fakeLauncher.Process(0).Exit(nil)
+			Consistently(fakeLauncher.StartCount).Should(Equal(1))
+		})
+	})
+
+	Context("when the state records a ceph-fuse process", func() {
+		BeforeEach(func() {
+			config.StateFile = "some-root/state.json"
+			config.Supervisor.Restart = true
+			stateFile = `{"volumes":{"volume-name":{"Keyring":"some-keyring","IP":"some-ip","Port":6789,"RemoteMountPoint":"/","LocalMountPoint":"some-root/volumes/volume-name","ManagedMountPoint":true,"Holders":{"container-1":true},"ShareKey":"abc"}},` +
+				`"shares":{"abc":{"Key":"abc","IP":"some-ip","Port":6789,"RemoteMountPoint":"/","MountPoint":"some-root/shares/abc","Binds":{"some-root/volumes/volume-name/container-1":true},"Pid":4321}}}`
+			mountInfo = "90 20 0:49 / some-root/shares/abc rw - fuse.ceph-fuse ceph-fuse rw\n" +
+				"91 20 0:49 / some-root/volumes/volume-name/container-1 rw - fuse.ceph-fuse ceph-fuse rw\n"
+		})
+
+		JustBeforeEach(func() {
+			Expect(driver.RestoreState(testEnv)).To(Succeed())
+		})
+
+		It("adopts it", func() {
+			Expect(fakeLauncher.adopted).To(Equal([]int{4321}))
+			Expect(status().FusePid).To(Equal(4321))
+		})
+
+		Context("when the process is gone", func() {
+			BeforeEach(func() {
+				fakeLauncher.adoptErr = errors.New("process already finished")
+			})
+
+			It("mounts the share again", func() {
+				Eventually(func() int { return status().FuseRestarts }).Should(Equal(1))
+				Expect(status().FuseExits).To(Equal(1))
+				Expect(status().FusePid).To(Equal(1000))
+			})
+		})
+	})
+
+	Describe("NewFuseLauncher", func() {
+		var (
+			launcher cephlocal.FuseLauncher
+			tmpDir   string
+		)
+
+		BeforeEach(func() {
+			launcher = cephlocal.NewFuseLauncher()
+
+			var err error
+			tmpDir, err = ioutil.TempDir("", "fuse-launcher")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("appends the output of the process to its output file", func() {
+			outputFile := filepath.Join(tmpDir, "ceph-fuse.log")
+			Expect(ioutil.WriteFile(outputFile, []byte("earlier\n"), 0600)).To(Succeed())
+
+			process, err := launcher.Start(testEnv, "sh", []string{"-c", "echo hello; echo world >&2"}, outputFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(process.Wait()).To(Succeed())
+
+			Expect(ioutil.ReadFile(outputFile)).To(Equal([]byte("earlier\nhello\nworld\n")))
+		})
+
+		It("logs the output of the process one line at a time", func() {
+			outputFile := filepath.Join(tmpDir, "ceph-fuse.log")
+			Expect(ioutil.WriteFile(outputFile, []byte("earlier\n"), 0600)).To(Succeed())
+
+			process, err := launcher.Start(testEnv, "sh", []string{"-c", "echo hello; sleep 0.2; printf world >&2"}, outputFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(process.Wait()).To(Succeed())
+
+			var lines []string
+			for _, message := range testEnv.Logger().(*lagertest.TestLogger).Logs() {
+				if strings.HasSuffix(message.Message, ".fuse-output.output") {
+					Expect(message.Data).To(HaveKeyWithValue("executable", "sh"))
+					Expect(message.Data).To(HaveKeyWithValue("pid", BeNumerically("==", process.Pid())))
+					lines = append(lines, message.Data["line"].(string))
+				}
+			}
+			Expect(lines).To(Equal([]string{"hello", "world"}))
+		})
+
+		It("logs the output without an output file", func() {
+			process, err := launcher.Start(testEnv, "sh", []string{"-c", "echo hello"}, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(process.Wait()).To(Succeed())
+
+			Expect(testEnv.Logger().(*lagertest.TestLogger).Buffer()).To(gbytes.Say(`"line":"hello"`))
+		})
+
+		It("refuses to adopt a process that is not the ceph-fuse of the mount point", func() {
+			_, err := launcher.Adopt(os.Getpid(), "some-root/shares/abc")
+			Expect(err).To(MatchError(fmt.Sprintf("process %d is not the ceph-fuse of some-root/shares/abc", os.Getpid())))
+		})
+	})
+})
@@ -0,0 +1,217 @@
+package cephlocal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+type UpdateRequest struct {
+	Name string
+	Opts map[string]interface{}
+}
+
+type RemountRequest struct {
+	Name string
+}
+
+// Update merges new options into an existing volume. The stored metadata
+// changes immediately; holders that are already bound keep their current
+// share until the volume is next mounted from scratch or Remount is called.
+func (d *LocalDriver) Update(env voldriver.Env, updateRequest UpdateRequest) voldriver.ErrorResponse {
+	defer d.lockVolumes(updateRequest.Name)()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	defer d.persist(env.Logger())
+
+	return d.update(env, updateRequest)
+}
+
+func (d *LocalDriver) update(env voldriver.Env, updateRequest UpdateRequest) voldriver.ErrorResponse {
+	logger := env.Logger().Session("update", lager.Data{"volume_name": updateRequest.Name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	volume, ok := d.volumes[updateRequest.Name]
+	if !ok {
+		logger.Info("update-volume-not-found")
+		return voldriver.ErrorResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", updateRequest.Name).Encode()}
+	}
+
+	current := volume.mountConfig()
+	opts := current.Opts()
+	for key, value := range updateRequest.Opts {
+		opts[key] = value
+	}
+
+	config, err := cephdriver.ParseMountConfig(opts)
+	if err != nil {
+		logger.Info("invalid-opts", lager.Data{"error": err.Error()})
+		return voldriver.ErrorResponse{Err: newError(ERR_INVALID_OPTS, "%s", err.Error()).Encode()}
+	}
+
+	if limitsErr := d.checkLimits(config); limitsErr != nil {
+		logger.Info("unsupported-limits", lager.Data{"error": limitsErr.Message})
+		return voldriver.ErrorResponse{Err: limitsErr.Encode()}
+	}
+
+	changed := current.ChangedOpts(config)
+	if len(changed) == 0 {
+		logger.Info("update-volume-unchanged")
+		return voldriver.ErrorResponse{}
+	}
+
+	for _, opt := range changed {
+		if opt == "local_mount_point" {
+			logger.Info("update-volume-local-mount-point")
+			return voldriver.ErrorResponse{Err: newError(ERR_INVALID_OPTS, "Unable to update 'local_mount_point' field of an existing volume").Encode()}
+		}
+	}
+
+	volume.Keyring = config.Keyring
+	volume.IP = config.IP
+	volume.Port = config.Port
+	volume.RemoteMountPoint = config.RemoteMountPoint
+	volume.SubDirectory = config.SubDirectory
+	volume.ReadOnly = config.ReadOnly
+	volume.MemoryLimit = config.MemoryLimit
+	volume.CPULimit = config.CPULimit
+
+	if volume.mounted() {
+		volume.PendingChanges = mergeChanges(volume.PendingChanges, changed)
+	}
+
+	logger.Info("updated-volume", lager.Data{"changed": changed, "pending_changes": volume.PendingChanges})
+	return voldriver.ErrorResponse{}
+}
+
+// Remount applies pending changes to a mounted volume by mounting its new
+// share and moving the bind mount of each holder over one at a time.
+func (d *LocalDriver) Remount(env voldriver.Env, remountRequest RemountRequest) (response voldriver.ErrorResponse) {
+	started := time.Now()
+	defer func() {
+		d.publishOperation(EVENT_REMOUNT, remountRequest.Name, "", started, response.Err)
+	}()
+
+	defer d.lockVolumes(remountRequest.Name)()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	logger := env.Logger().Session("remount", lager.Data{"volume_name": remountRequest.Name})
+	logger.Info("start")
+	defer logger.Info("end")
+	defer d.persist(logger)
+
+	volume, ok := d.volumes[remountRequest.Name]
+	if !ok {
+		logger.Info("remount-volume-not-found")
+		return voldriver.ErrorResponse{Err: newError(ERR_VOLUME_NOT_FOUND, "Volume '%s' not found", remountRequest.Name).Encode()}
+	}
+
+	if !volume.mounted() {
+		logger.Info("remount-volume-not-mounted")
+		return voldriver.ErrorResponse{Err: newError(ERR_NOT_MOUNTED, "Volume '%s' not mounted", remountRequest.Name).Encode()}
+	}
+
+	if err := d.remount(driverhttp.EnvWithLogger(logger, env), volume); err != nil {
+		logger.Error("failed-remounting-volume", err)
+		remountErr := wrapError(err, ERR_REMOUNT_FAILED, "Error remounting '%s' (%s)", remountRequest.Name, err.Error())
+		volume.LastError = remountErr.Message
+		return voldriver.ErrorResponse{Err: remountErr.Encode()}
+	}
+	volume.LastError = ""
+	return voldriver.ErrorResponse{}
+}
+
+// remount moves the bind mount of every holder of a volume onto the share
+// its options now describe. If any holder cannot be moved, the holders moved
+// so far are moved back and the new share is released, so that the volume is
+// left entirely on its old share.
+func (d *LocalDriver) remount(env voldriver.Env, volume *volumeMetadata) error {
+	logger := env.Logger()
+
+	defer d.lockShares(volume.ShareKey, shareKey(volume))()
+
+	oldShare, ok := d.shares[volume.ShareKey]
+	if !ok {
+		return fmt.Errorf("share %s not found", volume.ShareKey)
+	}
+
+	newShare, err := d.acquireShare(env, volume)
+	if err != nil {
+		return err
+	}
+
+	moved := []string{}
+	for _, holderID := range volume.holderIDs() {
+		if err := d.moveBind(env, volume, holderID, oldShare, newShare); err != nil {
+			logger.Error("failed-moving-bind", err, lager.Data{"holder": holderID})
+			for _, movedID := range moved {
+				if rollbackErr := d.moveBind(env, volume, movedID, newShare, oldShare); rollbackErr != nil {
+					logger.Error("failed-moving-bind-back", rollbackErr, lager.Data{"holder": movedID})
+				}
+			}
+			if oldShare != newShare {
+				if releaseErr := d.releaseShare(env, newShare, false); releaseErr != nil {
+					logger.Error("failed-releasing-new-share", releaseErr)
+				}
+			}
+			return err
+		}
+		moved = append(moved, holderID)
+	}
+
+	volume.ShareKey = newShare.Key
+	volume.PendingChanges = nil
+
+	if oldShare != newShare {
+		return d.releaseShare(env, oldShare, false)
+	}
+	return nil
+}
+
+// moveBind moves the bind mount of a holder from one share to another. When
+// it cannot be bound to the new share, it is bound to the old one again.
+func (d *LocalDriver) moveBind(env voldriver.Env, volume *volumeMetadata, holderID string, from *shareMetadata, to *shareMetadata) error {
+	logger := env.Logger()
+	target := volume.bindPath(holderID)
+	logger.Info("moving-bind", lager.Data{"holder": holderID, "from": from.MountPoint, "to": to.MountPoint})
+
+	var err error
+	d.unlocked(func() {
+		_, err = d.useInvoker.Invoke(env, BIND_UNMOUNT_CMD, []string{target})
+	})
+	if err != nil {
+		return err
+	}
+	delete(from.Binds, target)
+
+	if err := d.mountBind(env, volume, to, holderID, volume.SubDirectories[holderID]); err != nil {
+		if restoreErr := d.mountBind(env, volume, from, holderID, volume.SubDirectories[holderID]); restoreErr != nil {
+			logger.Error("failed-restoring-bind", restoreErr, lager.Data{"holder": holderID})
+		}
+		return err
+	}
+	return nil
+}
+
+func mergeChanges(pending []string, changed []string) []string {
+	set := map[string]bool{}
+	for _, opt := range append(pending, changed...) {
+		set[opt] = true
+	}
+
+	merged := []string{}
+	for opt := range set {
+		merged = append(merged, opt)
+	}
+	sort.Strings(merged)
+	return merged
+}
@@ -0,0 +1,192 @@
+package cephlocal_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Update and Remount", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		testEnv     voldriver.Env
+		opts        map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("UpdateTest"), context.TODO())
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root"})
+
+		opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
+		createSuccessful(testEnv, driver, volumeName, opts)
+	})
+
+	status := func() cephlocal.VolumeStatus {
+		statusResponse := driver.Status(testEnv, cephlocal.StatusRequest{Name: volumeName})
+		Expect(statusResponse.Err).To(Equal(""))
+		return statusResponse.Status
+	}
+
+	It("reports an error for an unknown volume", func() {
+		updateResponse := driver.Update(testEnv, cephlocal.UpdateRequest{Name: "unknown", Opts: map[string]interface{}{"ip": "other-ip"}})
+		Expect(updateResponse.Err).To(Equal("Volume 'unknown' not found [VOLUME_NOT_FOUND]"))
+	})
+
+	It("rejects invalid opts", func() {
+		updateResponse := driver.Update(testEnv, cephlocal.UpdateRequest{Name: volumeName, Opts: map[string]interface{}{"port": "not-a-port"}})
+		Expect(updateResponse.Err).To(Equal("Unable to convert 'port' field in 'Opts' to an integer [INVALID_OPTS]"))
+	})
+
+	It("rejects a change of local_mount_point", func() {
+		updateResponse := driver.Update(testEnv, cephlocal.UpdateRequest{Name: volumeName, Opts: map[string]interface{}{"local_mount_point": "/elsewhere"}})
+		Expect(updateResponse.Err).To(Equal("Unable to update 'local_mount_point' field of an existing volume [INVALID_OPTS]"))
+	})
+
+	Context("when the volume is not mounted", func() {
+		It("uses the new opts on the next mount without pending changes", func() {
+			updateResponse := driver.Update(testEnv, cephlocal.UpdateRequest{Name: volumeName, Opts: map[string]interface{}{"ip": "other-ip"}})
+			Expect(updateResponse.Err).To(Equal(""))
+			Expect(status().PendingChanges).To(BeEmpty())
+
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args[3]).To(Equal("other-ip:6789"))
+		})
+
+		It("makes Create with the new opts a duplicate", func() {
+			driver.Update(testEnv, cephlocal.UpdateRequest{Name: volumeName, Opts: map[string]interface{}{"keyring": "other-keyring"}})
+			opts["keyring"] = "other-keyring"
+			createSuccessful(testEnv, driver, volumeName, opts)
+		})
+	})
+
+	Context("when the volume is mounted", func() {
+		var oldShare string
+
+		BeforeEach(func() {
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-2")
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			oldShare = args[6]
+
+			updateResponse := driver.Update(testEnv, cephlocal.UpdateRequest{Name: volumeName, Opts: map[string]interface{}{"keyring": "other-keyring", "ip": "other-ip"}})
+			Expect(updateResponse.Err).To(Equal(""))
+		})
+
+		It("reports the pending changes", func() {
+			Expect(status().PendingChanges).To(Equal([]string{"ip", "keyring"}))
+		})
+
+		It("binds new holders to the live share", func() {
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-3")
+			Expect(invocationsOf(fakeInvoker, "ceph-fuse")).To(Equal(1))
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+			Expect(args[1]).To(Equal(oldShare))
+		})
+
+		It("applies the changes once the volume is mounted from scratch", func() {
+			unmountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+			unmountSuccessfulWithID(testEnv, driver, volumeName, "container-2")
+			Expect(status().PendingChanges).To(BeEmpty())
+
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-3")
+			Expect(invocationsOf(fakeInvoker, "ceph-fuse")).To(Equal(2))
+			_, _, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 2)
+			Expect(args[3]).To(Equal("other-ip:6789"))
+		})
+
+		Context("when remounting", func() {
+			var remountResponse voldriver.ErrorResponse
+
+			JustBeforeEach(func() {
+				remountResponse = driver.Remount(testEnv, cephlocal.RemountRequest{Name: volumeName})
+			})
+
+			It("moves every holder to the new share and unmounts the old one", func() {
+				Expect(remountResponse.Err).To(Equal(""))
+				Expect(status().PendingChanges).To(BeEmpty())
+				Expect(status().Holders).To(Equal([]string{"container-1", "container-2"}))
+
+				Expect(invocationsOf(fakeInvoker, "ceph-fuse")).To(Equal(2))
+				Expect(invocationsOf(fakeInvoker, "umount")).To(Equal(2))
+				Expect(invocationsOf(fakeInvoker, "mount")).To(Equal(4))
+				Expect(invocationsOf(fakeInvoker, "fusermount")).To(Equal(1))
+
+				_, cmd, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+				Expect(cmd).To(Equal("fusermount"))
+				Expect(args).To(Equal([]string{"-u", oldShare}))
+			})
+
+			Context("when the new share cannot be mounted", func() {
+				BeforeEach(func() {
+					fakeInvoker.InvokeReturns(nil, fmt.Errorf("bad key"))
+				})
+
+				It("keeps the holders on the old share", func() {
+					Expect(remountResponse.Err).To(Equal(fmt.Sprintf("Error remounting '%s' (bad key) [MOUNT_FAILED]", volumeName)))
+					Expect(status().PendingChanges).To(Equal([]string{"ip", "keyring"}))
+					Expect(invocationsOf(fakeInvoker, "umount")).To(Equal(0))
+				})
+			})
+
+			Context("when a holder cannot be moved to the new share", func() {
+				BeforeEach(func() {
+					fakeInvoker.InvokeStub = func(env voldriver.Env, executable string, args []string) ([]byte, error) {
+						if executable == "mount" && args[1] != oldShare && strings.HasSuffix(args[2], "container-2") {
+							return nil, fmt.Errorf("device busy")
+						}
+						return nil, nil
+					}
+				})
+
+				It("moves the holders moved so far back and releases the new share", func() {
+					Expect(remountResponse.Err).To(Equal(fmt.Sprintf("Error remounting '%s' (device busy) [REMOUNT_FAILED]", volumeName)))
+					Expect(status().PendingChanges).To(Equal([]string{"ip", "keyring"}))
+					Expect(status().Holders).To(Equal([]string{"container-1", "container-2"}))
+
+					binds := map[string]string{}
+					for i := 0; i < fakeInvoker.InvokeCallCount(); i++ {
+						_, cmd, args := fakeInvoker.InvokeArgsForCall(i)
+						if cmd == "mount" {
+							binds[args[2]] = args[1]
+						}
+					}
+					Expect(binds).To(Equal(map[string]string{
+						"some-root/volumes/volume-name/container-1": oldShare,
+						"some-root/volumes/volume-name/container-2": oldShare,
+					}))
+
+					_, cmd, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+					Expect(cmd).To(Equal("fusermount"))
+					Expect(args).NotTo(ContainElement(oldShare))
+
+					mountSuccessfulWithID(testEnv, driver, volumeName, "container-3")
+					_, _, args = fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+					Expect(args[1]).To(Equal(oldShare))
+				})
+			})
+		})
+	})
+
+	It("reports an error when remounting a volume that is not mounted", func() {
+		remountResponse := driver.Remount(testEnv, cephlocal.RemountRequest{Name: volumeName})
+		Expect(remountResponse.Err).To(Equal(fmt.Sprintf("Volume '%s' not mounted [NOT_MOUNTED]", volumeName)))
+	})
+})
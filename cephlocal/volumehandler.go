@@ -0,0 +1,96 @@
+package cephlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+const (
+	GET_ROUTE   = "/VolumeDriver.Get"
+	MOUNT_ROUTE = "/VolumeDriver.Mount"
+	PATH_ROUTE  = "/VolumeDriver.Path"
+)
+
+// NewVolumeHandler answers the voldriver routes whose requests carry more
+// than voldriver's own types have room for, and passes every other request
+// on to handler: Mount takes 'Opts', and Get and Path the ID of a holder.
+// Operations are counted and timed in
+// metrics like those of an instrumented driver.
+func NewVolumeHandler(logger lager.Logger, driver *LocalDriver, metrics *Metrics, handler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(GET_ROUTE, getHandler(logger.Session("handle-get"), driver, metrics))
+	mux.Handle(MOUNT_ROUTE, mountHandler(logger.Session("handle-mount"), driver, metrics))
+	mux.Handle(PATH_ROUTE, pathHandler(logger.Session("handle-path"), driver, metrics))
+	mux.Handle("/", handler)
+	return mux
+}
+
+func mountHandler(logger lager.Logger, driver *LocalDriver, metrics *Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		mountRequest := MountRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&mountRequest); err != nil {
+			logger.Error("failed-parsing-mount-request", err)
+			writeVolumeResponse(logger, w, err.Error(), voldriver.MountResponse{Err: err.Error()})
+			return
+		}
+
+		start := time.Now()
+		response := driver.MountWithOpts(driverhttp.NewHttpDriverEnv(logger, req.Context()), mountRequest)
+		metrics.observeOperation("mount", response.Err, start)
+		writeVolumeResponse(logger, w, response.Err, response)
+	}
+}
+
+func getHandler(logger lager.Logger, driver *LocalDriver, metrics *Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		getRequest := GetRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&getRequest); err != nil {
+			logger.Error("failed-parsing-get-request", err)
+			writeVolumeResponse(logger, w, err.Error(), GetResponse{Err: err.Error()})
+			return
+		}
+
+		start := time.Now()
+		response := driver.GetForHolder(driverhttp.NewHttpDriverEnv(logger, req.Context()), getRequest)
+		metrics.observeOperation("get", response.Err, start)
+		writeVolumeResponse(logger, w, response.Err, response)
+	}
+}
+
+func pathHandler(logger lager.Logger, driver *LocalDriver, metrics *Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		pathRequest := PathRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&pathRequest); err != nil {
+			logger.Error("failed-parsing-path-request", err)
+			writeVolumeResponse(logger, w, err.Error(), voldriver.PathResponse{Err: err.Error()})
+			return
+		}
+
+		start := time.Now()
+		response := driver.PathForHolder(driverhttp.NewHttpDriverEnv(logger, req.Context()), pathRequest)
+		metrics.observeOperation("path", response.Err, start)
+		writeVolumeResponse(logger, w, response.Err, response)
+	}
+}
+
+// writeVolumeResponse answers the way the voldriver handler does: with 500
+// Internal Server Error when the response carries an error.
+func writeVolumeResponse(logger lager.Logger, w http.ResponseWriter, err string, response interface{}) {
+	status := http.StatusOK
+	if err != "" {
+		logger.Error("request-failed", errors.New(err))
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("failed-writing-response", err)
+	}
+}
@@ -0,0 +1,348 @@
+package cephlocal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+const DEFAULT_WEBHOOK_RETRIES = 3
+const DEFAULT_WEBHOOK_RETRY_INTERVAL = 2 * time.Second
+const DEFAULT_WEBHOOK_TIMEOUT = 10 * time.Second
+const DEFAULT_WEBHOOK_QUEUE_SIZE = 64
+const DEFAULT_WEBHOOK_REJECTION_INTERVAL = time.Minute
+
+// WEBHOOK_DEAD_LETTER_FILE_NAME is where, under the driver root, the driver
+// server keeps notifications it could not deliver.
+const WEBHOOK_DEAD_LETTER_FILE_NAME = "webhooks-dead-letter.ndjson"
+
+const (
+	WEBHOOK_SIGNATURE_HEADER    = "X-Cephdriver-Signature"
+	WEBHOOK_NOTIFICATION_HEADER = "X-Cephdriver-Notification"
+)
+
+const (
+	NOTIFY_MOUNT_FAILED   = "mount_failed"
+	NOTIFY_MOUNT_REJECTED = "mount_rejected"
+	NOTIFY_MOUNT_STALE    = "mount_stale"
+	NOTIFY_FORCE_UNMOUNT  = "force_unmount"
+)
+
+// WebhookConfig has the driver POST a notification to each of URLs when a
+// mount fails or is rejected for lack of room, a mount goes stale or holders
+// are force-unmounted. With a Secret, each payload is signed in the
+// X-Cephdriver-Signature header. A failed delivery is tried again up to
+// Retries times, waiting RetryInterval longer each time; a negative Retries
+// means DEFAULT_WEBHOOK_RETRIES. Each URL has a queue of QueueSize
+// notifications of its own. A notification that could not be delivered, or
+// queued, is appended to DeadLetterFile as a line of JSON. Rejected mounts
+// are notified at most once every RejectionInterval, as a busy cell rejects
+// them in bursts.
+type WebhookConfig struct {
+	URLs              []string
+	Secret            string
+	Retries           int
+	RetryInterval     time.Duration
+	Timeout           time.Duration
+	QueueSize         int
+	RejectionInterval time.Duration
+	DeadLetterFile    string
+}
+
+func (c WebhookConfig) withDefaults() WebhookConfig {
+	if c.Retries < 0 {
+		c.Retries = DEFAULT_WEBHOOK_RETRIES
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = DEFAULT_WEBHOOK_RETRY_INTERVAL
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DEFAULT_WEBHOOK_TIMEOUT
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = DEFAULT_WEBHOOK_QUEUE_SIZE
+	}
+	if c.RejectionInterval <= 0 {
+		c.RejectionInterval = DEFAULT_WEBHOOK_REJECTION_INTERVAL
+	}
+	return c
+}
+
+// A Notification is the payload POSTed to webhooks: the kind of notification
+// and the event that caused it. Suppressed counts the notifications of the
+// same kind left out since the last one.
+type Notification struct {
+	Kind       string `json:"kind"`
+	Event      Event  `json:"event"`
+	Suppressed int    `json:"suppressed,omitempty"`
+}
+
+type deadLetter struct {
+	Time         time.Time    `json:"time"`
+	URL          string       `json:"url"`
+	Attempts     int          `json:"attempts"`
+	Error        string       `json:"error"`
+	Notification Notification `json:"notification"`
+}
+
+// SignWebhookPayload is the value of the X-Cephdriver-Signature header for a
+// payload: its HMAC-SHA256 under secret, as "sha256=<hex>".
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func notificationKind(event Event) string {
+	switch {
+	case event.Operation == EVENT_MOUNT && event.Outcome == OUTCOME_FAILED:
+		if event.Code == ERR_OVERLOADED || event.Code == ERR_TOO_MANY_MOUNTS {
+			return NOTIFY_MOUNT_REJECTED
+		}
+		return NOTIFY_MOUNT_FAILED
+	case event.Operation == EVENT_STALE && event.Outcome == OUTCOME_DETECTED:
+		return NOTIFY_MOUNT_STALE
+	case event.Operation == EVENT_FORCE_UNMOUNT:
+		return NOTIFY_FORCE_UNMOUNT
+	}
+	return ""
+}
+
+type webhookNotifier struct {
+	driver *LocalDriver
+	config WebhookConfig
+	http   *http.Client
+
+	// deadLetters serialises the writes of the workers to the dead-letter
+	// file.
+	deadLetters sync.Mutex
+
+	lastRejection        time.Time
+	suppressedRejections int
+}
+
+// WebhookNotifierRunner delivers notifications for the events of the driver
+// until it is signalled. Each URL has a worker of its own, so that a URL that
+// is slow or down does not hold up the others, which delivers its
+// notifications one at a time in the order of their events. Notifications
+// for which there is no room in the queue of a URL, or whose events the
+// notifier's subscription had to drop, are dead-lettered.
+func (d *LocalDriver) WebhookNotifierRunner(logger lager.Logger, config WebhookConfig) ifrit.Runner {
+	n := &webhookNotifier{driver: d, config: config.withDefaults()}
+	n.http = &http.Client{Timeout: n.config.Timeout}
+
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		logger := logger.Session("webhook-notifier", lager.Data{"urls": n.config.URLs})
+		subscription := d.subscribeEvents(func(event Event) bool {
+			return notificationKind(event) != ""
+		})
+		defer subscription.Close()
+
+		// Deliveries in progress are abandoned when the notifier is
+		// signalled, and their notifications dead-lettered along with those
+		// still queued.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-signals:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		queues := map[string]chan Notification{}
+		workers := sync.WaitGroup{}
+		for _, url := range n.config.URLs {
+			queue := make(chan Notification, n.config.QueueSize)
+			queues[url] = queue
+
+			workers.Add(1)
+			go func(url string) {
+				defer workers.Done()
+				for notification := range queue {
+					n.notify(logger, ctx, url, notification)
+				}
+			}(url)
+		}
+		defer func() {
+			for _, queue := range queues {
+				close(queue)
+			}
+			workers.Wait()
+		}()
+
+		close(ready)
+		dropped := 0
+		for {
+			select {
+			case event := <-subscription.Events():
+				if notification, ok := n.notification(logger, event); ok {
+					n.enqueue(logger, queues, notification)
+				}
+				if missed := subscription.Dropped(); missed > dropped {
+					logger.Info("events-dropped", lager.Data{"dropped": missed - dropped})
+					dropped = missed
+					for _, event := range subscription.Missed() {
+						if notification, ok := n.notification(logger, event); ok {
+							n.deadLetterAll(logger, errors.New("event was dropped before it could be queued"), notification)
+						}
+					}
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+}
+
+// notification returns the notification for an event, if it is one the
+// webhooks are told of and is not to be suppressed.
+func (n *webhookNotifier) notification(logger lager.Logger, event Event) (Notification, bool) {
+	kind := notificationKind(event)
+	if kind == "" {
+		return Notification{}, false
+	}
+
+	notification := Notification{Kind: kind, Event: event}
+	if kind == NOTIFY_MOUNT_REJECTED {
+		if time.Since(n.lastRejection) < n.config.RejectionInterval {
+			n.suppressedRejections++
+			logger.Debug("suppressed-notification", lager.Data{"kind": kind, "volume_name": event.Volume, "sequence": event.Sequence})
+			return Notification{}, false
+		}
+		n.lastRejection = time.Now()
+		notification.Suppressed = n.suppressedRejections
+		n.suppressedRejections = 0
+	}
+	return notification, true
+}
+
+// enqueue hands a notification to the worker of each URL, dead-lettering it
+// for the URLs whose queue is full.
+func (n *webhookNotifier) enqueue(logger lager.Logger, queues map[string]chan Notification, notification Notification) {
+	for _, url := range n.config.URLs {
+		select {
+		case queues[url] <- notification:
+		default:
+			n.deadLetter(logger, url, 0, errors.New("delivery queue is full"), notification)
+		}
+	}
+}
+
+func (n *webhookNotifier) notify(logger lager.Logger, ctx context.Context, url string, notification Notification) {
+	logger = logger.Session("notify", lager.Data{"url": url, "kind": notification.Kind, "volume_name": notification.Event.Volume, "sequence": notification.Event.Sequence})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		logger.Error("failed-encoding-notification", err)
+		return
+	}
+
+	attempts, err := n.deliver(logger, ctx, url, notification.Kind, payload)
+	if err != nil {
+		n.deadLetter(logger, url, attempts, err, notification)
+		return
+	}
+	logger.Info("delivered", lager.Data{"attempts": attempts})
+}
+
+// deliver POSTs a payload to a URL until it is accepted, the retries run
+// out or the context ends, and returns the number of attempts it made.
+func (n *webhookNotifier) deliver(logger lager.Logger, ctx context.Context, url string, kind string, payload []byte) (int, error) {
+	var err error
+	attempts := 0
+	for attempts <= n.config.Retries {
+		if attempts > 0 {
+			select {
+			case <-time.After(time.Duration(attempts) * n.config.RetryInterval):
+			case <-ctx.Done():
+				return attempts, fmt.Errorf("notifier stopped after %s", err.Error())
+			}
+		}
+
+		attempts++
+		if err = n.post(ctx, url, kind, payload); err == nil {
+			return attempts, nil
+		}
+		logger.Error("failed-delivering-notification", err, lager.Data{"attempt": attempts})
+	}
+	return attempts, err
+}
+
+func (n *webhookNotifier) post(ctx context.Context, url string, kind string, payload []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_NOTIFICATION_HEADER, kind)
+	if n.config.Secret != "" {
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignWebhookPayload(n.config.Secret, payload))
+	}
+
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n *webhookNotifier) deadLetterAll(logger lager.Logger, deliveryErr error, notification Notification) {
+	for _, url := range n.config.URLs {
+		n.deadLetter(logger, url, 0, deliveryErr, notification)
+	}
+}
+
+func (n *webhookNotifier) deadLetter(logger lager.Logger, url string, attempts int, deliveryErr error, notification Notification) {
+	data := lager.Data{"url": url, "kind": notification.Kind, "attempts": attempts, "dead_letter_file": n.config.DeadLetterFile}
+	if n.config.DeadLetterFile == "" {
+		logger.Error("dropping-undeliverable-notification", deliveryErr, data)
+		return
+	}
+
+	line, err := json.Marshal(deadLetter{Time: time.Now(), URL: url, Attempts: attempts, Error: deliveryErr.Error(), Notification: notification})
+	if err != nil {
+		logger.Error("failed-encoding-dead-letter", err, data)
+		return
+	}
+
+	n.deadLetters.Lock()
+	defer n.deadLetters.Unlock()
+
+	file, err := n.driver.os.OpenFile(n.config.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Error("failed-opening-dead-letter-file", err, data)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		logger.Error("failed-writing-dead-letter", err, data)
+		return
+	}
+	logger.Error("dead-lettered-notification", deliveryErr, data)
+}
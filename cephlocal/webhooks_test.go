@@ -0,0 +1,289 @@
+package cephlocal_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+	"github.com/tedsuo/ifrit"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+var _ = Describe("Webhooks", func() {
+	const volumeName = "volume-name"
+
+	var (
+		driver      *cephlocal.LocalDriver
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeOs      *os_fake.FakeOs
+		testEnv     voldriver.Env
+		tmpDir      string
+
+		server    *httptest.Server
+		statuses  []int
+		requests  chan webhookRequest
+		config    cephlocal.WebhookConfig
+		process   ifrit.Process
+		receiving sync.Mutex
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "webhooks-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeInvoker = new(voldriverfakes.FakeInvoker)
+		fakeOs = new(os_fake.FakeOs)
+		fakeOs.OpenFileStub = os.OpenFile
+		testEnv = driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("WebhooksTest"), context.TODO())
+		driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root"})
+		createSuccessful(testEnv, driver, volumeName, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+
+		statuses = nil
+		requests = make(chan webhookRequest, 10)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			requests <- webhookRequest{header: req.Header, body: body}
+
+			receiving.Lock()
+			defer receiving.Unlock()
+			if len(statuses) > 0 {
+				w.WriteHeader(statuses[0])
+				statuses = statuses[1:]
+			}
+		}))
+
+		config = cephlocal.WebhookConfig{
+			URLs:           []string{server.URL + "/hook"},
+			Secret:         "some-secret",
+			Retries:        2,
+			RetryInterval:  time.Millisecond,
+			DeadLetterFile: filepath.Join(tmpDir, "dead-letter.ndjson"),
+		}
+	})
+
+	JustBeforeEach(func() {
+		process = ifrit.Invoke(driver.WebhookNotifierRunner(lagertest.NewTestLogger("WebhooksTest"), config))
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+		server.Close()
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	respondWith := func(codes ...int) {
+		receiving.Lock()
+		defer receiving.Unlock()
+		statuses = codes
+	}
+
+	failMount := func() {
+		fakeInvoker.InvokeReturns(nil, errors.New("connection refused"))
+		Expect(driver.Mount(testEnv, voldriver.MountRequest{Name: volumeName, ID: "container-1"}).Err).NotTo(BeEmpty())
+	}
+
+	readDeadLetters := func() string {
+		contents, _ := ioutil.ReadFile(filepath.Join(tmpDir, "dead-letter.ndjson"))
+		return string(contents)
+	}
+
+	notification := func(request webhookRequest) cephlocal.Notification {
+		notification := cephlocal.Notification{}
+		Expect(json.Unmarshal(request.body, &notification)).To(Succeed())
+		return notification
+	}
+
+	It("posts a signed notification when a mount fails", func() {
+		failMount()
+
+		var request webhookRequest
+		Eventually(requests).Should(Receive(&request))
+		Expect(request.header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(request.header.Get(cephlocal.WEBHOOK_NOTIFICATION_HEADER)).To(Equal(cephlocal.NOTIFY_MOUNT_FAILED))
+		Expect(request.header.Get(cephlocal.WEBHOOK_SIGNATURE_HEADER)).To(Equal(cephlocal.SignWebhookPayload("some-secret", request.body)))
+
+		sent := notification(request)
+		Expect(sent.Kind).To(Equal(cephlocal.NOTIFY_MOUNT_FAILED))
+		Expect(sent.Event.Volume).To(Equal(volumeName))
+		Expect(sent.Event.Holder).To(Equal("container-1"))
+		Expect(sent.Event.Error).To(ContainSubstring("connection refused"))
+	})
+
+	It("posts a notification when holders are force-unmounted", func() {
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		Expect(driver.ForceUnmount(testEnv, cephlocal.ForceUnmountRequest{Name: volumeName}).Err).To(BeEmpty())
+
+		var request webhookRequest
+		Eventually(requests).Should(Receive(&request))
+		Expect(notification(request).Kind).To(Equal(cephlocal.NOTIFY_FORCE_UNMOUNT))
+		Consistently(requests).ShouldNot(Receive())
+	})
+
+	It("posts a notification when a mount goes stale", func() {
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		fakeOs.StatReturns(nil, &os.PathError{Op: "stat", Path: "some-root/shares", Err: syscall.ENOTCONN})
+		driver.Health(testEnv)
+
+		var request webhookRequest
+		Eventually(requests).Should(Receive(&request))
+		Expect(notification(request).Kind).To(Equal(cephlocal.NOTIFY_MOUNT_STALE))
+	})
+
+	It("leaves other events alone", func() {
+		mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+		Expect(driver.Unmount(testEnv, voldriver.UnmountRequest{Name: volumeName, ID: "container-1"}).Err).To(BeEmpty())
+
+		Consistently(requests).ShouldNot(Receive())
+	})
+
+	It("retries deliveries that fail", func() {
+		respondWith(http.StatusServiceUnavailable, http.StatusInternalServerError)
+		failMount()
+
+		Eventually(requests).Should(Receive())
+		Eventually(requests).Should(Receive())
+		Eventually(requests).Should(Receive())
+		Consistently(requests).ShouldNot(Receive())
+		Expect(filepath.Join(tmpDir, "dead-letter.ndjson")).NotTo(BeAnExistingFile())
+	})
+
+	It("writes notifications that cannot be delivered to the dead-letter file", func() {
+		respondWith(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+		failMount()
+
+		Eventually(readDeadLetters).Should(HaveSuffix("\n"))
+
+		lines := strings.Split(strings.TrimSpace(readDeadLetters()), "\n")
+		Expect(lines).To(HaveLen(1))
+
+		deadLetter := struct {
+			URL          string                 `json:"url"`
+			Attempts     int                    `json:"attempts"`
+			Error        string                 `json:"error"`
+			Notification cephlocal.Notification `json:"notification"`
+		}{}
+		Expect(json.Unmarshal([]byte(lines[0]), &deadLetter)).To(Succeed())
+		Expect(deadLetter.URL).To(Equal(server.URL + "/hook"))
+		Expect(deadLetter.Attempts).To(Equal(3))
+		Expect(deadLetter.Error).To(Equal("unexpected status 500"))
+		Expect(deadLetter.Notification.Kind).To(Equal(cephlocal.NOTIFY_MOUNT_FAILED))
+	})
+
+	Context("without retries", func() {
+		BeforeEach(func() {
+			config.Retries = 0
+		})
+
+		It("tries each delivery once", func() {
+			respondWith(http.StatusInternalServerError)
+			failMount()
+
+			Eventually(requests).Should(Receive())
+			Eventually(readDeadLetters).Should(ContainSubstring(`"attempts":1,`))
+			Consistently(requests).ShouldNot(Receive())
+		})
+	})
+
+	Context("with several URLs", func() {
+		var (
+			slowServer *httptest.Server
+			release    chan struct{}
+		)
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			slowServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				<-release
+			}))
+			config.URLs = []string{slowServer.URL + "/hook", server.URL + "/hook"}
+			config.QueueSize = 1
+		})
+
+		AfterEach(func() {
+			close(release)
+			slowServer.Close()
+		})
+
+		It("delivers to each URL without waiting for the others", func() {
+			failMount()
+
+			var request webhookRequest
+			Eventually(requests).Should(Receive(&request))
+			Expect(notification(request).Kind).To(Equal(cephlocal.NOTIFY_MOUNT_FAILED))
+		})
+
+		It("dead-letters notifications for which a URL has no room in its queue", func() {
+			for i := 0; i < 3; i++ {
+				failMount()
+				Eventually(requests).Should(Receive())
+			}
+
+			Eventually(readDeadLetters).Should(ContainSubstring("delivery queue is full"))
+			Expect(readDeadLetters()).To(ContainSubstring(`"url":"` + slowServer.URL + `/hook"`))
+			Expect(readDeadLetters()).NotTo(ContainSubstring(`"url":"` + server.URL + `/hook"`))
+		})
+	})
+
+	Context("when mounts are rejected for lack of room", func() {
+		BeforeEach(func() {
+			driver = cephlocal.NewLocalDriverWithInvokerAndSystemUtil(fakeInvoker, fakeOs, new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root", Admission: cephlocal.AdmissionConfig{MaxMountedVolumes: 1}})
+			for _, name := range []string{volumeName, "other-volume"} {
+				createSuccessful(testEnv, driver, name, map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"})
+			}
+		})
+
+		It("posts a notification of its own kind at most once an interval", func() {
+			mountSuccessfulWithID(testEnv, driver, volumeName, "container-1")
+			for _, holderID := range []string{"container-2", "container-3"} {
+				response := driver.Mount(testEnv, voldriver.MountRequest{Name: "other-volume", ID: holderID})
+				Expect(response.Err).To(ContainSubstring(string(cephlocal.ERR_TOO_MANY_MOUNTS)))
+			}
+
+			var request webhookRequest
+			Eventually(requests).Should(Receive(&request))
+			Expect(notification(request).Kind).To(Equal(cephlocal.NOTIFY_MOUNT_REJECTED))
+			Expect(notification(request).Event.Holder).To(Equal("container-2"))
+			Consistently(requests).ShouldNot(Receive())
+		})
+	})
+
+	Context("without a secret", func() {
+		BeforeEach(func() {
+			config.Secret = ""
+		})
+
+		It("sends notifications unsigned", func() {
+			failMount()
+
+			var request webhookRequest
+			Eventually(requests).Should(Receive(&request))
+			Expect(request.header.Get(cephlocal.WEBHOOK_SIGNATURE_HEADER)).To(BeEmpty())
+		})
+	})
+})
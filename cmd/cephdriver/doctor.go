@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+type monitorList []string
+
+func (m *monitorList) String() string {
+	return strings.Join(*m, ", ")
+}
+
+func (m *monitorList) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
+// doctor runs the preflight checks of `cephdriver doctor` and returns the
+// exit status: 0 when every check passes, 1 when one fails, 2 on bad usage.
+func doctor(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	config := cephlocal.DoctorConfig{}
+	var monitors monitorList
+	var jsonOutput bool
+	flags.StringVar(&config.RootDir, "rootDir", cephlocal.DEFAULT_ROOT_DIR, "Root directory of the driver whose state file is checked")
+	flags.Var(&monitors, "monitor", "Ceph monitor (ip or ip:port) whose reachability is checked (may be repeated)")
+	flags.DurationVar(&config.Timeout, "timeout", cephlocal.DEFAULT_DOCTOR_TIMEOUT, "Timeout for each monitor connection")
+	flags.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	config.Monitors = monitors
+
+	logger := lager.NewLogger("cephdriver-doctor")
+	logger.RegisterSink(lager.NewWriterSink(stderr, lager.ERROR))
+
+	env := driverhttp.NewHttpDriverEnv(logger, context.Background())
+	report := cephlocal.NewDoctor(config).Run(env)
+
+	if jsonOutput {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			return 1
+		}
+	} else {
+		writeReport(stdout, report)
+	}
+
+	if !report.Healthy {
+		return 1
+	}
+	return 0
+}
+
+func writeReport(w io.Writer, report cephlocal.HealthReport) {
+	fmt.Fprintf(w, "cephdriver doctor (%s)\n\n", time.Now().Format(time.RFC3339))
+	for _, check := range report.Checks {
+		status := "PASS"
+		if !check.Healthy {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "[%s] %-24s %s\n", status, check.Name, check.Message)
+	}
+
+	if report.Healthy {
+		fmt.Fprintln(w, "\nAll checks passed.")
+	} else {
+		fmt.Fprintln(w, "\nSome checks failed.")
+	}
+}
+
+func runSubcommand(args []string) (int, bool) {
+	if len(args) < 2 {
+		return 0, false
+	}
+
+	switch args[1] {
+	case "doctor":
+		return doctor(args[2:], os.Stdout, os.Stderr), true
+	}
+	return 0, false
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
+	"github.com/tedsuo/ifrit/http_server"
 	"github.com/tedsuo/ifrit/sigmon"
 
 	"code.cloudfoundry.org/cephdriver/cephlocal"
@@ -23,10 +24,14 @@ func init() {
 }
 
 func main() {
+	if status, ok := runSubcommand(os.Args); ok {
+		os.Exit(status)
+	}
+
 	cephServerConfig := cephlocal.CephServerConfig{}
 	parseCommandLine(&cephServerConfig)
 
-	withLogger, _ := lagerflags.New("ceph-driver-server")
+	withLogger, logTap := lagerflags.New("ceph-driver-server")
 
 	syscall.Umask(000)
 
@@ -38,11 +43,58 @@ func main() {
 		{"cephdriver-server", cephDriverServer},
 	}
 
-	var logTap *lager.ReconfigurableSink
+	if cephServerConfig.MetricsAddress != "" {
+		metricsServer, err := cephServer.MetricsRunner(withLogger)
+		exitOnFailure(withLogger, err)
+		servers = append(servers, grouper.Member{"metrics-server", metricsServer})
+	}
+
+	if cephServerConfig.AdminAddress != "" {
+		adminServer, err := cephServer.AdminRunner(withLogger)
+		exitOnFailure(withLogger, err)
+		servers = append(servers, grouper.Member{"admin-server", adminServer})
+	}
+
+	if cephServerConfig.SuperviseFuse {
+		supervisor, err := cephServer.SupervisorRunner(withLogger)
+		exitOnFailure(withLogger, err)
+		servers = append(servers, grouper.Member{"fuse-supervisor", supervisor})
+	}
+
+	if cephServerConfig.EvictionCheckInterval > 0 {
+		evictionMonitor, err := cephServer.EvictionMonitorRunner(withLogger)
+		exitOnFailure(withLogger, err)
+		servers = append(servers, grouper.Member{"eviction-monitor", evictionMonitor})
+	}
+
+	if cephServerConfig.StaleCheckInterval > 0 {
+		staleMonitor, err := cephServer.StaleMonitorRunner(withLogger)
+		exitOnFailure(withLogger, err)
+		servers = append(servers, grouper.Member{"stale-monitor", staleMonitor})
+	}
+
+	if cephServerConfig.FuseLogDir != "" && cephServerConfig.FuseLogCheckInterval > 0 {
+		logRotator, err := cephServer.LogRotatorRunner(withLogger)
+		exitOnFailure(withLogger, err)
+		servers = append(servers, grouper.Member{"log-rotator", logRotator})
+	}
+
+	if cephServerConfig.IdleTTL > 0 {
+		idleReaper, err := cephServer.IdleReaperRunner(withLogger)
+		exitOnFailure(withLogger, err)
+		servers = append(servers, grouper.Member{"idle-reaper", idleReaper})
+	}
+
+	if len(cephServerConfig.WebhookURLs) > 0 {
+		webhookNotifier, err := cephServer.WebhookNotifierRunner(withLogger)
+		exitOnFailure(withLogger, err)
+		servers = append(servers, grouper.Member{"webhook-notifier", webhookNotifier})
+	}
 
 	if dbgAddr := cf_debug_server.DebugAddress(flag.CommandLine); dbgAddr != "" {
+		debugHandler := cephlocal.NewLogLevelHandler(withLogger, logTap, cf_debug_server.Handler(logTap))
 		servers = append(grouper.Members{
-			{"debug-server", cf_debug_server.Runner(dbgAddr, logTap)},
+			{"debug-server", http_server.New(dbgAddr, debugHandler)},
 		}, servers...)
 	}
 
@@ -68,6 +120,44 @@ func parseCommandLine(config *cephlocal.CephServerConfig) {
 	flag.StringVar(&config.DriversPath, "driversPath", "", "Path to directory where drivers are installed")
 	flag.StringVar(&config.Transport, "transport", "tcp", "Transport protocol to transmit HTTP over")
 	flag.Var(&config.FuseArgs, "fuseArg", "Additional arguments that will be included in each ceph-fuse invocation")
+	flag.StringVar(&config.DriverName, "driverName", cephlocal.DEFAULT_DRIVER_NAME, "Name of the driver, used for the driver spec file advertised to volman")
+	flag.StringVar(&config.Scope, "scope", cephlocal.SCOPE_GLOBAL, "Capability scope advertised to volman: local or global")
+	flag.StringVar(&config.RootDir, "rootDir", cephlocal.DEFAULT_ROOT_DIR, "Directory under which the driver keeps its ceph-fuse and volume mount points")
+	flag.Var(&config.AllowedMountRoots, "allowedMountRoot", "Directory under which callers may place a volume's local_mount_point (may be repeated)")
+	flag.StringVar(&config.MetricsAddress, "metricsAddr", "", "host:port to serve Prometheus metrics on at /metrics (disabled when empty)")
+	flag.StringVar(&config.AdminAddress, "adminAddr", "", "host:port to serve the admin API on (disabled when empty)")
+	flag.StringVar(&config.AdminTokenFile, "adminTokenFile", "", "File holding the bearer token admin API requests must present")
+	flag.StringVar(&config.AdminCertFile, "adminCertFile", "", "Certificate to serve the admin API over TLS with (plain HTTP when empty)")
+	flag.StringVar(&config.AdminKeyFile, "adminKeyFile", "", "Private key of -adminCertFile")
+	flag.StringVar(&config.AdminCAFile, "adminCAFile", "", "CA whose client certificates admin API requests must present (no client certificates required when empty)")
+	flag.BoolVar(&config.AdminInsecure, "adminInsecure", false, "Serve the admin API over plain HTTP on a non-loopback -adminAddr")
+	flag.StringVar(&config.FuseLogDir, "fuseLogDir", "", "Directory in which ceph-fuse writes a log file per share (ceph-fuse's own logging when empty)")
+	flag.Int64Var(&config.FuseLogMaxSize, "fuseLogMaxSize", cephlocal.DEFAULT_LOG_MAX_SIZE, "Size in bytes beyond which a ceph-fuse log file is rotated")
+	flag.DurationVar(&config.FuseLogCheckInterval, "fuseLogCheckInterval", cephlocal.DEFAULT_LOG_CHECK_INTERVAL, "How often to check ceph-fuse log files for having grown to -fuseLogMaxSize (only rotated when their share is next mounted when 0)")
+	flag.BoolVar(&config.SuperviseFuse, "superviseFuse", false, "Run ceph-fuse in the foreground under the driver, which then tracks its process and notices when it exits")
+	flag.BoolVar(&config.RestartFuse, "restartFuse", false, "Mount a share again, with backoff, when its supervised ceph-fuse process exits")
+	flag.IntVar(&config.FuseLogMaxFiles, "fuseLogMaxFiles", cephlocal.DEFAULT_LOG_MAX_FILES, "Number of rotated ceph-fuse log files to keep per share")
+	flag.StringVar(&config.FuseMemoryLimit, "fuseMemoryLimit", "", "Default memory limit of each supervised ceph-fuse process, in bytes with an optional K, M, G or T suffix (unlimited when empty)")
+	flag.StringVar(&config.FuseCPULimit, "fuseCPULimit", "", "Default CPU limit of each supervised ceph-fuse process, as a number of CPUs (unlimited when empty)")
+	flag.DurationVar(&config.EvictionCheckInterval, "evictionCheckInterval", 0, "How often to look for ceph-fuse clients evicted by the MDS, such as every 30s (disabled when 0)")
+	flag.BoolVar(&config.RemountEvicted, "remountEvicted", false, "Mount the share of an evicted ceph-fuse client again and move its holders' bind mounts onto it (requires -evictionCheckInterval)")
+	flag.DurationVar(&config.StaleCheckInterval, "staleCheckInterval", cephlocal.DEFAULT_STALE_CHECK_INTERVAL, "How often to check ceph-fuse mounts for having gone stale, publishing changes as events and webhook notifications (disabled when 0)")
+	flag.DurationVar(&config.IdleTTL, "idleTTL", 0, "Unmount holders that have shown no sign of life for this long (disabled when 0)")
+	flag.DurationVar(&config.IdleCheckInterval, "idleCheckInterval", cephlocal.DEFAULT_IDLE_CHECK_INTERVAL, "How often to look for idle holders")
+	flag.BoolVar(&config.IdleHeartbeats, "idleHeartbeats", false, "Only count heartbeats sent through the admin API as signs of life, rather than a holder's bind mount being mounted into a container")
+	flag.BoolVar(&config.AsyncMount, "asyncMount", false, "Mount in the background, answering Mount with MOUNT_PENDING until the mount is done; callers poll Mount, Get or Path")
+	flag.DurationVar(&config.AsyncMountTTL, "asyncMountTTL", cephlocal.DEFAULT_ASYNC_MOUNT_TTL, "How long the outcome of a background mount is kept for its holder to poll")
+	flag.IntVar(&config.MaxConcurrentMounts, "maxConcurrentMounts", 0, "Mount and unmount calls to run at once; further calls wait in a queue (unlimited when 0)")
+	flag.IntVar(&config.MaxQueuedMounts, "maxQueuedMounts", 0, "Mount and unmount calls that may wait for one of -maxConcurrentMounts; further calls are rejected (unbounded when 0)")
+	flag.DurationVar(&config.MountQueueTimeout, "mountQueueTimeout", 0, "How long a mount or unmount call waits in the queue before it is rejected (as long as the request lasts when 0)")
+	flag.IntVar(&config.MaxMountedVolumes, "maxMountedVolumes", 0, "Volumes that may be mounted on the cell at once (unlimited when 0)")
+	flag.Var(&config.WebhookURLs, "webhookURL", "URL to POST notifications of failed, rejected, stale and force-unmounted mounts to (may be repeated)")
+	flag.StringVar(&config.WebhookSecretFile, "webhookSecretFile", "", "File holding the secret webhook payloads are signed with using HMAC-SHA256 (unsigned when empty)")
+	flag.IntVar(&config.WebhookRetries, "webhookRetries", cephlocal.DEFAULT_WEBHOOK_RETRIES, "Times to retry a webhook notification that could not be delivered (not retried when 0)")
+	flag.DurationVar(&config.WebhookRetryInterval, "webhookRetryInterval", cephlocal.DEFAULT_WEBHOOK_RETRY_INTERVAL, "How long to wait before the first retry of a webhook notification, growing with each retry")
+	flag.StringVar(&config.WebhookDeadLetterFile, "webhookDeadLetterFile", "", "File to append undeliverable webhook notifications to (defaults to a file under the root directory)")
+	flag.IntVar(&config.EventBuffer, "eventBuffer", cephlocal.DEFAULT_EVENT_BUFFER, "Lifecycle events buffered for each consumer of the admin event stream; further events are dropped for consumers that fall behind")
+	flag.StringVar(&config.CgroupRoot, "cgroupRoot", cephlocal.DEFAULT_CGROUP_ROOT, "cgroup v2 directory under which each limited ceph-fuse process gets a group of its own")
 
 	lagerflags.AddFlags(flag.CommandLine)
 	cf_debug_server.AddFlags(flag.CommandLine)
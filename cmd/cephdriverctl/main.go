@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/cephdriver/cephclient"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+const usage = `Usage: cephdriverctl [flags] <command> [arguments]
+
+Driver commands:
+  create <volume> key=value...      create a volume with the given opts
+  get <volume> [id]                 show a volume
+  list                              list volumes
+  path <volume> [id]                show the mount point of a volume for a holder
+  mount <volume> [id] [key=value...]
+                                    mount a volume, with the given mount opts
+                                    (sub_directory=<dir> binds a sub-directory)
+  unmount <volume> [id]             unmount a volume
+  remove <volume>                   remove a volume
+  capabilities                      show the capabilities of the driver
+
+Admin commands (require -adminAddr and -adminTokenFile):
+  admin list                        list volumes with full metadata
+  admin show <volume>               show a volume with full metadata
+  admin update <volume> key=value...
+                                    update the opts of a volume; bound holders
+                                    keep the old opts until it is remounted
+  admin force-unmount <volume> [id] force-unmount one or all holders
+  admin remount <volume>            remount a volume
+  admin heartbeat <volume> <id>     record that a holder is alive
+  admin rotate-keyring <volume> <keyring-file>
+                                    replace the keyring of a volume
+  admin rotate-client-keyring <client> <keyring-file>
+                                    replace the keyring of every volume of a
+                                    cephx client
+  admin remove <volume>             unmount and remove a volume
+  admin diagnostics <volume>        query the admin socket of a volume's ceph-fuse
+  admin events [volume]             stream lifecycle events of all or one volume
+
+Flags:
+`
+
+type config struct {
+	driversPath    string
+	driverName     string
+	address        string
+	adminAddress   string
+	adminTokenFile string
+	jsonOutput     bool
+	tls            voldriver.TLSConfig
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("cephdriverctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	cfg := config{}
+	flags.StringVar(&cfg.driversPath, "driversPath", "", "Path to the directory holding the driver spec")
+	flags.StringVar(&cfg.driverName, "driverName", cephdriver.DEFAULT_DRIVER_NAME, "Name of the driver spec to read")
+	flags.StringVar(&cfg.address, "address", "", "Address of the driver (host:port, http(s)://host:port or unix:///path), instead of reading its spec")
+	flags.StringVar(&cfg.adminAddress, "adminAddr", "", "host:port of the driver's admin API")
+	flags.StringVar(&cfg.adminTokenFile, "adminTokenFile", "", "File holding the admin API bearer token")
+	flags.BoolVar(&cfg.jsonOutput, "json", false, "Print results as JSON")
+	flags.StringVar(&cfg.tls.CAFile, "caFile", "", "CA certificate to verify the driver with")
+	flags.StringVar(&cfg.tls.CertFile, "certFile", "", "Client certificate to present to the driver")
+	flags.StringVar(&cfg.tls.KeyFile, "keyFile", "", "Key of the client certificate")
+	flags.BoolVar(&cfg.tls.InsecureSkipVerify, "insecureSkipVerify", false, "Do not verify the driver's certificate")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	logger := lager.NewLogger("cephdriverctl")
+	logger.RegisterSink(lager.NewWriterSink(stderr, lager.FATAL))
+	env := driverhttp.NewHttpDriverEnv(logger, context.Background())
+
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+
+	var err error
+	if command == "admin" {
+		err = runAdmin(env, cfg, commandArgs, stdout)
+	} else {
+		err = runDriver(env, cfg, command, commandArgs, stdout)
+	}
+
+	if err == errUsage {
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+var errUsage = errors.New("usage")
+
+func (cfg config) tlsConfig() *voldriver.TLSConfig {
+	if cfg.tls == (voldriver.TLSConfig{}) {
+		return nil
+	}
+	return &cfg.tls
+}
+
+func (cfg config) driverClient() (*cephclient.Client, error) {
+	if cfg.address != "" {
+		return cephclient.NewClient(voldriver.DriverSpec{Name: cfg.driverName, Address: cfg.address, TLSConfig: cfg.tlsConfig()})
+	}
+
+	if cfg.driversPath == "" {
+		return nil, errors.New("either -driversPath or -address is required")
+	}
+
+	spec, err := cephclient.DiscoverSpec(cfg.driversPath, cfg.driverName)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig := cfg.tlsConfig(); tlsConfig != nil {
+		spec.TLSConfig = tlsConfig
+	}
+	return cephclient.NewClient(spec)
+}
+
+func runDriver(env voldriver.Env, cfg config, command string, args []string, stdout io.Writer) error {
+	arity := map[string][2]int{
+		"create":       {1, -1},
+		"get":          {1, 2},
+		"list":         {0, 0},
+		"path":         {1, 2},
+		"mount":        {1, -1},
+		"unmount":      {1, 2},
+		"remove":       {1, 1},
+		"capabilities": {0, 0},
+	}
+	if !validArity(arity, command, args) {
+		return errUsage
+	}
+
+	client, err := cfg.driverClient()
+	if err != nil {
+		return err
+	}
+
+	id, rest := "", []string{}
+	if len(args) > 1 {
+		rest = args[1:]
+	}
+	if len(rest) > 0 && !strings.Contains(rest[0], "=") {
+		id, rest = rest[0], rest[1:]
+	}
+
+	switch command {
+	case "create":
+		opts, err := parseOpts(args[1:])
+		if err != nil {
+			return err
+		}
+		response := client.Create(env, voldriver.CreateRequest{Name: args[0], Opts: opts})
+		return output(cfg, stdout, response, response.Err, func(w io.Writer) { fmt.Fprintf(w, "created %s\n", args[0]) })
+
+	case "get":
+		response := client.GetForHolder(env, cephdriver.GetRequest{Name: args[0], ID: id})
+		return output(cfg, stdout, response, response.Err, func(w io.Writer) { writeVolume(w, response.Volume) })
+
+	case "list":
+		response := client.List(env)
+		return output(cfg, stdout, response, response.Err, func(w io.Writer) { writeVolumeTable(w, response.Volumes) })
+
+	case "path":
+		response := client.PathForHolder(env, cephdriver.PathRequest{Name: args[0], ID: id})
+		return output(cfg, stdout, response, response.Err, func(w io.Writer) { fmt.Fprintln(w, response.Mountpoint) })
+
+	case "mount":
+		opts, err := parseOpts(rest)
+		if err != nil {
+			return err
+		}
+		response := client.MountWithOpts(env, cephdriver.MountRequest{Name: args[0], ID: id, Opts: opts})
+		return output(cfg, stdout, response, response.Err, func(w io.Writer) { fmt.Fprintln(w, response.Mountpoint) })
+
+	case "unmount":
+		response := client.Unmount(env, voldriver.UnmountRequest{Name: args[0], ID: id})
+		return output(cfg, stdout, response, response.Err, func(w io.Writer) { fmt.Fprintf(w, "unmounted %s\n", args[0]) })
+
+	case "remove":
+		response := client.Remove(env, voldriver.RemoveRequest{Name: args[0]})
+		return output(cfg, stdout, response, response.Err, func(w io.Writer) { fmt.Fprintf(w, "removed %s\n", args[0]) })
+
+	default:
+		response := client.Capabilities(env)
+		return output(cfg, stdout, response, "", func(w io.Writer) { fmt.Fprintf(w, "scope: %s\n", response.Capabilities.Scope) })
+	}
+}
+
+func runAdmin(env voldriver.Env, cfg config, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	command, args := args[0], args[1:]
+
+	arity := map[string][2]int{
+		"list":                  {0, 0},
+		"show":                  {1, 1},
+		"update":                {2, -1},
+		"force-unmount":         {1, 2},
+		"remount":               {1, 1},
+		"heartbeat":             {2, 2},
+		"rotate-keyring":        {2, 2},
+		"rotate-client-keyring": {2, 2},
+		"remove":                {1, 1},
+		"diagnostics":           {1, 1},
+		"events":                {0, 1},
+	}
+	if !validArity(arity, command, args) {
+		return errUsage
+	}
+
+	if cfg.adminAddress == "" || cfg.adminTokenFile == "" {
+		return errors.New("-adminAddr and -adminTokenFile are required for admin commands")
+	}
+	token, err := ioutil.ReadFile(cfg.adminTokenFile)
+	if err != nil {
+		return err
+	}
+
+	client, err := cephclient.NewAdminClient(cfg.adminAddress, strings.TrimSpace(string(token)), cfg.tlsConfig())
+	if err != nil {
+		return err
+	}
+
+	var volume cephdriver.VolumeDetails
+	switch command {
+	case "list":
+		volumes, err := client.Volumes(env)
+		if err != nil {
+			return err
+		}
+		return output(cfg, stdout, volumes, "", func(w io.Writer) { writeDetailsTable(w, volumes) })
+	case "show":
+		volume, err = client.Volume(env, args[0])
+	case "update":
+		var opts map[string]interface{}
+		if opts, err = parseOpts(args[1:]); err != nil {
+			return err
+		}
+		volume, err = client.Update(env, args[0], opts)
+	case "force-unmount":
+		holderID := ""
+		if len(args) == 2 {
+			holderID = args[1]
+		}
+		volume, err = client.ForceUnmount(env, args[0], holderID)
+	case "remount":
+		volume, err = client.Remount(env, args[0])
+	case "heartbeat":
+		volume, err = client.Heartbeat(env, args[0], args[1])
+	case "rotate-keyring":
+		var keyring []byte
+		if keyring, err = ioutil.ReadFile(args[1]); err != nil {
+			return err
+		}
+		volume, err = client.RotateKeyring(env, args[0], string(keyring))
+	case "rotate-client-keyring":
+		keyring, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		volumes, err := client.RotateClientKeyring(env, args[0], string(keyring))
+		if err != nil {
+			return err
+		}
+		return output(cfg, stdout, volumes, "", func(w io.Writer) { writeDetailsTable(w, volumes) })
+	case "diagnostics":
+		diagnostics, err := client.Diagnostics(env, args[0])
+		if err != nil {
+			return err
+		}
+		return output(cfg, stdout, diagnostics, "", func(w io.Writer) { writeDiagnostics(w, diagnostics) })
+	case "events":
+		name := ""
+		if len(args) == 1 {
+			name = args[0]
+		}
+		return client.Events(env, name, func(event cephdriver.Event) error { return writeEvent(cfg, stdout, event) })
+	case "remove":
+		if err := client.Remove(env, args[0]); err != nil {
+			return err
+		}
+		return output(cfg, stdout, map[string]string{"removed": args[0]}, "", func(w io.Writer) { fmt.Fprintf(w, "removed %s\n", args[0]) })
+	default:
+		return errUsage
+	}
+
+	if err != nil {
+		return err
+	}
+	return output(cfg, stdout, volume, "", func(w io.Writer) { writeDetails(w, volume) })
+}
+
+// validArity reports whether command is in arity and takes as many
+// arguments as args holds: at least the first bound, and at most the second
+// unless it is negative.
+func validArity(arity map[string][2]int, command string, args []string) bool {
+	bounds, ok := arity[command]
+	return ok && len(args) >= bounds[0] && (bounds[1] < 0 || len(args) <= bounds[1])
+}
+
+// parseOpts turns key=value arguments into Create, Mount or Update opts. Values are passed as
+// strings; the driver converts them to the type of each option.
+func parseOpts(args []string) (map[string]interface{}, error) {
+	opts := map[string]interface{}{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid opt '%s', expected key=value", arg)
+		}
+		opts[parts[0]] = parts[1]
+	}
+	return opts, nil
+}
+
+func output(cfg config, stdout io.Writer, response interface{}, responseErr string, table func(io.Writer)) error {
+	if cfg.jsonOutput {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(response); err != nil {
+			return err
+		}
+	} else if responseErr == "" {
+		table(stdout)
+	}
+
+	if responseErr != "" {
+		return errors.New(responseErr)
+	}
+	return nil
+}
+
+func writeVolumeTable(stdout io.Writer, volumes []voldriver.VolumeInfo) {
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMOUNTPOINT")
+	for _, volume := range volumes {
+		fmt.Fprintf(w, "%s\t%s\n", volume.Name, volume.Mountpoint)
+	}
+	w.Flush()
+}
+
+func writeVolume(stdout io.Writer, volume cephdriver.VolumeInfo) {
+	writeVolumeTable(stdout, []voldriver.VolumeInfo{{Name: volume.Name, Mountpoint: volume.Mountpoint}})
+	if len(volume.Holders) == 0 {
+		return
+	}
+
+	fmt.Fprintln(stdout)
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOLDER\tMOUNTPOINT")
+	for _, holder := range volume.Holders {
+		fmt.Fprintf(w, "%s\t%s\n", holder.ID, holder.Mountpoint)
+	}
+	w.Flush()
+}
+
+func writeDetailsTable(stdout io.Writer, volumes []cephdriver.VolumeDetails) {
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tMONITOR\tREMOTE\tHOLDERS\tHEALTHY\tPENDING\tLAST ERROR")
+	for _, volume := range volumes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%t\t%s\t%s\n", volume.Name, volume.Monitor, volume.RemoteMountPoint, volume.MountCount, volume.Healthy, strings.Join(volume.PendingChanges, ","), volume.LastError)
+	}
+	w.Flush()
+}
+
+func writeDiagnostics(stdout io.Writer, diagnostics cephdriver.VolumeDiagnostics) {
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "name:\t%s\n", diagnostics.Name)
+	fmt.Fprintf(w, "admin socket:\t%s\n", diagnostics.AdminSocket)
+	fmt.Fprintf(w, "client id:\t%d\n", diagnostics.ClientID)
+	fmt.Fprintf(w, "blocklisted:\t%t\n", diagnostics.Blocklisted)
+	fmt.Fprintf(w, "cached inodes:\t%d\n", diagnostics.InodeCount)
+	fmt.Fprintf(w, "cached dentries:\t%d\n", diagnostics.DentryCount)
+	for _, session := range diagnostics.MDSSessions {
+		fmt.Fprintf(w, "mds.%d session:\t%s (%d caps)\n", session.MDS, session.State, session.NumCaps)
+	}
+
+	counters := []string{}
+	for counter := range diagnostics.PerfCounters {
+		counters = append(counters, counter)
+	}
+	sort.Strings(counters)
+	for _, counter := range counters {
+		fmt.Fprintf(w, "%s:\t%g\n", counter, diagnostics.PerfCounters[counter])
+	}
+	w.Flush()
+}
+
+// writeEvent prints an event on a line of its own, so that the stream can be
+// followed as it arrives.
+func writeEvent(cfg config, stdout io.Writer, event cephdriver.Event) error {
+	if cfg.jsonOutput {
+		return json.NewEncoder(stdout).Encode(event)
+	}
+
+	line := fmt.Sprintf("%s %s %s %s", event.Time.Format(time.RFC3339), event.Volume, event.Operation, event.Outcome)
+	if event.Holder != "" {
+		line += " holder=" + event.Holder
+	}
+	if event.Duration > 0 {
+		line += fmt.Sprintf(" duration=%.3fs", event.Duration)
+	}
+	if event.Error != "" {
+		line += fmt.Sprintf(" error=%q", event.Error)
+	}
+	_, err := fmt.Fprintln(stdout, line)
+	return err
+}
+
+func writeDetails(stdout io.Writer, volume cephdriver.VolumeDetails) {
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "name:\t%s\n", volume.Name)
+	fmt.Fprintf(w, "monitor:\t%s\n", volume.Monitor)
+	fmt.Fprintf(w, "remote mount point:\t%s\n", volume.RemoteMountPoint)
+	fmt.Fprintf(w, "sub directory:\t%s\n", volume.SubDirectory)
+	fmt.Fprintf(w, "read only:\t%t\n", volume.ReadOnly)
+	fmt.Fprintf(w, "keyring:\t%s\n", volume.Keyring)
+	fmt.Fprintf(w, "local mount point:\t%s\n", volume.LocalMountPoint)
+	fmt.Fprintf(w, "share mount point:\t%s\n", volume.ShareMountPoint)
+	fmt.Fprintf(w, "key path:\t%s\n", volume.KeyPath)
+	fmt.Fprintf(w, "holders:\t%s\n", strings.Join(volume.Holders, ", "))
+	fmt.Fprintf(w, "pending changes:\t%s\n", strings.Join(volume.PendingChanges, ", "))
+	fmt.Fprintf(w, "healthy:\t%t\n", volume.Healthy)
+	fmt.Fprintf(w, "evicted:\t%t (%d evictions)\n", volume.Evicted, volume.Evictions)
+	fmt.Fprintf(w, "last error:\t%s\n", volume.LastError)
+	w.Flush()
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+
+	"code.cloudfoundry.org/cephdriver"
+	"code.cloudfoundry.org/cephdriver/cephlocal"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cephdriverctl", func() {
+	var (
+		tmpDir         string
+		stdout, stderr *bytes.Buffer
+
+		lock     sync.Mutex
+		requests []string
+		bodies   []map[string]interface{}
+		handler  http.HandlerFunc
+		driver   *httptest.Server
+	)
+
+	ctl := func(args ...string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return run(args, stdout, stderr)
+	}
+
+	requested := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, requests...)
+	}
+
+	lastBody := func() map[string]interface{} {
+		lock.Lock()
+		defer lock.Unlock()
+		return bodies[len(bodies)-1]
+	}
+
+	writeSpec := func(name string, contents string) {
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(contents), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "cephdriverctl")
+		Expect(err).NotTo(HaveOccurred())
+		stdout, stderr = new(bytes.Buffer), new(bytes.Buffer)
+
+		requests = nil
+		bodies = nil
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			body := map[string]interface{}{}
+			json.NewDecoder(req.Body).Decode(&body)
+			lock.Lock()
+			requests = append(requests, req.Method+" "+req.URL.Path)
+			bodies = append(bodies, body)
+			lock.Unlock()
+
+			switch req.URL.Path {
+			case "/VolumeDriver.Mount", "/VolumeDriver.Path":
+				w.Write([]byte(`{"Mountpoint":"/some/mountpoint"}`))
+			case "/VolumeDriver.Get":
+				w.Write([]byte(`{"Volume":{"Name":"volume-name","Mountpoint":"/some/mountpoint","Holders":[{"ID":"container-1","Mountpoint":"/some/mountpoint"}]}}`))
+			case "/VolumeDriver.List":
+				w.Write([]byte(`{"Volumes":[{"Name":"volume-name","Mountpoint":"/some/mountpoint"}]}`))
+			case "/VolumeDriver.Remove":
+				w.Write([]byte(`{"Err":"Volume 'volume-name' not found [VOLUME_NOT_FOUND]"}`))
+			default:
+				w.Write([]byte(`{}`))
+			}
+		}
+		driver = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		driver.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	Describe("arguments", func() {
+		It("exits with 2 and prints the usage for unknown commands and wrong numbers of arguments", func() {
+			for _, args := range [][]string{
+				{},
+				{"frobnicate"},
+				{"list", "extra"},
+				{"capabilities", "extra"},
+				{"create"},
+				{"get"},
+				{"get", "volume-name", "container-1", "extra"},
+				{"path", "volume-name", "container-1", "extra"},
+				{"unmount", "volume-name", "container-1", "extra"},
+				{"remove"},
+				{"remove", "volume-name", "extra"},
+				{"admin"},
+				{"admin", "frobnicate"},
+				{"admin", "list", "extra"},
+				{"admin", "show"},
+				{"admin", "show", "volume-name", "extra"},
+				{"admin", "update", "volume-name"},
+				{"admin", "force-unmount"},
+				{"admin", "force-unmount", "volume-name", "container-1", "extra"},
+				{"admin", "remount", "volume-name", "extra"},
+				{"admin", "heartbeat", "volume-name"},
+				{"admin", "rotate-keyring", "volume-name"},
+				{"admin", "rotate-client-keyring", "client", "keyring-file", "extra"},
+				{"admin", "remove"},
+				{"admin", "diagnostics"},
+				{"admin", "events", "volume-name", "extra"},
+			} {
+				Expect(ctl(append([]string{"-address", driver.URL, "-adminAddr", "127.0.0.1:1", "-adminTokenFile", "token"}, args...)...)).To(Equal(2), strings.Join(args, " "))
+				Expect(stderr.String()).To(HavePrefix("Usage: cephdriverctl"), strings.Join(args, " "))
+			}
+			Expect(requested()).To(BeEmpty())
+		})
+
+		It("exits with 2 on unknown flags", func() {
+			Expect(ctl("-frobnicate", "list")).To(Equal(2))
+		})
+
+		It("accepts optional arguments", func() {
+			Expect(ctl("-address", driver.URL, "get", "volume-name")).To(Equal(0))
+			Expect(ctl("-address", driver.URL, "mount", "volume-name", "container-1", "sub_directory=some/dir", "read_only=true")).To(Equal(0))
+			Expect(requested()).To(Equal([]string{"POST /VolumeDriver.Get", "POST /VolumeDriver.Mount"}))
+		})
+	})
+
+	Describe("holder IDs and opts", func() {
+		It("takes an argument without '=' after the volume as the holder ID", func() {
+			Expect(ctl("-address", driver.URL, "mount", "volume-name", "container-1", "sub_directory=some/dir")).To(Equal(0))
+			Expect(lastBody()).To(Equal(map[string]interface{}{"Name": "volume-name", "ID": "container-1", "Opts": map[string]interface{}{"sub_directory": "some/dir"}}))
+
+			Expect(ctl("-address", driver.URL, "path", "volume-name", "container-1")).To(Equal(0))
+			Expect(lastBody()).To(Equal(map[string]interface{}{"Name": "volume-name", "ID": "container-1"}))
+
+			Expect(ctl("-address", driver.URL, "unmount", "volume-name", "container-1")).To(Equal(0))
+			Expect(lastBody()).To(Equal(map[string]interface{}{"Name": "volume-name", "ID": "container-1"}))
+		})
+
+		It("takes key=value arguments as opts", func() {
+			Expect(ctl("-address", driver.URL, "mount", "volume-name", "sub_directory=some/dir")).To(Equal(0))
+			Expect(lastBody()).To(Equal(map[string]interface{}{"Name": "volume-name", "ID": "", "Opts": map[string]interface{}{"sub_directory": "some/dir"}}))
+
+			Expect(ctl("-address", driver.URL, "create", "volume-name", "ip=some-ip", "keyring=a=b")).To(Equal(0))
+			Expect(lastBody()).To(Equal(map[string]interface{}{"Name": "volume-name", "Opts": map[string]interface{}{"ip": "some-ip", "keyring": "a=b"}}))
+		})
+
+		It("fails on opts without a key", func() {
+			Expect(ctl("-address", driver.URL, "mount", "volume-name", "container-1", "=value")).To(Equal(1))
+			Expect(stderr.String()).To(Equal("error: invalid opt '=value', expected key=value\n"))
+
+			Expect(ctl("-address", driver.URL, "create", "volume-name", "some-ip")).To(Equal(1))
+			Expect(stderr.String()).To(Equal("error: invalid opt 'some-ip', expected key=value\n"))
+			Expect(requested()).To(BeEmpty())
+		})
+	})
+
+	Describe("output", func() {
+		It("prints tables by default", func() {
+			Expect(ctl("-address", driver.URL, "list")).To(Equal(0))
+			Expect(stdout.String()).To(Equal("NAME         MOUNTPOINT\nvolume-name  /some/mountpoint\n"))
+
+			Expect(ctl("-address", driver.URL, "get", "volume-name", "container-1")).To(Equal(0))
+			Expect(stdout.String()).To(ContainSubstring("HOLDER       MOUNTPOINT\ncontainer-1  /some/mountpoint\n"))
+		})
+
+		It("prints JSON with -json", func() {
+			Expect(ctl("-address", driver.URL, "-json", "list")).To(Equal(0))
+			response := voldriver.ListResponse{}
+			Expect(json.Unmarshal(stdout.Bytes(), &response)).To(Succeed())
+			Expect(response.Volumes).To(Equal([]voldriver.VolumeInfo{{Name: "volume-name", Mountpoint: "/some/mountpoint"}}))
+		})
+
+		It("exits with 1 on driver errors, printing them to stderr", func() {
+			Expect(ctl("-address", driver.URL, "remove", "volume-name")).To(Equal(1))
+			Expect(stdout.String()).To(BeEmpty())
+			Expect(stderr.String()).To(Equal("error: Volume 'volume-name' not found [VOLUME_NOT_FOUND]\n"))
+		})
+
+		It("prints the response with -json even when it carries an error", func() {
+			Expect(ctl("-address", driver.URL, "-json", "remove", "volume-name")).To(Equal(1))
+			Expect(stdout.String()).To(ContainSubstring(`"Err": "Volume 'volume-name' not found [VOLUME_NOT_FOUND]"`))
+		})
+	})
+
+	Describe("spec discovery", func() {
+		It("reads the JSON spec of the driver from -driversPath", func() {
+			writeSpec("cephdriver.json", `{"Name":"cephdriver","Addr":"`+driver.URL+`"}`)
+
+			Expect(ctl("-driversPath", tmpDir, "capabilities")).To(Equal(0))
+			Expect(requested()).To(Equal([]string{"POST /VolumeDriver.Capabilities"}))
+		})
+
+		It("reads the URL spec of the driver named by -driverName", func() {
+			writeSpec("other.spec", driver.URL+"\n")
+
+			Expect(ctl("-driversPath", tmpDir, "-driverName", "other", "list")).To(Equal(0))
+			Expect(requested()).To(Equal([]string{"POST /VolumeDriver.List"}))
+		})
+
+		It("fails without a spec", func() {
+			Expect(ctl("-driversPath", tmpDir, "list")).To(Equal(1))
+			Expect(stderr.String()).To(Equal("error: no spec for driver 'cephdriver' in " + tmpDir + "\n"))
+		})
+
+		It("fails without -driversPath or -address", func() {
+			Expect(ctl("list")).To(Equal(1))
+			Expect(stderr.String()).To(Equal("error: either -driversPath or -address is required\n"))
+		})
+
+		Context("when the driver serves TLS", func() {
+			var tlsDriver *httptest.Server
+
+			BeforeEach(func() {
+				tlsDriver = httptest.NewTLSServer(handler)
+				writeSpec("cephdriver.json", `{"Name":"cephdriver","Addr":"http://`+tlsDriver.Listener.Addr().String()+`"}`)
+			})
+
+			AfterEach(func() {
+				tlsDriver.Close()
+			})
+
+			It("overrides the TLS config of the spec with the TLS flags", func() {
+				Expect(ctl("-driversPath", tmpDir, "list")).To(Equal(1))
+
+				Expect(ctl("-driversPath", tmpDir, "-insecureSkipVerify", "list")).To(Equal(0))
+				Expect(requested()).To(Equal([]string{"POST /VolumeDriver.List"}))
+			})
+		})
+	})
+
+	Describe("admin commands", func() {
+		var (
+			admin     *httptest.Server
+			tokenFile string
+			adminArgs []string
+		)
+
+		BeforeEach(func() {
+			testEnv := driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("CephdriverctlTest"), context.TODO())
+			localDriver := cephlocal.NewLocalDriverWithInvokerAndSystemUtil(new(voldriverfakes.FakeInvoker), new(os_fake.FakeOs), new(ioutil_fake.FakeIoutil), cephlocal.LocalDriverConfig{RootDir: "some-root"})
+			Expect(localDriver.Create(testEnv, voldriver.CreateRequest{Name: "volume-name", Opts: map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}}).Err).To(BeEmpty())
+			Expect(localDriver.Mount(testEnv, voldriver.MountRequest{Name: "volume-name", ID: "container-1"}).Err).To(BeEmpty())
+			admin = httptest.NewServer(cephlocal.NewAdminHandler(lagertest.NewTestLogger("CephdriverctlTest"), localDriver, "some-token"))
+
+			tokenFile = filepath.Join(tmpDir, "admin-token")
+			Expect(ioutil.WriteFile(tokenFile, []byte("some-token\n"), 0600)).To(Succeed())
+			adminArgs = []string{"-adminAddr", admin.Listener.Addr().String(), "-adminTokenFile", tokenFile}
+		})
+
+		AfterEach(func() {
+			admin.Close()
+		})
+
+		It("lists volumes as a table", func() {
+			Expect(ctl(append(adminArgs, "admin", "list")...)).To(Equal(0))
+			Expect(stdout.String()).To(HavePrefix("NAME         MONITOR"))
+			Expect(stdout.String()).To(ContainSubstring("volume-name  some-ip:6789"))
+		})
+
+		It("shows a volume as JSON with -json", func() {
+			Expect(ctl(append(adminArgs, "-json", "admin", "show", "volume-name")...)).To(Equal(0))
+			volume := cephdriver.VolumeDetails{}
+			Expect(json.Unmarshal(stdout.Bytes(), &volume)).To(Succeed())
+			Expect(volume.Name).To(Equal("volume-name"))
+			Expect(volume.Holders).To(Equal([]string{"container-1"}))
+		})
+
+		It("passes the holder of force-unmount and heartbeat", func() {
+			Expect(ctl(append(adminArgs, "admin", "heartbeat", "volume-name", "container-1")...)).To(Equal(0))
+
+			Expect(ctl(append(adminArgs, "-json", "admin", "force-unmount", "volume-name", "container-1")...)).To(Equal(0))
+			volume := cephdriver.VolumeDetails{}
+			Expect(json.Unmarshal(stdout.Bytes(), &volume)).To(Succeed())
+			Expect(volume.Holders).To(BeEmpty())
+		})
+
+		It("takes key=value arguments of update as opts", func() {
+			Expect(ctl(append(adminArgs, "-json", "admin", "update", "volume-name", "ip=other-ip")...)).To(Equal(0))
+			volume := cephdriver.VolumeDetails{}
+			Expect(json.Unmarshal(stdout.Bytes(), &volume)).To(Succeed())
+			Expect(volume.Monitor).To(Equal("other-ip:6789"))
+
+			Expect(ctl(append(adminArgs, "admin", "update", "volume-name", "other-ip")...)).To(Equal(1))
+			Expect(stderr.String()).To(Equal("error: invalid opt 'other-ip', expected key=value\n"))
+		})
+
+		It("exits with 1 on admin API errors", func() {
+			Expect(ctl(append(adminArgs, "admin", "show", "other-volume")...)).To(Equal(1))
+			Expect(stderr.String()).To(ContainSubstring("other-volume"))
+		})
+
+		It("requires -adminAddr and -adminTokenFile", func() {
+			Expect(ctl("admin", "list")).To(Equal(1))
+			Expect(stderr.String()).To(Equal("error: -adminAddr and -adminTokenFile are required for admin commands\n"))
+		})
+	})
+})
@@ -0,0 +1,90 @@
+package cephdriver
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ErrorCode classifies the errors the driver returns. Codes are stable:
+// clients may rely on them, unlike on the wording of messages.
+type ErrorCode string
+
+const (
+	ERR_INVALID_VOLUME_NAME ErrorCode = "INVALID_VOLUME_NAME"
+	ERR_INVALID_HOLDER_ID   ErrorCode = "INVALID_HOLDER_ID"
+	ERR_INVALID_OPTS        ErrorCode = "INVALID_OPTS"
+	ERR_INVALID_KEYRING     ErrorCode = "INVALID_KEYRING"
+	ERR_VOLUME_NOT_FOUND    ErrorCode = "VOLUME_NOT_FOUND"
+	ERR_VOLUME_CONFLICT     ErrorCode = "VOLUME_CONFLICT"
+	ERR_NOT_MOUNTED         ErrorCode = "NOT_MOUNTED"
+	ERR_AUTH_FAILED         ErrorCode = "AUTH_FAILED"
+	ERR_MOUNT_TIMEOUT       ErrorCode = "MOUNT_TIMEOUT"
+	ERR_MOUNT_FAILED        ErrorCode = "MOUNT_FAILED"
+	ERR_MOUNT_PENDING       ErrorCode = "MOUNT_PENDING"
+	ERR_UNMOUNT_FAILED      ErrorCode = "UNMOUNT_FAILED"
+	ERR_REMOUNT_FAILED      ErrorCode = "REMOUNT_FAILED"
+	ERR_ADMIN_SOCKET_FAILED ErrorCode = "ADMIN_SOCKET_FAILED"
+	ERR_OVERLOADED          ErrorCode = "OVERLOADED"
+	ERR_TOO_MANY_MOUNTS     ErrorCode = "TOO_MANY_MOUNTS"
+
+	// ERR_UNKNOWN is the code of errors decoded from responses that carry no
+	// code, such as those of older drivers.
+	ERR_UNKNOWN ErrorCode = "UNKNOWN"
+)
+
+// Failures of the host or the cluster may go away on their own; the others
+// need the request or the volume to change first.
+var retryableCodes = map[ErrorCode]bool{
+	ERR_MOUNT_TIMEOUT:       true,
+	ERR_MOUNT_FAILED:        true,
+	ERR_MOUNT_PENDING:       true,
+	ERR_UNMOUNT_FAILED:      true,
+	ERR_REMOUNT_FAILED:      true,
+	ERR_ADMIN_SOCKET_FAILED: true,
+	ERR_OVERLOADED:          true,
+	ERR_TOO_MANY_MOUNTS:     true,
+}
+
+// IsRetryable reports whether a request that failed with code may succeed if
+// it is sent again unchanged.
+func IsRetryable(code ErrorCode) bool {
+	return retryableCodes[code]
+}
+
+type Error struct {
+	Code      ErrorCode
+	Message   string
+	Retryable bool
+}
+
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), Retryable: IsRetryable(code)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Encode renders the error for the Err field of a voldriver response. The
+// code follows the message in brackets, so clients that only show or match
+// the message keep working.
+func (e *Error) Encode() string {
+	return fmt.Sprintf("%s [%s]", e.Message, e.Code)
+}
+
+var encodedErrorPattern = regexp.MustCompile(`(?s)^(.*) \[([A-Z_]+)\]$`)
+
+// DecodeError parses the Err field of a voldriver response, returning nil
+// when it is empty. Errors without a code are decoded as ERR_UNKNOWN.
+func DecodeError(encoded string) *Error {
+	if encoded == "" {
+		return nil
+	}
+
+	match := encodedErrorPattern.FindStringSubmatch(encoded)
+	if match == nil {
+		return &Error{Code: ERR_UNKNOWN, Message: encoded}
+	}
+	code := ErrorCode(match[2])
+	return &Error{Code: code, Message: match[1], Retryable: IsRetryable(code)}
+}
@@ -0,0 +1,34 @@
+package cephdriver_test
+
+import (
+	"code.cloudfoundry.org/cephdriver"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DecodeError", func() {
+	It("decodes the code and message of an error", func() {
+		err := cephdriver.DecodeError("Error mounting 'volume-name' (refused) [MOUNT_FAILED]")
+		Expect(err.Code).To(Equal(cephdriver.ERR_MOUNT_FAILED))
+		Expect(err.Message).To(Equal("Error mounting 'volume-name' (refused)"))
+		Expect(err.Retryable).To(BeTrue())
+	})
+
+	It("decodes errors without a code as unknown", func() {
+		err := cephdriver.DecodeError("Volume 'volume-name' not found")
+		Expect(err.Code).To(Equal(cephdriver.ERR_UNKNOWN))
+		Expect(err.Message).To(Equal("Volume 'volume-name' not found"))
+		Expect(err.Retryable).To(BeFalse())
+	})
+
+	It("returns nil without an error", func() {
+		Expect(cephdriver.DecodeError("")).To(BeNil())
+	})
+
+	It("encodes the code after the message", func() {
+		err := cephdriver.NewError(cephdriver.ERR_NOT_MOUNTED, "Volume '%s' not mounted", "volume-name")
+		Expect(err.Encode()).To(Equal("Volume 'volume-name' not mounted [NOT_MOUNTED]"))
+		Expect(cephdriver.DecodeError(err.Encode())).To(Equal(err))
+	})
+})
@@ -0,0 +1,299 @@
+package cephdriver
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_MONITOR_PORT = 6789
+
+var memoryLimitPattern = regexp.MustCompile(`(?i)^([0-9]+)([KMGT]?)$`)
+
+// ValidationError collects every problem found in a set of 'Opts'.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+type option struct {
+	name     string
+	required bool
+	index    int
+}
+
+// ParseMountConfig validates the 'Opts' of a Create request against the
+// MountConfig schema. Numbers and booleans are coerced to and from strings
+// where the conversion is unambiguous, and unknown keys are rejected with a
+// suggestion for the closest known key.
+func ParseMountConfig(opts map[string]interface{}) (MountConfig, error) {
+	config := MountConfig{Port: DEFAULT_MONITOR_PORT}
+	problems := parseOpts(opts, &config)
+
+	if config.SubDirectory != "" && !isValidSubDirectory(config.SubDirectory) {
+		problems = append(problems, "Invalid 'sub_directory' field in 'Opts': must be a relative path without '..'")
+	}
+
+	if config.Port <= 0 || config.Port > 65535 {
+		problems = append(problems, "Invalid 'port' field in 'Opts': must be between 1 and 65535")
+	}
+
+	if config.MemoryLimit != "" {
+		if _, err := ParseMemoryLimit(config.MemoryLimit); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid 'memory_limit' field in 'Opts': %s", err.Error()))
+		}
+	}
+
+	if config.CPULimit != "" {
+		if _, err := ParseCPULimit(config.CPULimit); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid 'cpu_limit' field in 'Opts': %s", err.Error()))
+		}
+	}
+
+	if len(problems) > 0 {
+		return MountConfig{}, &ValidationError{Problems: problems}
+	}
+	return config, nil
+}
+
+// ParseMountOptions validates the 'Opts' of a Mount request against the
+// MountOptions schema, the way ParseMountConfig does those of Create.
+func ParseMountOptions(opts map[string]interface{}) (MountOptions, error) {
+	options := MountOptions{}
+	problems := parseOpts(opts, &options)
+
+	if options.SubDirectory != "" && !isValidSubDirectory(options.SubDirectory) {
+		problems = append(problems, "Invalid 'sub_directory' field in 'Opts': must be a relative path without '..'")
+	}
+
+	if len(problems) > 0 {
+		return MountOptions{}, &ValidationError{Problems: problems}
+	}
+	return options, nil
+}
+
+// parseOpts assigns opts to the fields of the struct schema points to, and
+// returns the problems with missing, unconvertible and unknown keys.
+func parseOpts(opts map[string]interface{}, schema interface{}) []string {
+	problems := []string{}
+
+	value := reflect.ValueOf(schema).Elem()
+	options := schemaOptions(value.Type())
+	known := map[string]bool{}
+
+	for _, opt := range options {
+		known[opt.name] = true
+
+		raw, ok := opts[opt.name]
+		if !ok {
+			if opt.required {
+				problems = append(problems, fmt.Sprintf("Missing mandatory '%s' field in 'Opts'", opt.name))
+			}
+			continue
+		}
+
+		if err := assign(value.Field(opt.index), raw); err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to convert '%s' field in 'Opts' to %s", opt.name, err.Error()))
+		}
+	}
+
+	unknown := []string{}
+	for key := range opts {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	for _, key := range unknown {
+		problem := fmt.Sprintf("Unknown '%s' field in 'Opts'", key)
+		if suggestion, ok := suggest(key, options); ok {
+			problem = fmt.Sprintf("%s (did you mean '%s'?)", problem, suggestion)
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// Opts is the inverse of ParseMountConfig: it renders a config as Create
+// 'Opts', leaving out optional fields that hold their zero value.
+func (c MountConfig) Opts() map[string]interface{} {
+	return schemaOpts(c)
+}
+
+func schemaOpts(schema interface{}) map[string]interface{} {
+	opts := map[string]interface{}{}
+	value := reflect.ValueOf(schema)
+	for _, opt := range schemaOptions(value.Type()) {
+		field := value.Field(opt.index)
+		if !opt.required && field.Interface() == reflect.Zero(field.Type()).Interface() {
+			continue
+		}
+		opts[opt.name] = field.Interface()
+	}
+	return opts
+}
+
+// ChangedOpts lists the names of the opts whose values differ between two configs.
+func (c MountConfig) ChangedOpts(other MountConfig) []string {
+	changed := []string{}
+	value, otherValue := reflect.ValueOf(c), reflect.ValueOf(other)
+	for _, opt := range schemaOptions(value.Type()) {
+		if value.Field(opt.index).Interface() != otherValue.Field(opt.index).Interface() {
+			changed = append(changed, opt.name)
+		}
+	}
+	return changed
+}
+
+// ParseMemoryLimit converts a memory limit, a number of bytes with an
+// optional K, M, G or T suffix for powers of 1024, into bytes.
+func ParseMemoryLimit(limit string) (int64, error) {
+	matches := memoryLimitPattern.FindStringSubmatch(strings.TrimSpace(limit))
+	if matches == nil {
+		return 0, fmt.Errorf("must be a number of bytes with an optional K, M, G or T suffix")
+	}
+
+	bytes, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil || bytes <= 0 {
+		return 0, fmt.Errorf("must be a positive number of bytes")
+	}
+
+	shift := uint(0)
+	if matches[2] != "" {
+		shift = uint(strings.Index("KMGT", strings.ToUpper(matches[2]))+1) * 10
+	}
+	if bytes > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("must be a positive number of bytes")
+	}
+	return bytes << shift, nil
+}
+
+// ParseCPULimit converts a CPU limit, a number of CPUs such as 0.5 or 2,
+// into a float.
+func ParseCPULimit(limit string) (float64, error) {
+	cpus, err := strconv.ParseFloat(strings.TrimSpace(limit), 64)
+	if err != nil || cpus <= 0 || math.IsInf(cpus, 0) || math.IsNaN(cpus) {
+		return 0, fmt.Errorf("must be a positive number of CPUs")
+	}
+	return cpus, nil
+}
+
+// Opts is the inverse of ParseMountOptions.
+func (o MountOptions) Opts() map[string]interface{} {
+	return schemaOpts(o)
+}
+
+func isValidSubDirectory(dir string) bool {
+	return !filepath.IsAbs(dir) && filepath.Clean(dir) == dir && dir != ".." && !strings.HasPrefix(dir, "../")
+}
+
+func schemaOptions(schema reflect.Type) []option {
+	options := []option{}
+	for i := 0; i < schema.NumField(); i++ {
+		field := schema.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		options = append(options, option{name: name, required: field.Tag.Get("required") == "true", index: i})
+	}
+	return options
+}
+
+func assign(field reflect.Value, raw interface{}) error {
+	switch field.Kind() {
+	case reflect.String:
+		switch v := raw.(type) {
+		case string:
+			field.SetString(v)
+		case bool:
+			field.SetString(strconv.FormatBool(v))
+		case float64:
+			field.SetString(strconv.FormatFloat(v, 'f', -1, 64))
+		case int:
+			field.SetString(strconv.Itoa(v))
+		default:
+			return fmt.Errorf("a string")
+		}
+	case reflect.Int:
+		switch v := raw.(type) {
+		case float64:
+			if v != math.Trunc(v) {
+				return fmt.Errorf("an integer")
+			}
+			field.SetInt(int64(v))
+		case int:
+			field.SetInt(int64(v))
+		case string:
+			i, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("an integer")
+			}
+			field.SetInt(int64(i))
+		default:
+			return fmt.Errorf("an integer")
+		}
+	case reflect.Bool:
+		switch v := raw.(type) {
+		case bool:
+			field.SetBool(v)
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("a boolean")
+			}
+			field.SetBool(b)
+		default:
+			return fmt.Errorf("a boolean")
+		}
+	}
+	return nil
+}
+
+func suggest(key string, options []option) (string, bool) {
+	best := ""
+	bestDistance := math.MaxInt32
+	for _, opt := range options {
+		distance := levenshtein(strings.ToLower(key), opt.name)
+		if distance < bestDistance {
+			best, bestDistance = opt.name, distance
+		}
+	}
+	return best, bestDistance <= 3
+}
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
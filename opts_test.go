@@ -0,0 +1,202 @@
+package cephdriver_test
+
+import (
+	"code.cloudfoundry.org/cephdriver"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseMountConfig", func() {
+	var (
+		opts   map[string]interface{}
+		config cephdriver.MountConfig
+		err    error
+	)
+
+	BeforeEach(func() {
+		opts = map[string]interface{}{"keyring": "some-keyring", "ip": "some-ip", "remote_mount_point": "some-remote-mountpoint"}
+	})
+
+	JustBeforeEach(func() {
+		config, err = cephdriver.ParseMountConfig(opts)
+	})
+
+	Context("when only mandatory opts are given", func() {
+		It("fills in defaults", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config).To(Equal(cephdriver.MountConfig{
+				Keyring:          "some-keyring",
+				IP:               "some-ip",
+				Port:             6789,
+				RemoteMountPoint: "some-remote-mountpoint",
+			}))
+		})
+	})
+
+	Context("when optional opts are given", func() {
+		BeforeEach(func() {
+			opts["local_mount_point"] = "/some/local-mountpoint"
+			opts["sub_directory"] = "some/sub-dir"
+			opts["port"] = float64(6790)
+			opts["read_only"] = true
+		})
+
+		It("parses them", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.LocalMountPoint).To(Equal("/some/local-mountpoint"))
+			Expect(config.SubDirectory).To(Equal("some/sub-dir"))
+			Expect(config.Port).To(Equal(6790))
+			Expect(config.ReadOnly).To(BeTrue())
+		})
+	})
+
+	Context("when values have coercible types", func() {
+		BeforeEach(func() {
+			opts["keyring"] = float64(12345)
+			opts["port"] = "6790"
+			opts["read_only"] = "true"
+		})
+
+		It("coerces them", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Keyring).To(Equal("12345"))
+			Expect(config.Port).To(Equal(6790))
+			Expect(config.ReadOnly).To(BeTrue())
+		})
+	})
+
+	Context("when values cannot be coerced", func() {
+		BeforeEach(func() {
+			opts["port"] = "not-a-port"
+			opts["read_only"] = float64(1)
+			opts["ip"] = []interface{}{"some-ip"}
+		})
+
+		It("reports every conversion problem", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Unable to convert 'ip' field in 'Opts' to a string; " +
+				"Unable to convert 'port' field in 'Opts' to an integer; " +
+				"Unable to convert 'read_only' field in 'Opts' to a boolean"))
+		})
+	})
+
+	Context("when a mandatory opt is missing", func() {
+		BeforeEach(func() {
+			delete(opts, "ip")
+		})
+
+		It("errors", func() {
+			Expect(err).To(MatchError("Missing mandatory 'ip' field in 'Opts'"))
+		})
+	})
+
+	Context("when an unknown opt is given", func() {
+		BeforeEach(func() {
+			delete(opts, "remote_mount_point")
+			opts["remote_mountpoint"] = "some-remote-mountpoint"
+			opts["flavour"] = "vanilla"
+		})
+
+		It("reports all problems with suggestions", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*cephdriver.ValidationError).Problems).To(Equal([]string{
+				"Missing mandatory 'remote_mount_point' field in 'Opts'",
+				"Unknown 'flavour' field in 'Opts'",
+				"Unknown 'remote_mountpoint' field in 'Opts' (did you mean 'remote_mount_point'?)",
+			}))
+		})
+	})
+
+	Context("when the sub directory escapes the share", func() {
+		BeforeEach(func() {
+			opts["sub_directory"] = "../other"
+		})
+
+		It("errors", func() {
+			Expect(err).To(MatchError("Invalid 'sub_directory' field in 'Opts': must be a relative path without '..'"))
+		})
+	})
+
+	Context("when limits are given", func() {
+		BeforeEach(func() {
+			opts["memory_limit"] = "512M"
+			opts["cpu_limit"] = 1.5
+		})
+
+		It("keeps them as given", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.MemoryLimit).To(Equal("512M"))
+			Expect(config.CPULimit).To(Equal("1.5"))
+		})
+	})
+
+	Context("when limits are invalid", func() {
+		BeforeEach(func() {
+			opts["memory_limit"] = "lots"
+			opts["cpu_limit"] = float64(-1)
+		})
+
+		It("errors", func() {
+			Expect(err).To(MatchError("Invalid 'memory_limit' field in 'Opts': must be a number of bytes with an optional K, M, G or T suffix; " +
+				"Invalid 'cpu_limit' field in 'Opts': must be a positive number of CPUs"))
+		})
+	})
+
+	Context("when the port is out of range", func() {
+		BeforeEach(func() {
+			opts["port"] = float64(70000)
+		})
+
+		It("errors", func() {
+			Expect(err).To(MatchError("Invalid 'port' field in 'Opts': must be between 1 and 65535"))
+		})
+	})
+})
+
+var _ = Describe("MountConfig", func() {
+	var config cephdriver.MountConfig
+
+	BeforeEach(func() {
+		config = cephdriver.MountConfig{Keyring: "some-keyring", IP: "some-ip", Port: 6789, RemoteMountPoint: "some-remote-mountpoint"}
+	})
+
+	Describe("#Opts", func() {
+		It("round trips through ParseMountConfig", func() {
+			config.SubDirectory = "some/sub-dir"
+			parsed, err := cephdriver.ParseMountConfig(config.Opts())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(Equal(config))
+		})
+
+		It("leaves out optional zero values", func() {
+			Expect(config.Opts()).NotTo(HaveKey("read_only"))
+			Expect(config.Opts()).NotTo(HaveKey("local_mount_point"))
+		})
+	})
+
+	Describe("#ChangedOpts", func() {
+		It("lists the opts that differ", func() {
+			other := config
+			other.IP = "other-ip"
+			other.ReadOnly = true
+			Expect(config.ChangedOpts(other)).To(Equal([]string{"ip", "read_only"}))
+		})
+	})
+})
+
+var _ = Describe("ParseMemoryLimit", func() {
+	It("converts suffixes to bytes", func() {
+		Expect(cephdriver.ParseMemoryLimit("1024")).To(Equal(int64(1024)))
+		Expect(cephdriver.ParseMemoryLimit("64k")).To(Equal(int64(64 << 10)))
+		Expect(cephdriver.ParseMemoryLimit("512M")).To(Equal(int64(512 << 20)))
+		Expect(cephdriver.ParseMemoryLimit("2G")).To(Equal(int64(2 << 30)))
+	})
+
+	It("rejects zero and overflowing limits", func() {
+		_, err := cephdriver.ParseMemoryLimit("0")
+		Expect(err).To(HaveOccurred())
+		_, err = cephdriver.ParseMemoryLimit("99999999999T")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -1,7 +1,159 @@
 package cephdriver
 
+import "time"
+
+// DEFAULT_DRIVER_NAME is the name a driver server advertises when none is
+// configured, and the name clients look its spec up under.
+const DEFAULT_DRIVER_NAME = "cephdriver"
+
+// Paths of the admin API of a driver server.
+const (
+	ADMIN_VOLUMES_PATH = "/volumes"
+	ADMIN_CLIENTS_PATH = "/clients"
+	ADMIN_EVENTS_PATH  = "/events"
+)
+
+// KeyringRotation is the body of the admin API's keyring rotation routes.
+type KeyringRotation struct {
+	Keyring string `json:"keyring"`
+}
+
+// MountConfig is the typed form of the 'Opts' accepted by Create. Fields
+// tagged `required:"true"` must be present; all others are optional.
 type MountConfig struct {
-	Keyring    string `json:"keyring"`
-	IP         string `json:"ip"`
-	MountPoint string `json:"mountpoint"`
+	Keyring          string `json:"keyring" required:"true"`
+	IP               string `json:"ip" required:"true"`
+	Port             int    `json:"port,omitempty"`
+	RemoteMountPoint string `json:"remote_mount_point" required:"true"`
+	LocalMountPoint  string `json:"local_mount_point,omitempty"`
+	SubDirectory     string `json:"sub_directory,omitempty"`
+	ReadOnly         bool   `json:"read_only,omitempty"`
+
+	// MemoryLimit and CPULimit override the driver's default limits for the
+	// ceph-fuse process that mounts the volume; see ParseMemoryLimit and
+	// ParseCPULimit for their formats.
+	MemoryLimit string `json:"memory_limit,omitempty"`
+	CPULimit    string `json:"cpu_limit,omitempty"`
+}
+
+// MountOptions is the typed form of the 'Opts' a holder may give to Mount.
+type MountOptions struct {
+	// SubDirectory is bound for the holder instead of the whole volume,
+	// relative to the volume's own sub_directory.
+	SubDirectory string `json:"sub_directory,omitempty"`
+}
+
+// MountRequest is a voldriver MountRequest that also carries the 'Opts' the
+// driver server accepts on its Mount route.
+type MountRequest struct {
+	Name string
+	ID   string
+	Opts map[string]interface{} `json:",omitempty"`
+}
+
+// GetRequest and PathRequest are the voldriver requests with the ID of the
+// holder whose mount point the driver server answers with. Without an ID it
+// answers with that of the anonymous holder, or of the only holder.
+type GetRequest struct {
+	Name string
+	ID   string `json:",omitempty"`
+}
+
+type PathRequest struct {
+	Name string
+	ID   string `json:",omitempty"`
+}
+
+// GetResponse is a voldriver GetResponse whose volume also lists its holders.
+type GetResponse struct {
+	Volume VolumeInfo
+	Err    string
+}
+
+// VolumeInfo is a voldriver VolumeInfo with the holders of the volume.
+type VolumeInfo struct {
+	Name       string
+	Mountpoint string
+	Holders    []HolderInfo `json:",omitempty"`
+}
+
+// HolderInfo is a holder of a volume and the bind mount it was handed.
+type HolderInfo struct {
+	ID         string
+	Mountpoint string
+}
+
+// VolumeDetails is the full state of a volume as shown by the admin API.
+// Secrets are redacted.
+type VolumeDetails struct {
+	Name             string               `json:"name"`
+	Monitor          string               `json:"monitor"`
+	RemoteMountPoint string               `json:"remote_mount_point"`
+	SubDirectory     string               `json:"sub_directory,omitempty"`
+	ReadOnly         bool                 `json:"read_only"`
+	Keyring          string               `json:"keyring"`
+	LocalMountPoint  string               `json:"local_mount_point"`
+	ShareMountPoint  string               `json:"share_mount_point,omitempty"`
+	KeyPath          string               `json:"key_path,omitempty"`
+	LogFile          string               `json:"log_file,omitempty"`
+	FusePid          int                  `json:"fuse_pid,omitempty"`
+	FuseExits        int                  `json:"fuse_exits,omitempty"`
+	FuseRestarts     int                  `json:"fuse_restarts,omitempty"`
+	LastFuseExit     string               `json:"last_fuse_exit,omitempty"`
+	MemoryLimit      int64                `json:"memory_limit,omitempty"`
+	CPULimit         float64              `json:"cpu_limit,omitempty"`
+	Cgroup           string               `json:"cgroup,omitempty"`
+	MemoryUsage      int64                `json:"memory_usage,omitempty"`
+	CPUUsage         float64              `json:"cpu_usage_seconds,omitempty"`
+	OOMKills         int                  `json:"oom_kills,omitempty"`
+	AdminSocket      string               `json:"admin_socket,omitempty"`
+	Evicted          bool                 `json:"evicted,omitempty"`
+	Evictions        int                  `json:"evictions,omitempty"`
+	LastEviction     string               `json:"last_eviction,omitempty"`
+	Holders          []string             `json:"holders"`
+	LastSeen         map[string]time.Time `json:"last_seen,omitempty"`
+	MountCount       int                  `json:"mount_count"`
+	PendingChanges   []string             `json:"pending_changes,omitempty"`
+	Healthy          bool                 `json:"healthy"`
+	LastError        string               `json:"last_error,omitempty"`
+}
+
+type MDSSession struct {
+	MDS     int    `json:"mds"`
+	State   string `json:"state"`
+	NumCaps int64  `json:"num_caps"`
+}
+
+// FuseDiagnostics is what a ceph-fuse process reports about its client on
+// its admin socket. Perf counters are flattened into dotted names such as
+// "client.reply.avgcount".
+type FuseDiagnostics struct {
+	ClientID     int64              `json:"client_id"`
+	Blocklisted  bool               `json:"blocklisted"`
+	InodeCount   int64              `json:"inode_count"`
+	DentryCount  int64              `json:"dentry_count"`
+	MDSSessions  []MDSSession       `json:"mds_sessions"`
+	PerfCounters map[string]float64 `json:"perf_counters"`
+}
+
+type VolumeDiagnostics struct {
+	Name        string `json:"name"`
+	AdminSocket string `json:"admin_socket"`
+	FuseDiagnostics
+}
+
+// An Event is a change in the lifecycle of a volume: the outcome of an
+// operation on it, or a problem detected with its mount. Events are numbered
+// in the order they happened, so that a gap in the sequence tells a consumer
+// that events were dropped because it did not keep up.
+type Event struct {
+	Sequence  uint64    `json:"sequence"`
+	Time      time.Time `json:"time"`
+	Volume    string    `json:"volume_name"`
+	Operation string    `json:"operation"`
+	Outcome   string    `json:"outcome"`
+	Holder    string    `json:"holder_id,omitempty"`
+	Duration  float64   `json:"duration_seconds,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Code      ErrorCode `json:"code,omitempty"`
 }